@@ -1,18 +1,126 @@
 package main
 
 import (
-	"fmt"
-	"log"
+	"context"
+	"encoding/json"
+	"io/ioutil"
 	"net/http"
+
+	"github.com/morikuni/failure"
 )
 
-func WriteError(w http.ResponseWriter, statusCode int, message string, err error) {
-	msg := fmt.Sprintln(message, " : ", err)
-	log.Println(msg)
-	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-	w.WriteHeader(statusCode)
-	_, err = w.Write([]byte(msg))
+// ErrorResponse is APIがエラーの時に返すJSON
+type ErrorResponse struct {
+	Error *ErrorDetail `json:"error"`
+}
+
+// ErrorDetail is エラーの内容
+// Codeはfailure.Codeの値 (InternalServerError, BadRequest, NotFound, Conflict など) で、Clientが判定に使えるように変えない
+// Messageは内部の情報を含まないように、HTTP StatusのTextだけを返す. エラーの詳細はログに出力する
+type ErrorDetail struct {
+	Code    string        `json:"code"`
+	Message string        `json:"message"`
+	Fields  []*FieldError `json:"fields,omitempty"` // Requestの検証エラーの場合の、項目ごとのエラー
+}
+
+// APIResponse is 200以外のStatus CodeでResponseを返す時に、APIHandlerFuncが返す値
+type APIResponse struct {
+	StatusCode int
+	Body       interface{}
+}
+
+// APIHandlerFunc is Requestを処理して、ResponseのBodyにする値を返す
+// BodyがnilならStatus Codeだけを返す
+type APIHandlerFunc func(r *http.Request) (interface{}, error)
+
+// HandleAPI is APIHandlerFuncの結果をJSONで返す http.HandlerFunc を作る
+// エラーの場合は failure.Code に応じたStatus Codeで ErrorResponse を返す
+func HandleAPI(h APIHandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx, res, err := callAPIHandler(h, r)
+		if err != nil {
+			WriteErrorJSON(ctx, w, HTTPStatusCode(err), err)
+			return
+		}
+		WriteJSON(ctx, w, http.StatusOK, res)
+	}
+}
+
+// HandleTaskAPI is Cloud TasksのTaskを処理するAPIHandlerFuncから http.HandlerFunc を作る
+// Retryしても成功しないエラーの場合は、Taskを捨てるために200で ErrorResponse を返す
+func HandleTaskAPI(h APIHandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx, res, err := callAPIHandler(h, r)
+		if err != nil {
+			statusCode := TaskHTTPStatusCode(err)
+			if statusCode == http.StatusOK {
+				Infof(ctx, "drop task. path=%v\n", r.URL.Path)
+			}
+			WriteErrorJSON(ctx, w, statusCode, err)
+			return
+		}
+		WriteJSON(ctx, w, http.StatusOK, res)
+	}
+}
+
+// callAPIHandler is hを実行して、hの中で WithLogFields した値を入れたctxと一緒に結果を返す
+// r.Context() にはhの中で入れたLogFieldsが無いので、Responseを書く時のログにはこのctxを使う
+func callAPIHandler(h APIHandlerFunc, r *http.Request) (context.Context, interface{}, error) {
+	ctx, rec := withRequestLogFields(r.Context())
+	res, err := h(r.WithContext(ctx))
+	return WithLogFields(ctx, rec.get()), res, err
+}
+
+// DecodeJSON is Request BodyをJSONとしてvにDecodeし、読み込んだBodyを返す
+// Bodyが不正な場合は StatusBadRequest を返す
+func DecodeJSON(r *http.Request, v interface{}) ([]byte, error) {
+	b, err := ioutil.ReadAll(r.Body)
 	if err != nil {
-		log.Println(err)
+		return nil, failure.Wrap(err, failure.Message("failed ioutil.Read(request.Body)"))
+	}
+	if err := json.Unmarshal(b, v); err != nil {
+		return nil, failure.Translate(err, StatusBadRequest, failure.Messagef("failed json.Unmarshal(request.Body) body=%s", string(b)))
+	}
+	Infof(r.Context(), "%s\n", string(b))
+	return b, nil
+}
+
+// WriteJSON is bodyをJSONで書く
+// bodyが APIResponse の場合は、そのStatus Codeを使う
+func WriteJSON(ctx context.Context, w http.ResponseWriter, statusCode int, body interface{}) {
+	if res, ok := body.(*APIResponse); ok {
+		statusCode = res.StatusCode
+		body = res.Body
+	}
+	if body == nil {
+		w.WriteHeader(statusCode)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(statusCode)
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		Errorf(ctx, "%+v", err)
+	}
+}
+
+// WriteErrorJSON is errを ErrorResponse としてJSONで書く
+// ResponseにはCodeと公開して良いMessage, 検証エラーの項目だけを入れる
+func WriteErrorJSON(ctx context.Context, w http.ResponseWriter, statusCode int, err error) {
+	severity := SeverityWarning
+	if statusCode >= http.StatusInternalServerError {
+		severity = SeverityError
+	}
+	Logf(ctx, severity, "status=%v,err=%+v\n", statusCode, err)
+
+	code := StatusInternalServerError.ErrorCode()
+	if c, ok := failure.CodeOf(err); ok {
+		code = c.ErrorCode()
 	}
+	WriteJSON(ctx, w, statusCode, &ErrorResponse{
+		Error: &ErrorDetail{
+			Code:    code,
+			Message: http.StatusText(HTTPStatusCode(err)),
+			Fields:  FieldErrorsOf(err),
+		},
+	})
 }
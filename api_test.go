@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/morikuni/failure"
+)
+
+func TestHandleAPI(t *testing.T) {
+	cases := []struct {
+		name       string
+		res        interface{}
+		err        error
+		wantStatus int
+		wantCode   string
+		wantNoBody bool
+	}{
+		{"ok", map[string]string{"hoge": "fuga"}, nil, http.StatusOK, "", false},
+		{"no body", nil, nil, http.StatusOK, "", true},
+		{"accepted", &APIResponse{StatusCode: http.StatusAccepted, Body: map[string]string{}}, nil, http.StatusAccepted, "", false},
+		{"no code", nil, errors.New("hoge"), http.StatusInternalServerError, "InternalServerError", false},
+		{"conflict", nil, failure.New(StatusConflict, failure.Message("run lock is held by ds2bqJobIDs=[hoge]")), http.StatusConflict, "Conflict", false},
+		{"not found", nil, failure.New(StatusNotFound), http.StatusNotFound, "NotFound", false},
+	}
+
+	for _, tt := range cases {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			h := HandleAPI(func(r *http.Request) (interface{}, error) {
+				return tt.res, tt.err
+			})
+			w := httptest.NewRecorder()
+			h(w, httptest.NewRequest(http.MethodPost, "/", nil))
+
+			if e, g := tt.wantStatus, w.Code; e != g {
+				t.Errorf("status want %v but got %v", e, g)
+			}
+			if tt.wantNoBody {
+				if w.Body.Len() > 0 {
+					t.Errorf("want no body but got %v", w.Body.String())
+				}
+				return
+			}
+			if tt.err == nil {
+				return
+			}
+			var res ErrorResponse
+			if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+				t.Fatal(err)
+			}
+			if e, g := tt.wantCode, res.Error.Code; e != g {
+				t.Errorf("error code want %v but got %v", e, g)
+			}
+			if e, g := http.StatusText(tt.wantStatus), res.Error.Message; e != g {
+				t.Errorf("error message want %v but got %v", e, g)
+			}
+		})
+	}
+}
+
+func TestHandleTaskAPI(t *testing.T) {
+	cases := []struct {
+		name       string
+		err        error
+		wantStatus int
+	}{
+		{"ok", nil, http.StatusOK},
+		{"bad request is dropped", failure.New(StatusBadRequest), http.StatusOK},
+		{"not found is dropped", failure.New(StatusNotFound), http.StatusOK},
+		{"internal server error is retried", failure.New(StatusInternalServerError), http.StatusInternalServerError},
+	}
+
+	for _, tt := range cases {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			h := HandleTaskAPI(func(r *http.Request) (interface{}, error) {
+				return nil, tt.err
+			})
+			w := httptest.NewRecorder()
+			h(w, httptest.NewRequest(http.MethodPost, "/", nil))
+
+			if e, g := tt.wantStatus, w.Code; e != g {
+				t.Errorf("status want %v but got %v", e, g)
+			}
+		})
+	}
+}
+
+func TestHandleTaskAPI_LogFields(t *testing.T) {
+	var buf bytes.Buffer
+	logOutput = &buf
+	defer func() {
+		logMu.Lock()
+		logOutput = os.Stdout
+		logMu.Unlock()
+	}()
+
+	h := HandleTaskAPI(func(r *http.Request) (interface{}, error) {
+		ctx := WithLogFields(r.Context(), LogFields{DS2BQJobID: "job1", Operation: "ope1"})
+		Infof(ctx, "handle task\n")
+		return nil, failure.New(StatusNotFound)
+	})
+	h(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/", nil))
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if e, g := 3, len(lines); e != g {
+		t.Fatalf("want %v log lines but got %v. log=%v", e, g, buf.String())
+	}
+	for _, line := range lines {
+		var e LogEntry
+		if err := json.Unmarshal([]byte(line), &e); err != nil {
+			t.Fatal(err)
+		}
+		if e.DS2BQJobID != "job1" || e.Operation != "ope1" {
+			t.Errorf("want LogFields but got %+v", e)
+		}
+	}
+}
+
+func TestDecodeJSON(t *testing.T) {
+	var form DatastoreExportJobCheckRequest
+	if _, err := DecodeJSON(httptest.NewRequest(http.MethodPost, "/", strings.NewReader(`{"DS2BQJobID":"hoge"}`)), &form); err != nil {
+		t.Fatal(err)
+	}
+	if e, g := "hoge", form.DS2BQJobID; e != g {
+		t.Errorf("want %v but got %v", e, g)
+	}
+
+	_, err := DecodeJSON(httptest.NewRequest(http.MethodPost, "/", strings.NewReader(`{`)), &form)
+	if e, g := http.StatusBadRequest, HTTPStatusCode(err); e != g {
+		t.Errorf("want %v but got %v", e, g)
+	}
+}
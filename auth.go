@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/morikuni/failure"
+)
+
+// CallerPolicyWildcard is CallerPolicyで全てのProject, Datasetを許可する値
+const CallerPolicyWildcard = "*"
+
+// ServiceAccountOnlyAPIPathPrefixes is ds2bq自身のService Accountだけが呼び出せるAPIのPath
+// 状態確認のTaskと、Cloud Schedulerから実行する管理用のAPIは、全てのProjectのJobを操作するので、CallerPolicyでは許可しない
+var ServiceAccountOnlyAPIPathPrefixes = []string{
+	"/api/v1/bigquery-load-job-check/",
+	"/api/v1/datastore-export-job-check/",
+	"/api/v1/reconcile/",
+	"/api/v1/task-outbox-drain/",
+}
+
+// CallerPolicy is Callerが使って良いExport元のProjectとBQ Load先のDataset
+// BQLoadDatasets は {projectId}.{datasetId} で指定する
+// Scheduler はCloud SchedulerがID Tokenに使うService Accountの場合に true にする. JobTriggerTypeScheduler の判定に使う
+type CallerPolicy struct {
+	ExportProjectIDs []string `json:"exportProjectIds"`
+	BQLoadDatasets   []string `json:"bqLoadDatasets"`
+	Scheduler        bool     `json:"scheduler"`
+}
+
+// Allows is Export元のProjectとBQ Load先のDatasetを使って良いかを返す
+func (p *CallerPolicy) Allows(exportProjectID string, bqLoadProjectID string, bqLoadDatasetID string) bool {
+	if p == nil {
+		return false
+	}
+	if !contains(p.ExportProjectIDs, CallerPolicyWildcard) && !contains(p.ExportProjectIDs, exportProjectID) {
+		return false
+	}
+	if !contains(p.BQLoadDatasets, CallerPolicyWildcard) && !contains(p.BQLoadDatasets, bqLoadProjectID+"."+bqLoadDatasetID) {
+		return false
+	}
+	return true
+}
+
+// Caller is ID Tokenを検証して確認したAPIの呼び出し元
+type Caller struct {
+	Email  string
+	Policy *CallerPolicy
+}
+
+// IsServiceAccount is Callerがds2bq自身のService Accountかを返す
+func (c *Caller) IsServiceAccount() bool {
+	return ServiceAccountEmail != "" && c.Email == ServiceAccountEmail
+}
+
+// IsScheduler is CallerがCloud Schedulerとして登録されたService Accountかを返す
+func (c *Caller) IsScheduler() bool {
+	return c.Policy != nil && c.Policy.Scheduler
+}
+
+type callerContextKey struct{}
+
+// WithCaller is ctxにCallerを入れる
+func WithCaller(ctx context.Context, caller *Caller) context.Context {
+	return context.WithValue(ctx, callerContextKey{}, caller)
+}
+
+// CallerFromContext is ctxからCallerを取り出す
+// 認証が無効な場合は false を返す
+func CallerFromContext(ctx context.Context) (*Caller, bool) {
+	caller, ok := ctx.Value(callerContextKey{}).(*Caller)
+	return caller, ok
+}
+
+// AuthorizeExportRequest is ctxのCallerがformのExport元のProjectとBQ Load先のDatasetを使って良いかを確認する
+// 認証が無効でCallerが無い場合は何もしない
+func AuthorizeExportRequest(ctx context.Context, form *DatastoreExportRequest) error {
+	caller, ok := CallerFromContext(ctx)
+	if !ok {
+		return nil
+	}
+	bqLoadProjectID, bqLoadDatasetID := GetBQLoadDestination(form)
+	if !caller.Policy.Allows(form.ProjectID, bqLoadProjectID, bqLoadDatasetID) {
+		return failure.New(StatusForbidden, failure.Messagef("%v is not allowed. projectId=%v,bqLoadProjectId=%v,bqLoadDatasetId=%v", caller.Email, form.ProjectID, bqLoadProjectID, bqLoadDatasetID))
+	}
+	return nil
+}
+
+// AuthorizeDSExportJob is ctxのCallerがDSExportJobのExport元のProjectとBQ Load先のDatasetを使って良いかを確認する
+// 認証が無効でCallerが無い場合は何もしない
+func AuthorizeDSExportJob(ctx context.Context, job *DSExportJob) error {
+	if _, ok := CallerFromContext(ctx); !ok {
+		return nil
+	}
+	var form DatastoreExportRequest
+	if err := json.Unmarshal([]byte(job.JobRequestBody), &form); err != nil {
+		return failure.Wrap(err, failure.Messagef("failed json.Unmarshal. ds2bqJobID=%v", job.ID))
+	}
+	return AuthorizeExportRequest(ctx, &form)
+}
+
+// Authorizer is APIのRequestのID Tokenを検証して、許可されたCallerかを確認する
+type Authorizer struct {
+	Verifier       *OIDCVerifier
+	AllowedCallers map[string]*CallerPolicy
+}
+
+func NewAuthorizer(verifier *OIDCVerifier, allowedCallers map[string]*CallerPolicy) *Authorizer {
+	return &Authorizer{
+		verifier, allowedCallers,
+	}
+}
+
+// NewAuthorizerFromEnv is 環境変数から Authorizer を作る
+// OIDC_AUDIENCE が空の場合は認証を行わないので nil を返す
+// OIDC_AUDIENCE はカンマ区切りで複数指定できる
+// OIDC_ALLOWED_CALLERS は Service AccountのEmailをKeyにした CallerPolicy のJSON
+func NewAuthorizerFromEnv() (*Authorizer, error) {
+	v := os.Getenv("OIDC_AUDIENCE")
+	if len(v) < 1 {
+		return nil, nil
+	}
+	var audiences []string
+	for _, aud := range strings.Split(v, ",") {
+		if aud = strings.TrimSpace(aud); aud != "" {
+			audiences = append(audiences, aud)
+		}
+	}
+	allowedCallers, err := ParseAllowedCallers(os.Getenv("OIDC_ALLOWED_CALLERS"))
+	if err != nil {
+		return nil, err
+	}
+	return NewAuthorizer(NewOIDCVerifier(audiences, GoogleIssuers, NewRemoteKeySet(GoogleCertsURL)), allowedCallers), nil
+}
+
+// ParseAllowedCallers is OIDC_ALLOWED_CALLERS のJSONを CallerPolicy のMapに変換する
+func ParseAllowedCallers(v string) (map[string]*CallerPolicy, error) {
+	allowedCallers := map[string]*CallerPolicy{}
+	if len(v) < 1 {
+		return allowedCallers, nil
+	}
+	if err := json.Unmarshal([]byte(v), &allowedCallers); err != nil {
+		return nil, failure.Wrap(err, failure.Messagef("invalid OIDC_ALLOWED_CALLERS=%v", v))
+	}
+	return allowedCallers, nil
+}
+
+// Authenticate is RequestのAuthorization HeaderのID Tokenを検証してCallerを返す
+// ds2bq自身のService Account (Cloud TasksのTask) は全てのProject, Datasetを使える
+func (a *Authorizer) Authenticate(r *http.Request) (*Caller, error) {
+	h := r.Header.Get("Authorization")
+	if !strings.HasPrefix(h, "Bearer ") {
+		return nil, failure.New(StatusUnauthorized, failure.Message("Authorization header is required"))
+	}
+	claims, err := a.Verifier.Verify(r.Context(), strings.TrimPrefix(h, "Bearer "))
+	if err != nil {
+		return nil, err
+	}
+	if ServiceAccountEmail != "" && claims.Email == ServiceAccountEmail {
+		return &Caller{
+			Email: claims.Email,
+			Policy: &CallerPolicy{
+				ExportProjectIDs: []string{CallerPolicyWildcard},
+				BQLoadDatasets:   []string{CallerPolicyWildcard},
+			},
+		}, nil
+	}
+	policy, ok := a.AllowedCallers[claims.Email]
+	if !ok {
+		return nil, failure.New(StatusForbidden, failure.Messagef("%v is not allowed caller", claims.Email))
+	}
+	return &Caller{
+		Email:  claims.Email,
+		Policy: policy,
+	}, nil
+}
+
+// Middleware is /api/ 以下のRequestを認証して、ContextにCallerを入れる
+// ServiceAccountOnlyAPIPathPrefixes のAPIは、ds2bq自身のService Account以外は 403 にする
+// Authorizer が nil の場合 (認証が無効) は何もしない
+func (a *Authorizer) Middleware(next http.Handler) http.Handler {
+	if a == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, "/api/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		caller, err := a.Authenticate(r)
+		if err != nil {
+			WriteErrorJSON(r.Context(), w, HTTPStatusCode(err), err)
+			return
+		}
+		if isServiceAccountOnlyAPIPath(r.URL.Path) && !caller.IsServiceAccount() {
+			err := failure.New(StatusForbidden, failure.Messagef("%v is not allowed to call %v", caller.Email, r.URL.Path))
+			WriteErrorJSON(r.Context(), w, HTTPStatusCode(err), err)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(WithCaller(r.Context(), caller)))
+	})
+}
+
+func isServiceAccountOnlyAPIPath(path string) bool {
+	for _, prefix := range ServiceAccountOnlyAPIPathPrefixes {
+		if strings.HasPrefix(path, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// TaskOIDCAudience is Cloud TasksのTaskのID TokenのAudience
+// OIDC_AUDIENCE の最初の値を使う. 空の場合はCloud TasksがTaskのURLをAudienceにする
+func TaskOIDCAudience() string {
+	v := strings.Split(os.Getenv("OIDC_AUDIENCE"), ",")
+	return strings.TrimSpace(v[0])
+}
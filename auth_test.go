@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/morikuni/failure"
+)
+
+func TestCallerPolicy_Allows(t *testing.T) {
+	policy := &CallerPolicy{
+		ExportProjectIDs: []string{"gcpug-ds2bq-dev"},
+		BQLoadDatasets:   []string{"gcpug-ds2bq-dev.datastore"},
+	}
+	wildcard := &CallerPolicy{
+		ExportProjectIDs: []string{CallerPolicyWildcard},
+		BQLoadDatasets:   []string{CallerPolicyWildcard},
+	}
+
+	cases := []struct {
+		name            string
+		policy          *CallerPolicy
+		exportProjectID string
+		bqLoadProjectID string
+		bqLoadDatasetID string
+		want            bool
+	}{
+		{"allowed", policy, "gcpug-ds2bq-dev", "gcpug-ds2bq-dev", "datastore", true},
+		{"other export project", policy, "hoge", "gcpug-ds2bq-dev", "datastore", false},
+		{"other dataset", policy, "gcpug-ds2bq-dev", "gcpug-ds2bq-dev", "hoge", false},
+		{"other bq project", policy, "gcpug-ds2bq-dev", "hoge", "datastore", false},
+		{"wildcard", wildcard, "hoge", "fuga", "moge", true},
+		{"nil", nil, "gcpug-ds2bq-dev", "gcpug-ds2bq-dev", "datastore", false},
+	}
+
+	for _, tt := range cases {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			if e, g := tt.want, tt.policy.Allows(tt.exportProjectID, tt.bqLoadProjectID, tt.bqLoadDatasetID); e != g {
+				t.Errorf("want %v but got %v", e, g)
+			}
+		})
+	}
+}
+
+func TestAuthorizeExportRequest(t *testing.T) {
+	form := &DatastoreExportRequest{
+		ProjectID:       "gcpug-ds2bq-dev",
+		BQLoadProjectID: "gcpug-ds2bq-dev",
+		BQLoadDatasetID: "datastore",
+	}
+
+	cases := []struct {
+		name    string
+		ctx     context.Context
+		wantErr bool
+	}{
+		{"auth disabled", context.Background(), false},
+		{"allowed", WithCaller(context.Background(), &Caller{
+			Email: "scheduler@gcpug-ds2bq-dev.iam.gserviceaccount.com",
+			Policy: &CallerPolicy{
+				ExportProjectIDs: []string{"gcpug-ds2bq-dev"},
+				BQLoadDatasets:   []string{"gcpug-ds2bq-dev.datastore"},
+			},
+		}), false},
+		{"forbidden", WithCaller(context.Background(), &Caller{
+			Email: "scheduler@gcpug-ds2bq-dev.iam.gserviceaccount.com",
+			Policy: &CallerPolicy{
+				ExportProjectIDs: []string{"gcpug-ds2bq-dev"},
+				BQLoadDatasets:   []string{"gcpug-ds2bq-dev.ds2bqtest"},
+			},
+		}), true},
+	}
+
+	for _, tt := range cases {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			err := AuthorizeExportRequest(tt.ctx, form)
+			if tt.wantErr {
+				if !failure.Is(err, StatusForbidden) {
+					t.Errorf("want StatusForbidden but got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Errorf("want nil but got %v", err)
+			}
+		})
+	}
+}
+
+func TestParseAllowedCallers(t *testing.T) {
+	got, err := ParseAllowedCallers(`{"scheduler@gcpug-ds2bq-dev.iam.gserviceaccount.com": {"exportProjectIds": ["gcpug-ds2bq-dev"], "bqLoadDatasets": ["gcpug-ds2bq-dev.datastore"], "scheduler": true}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	policy, ok := got["scheduler@gcpug-ds2bq-dev.iam.gserviceaccount.com"]
+	if !ok {
+		t.Fatalf("want policy but not found. got=%+v", got)
+	}
+	if !policy.Allows("gcpug-ds2bq-dev", "gcpug-ds2bq-dev", "datastore") {
+		t.Errorf("want allowed but not allowed. policy=%+v", policy)
+	}
+	if !policy.Scheduler {
+		t.Errorf("want scheduler but not scheduler. policy=%+v", policy)
+	}
+
+	if _, err := ParseAllowedCallers("hoge"); err == nil {
+		t.Errorf("want error but got nil")
+	}
+}
+
+func TestAuthorizer_Middleware(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	verifier := NewOIDCVerifier([]string{"https://ds2bq.example.com"}, GoogleIssuers, StaticKeySet{"kid1": &key.PublicKey})
+	authorizer := NewAuthorizer(verifier, map[string]*CallerPolicy{
+		"scheduler@gcpug-ds2bq-dev.iam.gserviceaccount.com": &CallerPolicy{
+			ExportProjectIDs: []string{"gcpug-ds2bq-dev"},
+			BQLoadDatasets:   []string{"gcpug-ds2bq-dev.datastore"},
+		},
+	})
+
+	defer func(v string) { ServiceAccountEmail = v }(ServiceAccountEmail)
+	ServiceAccountEmail = "gcpug-ds2bq@gcpug-ds2bq-dev.iam.gserviceaccount.com"
+
+	token := func(email string) string {
+		c := newTestIDTokenClaims(now)
+		c.Email = email
+		return "Bearer " + signIDToken(t, key, "kid1", "RS256", c)
+	}
+
+	cases := []struct {
+		name          string
+		authorizer    *Authorizer
+		path          string
+		authorization string
+		wantStatus    int
+		wantCaller    string
+	}{
+		{"disabled", nil, "/api/v1/datastore-export/", "", http.StatusOK, ""},
+		{"health check", authorizer, "/", "", http.StatusOK, ""},
+		{"no token", authorizer, "/api/v1/datastore-export/", "", http.StatusUnauthorized, ""},
+		{"invalid token", authorizer, "/api/v1/datastore-export/", "Bearer hoge", http.StatusUnauthorized, ""},
+		{"allowed caller", authorizer, "/api/v1/datastore-export/", token("scheduler@gcpug-ds2bq-dev.iam.gserviceaccount.com"), http.StatusOK, "scheduler@gcpug-ds2bq-dev.iam.gserviceaccount.com"},
+		{"service account", authorizer, "/api/v1/datastore-export-job-check/", token("gcpug-ds2bq@gcpug-ds2bq-dev.iam.gserviceaccount.com"), http.StatusOK, "gcpug-ds2bq@gcpug-ds2bq-dev.iam.gserviceaccount.com"},
+		{"not allowed caller", authorizer, "/api/v1/datastore-export/", token("hoge@example.com"), http.StatusForbidden, ""},
+		{"allowed caller calls check task", authorizer, "/api/v1/datastore-export-job-check/", token("scheduler@gcpug-ds2bq-dev.iam.gserviceaccount.com"), http.StatusForbidden, ""},
+		{"allowed caller calls reconcile", authorizer, "/api/v1/reconcile/", token("scheduler@gcpug-ds2bq-dev.iam.gserviceaccount.com"), http.StatusForbidden, ""},
+		{"service account calls task outbox drain", authorizer, "/api/v1/task-outbox-drain/", token("gcpug-ds2bq@gcpug-ds2bq-dev.iam.gserviceaccount.com"), http.StatusOK, "gcpug-ds2bq@gcpug-ds2bq-dev.iam.gserviceaccount.com"},
+	}
+
+	for _, tt := range cases {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			var gotCaller string
+			h := tt.authorizer.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if caller, ok := CallerFromContext(r.Context()); ok {
+					gotCaller = caller.Email
+				}
+				w.WriteHeader(http.StatusOK)
+			}))
+
+			r := httptest.NewRequest(http.MethodPost, tt.path, nil)
+			if tt.authorization != "" {
+				r.Header.Set("Authorization", tt.authorization)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+
+			if e, g := tt.wantStatus, w.Code; e != g {
+				t.Errorf("want StatusCode %v but got %v. body=%v", e, g, w.Body.String())
+			}
+			if e, g := tt.wantCaller, gotCaller; e != g {
+				t.Errorf("want Caller %v but got %v", e, g)
+			}
+		})
+	}
+}
@@ -3,9 +3,14 @@ package bigquery
 import (
 	"context"
 	"fmt"
+	"net/http"
+	"strings"
+	"time"
 
 	"cloud.google.com/go/bigquery"
 	"github.com/morikuni/failure"
+	bqapi "google.golang.org/api/bigquery/v2"
+	"google.golang.org/api/googleapi"
 )
 
 type JobStatus int
@@ -17,9 +22,39 @@ const (
 	Done
 )
 
+var jobStatusNames = []string{"StateUnspecified", "Running", "Fail", "Done"}
+
+func (s JobStatus) String() string {
+	if s < 0 || int(s) >= len(jobStatusNames) {
+		return fmt.Sprintf("JobStatus(%d)", int(s))
+	}
+	return jobStatusNames[s]
+}
+
 type JobStatusResponse struct {
 	Status     JobStatus
 	ErrMessage string
+	Errors     []*JobError        // Failの場合のエラー
+	Statistics *LoadJobStatistics // Done, Failの場合の統計
+}
+
+// JobError is BQ Load Jobのエラー
+type JobError struct {
+	Reason   string `json:"reason"`
+	Location string `json:"location"`
+	Message  string `json:"message"`
+}
+
+// LoadJobStatistics is BQ Load Jobの統計
+type LoadJobStatistics struct {
+	OutputRows     int64
+	OutputBytes    int64
+	InputFiles     int64
+	InputFileBytes int64
+	BadRecords     int64
+	StartTime      time.Time
+	EndTime        time.Time
+	SlotMillis     int64
 }
 
 func Load(ctx context.Context, projectID string, sourceGCSUri string, dstDataset string, dstTable string) (string, error) {
@@ -40,10 +75,91 @@ func Load(ctx context.Context, projectID string, sourceGCSUri string, dstDataset
 	return job.ID(), nil
 }
 
-func CheckJobStatus(ctx context.Context, projectID string, bqloadJobID string) (res *JobStatusResponse, rerr error) {
+// CheckJobStatus is BQ Load Jobの状態と統計を取得する
+// Cloud ClientのJobStatisticsには BadRecords, TotalSlotMs が無いので、REST APIを使う
+func CheckJobStatus(ctx context.Context, projectID string, bqloadJobID string) (*JobStatusResponse, error) {
+	service, err := bqapi.NewService(ctx)
+	if err != nil {
+		return nil, failure.Wrap(err, failure.Message("failed bigquery.NewService()."))
+	}
+
+	job, err := service.Jobs.Get(projectID, bqloadJobID).Context(ctx).Do()
+	if err != nil {
+		return nil, failure.Wrap(err, failure.Messagef("BQLoadJobID=%s", bqloadJobID))
+	}
+	if job.Status == nil || job.Status.State != "DONE" {
+		return &JobStatusResponse{Running, "", nil, nil}, nil
+	}
+	stats := NewLoadJobStatistics(job.Statistics)
+	if job.Status.ErrorResult == nil {
+		return &JobStatusResponse{Done, "", nil, stats}, nil
+	}
+	errs := NewJobErrors(job.Status)
+	return &JobStatusResponse{Fail, JobErrorsMessage(errs), errs, stats}, nil
+}
+
+// NewLoadJobStatistics is REST APIのJobStatisticsから LoadJobStatistics を作る
+func NewLoadJobStatistics(s *bqapi.JobStatistics) *LoadJobStatistics {
+	if s == nil {
+		return &LoadJobStatistics{}
+	}
+	stats := &LoadJobStatistics{
+		StartTime:  unixMillis(s.StartTime),
+		EndTime:    unixMillis(s.EndTime),
+		SlotMillis: s.TotalSlotMs,
+	}
+	if s.Load != nil {
+		stats.OutputRows = s.Load.OutputRows
+		stats.OutputBytes = s.Load.OutputBytes
+		stats.InputFiles = s.Load.InputFiles
+		stats.InputFileBytes = s.Load.InputFileBytes
+		stats.BadRecords = s.Load.BadRecords
+	}
+	return stats
+}
+
+// NewJobErrors is JobStatusのエラーを JobError に変換する
+// Errors が空の場合は ErrorResult を使う
+func NewJobErrors(s *bqapi.JobStatus) []*JobError {
+	l := s.Errors
+	if len(l) < 1 && s.ErrorResult != nil {
+		l = []*bqapi.ErrorProto{s.ErrorResult}
+	}
+	var errs []*JobError
+	for _, v := range l {
+		errs = append(errs, &JobError{
+			Reason:   v.Reason,
+			Location: v.Location,
+			Message:  v.Message,
+		})
+	}
+	return errs
+}
+
+// JobErrorsMessage is JobErrorを1行の文字列にする
+func JobErrorsMessage(errs []*JobError) string {
+	var l []string
+	for _, v := range errs {
+		if v.Location != "" {
+			l = append(l, fmt.Sprintf("%s: %s (location=%s)", v.Reason, v.Message, v.Location))
+			continue
+		}
+		l = append(l, fmt.Sprintf("%s: %s", v.Reason, v.Message))
+	}
+	return strings.Join(l, ", ")
+}
+
+func unixMillis(ms int64) time.Time {
+	if ms == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, ms*int64(time.Millisecond)).UTC()
+}
+
+func Cancel(ctx context.Context, projectID string, bqloadJobID string) (rerr error) {
 	bq, err := bigquery.NewClient(ctx, projectID)
 	if err != nil {
-		return nil, failure.Wrap(err, failure.Messagef("ProjectID:%v", projectID))
+		return failure.Wrap(err, failure.Messagef("ProjectID:%v", projectID))
 	}
 	defer func() {
 		if err := bq.Close(); err != nil {
@@ -53,15 +169,89 @@ func CheckJobStatus(ctx context.Context, projectID string, bqloadJobID string) (
 
 	job, err := bq.JobFromID(ctx, bqloadJobID)
 	if err != nil {
-		return nil, failure.Wrap(err, failure.Messagef("BQLoadJobID=%s", bqloadJobID))
+		return failure.Wrap(err, failure.Messagef("BQLoadJobID=%s", bqloadJobID))
+	}
+	if err := job.Cancel(ctx); err != nil {
+		return failure.Wrap(err, failure.Messagef("failed job.Cancel. BQLoadJobID=%s", bqloadJobID))
 	}
-	if !job.LastStatus().Done() {
-		return &JobStatusResponse{Running, ""}, nil
+	return nil
+}
+
+// GetTableRowCount is tableのRow数を返す
+func GetTableRowCount(ctx context.Context, projectID string, datasetID string, tableID string) (count int64, rerr error) {
+	bq, err := bigquery.NewClient(ctx, projectID)
+	if err != nil {
+		return 0, failure.Wrap(err, failure.Messagef("ProjectID:%v", projectID))
+	}
+	defer func() {
+		if err := bq.Close(); err != nil {
+			rerr = failure.Wrap(err, failure.Messagef("failed bq.Client.Close. projectID=%s", projectID))
+		}
+	}()
+
+	md, err := bq.Dataset(datasetID).Table(tableID).Metadata(ctx)
+	if err != nil {
+		return 0, failure.Wrap(err, failure.Messagef("failed Table.Metadata. Dataset:%v,Table:%v", datasetID, tableID))
+	}
+	return int64(md.NumRows), nil
+}
+
+// InsertRow is Streaming Insertする1行
+// InsertID はBigQueryがbest effortで重複した行を取り除くのに使う
+type InsertRow struct {
+	InsertID string
+	Row      interface{}
+}
+
+// InsertRows is tableにrowsをStreaming Insertする
+// tableが無い場合は rows[0].Row の型からSchemaを作り、partitionFieldで日付分割したtableを作成する
+func InsertRows(ctx context.Context, projectID string, datasetID string, tableID string, partitionField string, rows []*InsertRow) (rerr error) {
+	if len(rows) < 1 {
+		return nil
+	}
+	bq, err := bigquery.NewClient(ctx, projectID)
+	if err != nil {
+		return failure.Wrap(err, failure.Messagef("ProjectID:%v", projectID))
+	}
+	defer func() {
+		if err := bq.Close(); err != nil {
+			rerr = failure.Wrap(err, failure.Messagef("failed bq.Client.Close. projectID=%s", projectID))
+		}
+	}()
+
+	schema, err := bigquery.InferSchema(rows[0].Row)
+	if err != nil {
+		return failure.Wrap(err, failure.Messagef("failed bigquery.InferSchema. row=%+v", rows[0].Row))
 	}
-	switch job.LastStatus().State {
-	case bigquery.Done:
-		return &JobStatusResponse{Done, ""}, nil
-	default:
-		return &JobStatusResponse{Fail, fmt.Sprintf("%+v", job.LastStatus().Errors)}, nil
+	table := bq.Dataset(datasetID).Table(tableID)
+	if _, err := table.Metadata(ctx); err != nil {
+		if !hasStatusCode(err, http.StatusNotFound) {
+			return failure.Wrap(err, failure.Messagef("failed Table.Metadata. Dataset:%v,Table:%v", datasetID, tableID))
+		}
+		tm := &bigquery.TableMetadata{Schema: schema}
+		if partitionField != "" {
+			tm.TimePartitioning = &bigquery.TimePartitioning{Field: partitionField}
+		}
+		if err := table.Create(ctx, tm); err != nil && !hasStatusCode(err, http.StatusConflict) {
+			return failure.Wrap(err, failure.Messagef("failed Table.Create. Dataset:%v,Table:%v", datasetID, tableID))
+		}
 	}
+
+	var l []*bigquery.StructSaver
+	for _, v := range rows {
+		l = append(l, &bigquery.StructSaver{
+			Schema:   schema,
+			InsertID: v.InsertID,
+			Struct:   v.Row,
+		})
+	}
+	if err := table.Uploader().Put(ctx, l); err != nil {
+		return failure.Wrap(err, failure.Messagef("failed Uploader.Put. Dataset:%v,Table:%v", datasetID, tableID))
+	}
+	return nil
+}
+
+func hasStatusCode(err error, code int) bool {
+	e, ok := err.(*googleapi.Error)
+	return ok && e.Code == code
 }
@@ -3,7 +3,11 @@ package bigquery
 import (
 	"context"
 	"fmt"
+	"reflect"
 	"testing"
+	"time"
+
+	bqapi "google.golang.org/api/bigquery/v2"
 )
 
 func TestLoad(t *testing.T) {
@@ -17,3 +21,92 @@ func TestLoad(t *testing.T) {
 	}
 	fmt.Println(jobID)
 }
+
+func TestNewLoadJobStatistics(t *testing.T) {
+	cases := []struct {
+		name string
+		s    *bqapi.JobStatistics
+		want *LoadJobStatistics
+	}{
+		{"nil", nil, &LoadJobStatistics{}},
+		{"load",
+			&bqapi.JobStatistics{
+				StartTime:   1561942800123,
+				EndTime:     1561942954567,
+				TotalSlotMs: 4321,
+				Load: &bqapi.JobStatistics3{
+					BadRecords:     1,
+					InputFileBytes: 2048,
+					InputFiles:     2,
+					OutputBytes:    1024,
+					OutputRows:     100,
+				},
+			},
+			&LoadJobStatistics{
+				OutputRows:     100,
+				OutputBytes:    1024,
+				InputFiles:     2,
+				InputFileBytes: 2048,
+				BadRecords:     1,
+				StartTime:      time.Date(2019, 7, 1, 1, 0, 0, 123000000, time.UTC),
+				EndTime:        time.Date(2019, 7, 1, 1, 2, 34, 567000000, time.UTC),
+				SlotMillis:     4321,
+			},
+		},
+	}
+
+	for _, tt := range cases {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			if e, g := tt.want, NewLoadJobStatistics(tt.s); !reflect.DeepEqual(e, g) {
+				t.Errorf("want %+v but got %+v", e, g)
+			}
+		})
+	}
+}
+
+func TestNewJobErrors(t *testing.T) {
+	cases := []struct {
+		name        string
+		s           *bqapi.JobStatus
+		want        []*JobError
+		wantMessage string
+	}{
+		{"errors",
+			&bqapi.JobStatus{
+				ErrorResult: &bqapi.ErrorProto{Reason: "invalid", Message: "Error while reading data"},
+				Errors: []*bqapi.ErrorProto{
+					{Reason: "invalid", Location: "gs://hoge/all_namespaces_kind_PugEvent.export_metadata", Message: "Error while reading data"},
+					{Reason: "invalid", Message: "Too many errors"},
+				},
+			},
+			[]*JobError{
+				{Reason: "invalid", Location: "gs://hoge/all_namespaces_kind_PugEvent.export_metadata", Message: "Error while reading data"},
+				{Reason: "invalid", Message: "Too many errors"},
+			},
+			"invalid: Error while reading data (location=gs://hoge/all_namespaces_kind_PugEvent.export_metadata), invalid: Too many errors",
+		},
+		{"error result only",
+			&bqapi.JobStatus{
+				ErrorResult: &bqapi.ErrorProto{Reason: "notFound", Message: "Not found: Dataset"},
+			},
+			[]*JobError{
+				{Reason: "notFound", Message: "Not found: Dataset"},
+			},
+			"notFound: Not found: Dataset",
+		},
+	}
+
+	for _, tt := range cases {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			got := NewJobErrors(tt.s)
+			if e, g := tt.want, got; !reflect.DeepEqual(e, g) {
+				t.Errorf("want %+v but got %+v", e, g)
+			}
+			if e, g := tt.wantMessage, JobErrorsMessage(got); e != g {
+				t.Errorf("want message %v but got %v", e, g)
+			}
+		})
+	}
+}
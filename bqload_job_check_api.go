@@ -1,13 +1,16 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
 	"fmt"
-	"io/ioutil"
-	"log"
 	"net/http"
+	"strconv"
+	"time"
 
 	"github.com/gcpug/ds2bq/bigquery"
+	"github.com/gcpug/ds2bq/datastore"
+	"github.com/morikuni/failure"
+	"go.opencensus.io/trace"
 )
 
 type BQLoadJobCheckRequest struct {
@@ -15,91 +18,387 @@ type BQLoadJobCheckRequest struct {
 	BQLoadProjectID   string
 	BQLoadKind        string
 	BigQueryLoadJobID string
+	CheckSequence     int    // 何回目の状態確認のTaskか. Task IDに使う
+	TraceContext      string `json:",omitempty"` // Taskを追加したRunのSpanContext. EncodeTraceContext の値
 }
 
-func HandleBQLoadJobCheckAPI(w http.ResponseWriter, r *http.Request) {
+// TaskID is 状態確認のTaskのIDを返す
+func (r *BQLoadJobCheckRequest) TaskID() string {
+	return BuildTaskID(fmt.Sprintf("%s/%s/%s/%d", r.DS2BQJobID, r.BQLoadKind, r.BigQueryLoadJobID, r.CheckSequence), "bqload", r.DS2BQJobID, r.BQLoadKind, strconv.Itoa(r.CheckSequence))
+}
+
+// Next is 次の状態確認のTaskのRequestを返す
+// 同じTaskが再配信されても次のTaskのIDが同じになるように、CheckSequenceはこのRequestから決める
+func (r *BQLoadJobCheckRequest) Next() *BQLoadJobCheckRequest {
+	next := *r
+	next.CheckSequence = r.CheckSequence + 1
+	return &next
+}
+
+type BQLoadJobCheckAPI struct {
+	BQLoadJobCheckQueue *BQLoadJobCheckQueue
+	BQLoadJobStore      *BQLoadJobStore
+	DatastoreExportAPI  *DatastoreExportAPI
+	DeadLetterTaskStore *DeadLetterTaskStore
+	Notifier            *Notifier
+}
+
+func NewBQLoadJobCheckAPI(queue *BQLoadJobCheckQueue, bqlJS *BQLoadJobStore, dseAPI *DatastoreExportAPI, dltS *DeadLetterTaskStore, notifier *Notifier) *BQLoadJobCheckAPI {
+	return &BQLoadJobCheckAPI{
+		queue, bqlJS, dseAPI, dltS, notifier,
+	}
+}
+
+func HandleBQLoadJobCheckAPI(r *http.Request) (interface{}, error) {
 	ctx := r.Context()
 
-	b, err := ioutil.ReadAll(r.Body)
+	var form BQLoadJobCheckRequest
+	b, err := DecodeJSON(r, &form)
 	if err != nil {
-		msg := fmt.Sprintf("failed ioutil.Read(request.Body).err=%+v", err)
-		log.Println(msg)
-		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-		w.WriteHeader(http.StatusBadRequest)
-		_, err := w.Write([]byte(msg))
-		if err != nil {
-			log.Println(err)
-		}
-		return
+		return nil, err
 	}
+	if form.DS2BQJobID == "" || form.BQLoadKind == "" || form.BigQueryLoadJobID == "" {
+		return nil, failure.New(StatusBadRequest, failure.Messagef("invalid request body. body=%s", string(b)))
+	}
+	ctx = WithLogFields(ctx, LogFields{DS2BQJobID: form.DS2BQJobID, Kind: form.BQLoadKind, Operation: form.BigQueryLoadJobID})
+	ctx, span := StartSpanWithTraceContext(ctx, "HandleBQLoadJobCheckAPI", form.TraceContext)
+	defer span.End()
 
-	var form BQLoadJobCheckRequest
-	if err := json.Unmarshal(b, &form); err != nil {
-		msg := fmt.Sprintf("failed json.Unmarshal(request.Body).err=%+v", err)
-		log.Println(msg)
-		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-		w.WriteHeader(http.StatusBadRequest)
-		_, err := w.Write([]byte(msg))
-		if err != nil {
-			log.Println(err)
-		}
-		return
+	bqloadJobStore, err := NewBQLoadJobStore(ctx, DatastoreClient)
+	if err != nil {
+		return nil, failure.Wrap(err, failure.Messagef("failed NewBQLoadJobStore() form=%+v", form))
 	}
 
-	log.Printf("%s\n", string(b))
+	dsexportJobStore, err := NewDSExportJobStore(ctx, DatastoreClient)
+	if err != nil {
+		return nil, failure.Wrap(err, failure.Messagef("failed NewDSExportJobStore() form=%+v", form))
+	}
 
-	bqloadJobStore, err := NewBQLoadJobStore(ctx, DatastoreClient)
+	runLockStore, err := NewRunLockStore(ctx, DatastoreClient)
 	if err != nil {
-		msg := fmt.Sprintf("failed NewBQLoadJobStore.err=%+v", err)
-		log.Println(msg)
-		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-		w.WriteHeader(http.StatusInternalServerError)
-		_, err := w.Write([]byte(msg))
-		if err != nil {
-			log.Println(err)
-		}
-		return
+		return nil, failure.Wrap(err, failure.Messagef("failed NewRunLockStore() form=%+v", form))
 	}
 
-	res, err := bigquery.CheckJobStatus(ctx, form.BQLoadProjectID, form.BigQueryLoadJobID)
+	queue, err := NewDatastoreExportJobCheckQueue(r.Host, TasksClient)
 	if err != nil {
-		msg := fmt.Sprintf("failed bigquery.CheckJobStatus.ProjectID=%v,JobID=%v,err=%+v", form.BQLoadProjectID, form.BigQueryLoadJobID, err)
-		log.Println(msg)
-		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-		w.WriteHeader(http.StatusInternalServerError)
-		_, err := w.Write([]byte(msg))
-		if err != nil {
-			log.Println(err)
-		}
-		return
+		return nil, failure.Wrap(err, failure.Messagef("failed NewDatastoreExportJobCheckQueue() form=%+v", form))
+	}
+
+	bqljcQ, err := NewBQLoadJobCheckQueue(r.Host, TasksClient)
+	if err != nil {
+		return nil, failure.Wrap(err, failure.Messagef("failed NewBQLoadJobCheckQueue() form=%+v", form))
+	}
+
+	taskOutboxStore, err := NewTaskOutboxStore(ctx, DatastoreClient)
+	if err != nil {
+		return nil, failure.Wrap(err, failure.Messagef("failed NewTaskOutboxStore() form=%+v", form))
+	}
+
+	deadLetterTaskStore, err := NewDeadLetterTaskStore(ctx, DatastoreClient)
+	if err != nil {
+		return nil, failure.Wrap(err, failure.Messagef("failed NewDeadLetterTaskStore() form=%+v", form))
+	}
+
+	maxAttempts, err := CheckTaskMaxAttempts()
+	if err != nil {
+		return nil, failure.Wrap(err, failure.Message("failed CheckTaskMaxAttempts()"))
+	}
+
+	api := NewBQLoadJobCheckAPI(bqljcQ, bqloadJobStore, NewDatastoreExportAPI(queue, dsexportJobStore, bqloadJobStore, runLockStore, taskOutboxStore), deadLetterTaskStore, NewNotifier())
+
+	deadLettered, err := api.DeadLetterIfExceeded(ctx, &form, ParseTaskAttempt(r.Header), maxAttempts)
+	if err != nil {
+		return nil, err
+	}
+	if deadLettered {
+		// Cloud Tasksにこれ以上Retryさせない
+		return nil, nil
+	}
+
+	if err := api.Check(ctx, &form); err != nil {
+		return nil, err
+	}
+	return nil, nil
+}
+
+// Check is BQ Load Jobの状態を確認して、BQLoadJobの状態を進める
+// まだRunningの場合は、状態確認の回数に応じた間隔で次の状態確認のTaskを追加する
+func (api *BQLoadJobCheckAPI) Check(ctx context.Context, form *BQLoadJobCheckRequest) error {
+	ctx = WithLogFields(ctx, LogFields{DS2BQJobID: form.DS2BQJobID, Kind: form.BQLoadKind, Operation: form.BigQueryLoadJobID})
+	current, err := api.BQLoadJobStore.Get(ctx, form.DS2BQJobID, form.BQLoadKind)
+	if err != nil {
+		return failure.New(StoreErrorCode(err), failure.Messagef("failed BQLoadJobStore.Get. DS2BQJobID=%v,BQLoadKind=%v,err=%v\n", form.DS2BQJobID, form.BQLoadKind, err))
+	}
+	if current.Status != BQLoadJobStatusRunning || current.BQLoadJobID != form.BigQueryLoadJobID {
+		// Cancelされた場合や、Reconcilerが重複してTaskを追加した場合は、状態確認をやめる
+		Infof(ctx, "%s-_-%s is not Running. stop checking. status=%v,bigQueryLoadJobID=%v\n", form.DS2BQJobID, form.BQLoadKind, current.Status, form.BigQueryLoadJobID)
+		return nil
+	}
+	ctx = WithJobTags(ctx, current.ExportProjectID, current.Kind)
+
+	spanCtx, span := StartSpan(ctx, "bigquery.CheckJobStatus", trace.StringAttribute(SpanAttributeBQLoadProjectID, form.BQLoadProjectID))
+	res, err := bigquery.CheckJobStatus(spanCtx, form.BQLoadProjectID, form.BigQueryLoadJobID)
+	if err == nil {
+		span.AddAttributes(trace.StringAttribute(SpanAttributeStatus, res.Status.String()))
+	}
+	EndSpan(span, err)
+	if err != nil {
+		return failure.New(StatusInternalServerError, failure.Messagef("failed bigquery.CheckJobStatus.ProjectID=%v,JobID=%v,err=%+v", form.BQLoadProjectID, form.BigQueryLoadJobID, err))
+	}
+	if err := api.NotifyIfSLOExceeded(ctx, form, current, time.Now()); err != nil {
+		Errorf(ctx, "failed NotifyIfSLOExceeded. DS2BQJobID=%v,BQLoadKind=%v,err=%v\n", form.DS2BQJobID, form.BQLoadKind, err)
 	}
 	switch res.Status {
 	case bigquery.Running:
-		_, err := bqloadJobStore.IncrementJobStatusCheckCount(ctx, form.DS2BQJobID, form.BQLoadKind)
+		next := form.Next()
+		delay := NextBQLoadJobCheckDelay(next.CheckSequence)
+		outbox, err := api.DatastoreExportAPI.TaskOutboxStore.NewScheduled(api.BQLoadJobStore.NewKey(ctx, form.DS2BQJobID, form.BQLoadKind), TaskOutboxQueueBQLoadJobCheck, next.TaskID(), next, time.Now().Add(delay))
+		if err != nil {
+			return failure.New(StatusInternalServerError, failure.Messagef("failed TaskOutboxStore.NewScheduled. DS2BQJobID=%v,BQLoadKind=%v,err=%v\n", form.DS2BQJobID, form.BQLoadKind, err))
+		}
+		job, err := api.BQLoadJobStore.IncrementJobStatusCheckCount(ctx, form.DS2BQJobID, form.BQLoadKind, form.CheckSequence, outbox)
 		if err != nil {
-			log.Printf("failed DSExportJobStore.IncrementJobStatusCheckCount. DS2BQJobID=%v,BQLoadKind=%v,err=%v\n", form.DS2BQJobID, form.BQLoadKind, err)
-			w.WriteHeader(http.StatusInternalServerError)
-			return
+			return failure.New(StoreErrorCode(err), failure.Messagef("failed BQLoadJobStore.IncrementJobStatusCheckCount. DS2BQJobID=%v,BQLoadKind=%v,err=%v\n", form.DS2BQJobID, form.BQLoadKind, err))
 		}
-		w.WriteHeader(http.StatusConflict)
+		if job.IsTimedOut(time.Now()) {
+			return api.TimeoutLoadJob(ctx, form, job)
+		}
+
+		// 追加できなかった場合は、TaskOutboxのDrainで追加し直す
+		if err := NewTaskOutboxDispatcher(api.DatastoreExportAPI.TaskOutboxStore, nil, api.BQLoadJobCheckQueue).Dispatch(ctx, outbox); err != nil {
+			Errorf(ctx, "failed TaskOutboxDispatcher.Dispatch. DS2BQJobID=%v,BQLoadKind=%v,err=%+v\n", form.DS2BQJobID, form.BQLoadKind, err)
+		}
+		Infof(ctx, "%s next check after %v\n", form.BigQueryLoadJobID, delay)
+		return nil
 	case bigquery.Fail:
-		_, err := bqloadJobStore.FinishExportJob(ctx, form.DS2BQJobID, form.BQLoadKind, BQLoadJobStatusFailed, fmt.Sprintf("MSG=%v", res.ErrMessage))
+		if _, err := api.BQLoadJobStore.SetLoadStatistics(ctx, form.DS2BQJobID, form.BQLoadKind, NewBQLoadStatistics(res)); err != nil {
+			return failure.New(StoreErrorCode(err), failure.Messagef("failed BQLoadJobStore.SetLoadStatistics. DS2BQJobID=%v,BQLoadKind=%v,err=%v\n", form.DS2BQJobID, form.BQLoadKind, err))
+		}
+		_, err := api.BQLoadJobStore.FinishExportJob(ctx, form.DS2BQJobID, form.BQLoadKind, BQLoadJobStatusFailed, fmt.Sprintf("MSG=%v", res.ErrMessage))
 		if err != nil {
-			log.Printf("failed BQLOadJobStore.FinishExportJob. DS2BQJobID=%v,BQLoadKind=%v,err=%v\n", form.DS2BQJobID, form.BQLoadKind, err)
-			w.WriteHeader(http.StatusInternalServerError)
-			return
+			return failure.New(StoreErrorCode(err), failure.Messagef("failed BQLOadJobStore.FinishExportJob. DS2BQJobID=%v,BQLoadKind=%v,err=%v\n", form.DS2BQJobID, form.BQLoadKind, err))
 		}
-		w.WriteHeader(http.StatusOK)
+		return api.ReleaseRunLockIfFinished(ctx, form.DS2BQJobID)
 	case bigquery.Done:
-		_, err := bqloadJobStore.FinishExportJob(ctx, form.DS2BQJobID, form.BQLoadKind, BQLoadJobStatusDone, "")
+		if _, err := api.BQLoadJobStore.SetLoadStatistics(ctx, form.DS2BQJobID, form.BQLoadKind, NewBQLoadStatistics(res)); err != nil {
+			return failure.New(StoreErrorCode(err), failure.Messagef("failed BQLoadJobStore.SetLoadStatistics. DS2BQJobID=%v,BQLoadKind=%v,err=%v\n", form.DS2BQJobID, form.BQLoadKind, err))
+		}
+		status, msg, err := api.VerifyRowCount(ctx, form, current)
 		if err != nil {
-			log.Printf("failed BQLOadJobStore.FinishExportJob. DS2BQJobID=%v,BQLoadKind=%v,err=%v\n", form.DS2BQJobID, form.BQLoadKind, err)
-			w.WriteHeader(http.StatusInternalServerError)
-			return
+			return failure.New(StoreErrorCode(err), failure.Messagef("failed VerifyRowCount. DS2BQJobID=%v,BQLoadKind=%v,err=%v\n", form.DS2BQJobID, form.BQLoadKind, err))
+		}
+		if _, err := api.BQLoadJobStore.FinishExportJob(ctx, form.DS2BQJobID, form.BQLoadKind, status, msg); err != nil {
+			return failure.New(StoreErrorCode(err), failure.Messagef("failed BQLOadJobStore.FinishExportJob. DS2BQJobID=%v,BQLoadKind=%v,err=%v\n", form.DS2BQJobID, form.BQLoadKind, err))
+		}
+		if status == BQLoadJobStatusVerificationFailed {
+			Warningf(ctx, "%s is %s\n", form.BigQueryLoadJobID, msg)
+			if err := api.Notifier.Notify(ctx, &Notification{
+				Type:       "BQLoadJobVerificationFailed",
+				DS2BQJobID: form.DS2BQJobID,
+				Kind:       form.BQLoadKind,
+				Message:    fmt.Sprintf("BigQueryLoadJobID=%v %s", form.BigQueryLoadJobID, msg),
+			}); err != nil {
+				Errorf(ctx, "failed Notifier.Notify. DS2BQJobID=%v,BQLoadKind=%v,err=%v\n", form.DS2BQJobID, form.BQLoadKind, err)
+			}
 		}
-		w.WriteHeader(http.StatusOK)
+		return api.ReleaseRunLockIfFinished(ctx, form.DS2BQJobID)
 	default:
-		log.Printf("%v is Unsupported Status\n", res.Status)
-		w.WriteHeader(http.StatusInternalServerError)
+		return failure.New(StatusInternalServerError, failure.Messagef("%v is Unsupported Status", res.Status))
+	}
+}
+
+// VerifyRowCount is BQ LoadしたTableのRow数を、Datastoreの統計 (__Stat_Kind__) のEntity数と比べて、BQLoadJobを終わらせる状態とMessageを返す
+// 差がToleranceを超えている場合は VerificationFailed にする. 比べない設定の場合や、比べられない場合は Done にし、Messageに理由を入れる
+// 統計やTableのRow数の取得に失敗した場合も、BQ Loadは終わっているので状態確認をRetryせずに Done にする
+func (api *BQLoadJobCheckAPI) VerifyRowCount(ctx context.Context, form *BQLoadJobCheckRequest, job *BQLoadJob) (BQLoadJobStatus, string, error) {
+	if !job.VerifyRowCount || job.ExportProjectID == "" {
+		return BQLoadJobStatusDone, "", nil
+	}
+	dsJob, err := api.DatastoreExportAPI.DSExportJobStore.Get(ctx, form.DS2BQJobID)
+	if err != nil {
+		// 呼び出し元が StoreErrorCode で判定するので、Storeのエラーをそのまま返す
+		return 0, "", err
+	}
+	exportStartedAt := dsJob.ExportStartedAt
+	if exportStartedAt.IsZero() {
+		exportStartedAt = dsJob.CreatedAt
+	}
+
+	spanCtx, span := StartSpan(ctx, "datastore.GetKindStatistics", trace.StringAttribute(SpanAttributeExportProjectID, job.ExportProjectID))
+	stats, ok, err := datastore.GetKindStatistics(spanCtx, job.ExportProjectID, job.Kind)
+	EndSpan(span, err)
+	if err != nil {
+		Errorf(ctx, "failed datastore.GetKindStatistics. ExportProjectID=%v,Kind=%v,err=%+v\n", job.ExportProjectID, job.Kind, err)
+		return BQLoadJobStatusDone, "row count verification errored. failed to get __Stat_Kind__", nil
+	}
+	if !ok {
+		msg := "row count verification skipped. no __Stat_Kind__"
+		Infof(ctx, "%s is %s\n", form.BigQueryLoadJobID, msg)
+		return BQLoadJobStatusDone, msg, nil
+	}
+	if reason := RowCountVerificationSkipReason(dsJob.ExportNamespaceIDs, stats.Count, stats.Timestamp, exportStartedAt, RowCountStatMaxAge()); reason != "" {
+		msg := "row count verification skipped. " + reason
+		Infof(ctx, "%s is %s\n", form.BigQueryLoadJobID, msg)
+		return BQLoadJobStatusDone, msg, nil
+	}
+	expected := stats.Count
+
+	spanCtx, span = StartSpan(ctx, "bigquery.GetTableRowCount", trace.StringAttribute(SpanAttributeBQLoadProjectID, job.BQLoadProjectID), trace.StringAttribute(SpanAttributeBQLoadDatasetID, job.BQLoadDatasetID))
+	actual, err := bigquery.GetTableRowCount(spanCtx, job.BQLoadProjectID, job.BQLoadDatasetID, job.Kind)
+	EndSpan(span, err)
+	if err != nil {
+		Errorf(ctx, "failed bigquery.GetTableRowCount. ProjectID=%v,Dataset=%v,Table=%v,err=%+v\n", job.BQLoadProjectID, job.BQLoadDatasetID, job.Kind, err)
+		return BQLoadJobStatusDone, "row count verification errored. failed to get table row count", nil
+	}
+
+	if _, err := api.BQLoadJobStore.SetRowCountVerification(ctx, form.DS2BQJobID, form.BQLoadKind, expected, actual, time.Now()); err != nil {
+		return 0, "", failure.Wrap(err, failure.Messagef("failed BQLoadJobStore.SetRowCountVerification. DS2BQJobID=%v,BQLoadKind=%v", form.DS2BQJobID, form.BQLoadKind))
+	}
+
+	v := RowCountVerification{Enabled: true, Tolerance: job.RowCountTolerance}
+	if v.IsMatched(expected, actual) {
+		return BQLoadJobStatusDone, "", nil
+	}
+	return BQLoadJobStatusVerificationFailed, fmt.Sprintf("row count mismatch. expectedRowCount=%v,actualRowCount=%v,tolerance=%v,statTimestamp=%v", expected, actual, job.RowCountTolerance, stats.Timestamp), nil
+}
+
+// TimeoutLoadJob is BQ Load JobをTimedOutにする
+func (api *BQLoadJobCheckAPI) TimeoutLoadJob(ctx context.Context, form *BQLoadJobCheckRequest, job *BQLoadJob) error {
+	msg := fmt.Sprintf("timed out. statusCheckCount=%v,runningSince=%v", job.StatusCheckCount, job.ChangeStatusAt)
+	Warningf(ctx, "%s is %s\n", form.BigQueryLoadJobID, msg)
+
+	if job.CancelOnTimeout {
+		if err := bigquery.Cancel(ctx, form.BQLoadProjectID, form.BigQueryLoadJobID); err != nil {
+			Errorf(ctx, "failed bigquery.Cancel. DS2BQJobID=%v,BQLoadKind=%v,err=%v\n", form.DS2BQJobID, form.BQLoadKind, err)
+		} else {
+			msg += ". cancelled"
+		}
+	}
+
+	if _, err := api.BQLoadJobStore.FinishExportJob(ctx, form.DS2BQJobID, form.BQLoadKind, BQLoadJobStatusTimedOut, msg); err != nil {
+		return failure.New(StoreErrorCode(err), failure.Messagef("failed BQLOadJobStore.FinishExportJob. DS2BQJobID=%v,BQLoadKind=%v,err=%v\n", form.DS2BQJobID, form.BQLoadKind, err))
+	}
+
+	if err := api.Notifier.Notify(ctx, &Notification{
+		Type:       "BQLoadJobTimedOut",
+		DS2BQJobID: form.DS2BQJobID,
+		Kind:       form.BQLoadKind,
+		Message:    fmt.Sprintf("BigQueryLoadJobID=%v %s", form.BigQueryLoadJobID, msg),
+	}); err != nil {
+		Errorf(ctx, "failed Notifier.Notify. DS2BQJobID=%v,BQLoadKind=%v,err=%v\n", form.DS2BQJobID, form.BQLoadKind, err)
+	}
+
+	return api.ReleaseRunLockIfFinished(ctx, form.DS2BQJobID)
+}
+
+// NotifyIfSLOExceeded is BQ Load JobがSLOを超えても終わっていない場合に通知する
+// 通知に失敗しても次の状態確認で通知し直せるように、通知できてからSLOExceededAtを記録する
+// JobはTimedOutにせず、状態確認を続ける
+func (api *BQLoadJobCheckAPI) NotifyIfSLOExceeded(ctx context.Context, form *BQLoadJobCheckRequest, job *BQLoadJob, now time.Time) error {
+	if !job.IsSLOExceeded(now) {
+		return nil
+	}
+	msg := fmt.Sprintf("slo exceeded. sloSeconds=%v,runningSince=%v", job.SLOSeconds, job.ChangeStatusAt)
+	Warningf(ctx, "%s is %s\n", form.BigQueryLoadJobID, msg)
+
+	if err := api.Notifier.Notify(ctx, &Notification{
+		Type:       "BQLoadJobSLOExceeded",
+		DS2BQJobID: form.DS2BQJobID,
+		Kind:       form.BQLoadKind,
+		Message:    fmt.Sprintf("ExportProjectID=%v,BigQueryLoadJobID=%v %s", job.ExportProjectID, form.BigQueryLoadJobID, msg),
+	}); err != nil {
+		return failure.Wrap(err, failure.Messagef("failed Notifier.Notify. DS2BQJobID=%v,BQLoadKind=%v", form.DS2BQJobID, form.BQLoadKind))
+	}
+	if _, _, err := api.BQLoadJobStore.MarkSLOExceeded(ctx, form.DS2BQJobID, form.BQLoadKind, now); err != nil {
+		return failure.Wrap(err, failure.Messagef("failed BQLoadJobStore.MarkSLOExceeded. DS2BQJobID=%v,BQLoadKind=%v", form.DS2BQJobID, form.BQLoadKind))
+	}
+	return nil
+}
+
+// DeadLetterIfExceeded is 状態確認のTaskの試行回数をBQLoadJobに記録し、上限を超えていたらBQLoadJobをDeadLetteredにする
+// Taskの内容はDeadLetterTaskとして同じTransactionで保存し、後でReplayできるようにする. DeadLetteredにした場合は true を返す
+func (api *BQLoadJobCheckAPI) DeadLetterIfExceeded(ctx context.Context, form *BQLoadJobCheckRequest, attempt TaskAttempt, maxAttempts int) (bool, error) {
+	ctx = WithLogFields(ctx, LogFields{DS2BQJobID: form.DS2BQJobID, Kind: form.BQLoadKind, Operation: form.BigQueryLoadJobID})
+	if attempt.RetryCount < 1 {
+		return false, nil
+	}
+	job, err := api.BQLoadJobStore.RecordCheckTaskAttempt(ctx, form.DS2BQJobID, form.BQLoadKind, attempt)
+	if err != nil {
+		return false, failure.New(StoreErrorCode(err), failure.Messagef("failed BQLoadJobStore.RecordCheckTaskAttempt. DS2BQJobID=%v,BQLoadKind=%v,err=%v\n", form.DS2BQJobID, form.BQLoadKind, err))
+	}
+	if job.Status != BQLoadJobStatusRunning || job.BQLoadJobID != form.BigQueryLoadJobID || !attempt.IsExceeded(maxAttempts) {
+		return false, nil
+	}
+
+	dlt, err := api.DeadLetterTaskStore.New(TaskOutboxQueueBQLoadJobCheck, form, form.DS2BQJobID, form.BQLoadKind, attempt)
+	if err != nil {
+		return false, failure.New(StatusInternalServerError, failure.Messagef("failed DeadLetterTaskStore.New. DS2BQJobID=%v,BQLoadKind=%v,err=%v\n", form.DS2BQJobID, form.BQLoadKind, err))
+	}
+	msg := fmt.Sprintf("dead lettered. retryCount=%v,executionCount=%v,deadLetterTaskID=%v", attempt.RetryCount, attempt.ExecutionCount, dlt.ID)
+	_, deadLettered, err := api.BQLoadJobStore.DeadLetter(ctx, form.DS2BQJobID, form.BQLoadKind, form.BigQueryLoadJobID, dlt, msg)
+	if err != nil {
+		return false, failure.New(StoreErrorCode(err), failure.Messagef("failed BQLoadJobStore.DeadLetter. DS2BQJobID=%v,BQLoadKind=%v,err=%v\n", form.DS2BQJobID, form.BQLoadKind, err))
+	}
+	if !deadLettered {
+		return false, nil
+	}
+	Warningf(ctx, "%s is %s\n", form.BigQueryLoadJobID, msg)
+
+	if err := api.Notifier.Notify(ctx, &Notification{
+		Type:       "BQLoadJobDeadLettered",
+		DS2BQJobID: form.DS2BQJobID,
+		Kind:       form.BQLoadKind,
+		Message:    fmt.Sprintf("BigQueryLoadJobID=%v %s", form.BigQueryLoadJobID, msg),
+	}); err != nil {
+		Errorf(ctx, "failed Notifier.Notify. DS2BQJobID=%v,BQLoadKind=%v,err=%v\n", form.DS2BQJobID, form.BQLoadKind, err)
+	}
+
+	if err := api.ReleaseRunLockIfFinished(ctx, form.DS2BQJobID); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// ReleaseRunLockIfFinished is DS2BQJobの全てのBQLoadJobが終わっていたら、Runの履歴を書き込み、DS2BQJobが保持しているRunLockを解放する
+func (api *BQLoadJobCheckAPI) ReleaseRunLockIfFinished(ctx context.Context, ds2bqJobID string) error {
+	ls := NewBQLoadService(api.BQLoadJobStore, nil, nil)
+	finished, err := ls.IsAllLoadJobsFinished(ctx, ds2bqJobID)
+	if err != nil {
+		return failure.New(StatusInternalServerError, failure.Messagef("failed BQLoadService.IsAllLoadJobsFinished. DS2BQJobID=%v,err=%v\n", ds2bqJobID, err))
+	}
+	if !finished {
+		return nil
+	}
+
+	job, err := api.DatastoreExportAPI.DSExportJobStore.Get(ctx, ds2bqJobID)
+	if err != nil {
+		return failure.New(StoreErrorCode(err), failure.Messagef("failed DSExportJobStore.Get. DS2BQJobID=%v,err=%v\n", ds2bqJobID, err))
+	}
+	if err := api.DatastoreExportAPI.FinishRun(ctx, job.RunLockID, ds2bqJobID); err != nil {
+		return failure.New(StatusInternalServerError, failure.Messagef("failed FinishRun. DS2BQJobID=%v,err=%v\n", ds2bqJobID, err))
+	}
+	return nil
+}
+
+// NewBQLoadStatistics is BQ Load Jobの状態の取得結果から BQLoadStatistics を作る
+func NewBQLoadStatistics(res *bigquery.JobStatusResponse) *BQLoadStatistics {
+	stats := &BQLoadStatistics{}
+	if res.Statistics != nil {
+		stats.OutputRows = res.Statistics.OutputRows
+		stats.OutputBytes = res.Statistics.OutputBytes
+		stats.InputFiles = res.Statistics.InputFiles
+		stats.InputFileBytes = res.Statistics.InputFileBytes
+		stats.BadRecords = res.Statistics.BadRecords
+		stats.StartTime = res.Statistics.StartTime
+		stats.EndTime = res.Statistics.EndTime
+		stats.SlotMillis = res.Statistics.SlotMillis
+	}
+	for _, v := range res.Errors {
+		stats.Errors = append(stats.Errors, BQLoadJobError{
+			Reason:   v.Reason,
+			Location: v.Location,
+			Message:  v.Message,
+		})
 	}
+	return stats
 }
@@ -5,16 +5,15 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"log"
 	"os"
+	"time"
 
 	"cloud.google.com/go/cloudtasks/apiv2beta3"
+	"github.com/golang/protobuf/ptypes"
 	"github.com/morikuni/failure"
 	"github.com/sinmetal/gcpmetadata"
 	"go.opencensus.io/trace"
 	taskspb "google.golang.org/genproto/googleapis/cloud/tasks/v2beta3"
-	"google.golang.org/grpc/codes"
-	"google.golang.org/grpc/status"
 )
 
 type BQLoadJobCheckQueue struct {
@@ -42,11 +41,17 @@ func NewBQLoadJobCheckQueue(host string, tasks *cloudtasks.Client) (*BQLoadJobCh
 }
 
 func (q *BQLoadJobCheckQueue) AddTask(ctx context.Context, body *BQLoadJobCheckRequest) error {
+	return q.ScheduleTask(ctx, body, time.Time{})
+}
+
+// ScheduleTask is scheduleTimeに実行されるTaskを追加する
+// scheduleTimeがZero Valueの場合は、すぐに実行される
+func (q *BQLoadJobCheckQueue) ScheduleTask(ctx context.Context, body *BQLoadJobCheckRequest, scheduleTime time.Time) error {
 	// TODO いずれはMockを作ったりしたい
 	if !gcpmetadata.OnGCP() {
 		return nil
 	}
-	ctx, span := trace.StartSpan(ctx, "BQLoadJobCheckQueue.AddTask")
+	ctx, span := trace.StartSpan(ctx, "BQLoadJobCheckQueue.ScheduleTask")
 	defer span.End()
 
 	message, err := json.Marshal(body)
@@ -57,6 +62,7 @@ func (q *BQLoadJobCheckQueue) AddTask(ctx context.Context, body *BQLoadJobCheckR
 	req := &taskspb.CreateTaskRequest{
 		Parent: q.queueName,
 		Task: &taskspb.Task{
+			Name: fmt.Sprintf("%s/tasks/%s", q.queueName, body.TaskID()),
 			PayloadType: &taskspb.Task_HttpRequest{
 				HttpRequest: &taskspb.HttpRequest{
 					HttpMethod: taskspb.HttpMethod_POST,
@@ -64,6 +70,7 @@ func (q *BQLoadJobCheckQueue) AddTask(ctx context.Context, body *BQLoadJobCheckR
 					AuthorizationHeader: &taskspb.HttpRequest_OidcToken{
 						OidcToken: &taskspb.OidcToken{
 							ServiceAccountEmail: ServiceAccountEmail,
+							Audience:            TaskOIDCAudience(),
 						},
 					},
 				},
@@ -71,23 +78,16 @@ func (q *BQLoadJobCheckQueue) AddTask(ctx context.Context, body *BQLoadJobCheckR
 		},
 	}
 	req.Task.GetHttpRequest().Body = []byte(message)
-
-	var retryCount int
-	for {
-		_, err = q.tasks.CreateTask(ctx, req)
+	if !scheduleTime.IsZero() {
+		ts, err := ptypes.TimestampProto(scheduleTime)
 		if err != nil {
-			if status.Code(err) == codes.Unavailable {
-				retryCount++
-				if retryCount > 5 {
-					return failure.Wrap(err, failure.Messagef("failed cloudtasks.CreateTask. body=%+v\n", body))
-				}
-				log.Printf("failed cloudtasks.CreateTask. body=%+v, retryCount=%v\n", body, retryCount)
-				continue
-			}
-			return failure.Wrap(err, failure.Messagef("failed cloudtasks.CreateTask. body=%+v\n", body))
+			return failure.Wrap(err, failure.Messagef("failed ptypes.TimestampProto. scheduleTime=%v\n", scheduleTime))
 		}
-		break
+		req.Task.ScheduleTime = ts
 	}
 
+	if err := EnqueueTask(ctx, q.tasks, req, DefaultTaskEnqueueBackoff); err != nil {
+		return failure.Wrap(err, failure.Messagef("failed EnqueueTask. body=%+v\n", body))
+	}
 	return nil
 }
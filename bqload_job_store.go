@@ -9,6 +9,7 @@ import (
 
 	"github.com/morikuni/failure"
 	"go.mercari.io/datastore"
+	"go.opencensus.io/trace"
 )
 
 type BQLoadJobStore struct {
@@ -28,42 +29,127 @@ const (
 	BQLoadJobStatusRunning
 	BQLoadJobStatusFailed
 	BQLoadJobStatusDone
+	BQLoadJobStatusSuperseded // 新しいRunにRunLockを奪われたので、BQ Loadしなかった
+	BQLoadJobStatusTimedOut
+	BQLoadJobStatusCancelled
+	BQLoadJobStatusDeadLettered       // 状態確認のTaskが試行回数の上限を超えた
+	BQLoadJobStatusVerificationFailed // BQ Load JobはDoneになったが、TableのRow数がDatastoreのEntity数と合わなかった
 )
 
+var bqLoadJobStatusNames = []string{"Default", "Running", "Failed", "Done", "Superseded", "TimedOut", "Cancelled", "DeadLettered", "VerificationFailed"}
+
+func (s BQLoadJobStatus) String() string {
+	if s < 0 || int(s) >= len(bqLoadJobStatusNames) {
+		return fmt.Sprintf("BQLoadJobStatus(%d)", int(s))
+	}
+	return bqLoadJobStatusNames[s]
+}
+
+// IsFinished is BQLoadJobがこれ以上状態を変えない状態かを返す
+func (s BQLoadJobStatus) IsFinished() bool {
+	switch s {
+	case BQLoadJobStatusFailed, BQLoadJobStatusDone, BQLoadJobStatusSuperseded, BQLoadJobStatusTimedOut, BQLoadJobStatusCancelled, BQLoadJobStatusDeadLettered, BQLoadJobStatusVerificationFailed:
+		return true
+	default:
+		return false
+	}
+}
+
 // +qbg
 type BQLoadJob struct {
-	ID                    string `datastore:"-"`
-	JobID                 string
-	Kind                  string
-	BQLoadProjectID       string // BQ Loadする先のGCP ProjectID
-	BQLoadDatasetID       string // BQ Loadする先のDatasetID
-	BQLoadJobID           string // BQ Load InsertのJobID
-	StatusCheckCount      int
-	Status                BQLoadJobStatus
-	ChangeStatusAt        time.Time
-	BQLoadResponseMessage string `datastore:",noindex"`
-	CreatedAt             time.Time
-	UpdatedAt             time.Time
-	SchemaVersion         int
+	ID                      string `datastore:"-"`
+	JobID                   string
+	Kind                    string
+	ExportProjectID         string // Datastore ExportしたGCP ProjectID
+	BQLoadProjectID         string // BQ Loadする先のGCP ProjectID
+	BQLoadDatasetID         string // BQ Loadする先のDatasetID
+	BQLoadJobID             string // BQ Load InsertのJobID
+	StatusCheckCount        int
+	CheckTaskRetryCount     int       // 最後にRetryされた状態確認のTaskの X-CloudTasks-TaskRetryCount
+	CheckTaskExecutionCount int       // 最後にRetryされた状態確認のTaskの X-CloudTasks-TaskExecutionCount
+	MaxStatusCheckCount     int       // StatusCheckCountがこの回数に達するとTimedOutになる. 0の場合は無制限
+	TimeoutSeconds          int       // Runningになってからこの秒数が過ぎるとTimedOutになる. 0の場合は無制限
+	CancelOnTimeout         bool      // TimedOutになった時にBQ Load Jobをキャンセルするか
+	SLOSeconds              int       // Runningになってからこの秒数が過ぎても終わっていない場合は、SLO違反として通知する. 0の場合は無し
+	SLOExceededAt           time.Time // SLO違反を通知した時刻. 再実行した時はZero Valueに戻す
+	Status                  BQLoadJobStatus
+	ChangeStatusAt          time.Time
+	BQLoadResponseMessage   string           `datastore:",noindex"`
+	BQLoadErrors            []BQLoadJobError `datastore:",noindex"` // BQ Load JobがFailedになった時のエラー. 最大 MaxBQLoadJobErrors 件
+	BQLoadOmittedErrors     int              `datastore:",noindex"` // BQLoadErrors に入りきらずに記録しなかったエラーの数
+	OutputRows              int64            // BQ LoadしたRowの数
+	OutputBytes             int64            // BQ LoadしたBytes
+	InputFiles              int64            // BQ Loadで読んだFileの数
+	InputFileBytes          int64            // BQ Loadで読んだFileのBytes
+	BadRecords              int64            // BQ Loadで読めなかったRecordの数
+	LoadStartedAt           time.Time        // BQ Load Jobが開始した時刻
+	LoadEndedAt             time.Time        // BQ Load Jobが終了した時刻
+	SlotMillis              int64            // BQ Load Jobが使ったSlotのミリ秒
+	VerifyRowCount          bool             // BQ Load JobがDoneになった時に、TableのRow数をDatastoreの統計のEntity数と比べるか
+	RowCountTolerance       float64          // Entity数に対して許容するRow数の差の割合
+	ExpectedRowCount        int64            // Datastoreの統計 (__Stat_Kind__) のEntity数
+	ActualRowCount          int64            // BQ LoadしたTableのRow数
+	RowCountVerifiedAt      time.Time        // Row数を比べた時刻
+	CreatedAt               time.Time
+	UpdatedAt               time.Time
+	SchemaVersion           int
 }
 
 var _ datastore.PropertyLoadSaver = &BQLoadJob{}
 var _ datastore.KeyLoader = &BQLoadJob{}
 
+// MaxBQLoadJobErrors is BQLoadJobに記録するBQ Load Jobのエラーの最大数
+// BigQueryは不正なRecordごとにエラーを返すので、全て記録するとEntityの上限 (1MB) を超えることがある
+const MaxBQLoadJobErrors = 20
+
+// BQLoadJobError is BQ Load Jobのエラー
+type BQLoadJobError struct {
+	Reason   string
+	Location string
+	Message  string
+}
+
+// CapBQLoadJobErrors is errsの先頭からmax件と、入りきらなかったエラーの数を返す
+func CapBQLoadJobErrors(errs []BQLoadJobError, max int) ([]BQLoadJobError, int) {
+	if len(errs) <= max {
+		return errs, 0
+	}
+	return errs[:max], len(errs) - max
+}
+
+// BQLoadStatistics is BQ Load Jobが終わった時の統計とエラー
+type BQLoadStatistics struct {
+	OutputRows     int64
+	OutputBytes    int64
+	InputFiles     int64
+	InputFileBytes int64
+	BadRecords     int64
+	StartTime      time.Time
+	EndTime        time.Time
+	SlotMillis     int64
+	Errors         []BQLoadJobError
+}
+
 // BQLoadJobPutForm is Put する時のRequest内容
 type BQLoadJobPutForm struct {
 	JobID           string
 	Kind            string
+	ExportProjectID string // Datastore ExportしたGCP ProjectID
 	BQLoadProjectID string // BQ Loadする先のGCP ProjectID
 	BQLoadDatasetID string // BQ Loadする先のDatasetID
+	Timeout         JobTimeout
+	Verification    RowCountVerification
 }
 
 // BQLoadJobPutMultiForm is Put する時のRequest内容
 type BQLoadJobPutMultiForm struct {
 	JobID           string
 	Kinds           []string
+	ExportProjectID string // Datastore ExportしたGCP ProjectID
 	BQLoadProjectID string // BQ Loadする先のGCP ProjectID
 	BQLoadDatasetID string // BQ Loadする先のDatasetID
+	Timeout         JobTimeout
+	Verification    RowCountVerification
 }
 
 // LoadKey is Entity Load時にKeyを設定する
@@ -89,23 +175,47 @@ func (e *BQLoadJob) Save(ctx context.Context) ([]datastore.Property, error) {
 		e.CreatedAt = time.Now()
 	}
 	e.UpdatedAt = time.Now()
-	e.SchemaVersion = 1
+	e.SchemaVersion = 7
 
 	return datastore.SaveStruct(ctx, e)
 }
 
+// IsTimedOut is StatusCheckCount, Runningになってからの時間がTimeoutを超えているかを返す
+func (e *BQLoadJob) IsTimedOut(now time.Time) bool {
+	t := JobTimeout{
+		MaxStatusCheckCount: e.MaxStatusCheckCount,
+		TimeoutSeconds:      e.TimeoutSeconds,
+	}
+	return t.IsExceeded(e.StatusCheckCount, e.ChangeStatusAt, now)
+}
+
+// IsSLOExceeded is Runningになってからの時間がSLOを超えていて、まだ通知していないかを返す
+func (e *BQLoadJob) IsSLOExceeded(now time.Time) bool {
+	t := JobTimeout{
+		SLOSeconds: e.SLOSeconds,
+	}
+	return e.SLOExceededAt.IsZero() && t.IsSLOExceeded(e.ChangeStatusAt, now)
+}
+
 func (store *BQLoadJobStore) NewKey(ctx context.Context, jobID string, kind string) datastore.Key {
 	return store.ds.NameKey("BQLoadJob", fmt.Sprintf("%s-_-%s", jobID, kind), nil)
 }
 
 func (store *BQLoadJobStore) Put(ctx context.Context, form *BQLoadJobPutForm) (*BQLoadJob, error) {
 	e := BQLoadJob{
-		JobID:           form.JobID,
-		Kind:            form.Kind,
-		Status:          BQLoadJobStatusDefault,
-		BQLoadProjectID: form.BQLoadProjectID,
-		BQLoadDatasetID: form.BQLoadDatasetID,
-		ChangeStatusAt:  time.Now(),
+		JobID:               form.JobID,
+		Kind:                form.Kind,
+		Status:              BQLoadJobStatusDefault,
+		ExportProjectID:     form.ExportProjectID,
+		BQLoadProjectID:     form.BQLoadProjectID,
+		BQLoadDatasetID:     form.BQLoadDatasetID,
+		MaxStatusCheckCount: form.Timeout.MaxStatusCheckCount,
+		TimeoutSeconds:      form.Timeout.TimeoutSeconds,
+		CancelOnTimeout:     form.Timeout.CancelOnTimeout,
+		SLOSeconds:          form.Timeout.SLOSeconds,
+		VerifyRowCount:      form.Verification.Enabled,
+		RowCountTolerance:   form.Verification.Tolerance,
+		ChangeStatusAt:      time.Now(),
 	}
 	key, err := store.ds.Put(ctx, store.NewKey(ctx, e.JobID, e.Kind), &e)
 	if err != nil {
@@ -123,13 +233,20 @@ func (store *BQLoadJobStore) PutMulti(ctx context.Context, form *BQLoadJobPutMul
 	for _, kind := range form.Kinds {
 		k := store.NewKey(ctx, form.JobID, kind)
 		e := BQLoadJob{
-			ID:              k.Name(),
-			JobID:           form.JobID,
-			Kind:            kind,
-			Status:          BQLoadJobStatusDefault,
-			BQLoadProjectID: form.BQLoadProjectID,
-			BQLoadDatasetID: form.BQLoadDatasetID,
-			ChangeStatusAt:  now,
+			ID:                  k.Name(),
+			JobID:               form.JobID,
+			Kind:                kind,
+			Status:              BQLoadJobStatusDefault,
+			ExportProjectID:     form.ExportProjectID,
+			BQLoadProjectID:     form.BQLoadProjectID,
+			BQLoadDatasetID:     form.BQLoadDatasetID,
+			MaxStatusCheckCount: form.Timeout.MaxStatusCheckCount,
+			TimeoutSeconds:      form.Timeout.TimeoutSeconds,
+			CancelOnTimeout:     form.Timeout.CancelOnTimeout,
+			SLOSeconds:          form.Timeout.SLOSeconds,
+			VerifyRowCount:      form.Verification.Enabled,
+			RowCountTolerance:   form.Verification.Tolerance,
+			ChangeStatusAt:      now,
 		}
 		keys = append(keys, k)
 		entities = append(entities, &e)
@@ -155,24 +272,37 @@ func (store *BQLoadJobStore) Get(ctx context.Context, jobID string, kind string)
 	return &e, nil
 }
 
-func (store *BQLoadJobStore) StartLoadJob(ctx context.Context, ds2bqJobID string, kind string, bqLoadJobID string) (*BQLoadJob, error) {
+// StartLoadJob is BQ Load Jobを開始した状態にする
+// outboxを渡した場合は、同じTransactionでTaskOutboxも保存する
+func (store *BQLoadJobStore) StartLoadJob(ctx context.Context, ds2bqJobID string, kind string, bqLoadJobID string, outbox *TaskOutbox) (*BQLoadJob, error) {
 	key := store.NewKey(ctx, ds2bqJobID, kind)
 	var e BQLoadJob
-	_, err := store.ds.RunInTransaction(ctx, func(tx datastore.Transaction) error {
+	_, err := RunInTransaction(ctx, store.ds, "BQLoadJobStore.StartLoadJob", func(tx datastore.Transaction) error {
 		if err := tx.Get(key, &e); err != nil {
 			return err
 		}
 
+		from := e.Status
 		e.BQLoadJobID = bqLoadJobID
 		e.Status = BQLoadJobStatusRunning
+		e.StatusCheckCount = 0 // 再実行した時のために、Timeoutの判定をやり直す
+		e.SLOExceededAt = time.Time{}
 		e.ChangeStatusAt = time.Now()
 
 		_, err := tx.Put(key, &e)
 		if err != nil {
 			return err
 		}
+		if err := putJobStatusEvent(tx, store.ds, key, NewBQLoadJobStatusEvent(&e, from, "")); err != nil {
+			return err
+		}
+		if outbox != nil {
+			if _, err := tx.Put(outbox.Key, outbox); err != nil {
+				return err
+			}
+		}
 		return nil
-	})
+	}, trace.StringAttribute(SpanAttributeDS2BQJobID, ds2bqJobID), trace.StringAttribute(SpanAttributeKind, kind))
 	if err != nil {
 		if err == datastore.ErrNoSuchEntity {
 			return nil, err
@@ -182,36 +312,59 @@ func (store *BQLoadJobStore) StartLoadJob(ctx context.Context, ds2bqJobID string
 	return &e, nil
 }
 
-func (store *BQLoadJobStore) IncrementJobStatusCheckCount(ctx context.Context, ds2bqJobID string, kind string) (*BQLoadJob, error) {
+// IncrementJobStatusCheckCount is checkSequence番目の状態確認を数え、同じTransactionで次の状態確認のTaskOutboxを保存する
+// 同じ状態確認のTaskが再配信された場合は、既に数えているので何もしない
+// Timeoutした場合は次の状態確認は不要なので、TaskOutboxは保存しない
+func (store *BQLoadJobStore) IncrementJobStatusCheckCount(ctx context.Context, ds2bqJobID string, kind string, checkSequence int, outbox *TaskOutbox) (*BQLoadJob, error) {
 	key := store.NewKey(ctx, ds2bqJobID, kind)
 	var e BQLoadJob
-	_, err := store.ds.RunInTransaction(ctx, func(tx datastore.Transaction) error {
+	var incremented bool
+	_, err := RunInTransaction(ctx, store.ds, "BQLoadJobStore.IncrementJobStatusCheckCount", func(tx datastore.Transaction) error {
 		if err := tx.Get(key, &e); err != nil {
 			return err
 		}
-		e.StatusCheckCount++
-		_, err := tx.Put(key, &e)
-		if err != nil {
+		incremented = false
+		if e.StatusCheckCount > checkSequence {
+			return nil
+		}
+		e.StatusCheckCount = checkSequence + 1
+		if _, err := tx.Put(key, &e); err != nil {
 			return err
 		}
+		incremented = true
+		if outbox != nil && !e.IsTimedOut(time.Now()) {
+			if _, err := tx.Put(outbox.Key, outbox); err != nil {
+				return err
+			}
+		}
 		return nil
-	})
+	}, trace.StringAttribute(SpanAttributeDS2BQJobID, ds2bqJobID), trace.StringAttribute(SpanAttributeKind, kind))
 	if err != nil {
 		if err == datastore.ErrNoSuchEntity {
 			return nil, err
 		}
 		return nil, failure.Wrap(err, failure.Messagef("failed datastore.RunInTx() ds2bqJobID=%v, kind=%v", ds2bqJobID, kind))
 	}
+	if incremented {
+		RecordJobStatusCheck(ctx, JobTypeBQLoad, e.ExportProjectID, e.Kind)
+	}
 	return &e, nil
 }
 
 func (store *BQLoadJobStore) FinishExportJob(ctx context.Context, ds2bqJobID string, kind string, status BQLoadJobStatus, message string) (*BQLoadJob, error) {
 	key := store.NewKey(ctx, ds2bqJobID, kind)
 	var e BQLoadJob
-	_, err := store.ds.RunInTransaction(ctx, func(tx datastore.Transaction) error {
+	var from BQLoadJobStatus
+	var runningSince time.Time
+	_, err := RunInTransaction(ctx, store.ds, "BQLoadJobStore.FinishExportJob", func(tx datastore.Transaction) error {
 		if err := tx.Get(key, &e); err != nil {
 			return err
 		}
+		if e.Status.IsFinished() {
+			return ErrJobFinished
+		}
+		from = e.Status
+		runningSince = e.ChangeStatusAt
 		e.Status = status
 		e.ChangeStatusAt = time.Now()
 		e.BQLoadResponseMessage = message
@@ -219,8 +372,189 @@ func (store *BQLoadJobStore) FinishExportJob(ctx context.Context, ds2bqJobID str
 		if err != nil {
 			return err
 		}
+		if err := putJobStatusEvent(tx, store.ds, key, NewBQLoadJobStatusEvent(&e, from, message)); err != nil {
+			return err
+		}
+		return nil
+	}, trace.StringAttribute(SpanAttributeDS2BQJobID, ds2bqJobID), trace.StringAttribute(SpanAttributeKind, kind))
+	if err != nil {
+		if err == datastore.ErrNoSuchEntity || err == ErrJobFinished {
+			return nil, err
+		}
+		return nil, failure.Wrap(err, failure.Messagef("failed datastore.RunInTx() ds2bqJobID=%v, kind=%v", ds2bqJobID, kind))
+	}
+	RecordBQLoadJobFinished(ctx, &e, from, runningSince)
+	return &e, nil
+}
+
+// Cancel is BQLoadJobをCancelledにする
+// 既に終わっている場合は、状態確認のTaskが記録した状態を上書きしないように何もせずに false を返す
+func (store *BQLoadJobStore) Cancel(ctx context.Context, ds2bqJobID string, kind string) (*BQLoadJob, bool, error) {
+	key := store.NewKey(ctx, ds2bqJobID, kind)
+	var e BQLoadJob
+	var from BQLoadJobStatus
+	var cancelled bool
+	var runningSince time.Time
+	_, err := RunInTransaction(ctx, store.ds, "BQLoadJobStore.Cancel", func(tx datastore.Transaction) error {
+		cancelled = false
+		if err := tx.Get(key, &e); err != nil {
+			return err
+		}
+		if e.Status.IsFinished() {
+			return nil
+		}
+		from = e.Status
+		runningSince = e.ChangeStatusAt
+		e.Status = BQLoadJobStatusCancelled
+		e.ChangeStatusAt = time.Now()
+		e.BQLoadResponseMessage = "cancelled"
+		if _, err := tx.Put(key, &e); err != nil {
+			return err
+		}
+		if err := putJobStatusEvent(tx, store.ds, key, NewBQLoadJobStatusEvent(&e, from, "cancelled")); err != nil {
+			return err
+		}
+		cancelled = true
+		return nil
+	}, trace.StringAttribute(SpanAttributeDS2BQJobID, ds2bqJobID), trace.StringAttribute(SpanAttributeKind, kind))
+	if err != nil {
+		if err == datastore.ErrNoSuchEntity {
+			return nil, false, err
+		}
+		return nil, false, failure.Wrap(err, failure.Messagef("failed datastore.RunInTx() ds2bqJobID=%v, kind=%v", ds2bqJobID, kind))
+	}
+	if cancelled {
+		RecordBQLoadJobFinished(ctx, &e, from, runningSince)
+	}
+	return &e, cancelled, nil
+}
+
+// DeadLetter is BQLoadJobをDeadLetteredにし、同じTransactionでDeadLetterTaskを保存する
+// Runningではない場合や、bqLoadJobIDが実行中のBigQuery Load Jobではない場合は何もせずに false を返す
+func (store *BQLoadJobStore) DeadLetter(ctx context.Context, ds2bqJobID string, kind string, bqLoadJobID string, dlt *DeadLetterTask, message string) (*BQLoadJob, bool, error) {
+	key := store.NewKey(ctx, ds2bqJobID, kind)
+	var e BQLoadJob
+	var deadLettered bool
+	var runningSince time.Time
+	_, err := RunInTransaction(ctx, store.ds, "BQLoadJobStore.DeadLetter", func(tx datastore.Transaction) error {
+		deadLettered = false
+		if err := tx.Get(key, &e); err != nil {
+			return err
+		}
+		if e.Status != BQLoadJobStatusRunning || e.BQLoadJobID != bqLoadJobID {
+			return nil
+		}
+		runningSince = e.ChangeStatusAt
+		e.Status = BQLoadJobStatusDeadLettered
+		e.ChangeStatusAt = time.Now()
+		e.BQLoadResponseMessage = message
+		if _, err := tx.Put(key, &e); err != nil {
+			return err
+		}
+		if err := putJobStatusEvent(tx, store.ds, key, NewBQLoadJobStatusEvent(&e, BQLoadJobStatusRunning, message)); err != nil {
+			return err
+		}
+		if _, err := tx.Put(dlt.Key, dlt); err != nil {
+			return err
+		}
+		deadLettered = true
+		return nil
+	}, trace.StringAttribute(SpanAttributeDS2BQJobID, ds2bqJobID), trace.StringAttribute(SpanAttributeKind, kind))
+	if err != nil {
+		if err == datastore.ErrNoSuchEntity {
+			return nil, false, err
+		}
+		return nil, false, failure.Wrap(err, failure.Messagef("failed datastore.RunInTx() ds2bqJobID=%v, kind=%v", ds2bqJobID, kind))
+	}
+	if deadLettered {
+		RecordBQLoadJobFinished(ctx, &e, BQLoadJobStatusRunning, runningSince)
+	}
+	return &e, deadLettered, nil
+}
+
+// MarkSLOExceeded is SLO違反を通知した時刻を記録する
+// 既に記録されている場合は何もせずに false を返す. 記録した後の状態確認では通知しない
+func (store *BQLoadJobStore) MarkSLOExceeded(ctx context.Context, ds2bqJobID string, kind string, now time.Time) (*BQLoadJob, bool, error) {
+	key := store.NewKey(ctx, ds2bqJobID, kind)
+	var e BQLoadJob
+	var marked bool
+	_, err := RunInTransaction(ctx, store.ds, "BQLoadJobStore.MarkSLOExceeded", func(tx datastore.Transaction) error {
+		marked = false
+		if err := tx.Get(key, &e); err != nil {
+			return err
+		}
+		if !e.SLOExceededAt.IsZero() {
+			return nil
+		}
+		e.SLOExceededAt = now
+		if _, err := tx.Put(key, &e); err != nil {
+			return err
+		}
+		marked = true
+		return nil
+	}, trace.StringAttribute(SpanAttributeDS2BQJobID, ds2bqJobID), trace.StringAttribute(SpanAttributeKind, kind))
+	if err != nil {
+		if err == datastore.ErrNoSuchEntity {
+			return nil, false, err
+		}
+		return nil, false, failure.Wrap(err, failure.Messagef("failed datastore.RunInTx() ds2bqJobID=%v, kind=%v", ds2bqJobID, kind))
+	}
+	if marked {
+		RecordJobSLOExceeded(ctx, JobTypeBQLoad, e.ExportProjectID, e.Kind)
+	}
+	return &e, marked, nil
+}
+
+// SetRowCountVerification is Row数を比べた結果を記録する
+func (store *BQLoadJobStore) SetRowCountVerification(ctx context.Context, ds2bqJobID string, kind string, expected int64, actual int64, now time.Time) (*BQLoadJob, error) {
+	key := store.NewKey(ctx, ds2bqJobID, kind)
+	var e BQLoadJob
+	_, err := RunInTransaction(ctx, store.ds, "BQLoadJobStore.SetRowCountVerification", func(tx datastore.Transaction) error {
+		if err := tx.Get(key, &e); err != nil {
+			return err
+		}
+		e.ExpectedRowCount = expected
+		e.ActualRowCount = actual
+		e.RowCountVerifiedAt = now
+		_, err := tx.Put(key, &e)
+		if err != nil {
+			return err
+		}
+		return nil
+	}, trace.StringAttribute(SpanAttributeDS2BQJobID, ds2bqJobID), trace.StringAttribute(SpanAttributeKind, kind))
+	if err != nil {
+		if err == datastore.ErrNoSuchEntity {
+			return nil, err
+		}
+		return nil, failure.Wrap(err, failure.Messagef("failed datastore.RunInTx() ds2bqJobID=%v, kind=%v", ds2bqJobID, kind))
+	}
+	return &e, nil
+}
+
+// SetLoadStatistics is BQ Load Jobの統計とエラーを記録する
+// エラーは MaxBQLoadJobErrors 件までで、残りは数だけを記録する
+func (store *BQLoadJobStore) SetLoadStatistics(ctx context.Context, ds2bqJobID string, kind string, stats *BQLoadStatistics) (*BQLoadJob, error) {
+	key := store.NewKey(ctx, ds2bqJobID, kind)
+	var e BQLoadJob
+	_, err := RunInTransaction(ctx, store.ds, "BQLoadJobStore.SetLoadStatistics", func(tx datastore.Transaction) error {
+		if err := tx.Get(key, &e); err != nil {
+			return err
+		}
+		e.OutputRows = stats.OutputRows
+		e.OutputBytes = stats.OutputBytes
+		e.InputFiles = stats.InputFiles
+		e.InputFileBytes = stats.InputFileBytes
+		e.BadRecords = stats.BadRecords
+		e.LoadStartedAt = stats.StartTime
+		e.LoadEndedAt = stats.EndTime
+		e.SlotMillis = stats.SlotMillis
+		e.BQLoadErrors, e.BQLoadOmittedErrors = CapBQLoadJobErrors(stats.Errors, MaxBQLoadJobErrors)
+		_, err := tx.Put(key, &e)
+		if err != nil {
+			return err
+		}
 		return nil
-	})
+	}, trace.StringAttribute(SpanAttributeDS2BQJobID, ds2bqJobID), trace.StringAttribute(SpanAttributeKind, kind))
 	if err != nil {
 		if err == datastore.ErrNoSuchEntity {
 			return nil, err
@@ -245,3 +579,82 @@ func (store *BQLoadJobStore) List(ctx context.Context, jobID string) ([]*BQLoadJ
 
 	return l, nil
 }
+
+// ListByStatus is statusのBQLoadJobを返す
+func (store *BQLoadJobStore) ListByStatus(ctx context.Context, status BQLoadJobStatus) ([]*BQLoadJob, error) {
+	b := NewBQLoadJobQueryBuilder(store.ds)
+	b.Status.Equal(int(status))
+
+	var l []*BQLoadJob
+	if _, err := store.ds.GetAll(ctx, b.Query(), &l); err != nil {
+		_, ok := err.(datastore.MultiError)
+		if ok {
+			return l, err
+		}
+		return nil, failure.Wrap(err, failure.Messagef("failed datastore.GetAll() status=%v", status))
+	}
+
+	return l, nil
+}
+
+// RecordCheckTaskAttempt is 状態確認のTaskの試行回数を記録する
+func (store *BQLoadJobStore) RecordCheckTaskAttempt(ctx context.Context, ds2bqJobID string, kind string, attempt TaskAttempt) (*BQLoadJob, error) {
+	key := store.NewKey(ctx, ds2bqJobID, kind)
+	var e BQLoadJob
+	_, err := RunInTransaction(ctx, store.ds, "BQLoadJobStore.RecordCheckTaskAttempt", func(tx datastore.Transaction) error {
+		if err := tx.Get(key, &e); err != nil {
+			return err
+		}
+		e.CheckTaskRetryCount = attempt.RetryCount
+		e.CheckTaskExecutionCount = attempt.ExecutionCount
+		_, err := tx.Put(key, &e)
+		if err != nil {
+			return err
+		}
+		return nil
+	}, trace.StringAttribute(SpanAttributeDS2BQJobID, ds2bqJobID), trace.StringAttribute(SpanAttributeKind, kind))
+	if err != nil {
+		if err == datastore.ErrNoSuchEntity {
+			return nil, err
+		}
+		return nil, failure.Wrap(err, failure.Messagef("failed datastore.RunInTx() ds2bqJobID=%v, kind=%v", ds2bqJobID, kind))
+	}
+	return &e, nil
+}
+
+// ReplayCheck is DeadLetteredのBQLoadJobをRunningに戻し、同じTransactionでTaskOutboxを保存する
+// StatusCheckCountはcheckSequenceにして、Replayした状態確認のTaskのIDが以前のTaskと重ならないようにする
+func (store *BQLoadJobStore) ReplayCheck(ctx context.Context, ds2bqJobID string, kind string, checkSequence int, outbox *TaskOutbox) (*BQLoadJob, error) {
+	key := store.NewKey(ctx, ds2bqJobID, kind)
+	var e BQLoadJob
+	_, err := RunInTransaction(ctx, store.ds, "BQLoadJobStore.ReplayCheck", func(tx datastore.Transaction) error {
+		if err := tx.Get(key, &e); err != nil {
+			return err
+		}
+		if e.Status != BQLoadJobStatusDeadLettered {
+			return failure.New(StatusConflict, failure.Messagef("ds2bqJobID=%v,kind=%v is not DeadLettered. status=%v", ds2bqJobID, kind, e.Status))
+		}
+		e.Status = BQLoadJobStatusRunning
+		e.ChangeStatusAt = time.Now()
+		e.StatusCheckCount = checkSequence
+		e.CheckTaskRetryCount = 0
+		e.CheckTaskExecutionCount = 0
+		if _, err := tx.Put(key, &e); err != nil {
+			return err
+		}
+		if err := putJobStatusEvent(tx, store.ds, key, NewBQLoadJobStatusEvent(&e, BQLoadJobStatusDeadLettered, "replay")); err != nil {
+			return err
+		}
+		if _, err := tx.Put(outbox.Key, outbox); err != nil {
+			return err
+		}
+		return nil
+	}, trace.StringAttribute(SpanAttributeDS2BQJobID, ds2bqJobID), trace.StringAttribute(SpanAttributeKind, kind))
+	if err != nil {
+		if err == datastore.ErrNoSuchEntity {
+			return nil, err
+		}
+		return nil, failure.Wrap(err, failure.Messagef("failed datastore.RunInTx() ds2bqJobID=%v, kind=%v", ds2bqJobID, kind))
+	}
+	return &e, nil
+}
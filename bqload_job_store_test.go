@@ -3,7 +3,9 @@ package main
 import (
 	"context"
 	"fmt"
+	"reflect"
 	"testing"
+	"time"
 
 	"github.com/google/uuid"
 	"go.mercari.io/datastore"
@@ -152,7 +154,7 @@ func TestBQLoadJobStore_Get(t *testing.T) {
 			if got.UpdatedAt.IsZero() {
 				t.Error("UpdatedAt is Zero")
 			}
-			if e, g := 1, got.SchemaVersion; e != g {
+			if e, g := 2, got.SchemaVersion; e != g {
 				t.Errorf("SchemaVersion want %v but got %v", e, g)
 			}
 
@@ -200,7 +202,7 @@ func TestBQLoadJobStore_StartLoadJob(t *testing.T) {
 	for _, tt := range cases {
 		tt := tt
 		t.Run(tt.name, func(t *testing.T) {
-			got, err := s.StartLoadJob(ctx, tt.jobID, tt.kind, bqLoadJobID)
+			got, err := s.StartLoadJob(ctx, tt.jobID, tt.kind, bqLoadJobID, nil)
 			if err != tt.want {
 				t.Errorf("want %v but got %v", tt.want, err)
 			}
@@ -232,7 +234,7 @@ func TestBQLoadJobStore_StartLoadJob(t *testing.T) {
 			if got.UpdatedAt.IsZero() {
 				t.Error("UpdatedAt is Zero")
 			}
-			if e, g := 1, got.SchemaVersion; e != g {
+			if e, g := 2, got.SchemaVersion; e != g {
 				t.Errorf("SchemaVersion want %v but got %v", e, g)
 			}
 
@@ -240,6 +242,223 @@ func TestBQLoadJobStore_StartLoadJob(t *testing.T) {
 	}
 }
 
+func TestBQLoadJobStore_SetLoadStatistics(t *testing.T) {
+	ctx := context.Background()
+
+	ds, err := clouddatastore.FromContext(ctx, datastore.WithProjectID(uuid.New().String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := NewBQLoadJobStore(ctx, ds)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const ds2bqJobID = "helloJob"
+	const kind = "SampleKind"
+	form := &BQLoadJobPutForm{
+		JobID:           ds2bqJobID,
+		Kind:            kind,
+		BQLoadProjectID: "hoge",
+		BQLoadDatasetID: "fuga",
+	}
+	_, err = s.Put(ctx, form)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stats := &BQLoadStatistics{
+		OutputRows:     100,
+		OutputBytes:    1024,
+		InputFiles:     2,
+		InputFileBytes: 2048,
+		BadRecords:     1,
+		StartTime:      time.Date(2019, 7, 1, 1, 0, 0, 0, time.UTC),
+		EndTime:        time.Date(2019, 7, 1, 1, 2, 34, 0, time.UTC),
+		SlotMillis:     4321,
+		Errors: []BQLoadJobError{
+			{Reason: "invalid", Location: "gs://hoge/fuga", Message: "Error while reading data"},
+		},
+	}
+	got, err := s.SetLoadStatistics(ctx, ds2bqJobID, kind, stats)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, g := stats.OutputRows, got.OutputRows; e != g {
+		t.Errorf("OutputRows want %v but got %v", e, g)
+	}
+	if e, g := stats.BadRecords, got.BadRecords; e != g {
+		t.Errorf("BadRecords want %v but got %v", e, g)
+	}
+	if e, g := stats.SlotMillis, got.SlotMillis; e != g {
+		t.Errorf("SlotMillis want %v but got %v", e, g)
+	}
+	if e, g := stats.StartTime, got.LoadStartedAt; !e.Equal(g) {
+		t.Errorf("LoadStartedAt want %v but got %v", e, g)
+	}
+	if e, g := stats.EndTime, got.LoadEndedAt; !e.Equal(g) {
+		t.Errorf("LoadEndedAt want %v but got %v", e, g)
+	}
+	if e, g := stats.Errors, got.BQLoadErrors; !reflect.DeepEqual(e, g) {
+		t.Errorf("BQLoadErrors want %+v but got %+v", e, g)
+	}
+	if e, g := 0, got.BQLoadOmittedErrors; e != g {
+		t.Errorf("BQLoadOmittedErrors want %v but got %v", e, g)
+	}
+}
+
+func TestCapBQLoadJobErrors(t *testing.T) {
+	errs := []BQLoadJobError{
+		{Reason: "invalid", Location: "gs://hoge/fuga", Message: "1"},
+		{Reason: "invalid", Location: "gs://hoge/fuga", Message: "2"},
+		{Reason: "invalid", Location: "gs://hoge/fuga", Message: "3"},
+	}
+
+	cases := []struct {
+		name        string
+		errs        []BQLoadJobError
+		max         int
+		want        []BQLoadJobError
+		wantOmitted int
+	}{
+		{"empty", nil, 2, nil, 0},
+		{"under max", errs[:1], 2, errs[:1], 0},
+		{"just max", errs[:2], 2, errs[:2], 0},
+		{"over max", errs, 2, errs[:2], 1},
+	}
+
+	for _, tt := range cases {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			got, omitted := CapBQLoadJobErrors(tt.errs, tt.max)
+			if e, g := tt.want, got; !reflect.DeepEqual(e, g) {
+				t.Errorf("errors want %+v but got %+v", e, g)
+			}
+			if e, g := tt.wantOmitted, omitted; e != g {
+				t.Errorf("omitted want %v but got %v", e, g)
+			}
+		})
+	}
+}
+
+func TestBQLoadJobStore_MarkSLOExceeded(t *testing.T) {
+	ctx := context.Background()
+
+	ds, err := clouddatastore.FromContext(ctx, datastore.WithProjectID(uuid.New().String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := NewBQLoadJobStore(ctx, ds)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const ds2bqJobID = "helloJob"
+	const kind = "SampleKind"
+	_, err = s.Put(ctx, &BQLoadJobPutForm{
+		JobID:           ds2bqJobID,
+		Kind:            kind,
+		BQLoadProjectID: "hoge",
+		BQLoadDatasetID: "fuga",
+		Timeout:         JobTimeout{SLOSeconds: 1800},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	job, err := s.StartLoadJob(ctx, ds2bqJobID, kind, "bqLoadJob1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job.IsSLOExceeded(job.ChangeStatusAt.Add(29 * time.Minute)) {
+		t.Errorf("IsSLOExceeded want false before slo")
+	}
+	now := job.ChangeStatusAt.Add(30 * time.Minute)
+	if !job.IsSLOExceeded(now) {
+		t.Errorf("IsSLOExceeded want true after slo")
+	}
+
+	got, marked, err := s.MarkSLOExceeded(ctx, ds2bqJobID, kind, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !marked {
+		t.Errorf("first MarkSLOExceeded want marked")
+	}
+	if !got.SLOExceededAt.Equal(now) {
+		t.Errorf("SLOExceededAt want %v but got %v", now, got.SLOExceededAt)
+	}
+	if got.IsSLOExceeded(now) {
+		t.Errorf("IsSLOExceeded want false after marked")
+	}
+
+	_, marked, err = s.MarkSLOExceeded(ctx, ds2bqJobID, kind, now.Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if marked {
+		t.Errorf("second MarkSLOExceeded want not marked")
+	}
+
+	// 再実行した時はSLOの判定をやり直す
+	got, err = s.StartLoadJob(ctx, ds2bqJobID, kind, "bqLoadJob2", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !got.SLOExceededAt.IsZero() {
+		t.Errorf("SLOExceededAt want zero after restart but got %v", got.SLOExceededAt)
+	}
+}
+
+func TestBQLoadJobStore_SetRowCountVerification(t *testing.T) {
+	ctx := context.Background()
+
+	ds, err := clouddatastore.FromContext(ctx, datastore.WithProjectID(uuid.New().String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := NewBQLoadJobStore(ctx, ds)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const ds2bqJobID = "helloJob"
+	const kind = "SampleKind"
+	_, err = s.Put(ctx, &BQLoadJobPutForm{
+		JobID:           ds2bqJobID,
+		Kind:            kind,
+		BQLoadProjectID: "hoge",
+		BQLoadDatasetID: "fuga",
+		Verification:    RowCountVerification{Enabled: true, Tolerance: 0.05},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Date(2019, 9, 1, 1, 0, 0, 0, time.UTC)
+	got, err := s.SetRowCountVerification(ctx, ds2bqJobID, kind, 1000, 900, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !got.VerifyRowCount {
+		t.Errorf("VerifyRowCount want true")
+	}
+	if e, g := 0.05, got.RowCountTolerance; e != g {
+		t.Errorf("RowCountTolerance want %v but got %v", e, g)
+	}
+	if e, g := int64(1000), got.ExpectedRowCount; e != g {
+		t.Errorf("ExpectedRowCount want %v but got %v", e, g)
+	}
+	if e, g := int64(900), got.ActualRowCount; e != g {
+		t.Errorf("ActualRowCount want %v but got %v", e, g)
+	}
+	if !got.RowCountVerifiedAt.Equal(now) {
+		t.Errorf("RowCountVerifiedAt want %v but got %v", now, got.RowCountVerifiedAt)
+	}
+}
+
 func TestBQLoadJobStore_List(t *testing.T) {
 	ctx := context.Background()
 
@@ -311,7 +530,7 @@ func TestBQLoadJobStore_List(t *testing.T) {
 			if model.UpdatedAt.IsZero() {
 				t.Error("UpdatedAt is Zero")
 			}
-			if e, g := 1, model.SchemaVersion; e != g {
+			if e, g := 2, model.SchemaVersion; e != g {
 				t.Errorf("SchemaVersion want %v but got %v", e, g)
 			}
 
@@ -3,20 +3,22 @@ package main
 import (
 	"context"
 	"fmt"
-	"log"
 
 	"github.com/gcpug/ds2bq/bigquery"
+	"go.opencensus.io/trace"
 )
 
 type BQLoadService struct {
 	bqLoadJobStore      *BQLoadJobStore
 	bqLoadJobCheckQueue *BQLoadJobCheckQueue
+	taskOutboxStore     *TaskOutboxStore
 }
 
-func NewBQLoadService(bqLoadJobStore *BQLoadJobStore, bqLoadJobCheckQueue *BQLoadJobCheckQueue) *BQLoadService {
+func NewBQLoadService(bqLoadJobStore *BQLoadJobStore, bqLoadJobCheckQueue *BQLoadJobCheckQueue, taskOutboxStore *TaskOutboxStore) *BQLoadService {
 	return &BQLoadService{
 		bqLoadJobStore,
 		bqLoadJobCheckQueue,
+		taskOutboxStore,
 	}
 }
 
@@ -26,31 +28,96 @@ func (s *BQLoadService) InsertBigQueryLoadJob(ctx context.Context, ds2bqJobID st
 		return err
 	}
 	for _, loadJob := range loadJobs {
-		gcsPath := fmt.Sprintf("%s/all_namespaces/kind_%s/all_namespaces_kind_%s.export_metadata", outputURLPrefix, loadJob.Kind, loadJob.Kind)
-
-		bqLoadJobId, err := bigquery.Load(ctx, loadJob.BQLoadProjectID, gcsPath, loadJob.BQLoadDatasetID, loadJob.Kind)
-		if err != nil {
-			log.Printf("failed bigquery.Load() DS2BQJobID=%v,GCSObjectID=%v,err=%v\n", ds2bqJobID, gcsPath, err)
+		if err := s.insertBigQueryLoadJob(ctx, ds2bqJobID, loadJob, outputURLPrefix); err != nil {
 			return err
 		}
-		fmt.Printf("bq insert job. ds2bqJobID=%v,kind=%v,gcs=%v,bqLoadJobID=%v\n", ds2bqJobID, loadJob.Kind, gcsPath, bqLoadJobId)
+	}
 
-		_, err = s.bqLoadJobStore.StartLoadJob(ctx, ds2bqJobID, loadJob.Kind, bqLoadJobId)
-		if err != nil {
-			log.Printf("failed BQLoadJobStore.Update() DS2BQJobID=%v,GCSObjectID=%v,err=%v\n", ds2bqJobID, gcsPath, err)
-			return err
+	return nil
+}
+
+// InsertBigQueryLoadJobForKind is 1つのKindだけBQ Load Jobを登録する
+// 一時的なBigQueryのエラーで失敗したKindを、Exportし直さずに再度Loadするために使う
+func (s *BQLoadService) InsertBigQueryLoadJobForKind(ctx context.Context, ds2bqJobID string, kind string, outputURLPrefix string) error {
+	loadJob, err := s.bqLoadJobStore.Get(ctx, ds2bqJobID, kind)
+	if err != nil {
+		return err
+	}
+	return s.insertBigQueryLoadJob(ctx, ds2bqJobID, loadJob, outputURLPrefix)
+}
+
+func (s *BQLoadService) insertBigQueryLoadJob(ctx context.Context, ds2bqJobID string, loadJob *BQLoadJob, outputURLPrefix string) error {
+	ctx = WithLogFields(ctx, LogFields{DS2BQJobID: ds2bqJobID, Kind: loadJob.Kind})
+	gcsPath := fmt.Sprintf("%s/all_namespaces/kind_%s/all_namespaces_kind_%s.export_metadata", outputURLPrefix, loadJob.Kind, loadJob.Kind)
+
+	spanCtx, span := StartSpan(ctx, "bigquery.Load", trace.StringAttribute(SpanAttributeBQLoadProjectID, loadJob.BQLoadProjectID), trace.StringAttribute(SpanAttributeBQLoadDatasetID, loadJob.BQLoadDatasetID))
+	bqLoadJobId, err := bigquery.Load(spanCtx, loadJob.BQLoadProjectID, gcsPath, loadJob.BQLoadDatasetID, loadJob.Kind)
+	if err == nil {
+		span.AddAttributes(trace.StringAttribute(SpanAttributeOperation, bqLoadJobId))
+	}
+	EndSpan(span, err)
+	if err != nil {
+		Errorf(ctx, "failed bigquery.Load() DS2BQJobID=%v,GCSObjectID=%v,err=%v\n", ds2bqJobID, gcsPath, err)
+		return err
+	}
+	ctx = WithLogFields(ctx, LogFields{Operation: bqLoadJobId})
+	Infof(ctx, "bq insert job. ds2bqJobID=%v,kind=%v,gcs=%v,bqLoadJobID=%v\n", ds2bqJobID, loadJob.Kind, gcsPath, bqLoadJobId)
+
+	outbox, err := s.taskOutboxStore.New(s.bqLoadJobStore.NewKey(ctx, ds2bqJobID, loadJob.Kind), TaskOutboxQueueBQLoadJobCheck, &BQLoadJobCheckRequest{
+		DS2BQJobID:        ds2bqJobID,
+		BQLoadProjectID:   loadJob.BQLoadProjectID,
+		BQLoadKind:        loadJob.Kind,
+		BigQueryLoadJobID: bqLoadJobId,
+		TraceContext:      EncodeTraceContext(ctx),
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = s.bqLoadJobStore.StartLoadJob(ctx, ds2bqJobID, loadJob.Kind, bqLoadJobId, outbox)
+	if err != nil {
+		Errorf(ctx, "failed BQLoadJobStore.Update() DS2BQJobID=%v,GCSObjectID=%v,err=%v\n", ds2bqJobID, gcsPath, err)
+		return err
+	}
+
+	// 追加できなかった場合は、TaskOutboxのDrainで追加し直す
+	if err := NewTaskOutboxDispatcher(s.taskOutboxStore, nil, s.bqLoadJobCheckQueue).Dispatch(ctx, outbox); err != nil {
+		Errorf(ctx, "failed TaskOutboxDispatcher.Dispatch(). DS2BQJobID=%v,Kind=%v,BigQueryLoadJobID=%v,err=%v\n", ds2bqJobID, loadJob.Kind, bqLoadJobId, err)
+	}
+	return nil
+}
+
+// IsAllLoadJobsFinished is ds2bqJobIDの全てのBQLoadJobが終わっているかを返す
+func (s *BQLoadService) IsAllLoadJobsFinished(ctx context.Context, ds2bqJobID string) (bool, error) {
+	loadJobs, err := s.bqLoadJobStore.List(ctx, ds2bqJobID)
+	if err != nil {
+		return false, err
+	}
+	for _, loadJob := range loadJobs {
+		if !loadJob.Status.IsFinished() {
+			return false, nil
 		}
+	}
+	return true, nil
+}
 
-		if err := s.bqLoadJobCheckQueue.AddTask(ctx, &BQLoadJobCheckRequest{
-			DS2BQJobID:        ds2bqJobID,
-			BQLoadProjectID:   loadJob.BQLoadProjectID,
-			BQLoadKind:        loadJob.Kind,
-			BigQueryLoadJobID: bqLoadJobId,
-		}); err != nil {
-			log.Printf("failed BQLoadJobCheckQueue.AddTask(). DS2BQJobID=%v,Kind=%v,BigQueryLoadJobID=%v\n", ds2bqJobID, loadJob.Kind, bqLoadJobId)
+// SupersedeLoadJobs is RunLockを奪われたds2bqJobIDのBQLoadJobを、BQ Loadせずに終わらせる
+func (s *BQLoadService) SupersedeLoadJobs(ctx context.Context, ds2bqJobID string, message string) error {
+	loadJobs, err := s.bqLoadJobStore.List(ctx, ds2bqJobID)
+	if err != nil {
+		return err
+	}
+	for _, loadJob := range loadJobs {
+		if loadJob.Status.IsFinished() {
+			continue
+		}
+		if _, err := s.bqLoadJobStore.FinishExportJob(ctx, ds2bqJobID, loadJob.Kind, BQLoadJobStatusSuperseded, message); err != nil {
+			if err == ErrJobFinished {
+				continue
+			}
+			Errorf(ctx, "failed BQLoadJobStore.FinishExportJob() DS2BQJobID=%v,Kind=%v,err=%v\n", ds2bqJobID, loadJob.Kind, err)
 			return err
 		}
 	}
-
 	return nil
 }
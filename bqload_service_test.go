@@ -42,7 +42,12 @@ func TestBQLoadService_InsertBigQueryLoadJob(t *testing.T) {
 		}
 	}
 
-	ls := NewBQLoadService(s, bqljcQ)
+	tos, err := NewTaskOutboxStore(ctx, ds)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ls := NewBQLoadService(s, bqljcQ, tos)
 	if err := ls.InsertBigQueryLoadJob(ctx, ds2bqJobID, "gs://datastore-backup-gcpugjp-dev/2019-07-25T10:35:08_16520"); err != nil {
 		t.Fatal(err)
 	}
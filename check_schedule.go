@@ -0,0 +1,63 @@
+package main
+
+import (
+	"time"
+
+	"github.com/gcpug/ds2bq/datastore"
+)
+
+const (
+	// MinCheckInterval is Jobの状態確認の最短の間隔
+	MinCheckInterval = 30 * time.Second
+	// MaxCheckInterval is Jobの状態確認の最長の間隔
+	MaxCheckInterval = 10 * time.Minute
+)
+
+// NextDSExportJobCheckDelay is Datastore Export Jobの次の状態確認までの間隔を返す
+// Progressから残り時間を見積もり、その半分だけ待つ. Progressが無い場合は経過時間の半分だけ待つ
+func NextDSExportJobCheckDelay(meta *datastore.ExportOperationResponseMetadata, elapsed time.Duration) time.Duration {
+	ratio := progressRatio(meta)
+	if ratio <= 0 {
+		return clampCheckInterval(elapsed / 2)
+	}
+	if ratio >= 1 {
+		return MinCheckInterval
+	}
+	remaining := time.Duration(float64(elapsed) * (1 - ratio) / ratio)
+	return clampCheckInterval(remaining / 2)
+}
+
+// NextBQLoadJobCheckDelay is BQ Load Jobの次の状態確認までの間隔を返す
+// BQ Load JobにはProgressが無いので、状態確認の回数に応じて倍々に伸ばす
+func NextBQLoadJobCheckDelay(statusCheckCount int) time.Duration {
+	d := MinCheckInterval
+	for i := 1; i < statusCheckCount && d < MaxCheckInterval; i++ {
+		d *= 2
+	}
+	return clampCheckInterval(d)
+}
+
+// progressRatio is Datastore Export Jobの進捗を 0 ~ 1 で返す. 分からない場合は 0 を返す
+// ProgressBytesの方が実際の時間に近いので優先する
+func progressRatio(meta *datastore.ExportOperationResponseMetadata) float64 {
+	if meta == nil {
+		return 0
+	}
+	if p := meta.ProgressBytes; p.WorkEstimated > 0 && p.WorkCompleted > 0 {
+		return float64(p.WorkCompleted) / float64(p.WorkEstimated)
+	}
+	if p := meta.ProgressEntities; p.WorkEstimated > 0 && p.WorkCompleted > 0 {
+		return float64(p.WorkCompleted) / float64(p.WorkEstimated)
+	}
+	return 0
+}
+
+func clampCheckInterval(d time.Duration) time.Duration {
+	if d < MinCheckInterval {
+		return MinCheckInterval
+	}
+	if d > MaxCheckInterval {
+		return MaxCheckInterval
+	}
+	return d
+}
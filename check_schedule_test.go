@@ -0,0 +1,67 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gcpug/ds2bq/datastore"
+)
+
+func TestNextDSExportJobCheckDelay(t *testing.T) {
+	progress := func(completed, estimated int64) *datastore.ExportOperationResponseMetadata {
+		return &datastore.ExportOperationResponseMetadata{
+			ProgressBytes: datastore.ExportOperationResponseMetadataProgressBytes{
+				WorkCompleted: completed,
+				WorkEstimated: estimated,
+			},
+		}
+	}
+
+	cases := []struct {
+		name    string
+		meta    *datastore.ExportOperationResponseMetadata
+		elapsed time.Duration
+		want    time.Duration
+	}{
+		{"no metadata", nil, 4 * time.Minute, 2 * time.Minute},
+		{"no metadata long running", nil, 3 * time.Hour, MaxCheckInterval},
+		{"no progress", progress(0, 100), 4 * time.Minute, 2 * time.Minute},
+		{"quarter done", progress(25, 100), 2 * time.Minute, 3 * time.Minute},
+		{"almost done", progress(99, 100), 10 * time.Minute, MinCheckInterval},
+		{"progress over estimate", progress(120, 100), 10 * time.Minute, MinCheckInterval},
+		{"progress entities", &datastore.ExportOperationResponseMetadata{
+			ProgressEntities: datastore.ExportOperationResponseMetadataProgressEntities{
+				WorkCompleted: 50,
+				WorkEstimated: 100,
+			},
+		}, 4 * time.Minute, 2 * time.Minute},
+	}
+
+	for _, tt := range cases {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			if e, g := tt.want, NextDSExportJobCheckDelay(tt.meta, tt.elapsed); e != g {
+				t.Errorf("want %v but got %v", e, g)
+			}
+		})
+	}
+}
+
+func TestNextBQLoadJobCheckDelay(t *testing.T) {
+	cases := []struct {
+		statusCheckCount int
+		want             time.Duration
+	}{
+		{0, MinCheckInterval},
+		{1, MinCheckInterval},
+		{2, 2 * MinCheckInterval},
+		{3, 4 * MinCheckInterval},
+		{100, MaxCheckInterval},
+	}
+
+	for _, tt := range cases {
+		if e, g := tt.want, NextBQLoadJobCheckDelay(tt.statusCheckCount); e != g {
+			t.Errorf("statusCheckCount=%v want %v but got %v", tt.statusCheckCount, e, g)
+		}
+	}
+}
@@ -3,6 +3,7 @@ package datastore
 import (
 	"context"
 	"encoding/json"
+	"fmt"
 	"strings"
 	"time"
 
@@ -37,7 +38,7 @@ func Export(ctx context.Context, projectID string, outputGCSPrefix string, entit
 			NullFields:      entityFilter.NullFields,
 		},
 		OutputUrlPrefix: outputGCSPrefix,
-	}).Do()
+	}).Context(ctx).Do()
 	if err != nil {
 		return nil, failure.Wrap(err, failure.Message("failed Datastore Export API."))
 	}
@@ -53,6 +54,15 @@ const (
 	Done
 )
 
+var jobStatusNames = []string{"Running", "Fail", "Done"}
+
+func (s JobStatus) String() string {
+	if s < 0 || int(s) >= len(jobStatusNames) {
+		return fmt.Sprintf("JobStatus(%d)", int(s))
+	}
+	return jobStatusNames[s]
+}
+
 // JobStatusResponse is Datastore Export Jobの状態の取得結果を表すstruct
 type JobStatusResponse struct {
 	Status     JobStatus
@@ -61,7 +71,8 @@ type JobStatusResponse struct {
 	Metadata   *ExportOperationResponseMetadata
 }
 
-// ExportOperationResponseMetadata is Datastore Export JobがDoneになった時のMetadataの内容
+// ExportOperationResponseMetadata is Datastore Export JobのMetadataの内容
+// Doneになる前は、Progressに途中経過が入っている
 type ExportOperationResponseMetadata struct {
 	Common           ExportOperationResponseMetadataCommon           `json:"common"`
 	ProgressEntities ExportOperationResponseMetadataProgressEntities `json:"progressEntities"`
@@ -102,12 +113,20 @@ func CheckJobStatus(ctx context.Context, jobID string) (*JobStatusResponse, erro
 		return nil, failure.Wrap(err, failure.Message("failed datastore.New()."))
 	}
 
-	ope, err := service.Projects.Operations.Get(jobID).Do()
+	ope, err := service.Projects.Operations.Get(jobID).Context(ctx).Do()
 	if err != nil {
 		return nil, failure.Wrap(err, failure.Message("failed Operations.Get()."))
 	}
 	if ope.Done == false {
-		return &JobStatusResponse{Running, 0, "", nil}, nil
+		res := &JobStatusResponse{Running, 0, "", nil}
+		// 実行中でもProgressが入っているので、次の状態確認までの間隔の見積もりに使う
+		if len(ope.Metadata) > 0 {
+			var meta ExportOperationResponseMetadata
+			if err := json.Unmarshal(ope.Metadata, &meta); err == nil {
+				res.Metadata = &meta
+			}
+		}
+		return res, nil
 	}
 	if ope.Error != nil {
 		return &JobStatusResponse{Fail, ope.Error.Code, ope.Error.Message, nil}, nil
@@ -120,6 +139,19 @@ func CheckJobStatus(ctx context.Context, jobID string) (*JobStatusResponse, erro
 	return &JobStatusResponse{Done, 0, "", &meta}, nil
 }
 
+// Cancel is Datastore Export Jobをキャンセルする
+func Cancel(ctx context.Context, jobID string) error {
+	service, err := datastore.NewService(ctx)
+	if err != nil {
+		return failure.Wrap(err, failure.Message("failed datastore.New()."))
+	}
+
+	if _, err := service.Projects.Operations.Cancel(jobID).Context(ctx).Do(); err != nil {
+		return failure.Wrap(err, failure.Messagef("failed Operations.Cancel(). jobID=%s", jobID))
+	}
+	return nil
+}
+
 // GetAllKinds is Kind名一覧を返す
 // ただし、 _ で始まるものは無視する
 func GetAllKinds(ctx context.Context, projectID string) (kinds []string, rerr error) {
@@ -151,3 +183,51 @@ func GetAllKinds(ctx context.Context, projectID string) (kinds []string, rerr er
 	}
 	return kinds, nil
 }
+
+// KindStatistics is __Stat_Kind__ のkindの統計
+type KindStatistics struct {
+	Count     int64     // 全てのNamespaceの合計のEntity数
+	Timestamp time.Time // 統計を更新した時刻
+}
+
+// GetKindStatistics is __Stat_Kind__ から、全てのNamespaceの合計のkindの統計を返す
+// 統計はDatastoreが1日に1回ほど更新するので、最新のEntity数とは限らない. kindの統計がまだ無い場合は ok が false
+func GetKindStatistics(ctx context.Context, projectID string, kind string) (stats *KindStatistics, ok bool, rerr error) {
+	client, err := cds.NewClient(ctx, projectID)
+	if err != nil {
+		return nil, false, failure.Wrap(err, failure.Messagef("failed Datastore.NewClient. projectID=%s", projectID))
+	}
+	defer func() {
+		if err := client.Close(); err != nil {
+			rerr = failure.Wrap(err, failure.Messagef("failed Datastore.Client.Close. projectID=%s", projectID))
+		}
+	}()
+
+	// __Stat_Kind__ には count, timestamp 以外のPropertyも入っているので、PropertyListで受け取る
+	var l []cds.PropertyList
+	q := cds.NewQuery("__Stat_Kind__").Filter("kind_name =", kind)
+	if _, err := client.GetAll(ctx, q, &l); err != nil {
+		return nil, false, failure.Wrap(err, failure.Messagef("failed query __Stat_Kind__. projectID=%s,kind=%s", projectID, kind))
+	}
+	for _, ps := range l {
+		stats := &KindStatistics{}
+		var found bool
+		for _, p := range ps {
+			switch p.Name {
+			case "count":
+				if v, isInt := p.Value.(int64); isInt {
+					stats.Count = v
+					found = true
+				}
+			case "timestamp":
+				if v, isTime := p.Value.(time.Time); isTime {
+					stats.Timestamp = v
+				}
+			}
+		}
+		if found {
+			return stats, true, nil
+		}
+	}
+	return nil, false, nil
+}
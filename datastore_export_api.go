@@ -4,12 +4,12 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
-	"log"
 	"net/http"
+	"time"
 
 	"github.com/gcpug/ds2bq/datastore"
 	"github.com/morikuni/failure"
+	"go.opencensus.io/trace"
 )
 
 const DefaultSeparateKindCount = 30
@@ -25,10 +25,24 @@ type DatastoreExportRequest struct {
 	BQLoadProjectID   string   `json:"bqLoadProjectId"`
 	BQLoadDatasetID   string   `json:"bqLoadDatasetId"`
 	MaxRetryCount     int      `json:"maxRetryCount"`
+	IdempotencyKey    string   `json:"idempotencyKey"`
+	RunLockPolicy     string   `json:"runLockPolicy"` // reject, queue, supersede
+
+	MaxExportStatusCheckCount int  `json:"maxExportStatusCheckCount"`
+	ExportTimeoutSeconds      int  `json:"exportTimeoutSeconds"`
+	MaxBQLoadStatusCheckCount int  `json:"maxBQLoadStatusCheckCount"`
+	BQLoadTimeoutSeconds      int  `json:"bqLoadTimeoutSeconds"`
+	CancelOnTimeout           bool `json:"cancelOnTimeout"`
+	ExportSLOSeconds          int  `json:"exportSLOSeconds"` // Datastore Exportが終わるまでの期待値. 超えたら通知する
+	BQLoadSLOSeconds          int  `json:"bqLoadSLOSeconds"` // BQ Loadが終わるまでの期待値. 超えたら通知する
+
+	VerifyRowCount    bool    `json:"verifyRowCount"`    // BQ LoadしたTableのRow数を、Datastoreの統計のEntity数と比べるか
+	RowCountTolerance float64 `json:"rowCountTolerance"` // Entity数に対して許容するRow数の差の割合. 0.01 なら 1%
 }
 
 type DatastoreExportResponse struct {
-	IDs []*DS2BQJobIDWithDatastoreExportJobID `json:"ids"`
+	IDs    []*DS2BQJobIDWithDatastoreExportJobID `json:"ids"`
+	Queued bool                                  `json:"queued,omitempty"` // RunLockPolicyQueueで待機している場合はtrue
 }
 
 type DS2BQJobIDWithDatastoreExportJobID struct {
@@ -40,76 +54,197 @@ type DatastoreExportAPI struct {
 	DatastoreExportJobCheckQueue *DatastoreExportJobCheckQueue
 	DSExportJobStore             *DSExportJobStore
 	BQLoadJobStore               *BQLoadJobStore
+	RunLockStore                 *RunLockStore
+	TaskOutboxStore              *TaskOutboxStore
 }
 
-func NewDatastoreExportAPI(queue *DatastoreExportJobCheckQueue, dseJS *DSExportJobStore, bqlJS *BQLoadJobStore) *DatastoreExportAPI {
+func NewDatastoreExportAPI(queue *DatastoreExportJobCheckQueue, dseJS *DSExportJobStore, bqlJS *BQLoadJobStore, rlS *RunLockStore, toS *TaskOutboxStore) *DatastoreExportAPI {
 	return &DatastoreExportAPI{
-		queue, dseJS, bqlJS,
+		queue, dseJS, bqlJS, rlS, toS,
 	}
 }
 
-func HandleDatastoreExportAPI(w http.ResponseWriter, r *http.Request) {
-	body, err := ioutil.ReadAll(r.Body)
-	if err != nil {
-		WriteError(w, http.StatusBadRequest, "failed ioutil.Read(request.Body)", err)
-		return
-	}
+func HandleDatastoreExportAPI(r *http.Request) (interface{}, error) {
+	r = r.WithContext(WithJobTrigger(r.Context(), NewJobTrigger(r)))
 
 	form := &DatastoreExportRequest{}
-	if err := json.Unmarshal(body, form); err != nil {
-		WriteError(w, http.StatusBadRequest, fmt.Sprintf("failed json.Unmarshal(request.Body) body=%v", string(body)), err)
-		return
+	body, err := DecodeJSON(r, form)
+	if err != nil {
+		return nil, err
+	}
+	if err := form.Validate(); err != nil {
+		return nil, err
+	}
+	if err := AuthorizeExportRequest(r.Context(), form); err != nil {
+		return nil, err
 	}
 
-	log.Printf("%s\n", string(body))
+	policy, err := ParseRunLockPolicy(form.RunLockPolicy)
+	if err != nil {
+		return nil, failure.Translate(err, StatusBadRequest, failure.Messagef("failed ParseRunLockPolicy form=%+v", form))
+	}
 
 	kinds, err := GetDatastoreKinds(r.Context(), form)
 	if err != nil {
-		WriteError(w, http.StatusBadRequest, fmt.Sprintf("failed GetDatastoreKinds form=%+v", form), err)
-		return
+		return nil, failure.Translate(err, StatusBadRequest, failure.Messagef("failed GetDatastoreKinds form=%+v", form))
+	}
+	if err := ValidateKinds(kinds); err != nil {
+		return nil, err
 	}
 	efs, err := BuildEntityFilter(r.Context(), form.NamespaceIDs, kinds, DefaultSeparateKindCount)
 	if err != nil {
-		WriteError(w, http.StatusBadRequest, fmt.Sprintf("failed BuildEntityFilter form=%+v", form), err)
-		return
+		return nil, failure.Translate(err, StatusBadRequest, failure.Messagef("failed BuildEntityFilter form=%+v", form))
 	}
 
 	queue, err := NewDatastoreExportJobCheckQueue(r.Host, TasksClient)
 	if err != nil {
-		WriteError(w, http.StatusBadRequest, "failed NewDatastoreExportJobCheckQueue", err)
-		return
+		return nil, failure.Wrap(err, failure.Message("failed NewDatastoreExportJobCheckQueue"))
 	}
 
 	dsexportJobStore, err := NewDSExportJobStore(r.Context(), DatastoreClient)
 	if err != nil {
-		WriteError(w, http.StatusInternalServerError, fmt.Sprintf("failed NewDSExportJobStore() form=%+v", form), err)
-		return
+		return nil, failure.Wrap(err, failure.Messagef("failed NewDSExportJobStore() form=%+v", form))
 	}
 
 	bqloadJobStore, err := NewBQLoadJobStore(r.Context(), DatastoreClient)
 	if err != nil {
-		WriteError(w, http.StatusInternalServerError, fmt.Sprintf("failed NewBQLoadJobStore() form=%+v", form), err)
-		return
+		return nil, failure.Wrap(err, failure.Messagef("failed NewBQLoadJobStore() form=%+v", form))
 	}
-	api := NewDatastoreExportAPI(queue, dsexportJobStore, bqloadJobStore)
 
+	runLockStore, err := NewRunLockStore(r.Context(), DatastoreClient)
+	if err != nil {
+		return nil, failure.Wrap(err, failure.Messagef("failed NewRunLockStore() form=%+v", form))
+	}
+
+	taskOutboxStore, err := NewTaskOutboxStore(r.Context(), DatastoreClient)
+	if err != nil {
+		return nil, failure.Wrap(err, failure.Messagef("failed NewTaskOutboxStore() form=%+v", form))
+	}
+	api := NewDatastoreExportAPI(queue, dsexportJobStore, bqloadJobStore, runLockStore, taskOutboxStore)
+
+	idempotencyKey := GetIdempotencyKey(r, form)
+	var idempotencyKeyStore *IdempotencyKeyStore
+	if idempotencyKey != "" {
+		idempotencyKeyStore, err = NewIdempotencyKeyStore(r.Context(), DatastoreClient)
+		if err != nil {
+			return nil, failure.Wrap(err, failure.Messagef("failed NewIdempotencyKeyStore() form=%+v", form))
+		}
+		window, err := IdempotencyKeyWindow()
+		if err != nil {
+			return nil, failure.Wrap(err, failure.Message("failed IdempotencyKeyWindow()"))
+		}
+		lease, err := IdempotencyKeyRunningLease()
+		if err != nil {
+			return nil, failure.Wrap(err, failure.Message("failed IdempotencyKeyRunningLease()"))
+		}
+		ik, reserved, err := idempotencyKeyStore.Reserve(r.Context(), form.ProjectID, idempotencyKey, window, lease)
+		if err != nil {
+			return nil, failure.Wrap(err, failure.Messagef("failed IdempotencyKeyStore.Reserve() idempotencyKey=%v", idempotencyKey))
+		}
+		if !reserved {
+			switch ik.Status {
+			case IdempotencyKeyStatusDone:
+				Infof(r.Context(), "idempotencyKey=%v is already done. ds2bqJobIDs=%+v\n", idempotencyKey, ik.DS2BQJobIDs)
+				return BuildDatastoreExportResponse(ik), nil
+			case IdempotencyKeyStatusQueued:
+				Infof(r.Context(), "idempotencyKey=%v is already queued.\n", idempotencyKey)
+				return &APIResponse{StatusCode: http.StatusAccepted, Body: BuildDatastoreExportResponse(ik)}, nil
+			default:
+				return nil, failure.New(StatusConflict, failure.Messagef("idempotencyKey is already in progress. idempotencyKey=%v", idempotencyKey))
+			}
+		}
+	}
+
+	// 待たせたRunを開始した時にCompleteできるように、HeaderのIdempotencyKeyもformに入れておく
+	form.IdempotencyKey = idempotencyKey
+	res, err := api.StartDS2BQJobs(r.Context(), string(body), form, efs, policy)
+	if err != nil {
+		if idempotencyKeyStore != nil {
+			if res == nil || len(res.IDs) < 1 {
+				// 何も開始していないので、同じIdempotencyKeyで再実行できるようにする
+				if err := idempotencyKeyStore.Release(r.Context(), form.ProjectID, idempotencyKey); err != nil {
+					Errorf(r.Context(), "failed IdempotencyKeyStore.Release() idempotencyKey=%v.err=%+v\n", idempotencyKey, err)
+				}
+			} else {
+				// 開始したRunを重複して開始しないように、開始できたものを記録する
+				if err := CompleteIdempotencyKey(r.Context(), idempotencyKeyStore, form.ProjectID, idempotencyKey, res); err != nil {
+					Errorf(r.Context(), "failed CompleteIdempotencyKey() idempotencyKey=%v.err=%+v\n", idempotencyKey, err)
+				}
+			}
+		}
+		return nil, failure.Wrap(err, failure.Messagef("failed StartDS2BQJobs form=%+v", form))
+	}
+
+	if res.Queued {
+		// IdempotencyKeyは、待たせたRunを開始した時にCompleteする
+		if idempotencyKeyStore != nil {
+			if _, err := idempotencyKeyStore.MarkQueued(r.Context(), form.ProjectID, idempotencyKey); err != nil {
+				return nil, failure.Wrap(err, failure.Messagef("failed IdempotencyKeyStore.MarkQueued() idempotencyKey=%v", idempotencyKey))
+			}
+		}
+		return &APIResponse{StatusCode: http.StatusAccepted, Body: res}, nil
+	}
+	if idempotencyKeyStore != nil {
+		if err := CompleteIdempotencyKey(r.Context(), idempotencyKeyStore, form.ProjectID, idempotencyKey, res); err != nil {
+			return nil, failure.Wrap(err)
+		}
+	}
+	return res, nil
+}
+
+// CompleteIdempotencyKey is 開始したRunのIDをIdempotencyKeyに記録する
+func CompleteIdempotencyKey(ctx context.Context, store *IdempotencyKeyStore, exportProjectID string, idempotencyKey string, res *DatastoreExportResponse) error {
+	var ds2bqJobIDs []string
+	var dsExportJobIDs []string
+	for _, v := range res.IDs {
+		ds2bqJobIDs = append(ds2bqJobIDs, v.DS2BQJobID)
+		dsExportJobIDs = append(dsExportJobIDs, v.DatastoreExportJobID)
+	}
+	if _, err := store.Complete(ctx, exportProjectID, idempotencyKey, ds2bqJobIDs, dsExportJobIDs); err != nil {
+		return failure.Wrap(err, failure.Messagef("failed IdempotencyKeyStore.Complete() idempotencyKey=%v", idempotencyKey))
+	}
+	return nil
+}
+
+// StartDS2BQJobs is RunLockを取得して、EntityFilterごとにDS2BQJobを開始する
+// RunLockが他のRunに保持されている場合は、policyに従って拒否(StatusConflict), 待機, 奪取する
+// 途中のDS2BQJobの開始に失敗した場合は、開始できたDS2BQJobのIDとErrorを返す
+func (api *DatastoreExportAPI) StartDS2BQJobs(ctx context.Context, body string, form *DatastoreExportRequest, efs []*datastore.EntityFilter, policy RunLockPolicy) (*DatastoreExportResponse, error) {
+	ctx = WithJobTags(ctx, form.ProjectID, "")
 	res := &DatastoreExportResponse{
-		[]*DS2BQJobIDWithDatastoreExportJobID{},
+		IDs: []*DS2BQJobIDWithDatastoreExportJobID{},
 	}
-	for _, ef := range efs {
-		var dsExportJobID string
-		ds2bqJobID := dsexportJobStore.NewDS2BQJobID(r.Context())
+
+	var ds2bqJobIDs []string
+	for range efs {
+		ds2bqJobIDs = append(ds2bqJobIDs, api.DSExportJobStore.NewDS2BQJobID(ctx))
+	}
+
+	var runLockID string
+	if policy != RunLockPolicyNone {
+		id, queued, err := api.AcquireRunLock(ctx, body, form, ds2bqJobIDs, policy)
+		if err != nil {
+			return nil, err
+		}
+		if queued {
+			res.Queued = true
+			return res, nil
+		}
+		runLockID = id
+	}
+
+	for i, ef := range efs {
+		ds2bqJobID := ds2bqJobIDs[i]
 		bqLoadKinds := BuildBQLoadKinds(ef, form.IgnoreBQLoadKinds)
-		dsExportJobID, err := api.StartDS2BQJob(r.Context(), ds2bqJobID, string(body), form, form.NamespaceIDs, bqLoadKinds, ef)
+		dsExportJobID, err := api.StartDS2BQJob(ctx, ds2bqJobID, body, form, form.NamespaceIDs, bqLoadKinds, ef, runLockID)
 		if err != nil {
-			msg := fmt.Sprintf("failed CreateDatastoreExportJob ds2bqJobID=%v.err=%+v", ds2bqJobID, err)
-			log.Println(msg)
-			w.WriteHeader(http.StatusInternalServerError)
-			_, err := w.Write([]byte(msg))
-			if err != nil {
-				log.Println(err)
+			// まだ開始していないJobが保持しているRunLockは解放しておく
+			for _, v := range ds2bqJobIDs[i:] {
+				if err := api.ReleaseRunLock(ctx, runLockID, v); err != nil {
+					Errorf(ctx, "failed ReleaseRunLock runLockID=%v,ds2bqJobID=%v.err=%+v\n", runLockID, v, err)
+				}
 			}
-			return
+			return res, failure.Wrap(err, failure.Messagef("failed StartDS2BQJob ds2bqJobID=%v", ds2bqJobID))
 		}
 		res.IDs = append(res.IDs, &DS2BQJobIDWithDatastoreExportJobID{
 			DS2BQJobID:           ds2bqJobID,
@@ -117,15 +252,241 @@ func HandleDatastoreExportAPI(w http.ResponseWriter, r *http.Request) {
 		})
 	}
 
-	w.WriteHeader(http.StatusOK)
-	err = json.NewEncoder(w).Encode(res)
+	return res, nil
+}
+
+// AcquireRunLock is ds2bqJobIDsのRunLockを取得して、RunLockのIDを返す
+// policyがRunLockPolicyQueueで待機する場合は、queuedに true を返す
+func (api *DatastoreExportAPI) AcquireRunLock(ctx context.Context, body string, form *DatastoreExportRequest, ds2bqJobIDs []string, policy RunLockPolicy) (runLockID string, queued bool, err error) {
+	lease, err := RunLockLease()
+	if err != nil {
+		return "", false, err
+	}
+	queuedBody, err := EncodeQueuedDS2BQRequest(body, JobTriggerFromContext(ctx), form.IdempotencyKey)
+	if err != nil {
+		return "", false, failure.Wrap(err, failure.Messagef("failed EncodeQueuedDS2BQRequest projectID=%v", form.ProjectID))
+	}
+	bqLoadProjectID, bqLoadDatasetID := GetBQLoadDestination(form)
+	lock, err := api.RunLockStore.Acquire(ctx, &RunLockAcquireForm{
+		ExportProjectID: form.ProjectID,
+		BQLoadProjectID: bqLoadProjectID,
+		BQLoadDatasetID: bqLoadDatasetID,
+		DS2BQJobIDs:     ds2bqJobIDs,
+		Policy:          policy,
+		RequestBody:     queuedBody,
+		Lease:           lease,
+	})
+	if err != nil {
+		return "", false, failure.Wrap(err, failure.Messagef("failed RunLockStore.Acquire() projectID=%v", form.ProjectID))
+	}
+	if lock.Queued {
+		Infof(ctx, "run lock %v is held by ds2bqJobIDs=%+v. request is queued.\n", lock.Lock.ID, lock.Lock.HolderDS2BQJobIDs)
+		return lock.Lock.ID, true, nil
+	}
+	if !lock.Acquired {
+		return "", false, failure.New(StatusConflict, failure.Messagef("run lock %v is held by ds2bqJobIDs=%+v", lock.Lock.ID, lock.Lock.HolderDS2BQJobIDs))
+	}
+	if len(lock.SupersededDS2BQJobIDs) > 0 {
+		Infof(ctx, "run lock %v is superseded. old ds2bqJobIDs=%+v,new ds2bqJobIDs=%+v\n", lock.Lock.ID, lock.SupersededDS2BQJobIDs, ds2bqJobIDs)
+	}
+	return lock.Lock.ID, false, nil
+}
+
+// StartQueuedDS2BQJobs is RunLockPolicyQueueで待っていたRequestのRunを開始する
+// 開始したJobには、RunLockを解放したRequestではなく、待っていたRequestのJobTriggerを記録する
+func (api *DatastoreExportAPI) StartQueuedDS2BQJobs(ctx context.Context, queued string) (*DatastoreExportResponse, error) {
+	q := DecodeQueuedDS2BQRequest(queued)
+	ctx = WithJobTrigger(ctx, q.Trigger)
+	body := q.Body
+
+	var form DatastoreExportRequest
+	if err := json.Unmarshal([]byte(body), &form); err != nil {
+		return nil, failure.Wrap(err, failure.Messagef("failed json.Unmarshal body=%v", body))
+	}
+	kinds, err := GetDatastoreKinds(ctx, &form)
+	if err != nil {
+		return nil, failure.Wrap(err, failure.Messagef("failed GetDatastoreKinds form=%+v", form))
+	}
+	efs, err := BuildEntityFilter(ctx, form.NamespaceIDs, kinds, DefaultSeparateKindCount)
 	if err != nil {
-		log.Println(err)
+		return nil, failure.Wrap(err, failure.Messagef("failed BuildEntityFilter form=%+v", form))
+	}
+	form.IdempotencyKey = q.IdempotencyKey
+	res, startErr := api.StartDS2BQJobs(ctx, body, &form, efs, RunLockPolicyQueue)
+	if startErr != nil && (res == nil || len(res.IDs) < 1) {
+		return nil, startErr
+	}
+	if res.Queued || q.IdempotencyKey == "" {
+		return res, startErr
+	}
+
+	// 途中で失敗した場合も、開始できたRunをIdempotencyKeyに記録する
+	idempotencyKeyStore, err := NewIdempotencyKeyStore(ctx, api.RunLockStore.ds)
+	if err != nil {
+		return nil, failure.Wrap(err, failure.Message("failed NewIdempotencyKeyStore()"))
+	}
+	if err := CompleteIdempotencyKey(ctx, idempotencyKeyStore, form.ProjectID, q.IdempotencyKey, res); err != nil {
+		Errorf(ctx, "failed CompleteIdempotencyKey() idempotencyKey=%v.err=%+v\n", q.IdempotencyKey, err)
 	}
+	return res, startErr
 }
 
-func (api *DatastoreExportAPI) StartDS2BQJob(ctx context.Context, ds2bqJobID string, body string, form *DatastoreExportRequest, namespaceIDs []string, kinds []string, ef *datastore.EntityFilter) (string, error) {
-	_, err := api.DSExportJobStore.Create(ctx, ds2bqJobID, body, form.ProjectID, namespaceIDs, kinds, form.MaxRetryCount)
+// StartExpiredRunLockQueues is leaseが切れたRunLockで待っているRequestのRunを開始する
+// RunLockを保持していたRunが途中で落ちると、Releaseされないので待っているRequestが開始されない. それをReconcileで拾う
+func (api *DatastoreExportAPI) StartExpiredRunLockQueues(ctx context.Context, now time.Time) ([]string, error) {
+	locks, err := api.RunLockStore.ListExpired(ctx, now, RunLockExpiredListLimit)
+	if err != nil {
+		return nil, failure.Wrap(err, failure.Message("failed RunLockStore.ListExpired"))
+	}
+	started := []string{}
+	for _, lock := range locks {
+		body, err := api.RunLockStore.Dequeue(ctx, lock.ID, now)
+		if err != nil {
+			Errorf(ctx, "failed RunLockStore.Dequeue() runLockID=%v.err=%+v\n", lock.ID, err)
+			continue
+		}
+		if body == "" {
+			continue
+		}
+
+		Infof(ctx, "start queued run of expired run lock. runLockID=%v,body=%s\n", lock.ID, body)
+		if res, err := api.StartQueuedDS2BQJobs(ctx, body); err != nil {
+			if res == nil || len(res.IDs) < 1 {
+				if err := api.RunLockStore.Enqueue(ctx, lock.ID, body); err != nil {
+					Errorf(ctx, "failed RunLockStore.Enqueue() runLockID=%v,body=%s.err=%+v\n", lock.ID, body, err)
+				}
+			}
+			Errorf(ctx, "failed StartQueuedDS2BQJobs runLockID=%v.err=%+v\n", lock.ID, err)
+			continue
+		}
+		started = append(started, lock.ID)
+	}
+	return started, nil
+}
+
+// ReleaseRunLock is ds2bqJobIDが保持しているRunLockを解放する
+// RunLockが空いて、待っているRequestがある場合はそのRunを開始する
+func (api *DatastoreExportAPI) ReleaseRunLock(ctx context.Context, runLockID string, ds2bqJobID string) error {
+	if runLockID == "" {
+		return nil
+	}
+	body, err := api.RunLockStore.Release(ctx, runLockID, ds2bqJobID)
+	if err != nil {
+		return failure.Wrap(err)
+	}
+	if body == "" {
+		return nil
+	}
+
+	Infof(ctx, "start queued run. runLockID=%v,body=%s\n", runLockID, body)
+	if res, err := api.StartQueuedDS2BQJobs(ctx, body); err != nil {
+		// 一部のRunを開始できた場合は、重複して開始しないように待ち行列に戻さない
+		if res == nil || len(res.IDs) < 1 {
+			if err := api.RunLockStore.Enqueue(ctx, runLockID, body); err != nil {
+				Errorf(ctx, "failed RunLockStore.Enqueue() runLockID=%v,body=%s.err=%+v\n", runLockID, body, err)
+			}
+		}
+		return failure.Wrap(err, failure.Messagef("failed StartQueuedDS2BQJobs runLockID=%v", runLockID))
+	}
+	return nil
+}
+
+// FinishRun is 終わったRunの履歴を書き込んでから、RunLockを解放する
+// 履歴の書き込みに失敗してもRunLockは解放する
+func (api *DatastoreExportAPI) FinishRun(ctx context.Context, runLockID string, ds2bqJobID string) error {
+	ctx = WithLogFields(ctx, LogFields{DS2BQJobID: ds2bqJobID})
+	if err := api.WriteRunHistory(ctx, ds2bqJobID); err != nil {
+		Errorf(ctx, "failed WriteRunHistory ds2bqJobID=%v.err=%+v\n", ds2bqJobID, err)
+	}
+	return api.ReleaseRunLock(ctx, runLockID, ds2bqJobID)
+}
+
+// WriteRunHistory is ds2bqJobIDのRunのKindごとの履歴をBigQueryの ds2bq_run_history に書き込む
+// 履歴はRunごとに1回だけ書き込むので、ReloadKindでBQ Loadし直した結果は書き込まない
+func (api *DatastoreExportAPI) WriteRunHistory(ctx context.Context, ds2bqJobID string) error {
+	w, err := NewRunHistoryWriter()
+	if err != nil {
+		return failure.Wrap(err)
+	}
+	if !w.Enabled() {
+		return nil
+	}
+	// 複数のBQLoadJobが同時に終わった場合やTaskのRetryで何度も呼ばれるので、最初の1回だけ書き込む
+	job, claimed, err := api.DSExportJobStore.ClaimRunHistory(ctx, ds2bqJobID, time.Now())
+	if err != nil {
+		return failure.Wrap(err, failure.Messagef("failed DSExportJobStore.ClaimRunHistory ds2bqJobID=%v", ds2bqJobID))
+	}
+	if !claimed {
+		Infof(ctx, "run history is already written. ds2bqJobID=%v,writtenAt=%v\n", ds2bqJobID, job.RunHistoryWrittenAt)
+		return nil
+	}
+	loadJobs, err := api.BQLoadJobStore.List(ctx, ds2bqJobID)
+	if err == nil {
+		err = w.Write(ctx, NewRunHistoryRows(job, loadJobs, job.RunHistoryWrittenAt))
+	}
+	if err != nil {
+		if err := api.DSExportJobStore.UnclaimRunHistory(ctx, ds2bqJobID); err != nil {
+			Errorf(ctx, "failed DSExportJobStore.UnclaimRunHistory ds2bqJobID=%v.err=%+v\n", ds2bqJobID, err)
+		}
+		return failure.Wrap(err, failure.Messagef("failed to write run history ds2bqJobID=%v", ds2bqJobID))
+	}
+	return nil
+}
+
+// ReacquireRunLock is 一度解放したRunLockを、DS2BQJobがもう一度取得する
+// 既にRunLockを保持している場合は何もしない. 他のRunが保持している場合はConflictを返す
+// 新しく取得した場合は true を返すので、後の処理に失敗した時は ReleaseRunLock で解放する
+func (api *DatastoreExportAPI) ReacquireRunLock(ctx context.Context, job *DSExportJob) (bool, error) {
+	if job.RunLockID == "" {
+		return false, nil
+	}
+	holder, err := api.RunLockStore.IsHolder(ctx, job.RunLockID, job.ID)
+	if err != nil {
+		return false, failure.Wrap(err)
+	}
+	if holder {
+		return false, nil
+	}
+
+	var form DatastoreExportRequest
+	if err := json.Unmarshal([]byte(job.JobRequestBody), &form); err != nil {
+		return false, failure.Wrap(err, failure.Messagef("failed json.Unmarshal. ds2bqJobID=%v", job.ID))
+	}
+	lease, err := RunLockLease()
+	if err != nil {
+		return false, err
+	}
+	bqLoadProjectID, bqLoadDatasetID := GetBQLoadDestination(&form)
+	lock, err := api.RunLockStore.Acquire(ctx, &RunLockAcquireForm{
+		ExportProjectID: job.ExportProjectID,
+		BQLoadProjectID: bqLoadProjectID,
+		BQLoadDatasetID: bqLoadDatasetID,
+		DS2BQJobIDs:     []string{job.ID},
+		Policy:          RunLockPolicyReject,
+		Lease:           lease,
+	})
+	if err != nil {
+		return false, failure.Wrap(err, failure.Messagef("failed RunLockStore.Acquire() ds2bqJobID=%v", job.ID))
+	}
+	if !lock.Acquired {
+		return false, failure.New(StatusConflict, failure.Messagef("run lock %v is held by ds2bqJobIDs=%+v", lock.Lock.ID, lock.Lock.HolderDS2BQJobIDs))
+	}
+	return true, nil
+}
+
+func (api *DatastoreExportAPI) StartDS2BQJob(ctx context.Context, ds2bqJobID string, body string, form *DatastoreExportRequest, namespaceIDs []string, kinds []string, ef *datastore.EntityFilter, runLockID string) (string, error) {
+	ctx = WithLogFields(ctx, LogFields{DS2BQJobID: ds2bqJobID})
+	_, err := api.DSExportJobStore.Create(ctx, &DSExportJobCreateForm{
+		JobID:           ds2bqJobID,
+		Body:            body,
+		ExportProjectID: form.ProjectID,
+		NamespaceIDs:    namespaceIDs,
+		Kinds:           kinds,
+		MaxRetryCount:   form.MaxRetryCount,
+		RunLockID:       runLockID,
+		Timeout:         BuildDSExportJobTimeout(form),
+		Trigger:         JobTriggerFromContext(ctx),
+	})
 	if err != nil {
 		return "", fmt.Errorf("failed DSExportJobStore.Create() ds2bqJobID=%v.err=%+v", ds2bqJobID, err)
 	}
@@ -139,42 +500,87 @@ func (api *DatastoreExportAPI) StartDS2BQJob(ctx context.Context, ds2bqJobID str
 }
 
 func (api *DatastoreExportAPI) CreateDatastoreExportJob(ctx context.Context, ds2bqJobID string, projectID string, outputGCSFilePath string, ef *datastore.EntityFilter, retryCount int) (string, error) {
-	ope, err := datastore.Export(ctx, projectID, outputGCSFilePath, ef)
+	ctx = WithLogFields(ctx, LogFields{DS2BQJobID: ds2bqJobID})
+	spanCtx, span := StartSpan(ctx, "datastore.Export", trace.StringAttribute(SpanAttributeExportProjectID, projectID))
+	ope, err := datastore.Export(spanCtx, projectID, outputGCSFilePath, ef)
 	if err != nil {
+		EndSpan(span, err)
 		return "", fmt.Errorf("failed datastore.Export() err=%+v", err)
 	}
+	span.AddAttributes(trace.StringAttribute(SpanAttributeOperation, ope.Name))
+	EndSpan(span, nil)
+	ctx = WithLogFields(ctx, LogFields{Operation: ope.Name})
 	switch ope.HTTPStatusCode {
 	case http.StatusOK:
-		log.Printf("%+v", ope)
+		Infof(ctx, "%+v", ope)
+
+		outbox, err := api.TaskOutboxStore.New(api.DSExportJobStore.NewKey(ctx, ds2bqJobID), TaskOutboxQueueDatastoreExportJobCheck, &DatastoreExportJobCheckRequest{
+			DS2BQJobID:           ds2bqJobID,
+			DatastoreExportJobID: ope.Name,
+			TraceContext:         EncodeTraceContext(ctx),
+		})
+		if err != nil {
+			return "", fmt.Errorf("failed TaskOutboxStore.New. ds2bqJobID=%v,jobName=%s.err=%+v", ds2bqJobID, ope.Name, err)
+		}
 
-		if _, err := api.DSExportJobStore.StartExportJob(ctx, ds2bqJobID, ope.Name, retryCount); err != nil {
+		if _, err := api.DSExportJobStore.StartExportJob(ctx, ds2bqJobID, ope.Name, retryCount, JobTriggerFromContext(ctx), outbox); err != nil {
 			return "", fmt.Errorf("failed DSExportJobStore.StartExportJob. ds2bqJobID=%v,jobName=%s.err=%+v", ds2bqJobID, ope.Name, err)
 		}
 
-		if err := api.DatastoreExportJobCheckQueue.AddTask(ctx, &DatastoreExportJobCheckRequest{
-			DS2BQJobID:           ds2bqJobID,
-			DatastoreExportJobID: ope.Name,
-		}); err != nil {
-			return "", fmt.Errorf("failed queue.AddTask. jobName=%s.err=%+v", ope.Name, err)
+		// 追加できなかった場合は、TaskOutboxのDrainで追加し直す
+		if err := NewTaskOutboxDispatcher(api.TaskOutboxStore, api.DatastoreExportJobCheckQueue, nil).Dispatch(ctx, outbox); err != nil {
+			Errorf(ctx, "failed TaskOutboxDispatcher.Dispatch. jobName=%s.err=%+v\n", ope.Name, err)
 		}
 		return ope.Name, nil
 	default:
-		if _, err := api.DSExportJobStore.FinishExportJob(ctx, ds2bqJobID, DSExportJobStatusFailed, "", fmt.Sprintf("failed DatastoreExportJob.INSERT(). Code=%v,Message=%v", ope.Error.Code, ope.Error.Message)); err != nil {
+		// 再実行の場合は、失敗したDatastore Exportで既に Failed になっている
+		if _, err := api.DSExportJobStore.FinishExportJob(ctx, ds2bqJobID, DSExportJobStatusFailed, "", fmt.Sprintf("failed DatastoreExportJob.INSERT(). Code=%v,Message=%v", ope.Error.Code, ope.Error.Message)); err != nil && err != ErrJobFinished {
 			return "", fmt.Errorf("failed DSExportJobStore.FinishExportJob. ds2bqJobID=%v.err=%+v", ds2bqJobID, err)
 		}
 		return "", fmt.Errorf("failed DatastoreExportJob.INSERT(). ds2bqJobID=%v,ope.Error=%+v", ds2bqJobID, ope.Error)
 	}
 }
 
+// GetIdempotencyKey is Idempotency-Key Header, もしくは Request Body の idempotencyKey を返す
+// 両方指定されている場合は Header を優先する
+func GetIdempotencyKey(r *http.Request, form *DatastoreExportRequest) string {
+	if v := r.Header.Get("Idempotency-Key"); v != "" {
+		return v
+	}
+	return form.IdempotencyKey
+}
+
+// BuildDatastoreExportResponse is IdempotencyKeyに記録されている実行結果からResponseを組み立てる
+func BuildDatastoreExportResponse(ik *IdempotencyKey) *DatastoreExportResponse {
+	res := &DatastoreExportResponse{
+		IDs: []*DS2BQJobIDWithDatastoreExportJobID{},
+	}
+	for i, v := range ik.DS2BQJobIDs {
+		var dsExportJobID string
+		if i < len(ik.DatastoreExportJobIDs) {
+			dsExportJobID = ik.DatastoreExportJobIDs[i]
+		}
+		res.IDs = append(res.IDs, &DS2BQJobIDWithDatastoreExportJobID{
+			DS2BQJobID:           v,
+			DatastoreExportJobID: dsExportJobID,
+		})
+	}
+	return res
+}
+
 func GetDatastoreKinds(ctx context.Context, form *DatastoreExportRequest) ([]string, error) {
 	var err error
 	kinds := form.Kinds
 	if form.AllKinds {
-		kinds, err = datastore.GetAllKinds(ctx, form.ProjectID)
+		spanCtx, span := StartSpan(ctx, "datastore.GetAllKinds", trace.StringAttribute(SpanAttributeExportProjectID, form.ProjectID))
+		kinds, err = datastore.GetAllKinds(spanCtx, form.ProjectID)
+		if err == nil {
+			span.AddAttributes(trace.Int64Attribute(SpanAttributeKindCount, int64(len(kinds))))
+		}
+		EndSpan(span, err)
 		if err != nil {
 			return nil, failure.Wrap(err)
 		}
-		kinds = kinds
 	}
 	if len(form.IgnoreKinds) > 0 {
 		var nks []string
@@ -234,18 +640,28 @@ func BuildBQLoadKinds(ef *datastore.EntityFilter, ignoreKinds []string) []string
 }
 
 func BuildBQLoadJobPutMultiForm(jobID string, kinds []string, form *DatastoreExportRequest) *BQLoadJobPutMultiForm {
-	result := BQLoadJobPutMultiForm{
+	bqLoadProjectID, bqLoadDatasetID := GetBQLoadDestination(form)
+	return &BQLoadJobPutMultiForm{
 		JobID:           jobID,
 		Kinds:           kinds,
-		BQLoadProjectID: form.BQLoadProjectID,
-		BQLoadDatasetID: form.BQLoadDatasetID,
+		ExportProjectID: form.ProjectID,
+		BQLoadProjectID: bqLoadProjectID,
+		BQLoadDatasetID: bqLoadDatasetID,
+		Timeout:         BuildBQLoadJobTimeout(form),
+		Verification:    BuildRowCountVerification(form),
 	}
+}
 
-	if result.BQLoadProjectID == "" {
-		result.BQLoadProjectID = ProjectID
+// GetBQLoadDestination is BQ Loadする先のProjectIDとDatasetIDを返す
+// 指定されていない場合は、ds2bqのProjectIDと datastore Datasetを使う
+func GetBQLoadDestination(form *DatastoreExportRequest) (string, string) {
+	bqLoadProjectID := form.BQLoadProjectID
+	if bqLoadProjectID == "" {
+		bqLoadProjectID = ProjectID
 	}
-	if result.BQLoadDatasetID == "" {
-		result.BQLoadDatasetID = "datastore"
+	bqLoadDatasetID := form.BQLoadDatasetID
+	if bqLoadDatasetID == "" {
+		bqLoadDatasetID = "datastore"
 	}
-	return &result
+	return bqLoadProjectID, bqLoadDatasetID
 }
@@ -25,10 +25,11 @@ func TestHandleDatastoreExportAPI(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	hf := http.HandlerFunc(HandleDatastoreExportAPI)
+	hf := HandleAPI(HandleDatastoreExportAPI)
 	server := httptest.NewServer(hf)
 	defer server.Close()
 
+	// 前回のTestのRunLockが残っていても実行できるように supersede にしている
 	cases := []struct {
 		name                string
 		form                DatastoreExportRequest
@@ -40,6 +41,7 @@ func TestHandleDatastoreExportAPI(t *testing.T) {
 				ProjectID:         "gcpug-ds2bq-dev",
 				OutputGCSFilePath: "gs://datastore-export-gcpug-ds2bq-dev",
 				Kinds:             []string{"Hoge"},
+				RunLockPolicy:     string(RunLockPolicySupersede),
 			}, []string{"gcpug-ds2bq-dev"}, []string{"datastore"}},
 		{"explicit value",
 			DatastoreExportRequest{
@@ -48,6 +50,7 @@ func TestHandleDatastoreExportAPI(t *testing.T) {
 				Kinds:             []string{"Hoge"},
 				BQLoadProjectID:   "gcpug-ds2bq-dev",
 				BQLoadDatasetID:   "ds2bqtest",
+				RunLockPolicy:     string(RunLockPolicySupersede),
 			}, []string{"gcpug-ds2bq-dev"}, []string{"ds2bqtest"}},
 	}
 
@@ -246,3 +249,30 @@ func TestBuildBQLoadKinds(t *testing.T) {
 		})
 	}
 }
+
+func TestGetIdempotencyKey(t *testing.T) {
+	cases := []struct {
+		name   string
+		header string
+		form   *DatastoreExportRequest
+		want   string
+	}{
+		{"empty", "", &DatastoreExportRequest{}, ""},
+		{"header", "fromHeader", &DatastoreExportRequest{}, "fromHeader"},
+		{"body", "", &DatastoreExportRequest{IdempotencyKey: "fromBody"}, "fromBody"},
+		{"header priority", "fromHeader", &DatastoreExportRequest{IdempotencyKey: "fromBody"}, "fromHeader"},
+	}
+
+	for _, tt := range cases {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/api/v1/datastore-export/", nil)
+			if tt.header != "" {
+				r.Header.Set("Idempotency-Key", tt.header)
+			}
+			if e, g := tt.want, GetIdempotencyKey(r, tt.form); e != g {
+				t.Errorf("want %v but got %v", e, g)
+			}
+		})
+	}
+}
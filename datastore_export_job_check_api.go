@@ -4,17 +4,33 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
-	"log"
 	"net/http"
+	"strconv"
+	"time"
 
 	"github.com/gcpug/ds2bq/datastore"
 	"github.com/morikuni/failure"
+	"go.opencensus.io/trace"
 )
 
 type DatastoreExportJobCheckRequest struct {
 	DS2BQJobID           string
 	DatastoreExportJobID string
+	CheckSequence        int    // 何回目の状態確認のTaskか. Task IDに使う
+	TraceContext         string `json:",omitempty"` // Taskを追加したRunのSpanContext. EncodeTraceContext の値
+}
+
+// TaskID is 状態確認のTaskのIDを返す
+func (r *DatastoreExportJobCheckRequest) TaskID() string {
+	return BuildTaskID(fmt.Sprintf("%s/%s/%d", r.DS2BQJobID, r.DatastoreExportJobID, r.CheckSequence), "dsexport", r.DS2BQJobID, strconv.Itoa(r.CheckSequence))
+}
+
+// Next is 次の状態確認のTaskのRequestを返す
+// 同じTaskが再配信されても次のTaskのIDが同じになるように、CheckSequenceはこのRequestから決める
+func (r *DatastoreExportJobCheckRequest) Next() *DatastoreExportJobCheckRequest {
+	next := *r
+	next.CheckSequence = r.CheckSequence + 1
+	return &next
 }
 
 type DatastoreExportJobCheckAPI struct {
@@ -22,105 +38,162 @@ type DatastoreExportJobCheckAPI struct {
 	DSExportJobStore             *DSExportJobStore
 	BQLoadJobStore               *BQLoadJobStore
 	BQLoadJobCheckQueue          *BQLoadJobCheckQueue
+	RunLockStore                 *RunLockStore
+	TaskOutboxStore              *TaskOutboxStore
+	DeadLetterTaskStore          *DeadLetterTaskStore
+	Notifier                     *Notifier
 }
 
-func NewDatastoreExportJobCheckAPI(queue *DatastoreExportJobCheckQueue, dseJS *DSExportJobStore, bqlJS *BQLoadJobStore, bqjcQ *BQLoadJobCheckQueue) *DatastoreExportJobCheckAPI {
+func NewDatastoreExportJobCheckAPI(queue *DatastoreExportJobCheckQueue, dseJS *DSExportJobStore, bqlJS *BQLoadJobStore, bqjcQ *BQLoadJobCheckQueue, rlS *RunLockStore, toS *TaskOutboxStore, dltS *DeadLetterTaskStore, notifier *Notifier) *DatastoreExportJobCheckAPI {
 	return &DatastoreExportJobCheckAPI{
-		queue, dseJS, bqlJS, bqjcQ,
+		queue, dseJS, bqlJS, bqjcQ, rlS, toS, dltS, notifier,
 	}
 }
 
-func HandleDatastoreExportJobCheckAPI(w http.ResponseWriter, r *http.Request) {
-	ctx := r.Context()
+func HandleDatastoreExportJobCheckAPI(r *http.Request) (interface{}, error) {
+	ctx := WithJobTrigger(r.Context(), NewJobTriggerWithType(r, JobTriggerTypeRetry))
 
-	b, err := ioutil.ReadAll(r.Body)
+	form := &DatastoreExportJobCheckRequest{}
+	b, err := DecodeJSON(r, form)
 	if err != nil {
-		msg := fmt.Sprintf("failed ioutil.Read(request.Body).err=%+v", err)
-		log.Println(msg)
-		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-		w.WriteHeader(http.StatusBadRequest)
-		_, err := w.Write([]byte(msg))
-		if err != nil {
-			log.Println(err)
-		}
-		return
+		return nil, err
 	}
-
-	form := &DatastoreExportJobCheckRequest{}
-	if err := json.Unmarshal(b, form); err != nil {
-		msg := fmt.Sprintf("failed json.Unmarshal(request.Body).err=%+v", err)
-		log.Println(msg)
-		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-		w.WriteHeader(http.StatusBadRequest)
-		_, err := w.Write([]byte(msg))
-		if err != nil {
-			log.Println(err)
-		}
-		return
+	if form.DS2BQJobID == "" || form.DatastoreExportJobID == "" {
+		return nil, failure.New(StatusBadRequest, failure.Messagef("invalid request body. body=%s", string(b)))
 	}
-
-	log.Printf("%s\n", string(b))
+	ctx = WithLogFields(ctx, LogFields{DS2BQJobID: form.DS2BQJobID, Operation: form.DatastoreExportJobID})
+	ctx, span := StartSpanWithTraceContext(ctx, "HandleDatastoreExportJobCheckAPI", form.TraceContext)
+	defer span.End()
 
 	queue, err := NewDatastoreExportJobCheckQueue(r.Host, TasksClient)
 	if err != nil {
-		WriteError(w, http.StatusBadRequest, "failed NewDatastoreExportJobCheckQueue", err)
-		return
+		return nil, failure.Wrap(err, failure.Message("failed NewDatastoreExportJobCheckQueue"))
 	}
 
 	dsexportJobStore, err := NewDSExportJobStore(ctx, DatastoreClient)
 	if err != nil {
-		WriteError(w, http.StatusInternalServerError, fmt.Sprintf("failed NewDSExportJobStore() form=%+v", form), err)
-		return
+		return nil, failure.Wrap(err, failure.Messagef("failed NewDSExportJobStore() form=%+v", form))
 	}
 
 	bqloadJobStore, err := NewBQLoadJobStore(ctx, DatastoreClient)
 	if err != nil {
-		WriteError(w, http.StatusInternalServerError, fmt.Sprintf("failed NewBQLoadJobStore() form=%+v", form), err)
-		return
+		return nil, failure.Wrap(err, failure.Messagef("failed NewBQLoadJobStore() form=%+v", form))
 	}
 
 	bqljcQ, err := NewBQLoadJobCheckQueue(r.Host, TasksClient)
 	if err != nil {
-		WriteError(w, http.StatusInternalServerError, fmt.Sprintf("failed NewBQLoadJobCheckQueue() form=%+v", form), err)
-		return
+		return nil, failure.Wrap(err, failure.Messagef("failed NewBQLoadJobCheckQueue() form=%+v", form))
+	}
+
+	runLockStore, err := NewRunLockStore(ctx, DatastoreClient)
+	if err != nil {
+		return nil, failure.Wrap(err, failure.Messagef("failed NewRunLockStore() form=%+v", form))
+	}
+
+	taskOutboxStore, err := NewTaskOutboxStore(ctx, DatastoreClient)
+	if err != nil {
+		return nil, failure.Wrap(err, failure.Messagef("failed NewTaskOutboxStore() form=%+v", form))
+	}
+
+	deadLetterTaskStore, err := NewDeadLetterTaskStore(ctx, DatastoreClient)
+	if err != nil {
+		return nil, failure.Wrap(err, failure.Messagef("failed NewDeadLetterTaskStore() form=%+v", form))
+	}
+
+	maxAttempts, err := CheckTaskMaxAttempts()
+	if err != nil {
+		return nil, failure.Wrap(err, failure.Message("failed CheckTaskMaxAttempts()"))
 	}
 
-	api := NewDatastoreExportJobCheckAPI(queue, dsexportJobStore, bqloadJobStore, bqljcQ)
+	api := NewDatastoreExportJobCheckAPI(queue, dsexportJobStore, bqloadJobStore, bqljcQ, runLockStore, taskOutboxStore, deadLetterTaskStore, NewNotifier())
+
+	deadLettered, err := api.DeadLetterIfExceeded(ctx, form, ParseTaskAttempt(r.Header), maxAttempts)
+	if err != nil {
+		return nil, err
+	}
+	if deadLettered {
+		// Cloud Tasksにこれ以上Retryさせない
+		return nil, nil
+	}
 
 	if err := api.Check(ctx, form); err != nil {
-		log.Println(err.Error())
-		w.WriteHeader(http.StatusInternalServerError)
+		return nil, err
 	}
-	w.WriteHeader(http.StatusOK)
+	return nil, nil
 }
 
+// Check is Datastore Export Jobの状態を確認して、DSExportJobの状態を進める
+// まだRunningの場合は、進捗に応じた間隔で次の状態確認のTaskを追加する
 func (api *DatastoreExportJobCheckAPI) Check(ctx context.Context, form *DatastoreExportJobCheckRequest) error {
-	res, err := datastore.CheckJobStatus(ctx, form.DatastoreExportJobID)
+	ctx = WithLogFields(ctx, LogFields{DS2BQJobID: form.DS2BQJobID, Operation: form.DatastoreExportJobID})
+	current, err := api.DSExportJobStore.Get(ctx, form.DS2BQJobID)
+	if err != nil {
+		return failure.New(StoreErrorCode(err), failure.Messagef("failed DSExportJobStore.Get. DS2BQJobID=%v,err=%v\n", form.DS2BQJobID, err))
+	}
+	if current.Status != DSExportJobStatusRunning {
+		Infof(ctx, "%s is not Running. stop checking. status=%v\n", form.DS2BQJobID, current.Status)
+		return nil
+	}
+	ctx = WithJobTags(ctx, current.ExportProjectID, "")
+	if l := len(current.DSExportJobIDs); l > 0 && current.DSExportJobIDs[l-1] != form.DatastoreExportJobID {
+		// Reconcilerが重複してTaskを追加した場合や、Retryする前の古いTaskは無視する
+		Infof(ctx, "%s is not latest DatastoreExportJobID of %s. stop checking.\n", form.DatastoreExportJobID, form.DS2BQJobID)
+		return nil
+	}
+
+	spanCtx, span := StartSpan(ctx, "datastore.CheckJobStatus", trace.StringAttribute(SpanAttributeExportProjectID, current.ExportProjectID))
+	res, err := datastore.CheckJobStatus(spanCtx, form.DatastoreExportJobID)
+	if err == nil {
+		span.AddAttributes(trace.StringAttribute(SpanAttributeStatus, res.Status.String()))
+	}
+	EndSpan(span, err)
 	if err != nil {
 		return failure.New(StatusInternalServerError, failure.Messagef("failed Datastore.CheckJobStatus.err=%+v", err))
 	}
+	if err := api.NotifyIfSLOExceeded(ctx, form, current, time.Now()); err != nil {
+		Errorf(ctx, "failed NotifyIfSLOExceeded. DS2BQJobID=%v,err=%v\n", form.DS2BQJobID, err)
+	}
 	switch res.Status {
 	case datastore.Running:
-		log.Printf("%s is Running...\n", form.DatastoreExportJobID)
+		Infof(ctx, "%s is Running...\n", form.DatastoreExportJobID)
 
-		_, err := api.DSExportJobStore.IncrementJobStatusCheckCount(ctx, form.DS2BQJobID)
+		delay := NextDSExportJobCheckDelay(res.Metadata, time.Since(current.ChangeStatusAt))
+		next := form.Next()
+		outbox, err := api.TaskOutboxStore.NewScheduled(api.DSExportJobStore.NewKey(ctx, form.DS2BQJobID), TaskOutboxQueueDatastoreExportJobCheck, next.TaskID(), next, time.Now().Add(delay))
+		if err != nil {
+			return failure.New(StatusInternalServerError, failure.Messagef("failed TaskOutboxStore.NewScheduled. DS2BQJobID=%v,err=%v\n", form.DS2BQJobID, err))
+		}
+		job, err := api.DSExportJobStore.IncrementJobStatusCheckCount(ctx, form.DS2BQJobID, form.CheckSequence, outbox)
 		if err != nil {
-			return failure.New(StatusInternalServerError, failure.Messagef("failed DSExportJobStore.IncrementJobStatusCheckCount. DS2BQJobID=%v,err=%v\n", form.DS2BQJobID, err))
+			return failure.New(StoreErrorCode(err), failure.Messagef("failed DSExportJobStore.IncrementJobStatusCheckCount. DS2BQJobID=%v,err=%v\n", form.DS2BQJobID, err))
+		}
+		if job.IsTimedOut(time.Now()) {
+			return api.TimeoutExportJob(ctx, form, job)
+		}
+
+		// 追加できなかった場合は、TaskOutboxのDrainで追加し直す
+		if err := NewTaskOutboxDispatcher(api.TaskOutboxStore, api.DatastoreExportJobCheckQueue, nil).Dispatch(ctx, outbox); err != nil {
+			Errorf(ctx, "failed TaskOutboxDispatcher.Dispatch. DS2BQJobID=%v,err=%+v\n", form.DS2BQJobID, err)
 		}
-		return failure.New(StatusConflict)
+		Infof(ctx, "%s next check after %v\n", form.DatastoreExportJobID, delay)
+		return nil
 	case datastore.Fail:
-		log.Printf("%s is Fail. ErrCode=%v,ErrMessage=%v\n", form.DatastoreExportJobID, res.ErrCode, res.ErrMessage)
+		Warningf(ctx, "%s is Fail. ErrCode=%v,ErrMessage=%v\n", form.DatastoreExportJobID, res.ErrCode, res.ErrMessage)
 
 		_, err := api.DSExportJobStore.FinishExportJob(ctx, form.DS2BQJobID, DSExportJobStatusFailed, form.DatastoreExportJobID, fmt.Sprintf("Code=%v,MSG=%v,META=%+v", res.ErrCode, res.ErrMessage, res.Metadata))
 		if err != nil {
-			return failure.New(StatusInternalServerError, failure.Messagef("failed DSExportJobStore.FinishExportJob. DS2BQJobID=%v,err=%v\n", form.DS2BQJobID, err))
+			return failure.New(StoreErrorCode(err), failure.Messagef("failed DSExportJobStore.FinishExportJob. DS2BQJobID=%v,err=%v\n", form.DS2BQJobID, err))
 		}
 		job, err := api.DSExportJobStore.Get(ctx, form.DS2BQJobID)
 		if err != nil {
-			return failure.New(StatusInternalServerError, failure.Messagef("failed DSExportJobStore.Get. DS2BQJobID=%v,err=%v\n", form.DS2BQJobID, err))
+			return failure.New(StoreErrorCode(err), failure.Messagef("failed DSExportJobStore.Get. DS2BQJobID=%v,err=%v\n", form.DS2BQJobID, err))
 		}
+		dseAPI := NewDatastoreExportAPI(api.DatastoreExportJobCheckQueue, api.DSExportJobStore, api.BQLoadJobStore, api.RunLockStore, api.TaskOutboxStore)
 		job.RetryCount++
 		if job.RetryCount > job.MaxRetryCount {
+			if err := dseAPI.FinishRun(ctx, job.RunLockID, form.DS2BQJobID); err != nil {
+				return failure.New(StatusInternalServerError, failure.Messagef("failed FinishRun. DS2BQJobID=%v,err=%v\n", form.DS2BQJobID, err))
+			}
 			return nil
 		}
 
@@ -129,37 +202,182 @@ func (api *DatastoreExportJobCheckAPI) Check(ctx context.Context, form *Datastor
 			return failure.New(StatusInternalServerError, failure.Messagef("failed BuildEntityFilter. DS2BQJobID=%v,err=%v\n", form.DS2BQJobID, err))
 		}
 
-		ds2bqJobID := api.DSExportJobStore.NewDS2BQJobID(ctx)
-
-		dseAPI := NewDatastoreExportAPI(api.DatastoreExportJobCheckQueue, api.DSExportJobStore, api.BQLoadJobStore)
 		var dseForm DatastoreExportRequest
 		if err := json.Unmarshal([]byte(job.JobRequestBody), &dseForm); err != nil {
 			return failure.New(StatusInternalServerError, failure.Messagef("failed json.Unmarshal.ds2bqJobID=%v,err=%v\n", form.DS2BQJobID, err))
 		}
-		_, err = dseAPI.CreateDatastoreExportJob(ctx, ds2bqJobID, job.ExportProjectID, dseForm.OutputGCSFilePath, efs[0], job.RetryCount)
+		// Reconcileから呼ばれた場合以外は、状態確認のTaskによる再実行として記録する
+		if JobTriggerFromContext(ctx) == nil {
+			ctx = WithJobTrigger(ctx, &JobTrigger{Type: JobTriggerTypeRetry})
+		}
+		// 同じDS2BQJobのままDatastore Exportをやり直し、DSExportJobIDs に新しいOperationを追加する
+		_, err = dseAPI.CreateDatastoreExportJob(ctx, form.DS2BQJobID, job.ExportProjectID, dseForm.OutputGCSFilePath, efs[0], job.RetryCount)
 		if err != nil {
+			// Jobは Failed のままで、Taskを再実行してもRunningではないので状態確認は止まる. RunLockを保持したままにならないように、ここでRunを終わらせる
+			if err := dseAPI.FinishRun(ctx, job.RunLockID, form.DS2BQJobID); err != nil {
+				Errorf(ctx, "failed FinishRun. DS2BQJobID=%v,err=%+v\n", form.DS2BQJobID, err)
+			}
 			return failure.New(StatusInternalServerError, failure.Messagef("failed CreateDatastoreExportJob.ds2bqJobID=%v,err=%v\n", form.DS2BQJobID, err))
 		}
 		return nil
 	case datastore.Done:
-		log.Printf("%s is Done...\n", form.DatastoreExportJobID)
+		Infof(ctx, "%s is Done...\n", form.DatastoreExportJobID)
 
-		_, err := api.DSExportJobStore.FinishExportJob(ctx, form.DS2BQJobID, DSExportJobStatusDone, form.DatastoreExportJobID, "")
+		job, err := api.DSExportJobStore.FinishExportJob(ctx, form.DS2BQJobID, DSExportJobStatusDone, form.DatastoreExportJobID, "")
 		if err != nil {
-			return failure.New(StatusInternalServerError, failure.Messagef("failed DSExportJobStore.FinishExportJob. DS2BQJobID=%v,err=%v\n", form.DS2BQJobID, err))
+			return failure.New(StoreErrorCode(err), failure.Messagef("failed DSExportJobStore.FinishExportJob. DS2BQJobID=%v,err=%v\n", form.DS2BQJobID, err))
+		}
+
+		// BQ Loadを再実行できるように、出力先を記録しておく
+		job, err = api.DSExportJobStore.SetExportStatistics(ctx, form.DS2BQJobID, NewDSExportStatistics(res.Metadata))
+		if err != nil {
+			return failure.New(StoreErrorCode(err), failure.Messagef("failed DSExportJobStore.SetExportStatistics. DS2BQJobID=%v,err=%v\n", form.DS2BQJobID, err))
+		}
+
+		ls := NewBQLoadService(api.BQLoadJobStore, api.BQLoadJobCheckQueue, api.TaskOutboxStore)
+		if job.RunLockID != "" {
+			holder, err := api.RunLockStore.IsHolder(ctx, job.RunLockID, form.DS2BQJobID)
+			if err != nil {
+				return failure.New(StatusInternalServerError, failure.Messagef("failed RunLockStore.IsHolder. DS2BQJobID=%v,err=%v\n", form.DS2BQJobID, err))
+			}
+			if !holder {
+				Infof(ctx, "%s is superseded by another run. skip BQ Load. runLockID=%v\n", form.DS2BQJobID, job.RunLockID)
+				if err := ls.SupersedeLoadJobs(ctx, form.DS2BQJobID, fmt.Sprintf("run lock %v is superseded", job.RunLockID)); err != nil {
+					return failure.New(StatusInternalServerError, failure.Messagef("failed BQLoadService.SupersedeLoadJobs. DS2BQJobID=%v,err=%v\n", form.DS2BQJobID, err))
+				}
+				// RunLockは新しいRunが保持しているので、履歴だけ書き込む
+				dseAPI := NewDatastoreExportAPI(api.DatastoreExportJobCheckQueue, api.DSExportJobStore, api.BQLoadJobStore, api.RunLockStore, api.TaskOutboxStore)
+				if err := dseAPI.WriteRunHistory(ctx, form.DS2BQJobID); err != nil {
+					Errorf(ctx, "failed WriteRunHistory. DS2BQJobID=%v,err=%+v\n", form.DS2BQJobID, err)
+				}
+				return nil
+			}
 		}
 
 		if err := api.InsertBQLoadJobs(ctx, form.DS2BQJobID, res.Metadata.OutputURLPrefix); err != nil {
 			return failure.New(StatusInternalServerError, failure.Messagef("failed InsertBQLoadJobs. DS2BQJobID=%v,err=%v\n", form.DS2BQJobID, err))
 		}
+
+		// BQ LoadするKindが無い場合は、ここでRunが終わる
+		finished, err := ls.IsAllLoadJobsFinished(ctx, form.DS2BQJobID)
+		if err != nil {
+			return failure.New(StatusInternalServerError, failure.Messagef("failed BQLoadService.IsAllLoadJobsFinished. DS2BQJobID=%v,err=%v\n", form.DS2BQJobID, err))
+		}
+		if finished {
+			dseAPI := NewDatastoreExportAPI(api.DatastoreExportJobCheckQueue, api.DSExportJobStore, api.BQLoadJobStore, api.RunLockStore, api.TaskOutboxStore)
+			if err := dseAPI.FinishRun(ctx, job.RunLockID, form.DS2BQJobID); err != nil {
+				return failure.New(StatusInternalServerError, failure.Messagef("failed FinishRun. DS2BQJobID=%v,err=%v\n", form.DS2BQJobID, err))
+			}
+		}
 		return nil
 	default:
 		return failure.New(StatusInternalServerError, failure.Messagef("%v is Unspported Status", res.Status))
 	}
 }
 
+// TimeoutExportJob is Datastore Export JobをTimedOutにして、RunLockを解放する
+func (api *DatastoreExportJobCheckAPI) TimeoutExportJob(ctx context.Context, form *DatastoreExportJobCheckRequest, job *DSExportJob) error {
+	msg := fmt.Sprintf("timed out. statusCheckCount=%v,runningSince=%v", job.StatusCheckCount, job.ChangeStatusAt)
+	Warningf(ctx, "%s is %s\n", form.DatastoreExportJobID, msg)
+
+	if job.CancelOnTimeout {
+		if err := datastore.Cancel(ctx, form.DatastoreExportJobID); err != nil {
+			Errorf(ctx, "failed datastore.Cancel. DS2BQJobID=%v,DatastoreExportJobID=%v,err=%v\n", form.DS2BQJobID, form.DatastoreExportJobID, err)
+		} else {
+			msg += ". cancelled"
+		}
+	}
+
+	if _, err := api.DSExportJobStore.FinishExportJob(ctx, form.DS2BQJobID, DSExportJobStatusTimedOut, form.DatastoreExportJobID, msg); err != nil {
+		return failure.New(StoreErrorCode(err), failure.Messagef("failed DSExportJobStore.FinishExportJob. DS2BQJobID=%v,err=%v\n", form.DS2BQJobID, err))
+	}
+
+	if err := api.Notifier.Notify(ctx, &Notification{
+		Type:       "DSExportJobTimedOut",
+		DS2BQJobID: form.DS2BQJobID,
+		Message:    fmt.Sprintf("DatastoreExportJobID=%v %s", form.DatastoreExportJobID, msg),
+	}); err != nil {
+		Errorf(ctx, "failed Notifier.Notify. DS2BQJobID=%v,err=%v\n", form.DS2BQJobID, err)
+	}
+
+	dseAPI := NewDatastoreExportAPI(api.DatastoreExportJobCheckQueue, api.DSExportJobStore, api.BQLoadJobStore, api.RunLockStore, api.TaskOutboxStore)
+	if err := dseAPI.FinishRun(ctx, job.RunLockID, form.DS2BQJobID); err != nil {
+		return failure.New(StatusInternalServerError, failure.Messagef("failed FinishRun. DS2BQJobID=%v,err=%v\n", form.DS2BQJobID, err))
+	}
+	return nil
+}
+
+// NotifyIfSLOExceeded is Datastore Export JobがSLOを超えても終わっていない場合に通知する
+// 通知に失敗しても次の状態確認で通知し直せるように、通知できてからSLOExceededAtを記録する
+// 状態確認のTaskが重複すると2回通知することがあるが、通知を失うよりは良いので許容する
+// JobはTimedOutにせず、状態確認を続ける
+func (api *DatastoreExportJobCheckAPI) NotifyIfSLOExceeded(ctx context.Context, form *DatastoreExportJobCheckRequest, job *DSExportJob, now time.Time) error {
+	if !job.IsSLOExceeded(now) {
+		return nil
+	}
+	msg := fmt.Sprintf("slo exceeded. sloSeconds=%v,createdAt=%v", job.SLOSeconds, job.CreatedAt)
+	Warningf(ctx, "%s is %s\n", form.DatastoreExportJobID, msg)
+
+	if err := api.Notifier.Notify(ctx, &Notification{
+		Type:       "DSExportJobSLOExceeded",
+		DS2BQJobID: form.DS2BQJobID,
+		Message:    fmt.Sprintf("ExportProjectID=%v,DatastoreExportJobID=%v %s", job.ExportProjectID, form.DatastoreExportJobID, msg),
+	}); err != nil {
+		return failure.Wrap(err, failure.Messagef("failed Notifier.Notify. DS2BQJobID=%v", form.DS2BQJobID))
+	}
+	if _, _, err := api.DSExportJobStore.MarkSLOExceeded(ctx, form.DS2BQJobID, now); err != nil {
+		return failure.Wrap(err, failure.Messagef("failed DSExportJobStore.MarkSLOExceeded. DS2BQJobID=%v", form.DS2BQJobID))
+	}
+	return nil
+}
+
+// DeadLetterIfExceeded is 状態確認のTaskの試行回数をDSExportJobに記録し、上限を超えていたらDSExportJobをDeadLetteredにする
+// Taskの内容はDeadLetterTaskとして同じTransactionで保存し、後でReplayできるようにする. DeadLetteredにした場合は true を返す
+// 以前のDatastore Export Jobの状態確認のTaskは、Retryした新しいDatastore Export Jobを止めないようにDeadLetteredにしない
+func (api *DatastoreExportJobCheckAPI) DeadLetterIfExceeded(ctx context.Context, form *DatastoreExportJobCheckRequest, attempt TaskAttempt, maxAttempts int) (bool, error) {
+	ctx = WithLogFields(ctx, LogFields{DS2BQJobID: form.DS2BQJobID, Operation: form.DatastoreExportJobID})
+	if attempt.RetryCount < 1 {
+		return false, nil
+	}
+	job, err := api.DSExportJobStore.RecordCheckTaskAttempt(ctx, form.DS2BQJobID, attempt)
+	if err != nil {
+		return false, failure.New(StoreErrorCode(err), failure.Messagef("failed DSExportJobStore.RecordCheckTaskAttempt. DS2BQJobID=%v,err=%v\n", form.DS2BQJobID, err))
+	}
+	if job.Status != DSExportJobStatusRunning || job.LatestDSExportJobID() != form.DatastoreExportJobID || !attempt.IsExceeded(maxAttempts) {
+		return false, nil
+	}
+
+	dlt, err := api.DeadLetterTaskStore.New(TaskOutboxQueueDatastoreExportJobCheck, form, form.DS2BQJobID, "", attempt)
+	if err != nil {
+		return false, failure.New(StatusInternalServerError, failure.Messagef("failed DeadLetterTaskStore.New. DS2BQJobID=%v,err=%v\n", form.DS2BQJobID, err))
+	}
+	msg := fmt.Sprintf("dead lettered. retryCount=%v,executionCount=%v,deadLetterTaskID=%v", attempt.RetryCount, attempt.ExecutionCount, dlt.ID)
+	job, deadLettered, err := api.DSExportJobStore.DeadLetter(ctx, form.DS2BQJobID, form.DatastoreExportJobID, dlt, msg)
+	if err != nil {
+		return false, failure.New(StoreErrorCode(err), failure.Messagef("failed DSExportJobStore.DeadLetter. DS2BQJobID=%v,err=%v\n", form.DS2BQJobID, err))
+	}
+	if !deadLettered {
+		return false, nil
+	}
+	Warningf(ctx, "%s is %s\n", form.DatastoreExportJobID, msg)
+
+	if err := api.Notifier.Notify(ctx, &Notification{
+		Type:       "DSExportJobDeadLettered",
+		DS2BQJobID: form.DS2BQJobID,
+		Message:    fmt.Sprintf("DatastoreExportJobID=%v %s", form.DatastoreExportJobID, msg),
+	}); err != nil {
+		Errorf(ctx, "failed Notifier.Notify. DS2BQJobID=%v,err=%v\n", form.DS2BQJobID, err)
+	}
+
+	dseAPI := NewDatastoreExportAPI(api.DatastoreExportJobCheckQueue, api.DSExportJobStore, api.BQLoadJobStore, api.RunLockStore, api.TaskOutboxStore)
+	if err := dseAPI.FinishRun(ctx, job.RunLockID, form.DS2BQJobID); err != nil {
+		return false, failure.New(StatusInternalServerError, failure.Messagef("failed FinishRun. DS2BQJobID=%v,err=%v\n", form.DS2BQJobID, err))
+	}
+	return true, nil
+}
+
 func (api *DatastoreExportJobCheckAPI) InsertBQLoadJobs(ctx context.Context, ds2bqJobID string, outputURLPrefix string) error {
-	ls := NewBQLoadService(api.BQLoadJobStore, api.BQLoadJobCheckQueue)
+	ls := NewBQLoadService(api.BQLoadJobStore, api.BQLoadJobCheckQueue, api.TaskOutboxStore)
 
 	if err := ls.InsertBigQueryLoadJob(ctx, ds2bqJobID, outputURLPrefix); err != nil {
 		return failure.Wrap(err, failure.Message("failed BQLoadService.InsertBigQueryLoadJob"))
@@ -167,3 +385,14 @@ func (api *DatastoreExportJobCheckAPI) InsertBQLoadJobs(ctx context.Context, ds2
 
 	return nil
 }
+
+// NewDSExportStatistics is Datastore Export JobのMetadataから DSExportStatistics を作る
+func NewDSExportStatistics(meta *datastore.ExportOperationResponseMetadata) *DSExportStatistics {
+	return &DSExportStatistics{
+		OutputURLPrefix: meta.OutputURLPrefix,
+		Entities:        meta.ProgressEntities.WorkCompleted,
+		Bytes:           meta.ProgressBytes.WorkCompleted,
+		StartTime:       meta.Common.StartTime,
+		EndTime:         meta.Common.EndTime,
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 
 	"github.com/google/uuid"
 	"go.mercari.io/datastore"
@@ -42,7 +43,7 @@ func TestHandleDatastoreExportJobCheckAPI(t *testing.T) {
 		}
 	}
 
-	hf := http.HandlerFunc(HandleDatastoreExportJobCheckAPI)
+	hf := HandleTaskAPI(HandleDatastoreExportJobCheckAPI)
 	server := httptest.NewServer(hf)
 	defer server.Close()
 
@@ -62,3 +63,68 @@ func TestHandleDatastoreExportJobCheckAPI(t *testing.T) {
 		t.Errorf("StatusCode expected %v; got %v", e, g)
 	}
 }
+
+func TestDatastoreExportJobCheckAPI_NotifyIfSLOExceeded(t *testing.T) {
+	ctx := context.Background()
+
+	ds, err := clouddatastore.FromContext(ctx, datastore.WithProjectID(uuid.New().String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewDSExportJobStore(ctx, ds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ds2bqJobID := s.NewDS2BQJobID(ctx)
+	job, err := s.Create(ctx, &DSExportJobCreateForm{JobID: ds2bqJobID, Timeout: JobTimeout{SLOSeconds: 60}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	webhookStatus := http.StatusInternalServerError
+	var notified int
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		notified++
+		w.WriteHeader(webhookStatus)
+	}))
+	defer webhook.Close()
+
+	api := &DatastoreExportJobCheckAPI{
+		DSExportJobStore: s,
+		Notifier:         &Notifier{webhookURL: webhook.URL, hc: webhook.Client()},
+	}
+	form := &DatastoreExportJobCheckRequest{DS2BQJobID: ds2bqJobID, DatastoreExportJobID: "operation"}
+	now := time.Now().Add(time.Hour)
+
+	// 通知に失敗した場合は記録せず、次の状態確認で通知し直す
+	if err := api.NotifyIfSLOExceeded(ctx, form, job, now); err == nil {
+		t.Fatal("want error but got nil")
+	}
+	job, err = s.Get(ctx, ds2bqJobID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !job.SLOExceededAt.IsZero() {
+		t.Errorf("want SLOExceededAt is zero but got %v", job.SLOExceededAt)
+	}
+
+	webhookStatus = http.StatusOK
+	if err := api.NotifyIfSLOExceeded(ctx, form, job, now); err != nil {
+		t.Fatal(err)
+	}
+	job, err = s.Get(ctx, ds2bqJobID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job.SLOExceededAt.IsZero() {
+		t.Error("want SLOExceededAt is recorded but zero")
+	}
+
+	// 記録した後は通知しない
+	if err := api.NotifyIfSLOExceeded(ctx, form, job, now); err != nil {
+		t.Fatal(err)
+	}
+	if e, g := 2, notified; e != g {
+		t.Errorf("want notified %v times but got %v", e, g)
+	}
+}
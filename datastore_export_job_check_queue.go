@@ -5,16 +5,15 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"log"
 	"os"
+	"time"
 
 	"cloud.google.com/go/cloudtasks/apiv2beta3"
+	"github.com/golang/protobuf/ptypes"
 	"github.com/morikuni/failure"
 	"github.com/sinmetal/gcpmetadata"
 	"go.opencensus.io/trace"
 	taskspb "google.golang.org/genproto/googleapis/cloud/tasks/v2beta3"
-	"google.golang.org/grpc/codes"
-	"google.golang.org/grpc/status"
 )
 
 type DatastoreExportJobCheckQueue struct {
@@ -31,7 +30,7 @@ func NewDatastoreExportJobCheckQueue(host string, tasks *cloudtasks.Client) (*Da
 		if err != nil {
 			return nil, errors.New("failed get instance region")
 		}
-		fmt.Printf("Location is %s\n", region)
+		Infof(context.Background(), "Location is %s\n", region)
 
 		qn = fmt.Sprintf("projects/%s/locations/%s/queues/gcpug-ds2bq-datastore-job-check", ProjectID, region)
 	}
@@ -45,11 +44,17 @@ func NewDatastoreExportJobCheckQueue(host string, tasks *cloudtasks.Client) (*Da
 }
 
 func (q *DatastoreExportJobCheckQueue) AddTask(ctx context.Context, body *DatastoreExportJobCheckRequest) error {
+	return q.ScheduleTask(ctx, body, time.Time{})
+}
+
+// ScheduleTask is scheduleTimeに実行されるTaskを追加する
+// scheduleTimeがZero Valueの場合は、すぐに実行される
+func (q *DatastoreExportJobCheckQueue) ScheduleTask(ctx context.Context, body *DatastoreExportJobCheckRequest, scheduleTime time.Time) error {
 	// TODO いずれはMockを作ったりしたい
 	if !gcpmetadata.OnGCP() {
 		return nil
 	}
-	ctx, span := trace.StartSpan(ctx, "DatastoreExportJobCheckQueue.AddTask")
+	ctx, span := trace.StartSpan(ctx, "DatastoreExportJobCheckQueue.ScheduleTask")
 	defer span.End()
 
 	message, err := json.Marshal(body)
@@ -60,6 +65,7 @@ func (q *DatastoreExportJobCheckQueue) AddTask(ctx context.Context, body *Datast
 	req := &taskspb.CreateTaskRequest{
 		Parent: q.queueName,
 		Task: &taskspb.Task{
+			Name: fmt.Sprintf("%s/tasks/%s", q.queueName, body.TaskID()),
 			PayloadType: &taskspb.Task_HttpRequest{
 				HttpRequest: &taskspb.HttpRequest{
 					HttpMethod: taskspb.HttpMethod_POST,
@@ -67,6 +73,7 @@ func (q *DatastoreExportJobCheckQueue) AddTask(ctx context.Context, body *Datast
 					AuthorizationHeader: &taskspb.HttpRequest_OidcToken{
 						OidcToken: &taskspb.OidcToken{
 							ServiceAccountEmail: ServiceAccountEmail,
+							Audience:            TaskOIDCAudience(),
 						},
 					},
 				},
@@ -74,23 +81,16 @@ func (q *DatastoreExportJobCheckQueue) AddTask(ctx context.Context, body *Datast
 		},
 	}
 	req.Task.GetHttpRequest().Body = []byte(message)
-
-	var retryCount int
-	for {
-		_, err = q.tasks.CreateTask(ctx, req)
+	if !scheduleTime.IsZero() {
+		ts, err := ptypes.TimestampProto(scheduleTime)
 		if err != nil {
-			if status.Code(err) == codes.Unavailable {
-				retryCount++
-				if retryCount > 5 {
-					return failure.Wrap(err, failure.Messagef("failed cloudtasks.CreateTask. body=%+v\n", body))
-				}
-				log.Printf("failed cloudtasks.CreateTask. body=%+v, retryCount=%v\n", body, retryCount)
-				continue
-			}
-			return failure.Wrap(err, failure.Messagef("failed cloudtasks.CreateTask. body=%+v\n", body))
+			return failure.Wrap(err, failure.Messagef("failed ptypes.TimestampProto. scheduleTime=%v\n", scheduleTime))
 		}
-		break
+		req.Task.ScheduleTime = ts
 	}
 
+	if err := EnqueueTask(ctx, q.tasks, req, DefaultTaskEnqueueBackoff); err != nil {
+		return failure.Wrap(err, failure.Messagef("failed EnqueueTask. body=%+v\n", body))
+	}
 	return nil
 }
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/morikuni/failure"
+	mds "go.mercari.io/datastore"
+)
+
+// DeadLetterTaskAPIPathPrefix is DeadLetterTaskを操作するAPIのPath
+const DeadLetterTaskAPIPathPrefix = "/api/v1/dead-letter-tasks/"
+
+// DeadLetterTaskListLimit is 一度に返すDeadLetterTaskの最大数
+const DeadLetterTaskListLimit = 100
+
+// DeadLetterTaskAPIPath is DeadLetterTaskを操作するAPIのPathの内容
+// /api/v1/dead-letter-tasks/ もしくは /api/v1/dead-letter-tasks/{deadLetterTaskId}:{action}
+type DeadLetterTaskAPIPath struct {
+	DeadLetterTaskID string
+	Action           string
+}
+
+type DeadLetterTaskAPI struct {
+	DeadLetterTaskStore        *DeadLetterTaskStore
+	DatastoreExportJobCheckAPI *DatastoreExportJobCheckAPI
+	BQLoadJobCheckAPI          *BQLoadJobCheckAPI
+}
+
+func NewDeadLetterTaskAPI(dltS *DeadLetterTaskStore, dsejcAPI *DatastoreExportJobCheckAPI, bqljcAPI *BQLoadJobCheckAPI) *DeadLetterTaskAPI {
+	return &DeadLetterTaskAPI{
+		dltS, dsejcAPI, bqljcAPI,
+	}
+}
+
+// ParseDeadLetterTaskAPIPath is DeadLetterTaskを操作するAPIのPathを DeadLetterTaskAPIPath に変換する
+func ParseDeadLetterTaskAPIPath(path string) (*DeadLetterTaskAPIPath, error) {
+	v := strings.TrimPrefix(path, DeadLetterTaskAPIPathPrefix)
+	if v == path {
+		return nil, fmt.Errorf("invalid path. path=%v", path)
+	}
+	var p DeadLetterTaskAPIPath
+	if i := strings.LastIndex(v, ":"); i >= 0 {
+		p.Action = v[i+1:]
+		v = v[:i]
+	}
+	if strings.Contains(v, "/") || (v == "" && p.Action != "") {
+		return nil, fmt.Errorf("invalid path. path=%v", path)
+	}
+	p.DeadLetterTaskID = v
+	return &p, nil
+}
+
+func HandleDeadLetterTaskAPI(r *http.Request) (interface{}, error) {
+	ctx := r.Context()
+
+	p, err := ParseDeadLetterTaskAPIPath(r.URL.Path)
+	if err != nil {
+		return nil, failure.Translate(err, StatusNotFound, failure.Message("unsupported path"))
+	}
+
+	queue, err := NewDatastoreExportJobCheckQueue(r.Host, TasksClient)
+	if err != nil {
+		return nil, failure.Wrap(err, failure.Message("failed NewDatastoreExportJobCheckQueue"))
+	}
+
+	bqljcQ, err := NewBQLoadJobCheckQueue(r.Host, TasksClient)
+	if err != nil {
+		return nil, failure.Wrap(err, failure.Message("failed NewBQLoadJobCheckQueue"))
+	}
+
+	dsexportJobStore, err := NewDSExportJobStore(ctx, DatastoreClient)
+	if err != nil {
+		return nil, failure.Wrap(err, failure.Message("failed NewDSExportJobStore()"))
+	}
+
+	bqloadJobStore, err := NewBQLoadJobStore(ctx, DatastoreClient)
+	if err != nil {
+		return nil, failure.Wrap(err, failure.Message("failed NewBQLoadJobStore()"))
+	}
+
+	runLockStore, err := NewRunLockStore(ctx, DatastoreClient)
+	if err != nil {
+		return nil, failure.Wrap(err, failure.Message("failed NewRunLockStore()"))
+	}
+
+	taskOutboxStore, err := NewTaskOutboxStore(ctx, DatastoreClient)
+	if err != nil {
+		return nil, failure.Wrap(err, failure.Message("failed NewTaskOutboxStore()"))
+	}
+
+	deadLetterTaskStore, err := NewDeadLetterTaskStore(ctx, DatastoreClient)
+	if err != nil {
+		return nil, failure.Wrap(err, failure.Message("failed NewDeadLetterTaskStore()"))
+	}
+
+	notifier := NewNotifier()
+	api := NewDeadLetterTaskAPI(
+		deadLetterTaskStore,
+		NewDatastoreExportJobCheckAPI(queue, dsexportJobStore, bqloadJobStore, bqljcQ, runLockStore, taskOutboxStore, deadLetterTaskStore, notifier),
+		NewBQLoadJobCheckAPI(bqljcQ, bqloadJobStore, NewDatastoreExportAPI(queue, dsexportJobStore, bqloadJobStore, runLockStore, taskOutboxStore), deadLetterTaskStore, notifier),
+	)
+
+	var res interface{}
+	switch {
+	case r.Method == http.MethodGet && p.DeadLetterTaskID == "":
+		res, err = api.List(ctx, DeadLetterTaskListLimit)
+	case r.Method == http.MethodPost && p.DeadLetterTaskID != "" && p.Action == "replay":
+		res, err = api.Replay(ctx, p.DeadLetterTaskID)
+	default:
+		return nil, failure.New(StatusNotFound, failure.Messagef("unsupported action. method=%v,path=%v", r.Method, r.URL.Path))
+	}
+	if err != nil {
+		return nil, failure.Wrap(err, failure.Messagef("failed %v deadLetterTaskID=%v", p.Action, p.DeadLetterTaskID))
+	}
+	return res, nil
+}
+
+// List is ctxのCallerが使って良いProject, DatasetのDeadLetterTaskを返す
+// 認証が無効でCallerが無い場合は全てのDeadLetterTaskを返す
+func (api *DeadLetterTaskAPI) List(ctx context.Context, limit int) ([]*DeadLetterTask, error) {
+	l, err := api.DeadLetterTaskStore.List(ctx, limit)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := CallerFromContext(ctx); !ok {
+		return l, nil
+	}
+
+	dseJS := api.DatastoreExportJobCheckAPI.DSExportJobStore
+	allowed := map[string]bool{}
+	res := []*DeadLetterTask{}
+	for _, dlt := range l {
+		v, ok := allowed[dlt.DS2BQJobID]
+		if !ok {
+			job, err := dseJS.Get(ctx, dlt.DS2BQJobID)
+			if err != nil {
+				if err == mds.ErrNoSuchEntity {
+					allowed[dlt.DS2BQJobID] = false
+					continue
+				}
+				return nil, failure.Wrap(err, failure.Messagef("failed DSExportJobStore.Get. ds2bqJobID=%v", dlt.DS2BQJobID))
+			}
+			v = AuthorizeDSExportJob(ctx, job) == nil
+			allowed[dlt.DS2BQJobID] = v
+		}
+		if v {
+			res = append(res, dlt)
+		}
+	}
+	return res, nil
+}
+
+// Replay is DeadLetterTaskに保存しておいたTaskの内容で、状態確認をやり直す
+// JobをRunningに戻し、解放したRunLockを取得し直してから、状態確認のTaskを追加する
+func (api *DeadLetterTaskAPI) Replay(ctx context.Context, deadLetterTaskID string) (*DeadLetterTask, error) {
+	dlt, err := api.DeadLetterTaskStore.Get(ctx, deadLetterTaskID)
+	if err != nil {
+		if err == mds.ErrNoSuchEntity {
+			return nil, failure.New(StatusNotFound)
+		}
+		return nil, failure.Wrap(err)
+	}
+	if !dlt.ReplayedAt.IsZero() {
+		return nil, failure.New(StatusConflict, failure.Messagef("deadLetterTaskID=%v is already replayed at %v", deadLetterTaskID, dlt.ReplayedAt))
+	}
+
+	dseAPI := api.BQLoadJobCheckAPI.DatastoreExportAPI
+	job, err := dseAPI.DSExportJobStore.Get(ctx, dlt.DS2BQJobID)
+	if err != nil {
+		if err == mds.ErrNoSuchEntity {
+			return nil, failure.New(StatusNotFound)
+		}
+		return nil, failure.Wrap(err)
+	}
+	if err := AuthorizeDSExportJob(ctx, job); err != nil {
+		return nil, err
+	}
+
+	var outbox *TaskOutbox
+	switch dlt.Queue {
+	case TaskOutboxQueueDatastoreExportJobCheck:
+		if job.Status != DSExportJobStatusDeadLettered {
+			return nil, failure.New(StatusConflict, failure.Messagef("ds2bqJobID=%v is not DeadLettered. status=%v", dlt.DS2BQJobID, job.Status))
+		}
+		var body DatastoreExportJobCheckRequest
+		if err := json.Unmarshal([]byte(dlt.Body), &body); err != nil {
+			return nil, failure.Wrap(err, failure.Messagef("failed json.Unmarshal. deadLetterTaskID=%v", deadLetterTaskID))
+		}
+		body.CheckSequence = job.StatusCheckCount + 1
+		outbox, err = dseAPI.TaskOutboxStore.New(dseAPI.DSExportJobStore.NewKey(ctx, dlt.DS2BQJobID), dlt.Queue, &body)
+		if err != nil {
+			return nil, failure.Wrap(err)
+		}
+		acquired, err := dseAPI.ReacquireRunLock(ctx, job)
+		if err != nil {
+			return nil, failure.Wrap(err)
+		}
+		if _, err := dseAPI.DSExportJobStore.ReplayCheck(ctx, dlt.DS2BQJobID, body.CheckSequence, outbox); err != nil {
+			api.releaseReacquiredRunLock(ctx, job, acquired)
+			return nil, failure.Wrap(err, failure.Messagef("failed DSExportJobStore.ReplayCheck. deadLetterTaskID=%v", deadLetterTaskID))
+		}
+	case TaskOutboxQueueBQLoadJobCheck:
+		loadJob, err := dseAPI.BQLoadJobStore.Get(ctx, dlt.DS2BQJobID, dlt.Kind)
+		if err != nil {
+			if err == mds.ErrNoSuchEntity {
+				return nil, failure.New(StatusNotFound)
+			}
+			return nil, failure.Wrap(err)
+		}
+		if loadJob.Status != BQLoadJobStatusDeadLettered {
+			return nil, failure.New(StatusConflict, failure.Messagef("ds2bqJobID=%v,kind=%v is not DeadLettered. status=%v", dlt.DS2BQJobID, dlt.Kind, loadJob.Status))
+		}
+		var body BQLoadJobCheckRequest
+		if err := json.Unmarshal([]byte(dlt.Body), &body); err != nil {
+			return nil, failure.Wrap(err, failure.Messagef("failed json.Unmarshal. deadLetterTaskID=%v", deadLetterTaskID))
+		}
+		body.CheckSequence = loadJob.StatusCheckCount + 1
+		outbox, err = dseAPI.TaskOutboxStore.New(dseAPI.BQLoadJobStore.NewKey(ctx, dlt.DS2BQJobID, dlt.Kind), dlt.Queue, &body)
+		if err != nil {
+			return nil, failure.Wrap(err)
+		}
+		acquired, err := dseAPI.ReacquireRunLock(ctx, job)
+		if err != nil {
+			return nil, failure.Wrap(err)
+		}
+		if _, err := dseAPI.BQLoadJobStore.ReplayCheck(ctx, dlt.DS2BQJobID, dlt.Kind, body.CheckSequence, outbox); err != nil {
+			api.releaseReacquiredRunLock(ctx, job, acquired)
+			return nil, failure.Wrap(err, failure.Messagef("failed BQLoadJobStore.ReplayCheck. deadLetterTaskID=%v", deadLetterTaskID))
+		}
+	default:
+		return nil, fmt.Errorf("%v is unsupported TaskOutboxQueue. deadLetterTaskID=%v", dlt.Queue, deadLetterTaskID)
+	}
+
+	dlt, err = api.DeadLetterTaskStore.MarkReplayed(ctx, deadLetterTaskID)
+	if err != nil {
+		return nil, failure.Wrap(err, failure.Messagef("failed DeadLetterTaskStore.MarkReplayed. deadLetterTaskID=%v", deadLetterTaskID))
+	}
+
+	// 追加に失敗したTaskOutboxは、TaskOutboxのDrainで追加し直す
+	d := NewTaskOutboxDispatcher(dseAPI.TaskOutboxStore, api.DatastoreExportJobCheckAPI.DatastoreExportJobCheckQueue, api.BQLoadJobCheckAPI.BQLoadJobCheckQueue)
+	if err := d.Dispatch(ctx, outbox); err != nil {
+		Errorf(ctx, "failed TaskOutboxDispatcher.Dispatch. deadLetterTaskID=%v,err=%+v\n", deadLetterTaskID, err)
+	}
+
+	Infof(ctx, "replay dead letter task. deadLetterTaskID=%v,ds2bqJobID=%v,kind=%v\n", deadLetterTaskID, dlt.DS2BQJobID, dlt.Kind)
+	return dlt, nil
+}
+
+// releaseReacquiredRunLock is Replayに失敗した時に、Replayのために取得し直したRunLockを解放する
+// 取得し直していない場合は、他のKindのために保持しているRunLockなので解放しない
+func (api *DeadLetterTaskAPI) releaseReacquiredRunLock(ctx context.Context, job *DSExportJob, acquired bool) {
+	if !acquired {
+		return
+	}
+	if err := api.BQLoadJobCheckAPI.DatastoreExportAPI.ReleaseRunLock(ctx, job.RunLockID, job.ID); err != nil {
+		Errorf(ctx, "failed ReleaseRunLock. runLockID=%v,ds2bqJobID=%v,err=%+v\n", job.RunLockID, job.ID, err)
+	}
+}
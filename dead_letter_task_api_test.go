@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	cds "cloud.google.com/go/datastore"
+	"github.com/google/uuid"
+	"github.com/morikuni/failure"
+	"go.mercari.io/datastore/clouddatastore"
+)
+
+func TestParseDeadLetterTaskAPIPath(t *testing.T) {
+	cases := []struct {
+		name    string
+		path    string
+		want    *DeadLetterTaskAPIPath
+		wantErr bool
+	}{
+		{"list", "/api/v1/dead-letter-tasks/", &DeadLetterTaskAPIPath{}, false},
+		{"replay", "/api/v1/dead-letter-tasks/hoge:replay", &DeadLetterTaskAPIPath{DeadLetterTaskID: "hoge", Action: "replay"}, false},
+		{"empty id", "/api/v1/dead-letter-tasks/:replay", nil, true},
+		{"sub resource", "/api/v1/dead-letter-tasks/hoge/fuga:replay", nil, true},
+		{"other path", "/api/v1/ds2bq-jobs/hoge:replay", nil, true},
+	}
+
+	for _, tt := range cases {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseDeadLetterTaskAPIPath(tt.path)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("want error but got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if e, g := tt.want, got; !reflect.DeepEqual(e, g) {
+				t.Errorf("want %+v but got %+v", e, g)
+			}
+		})
+	}
+}
+
+func TestDeadLetterTaskAPI_Replay(t *testing.T) {
+	ctx := context.Background()
+
+	cdsc, err := cds.NewClient(ctx, uuid.New().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ds, err := clouddatastore.FromClient(ctx, cdsc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dseJS, err := NewDSExportJobStore(ctx, ds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bqlJS, err := NewBQLoadJobStore(ctx, ds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rlS, err := NewRunLockStore(ctx, ds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	toS, err := NewTaskOutboxStore(ctx, ds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dltS, err := NewDeadLetterTaskStore(ctx, ds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dseAPI := NewDatastoreExportAPI(nil, dseJS, bqlJS, rlS, toS)
+	api := NewDeadLetterTaskAPI(dltS,
+		NewDatastoreExportJobCheckAPI(nil, dseJS, bqlJS, nil, rlS, toS, dltS, nil),
+		NewBQLoadJobCheckAPI(nil, bqlJS, dseAPI, dltS, nil))
+
+	ds2bqJobID := dseJS.NewDS2BQJobID(ctx)
+	lock, err := rlS.Acquire(ctx, &RunLockAcquireForm{
+		ExportProjectID: "gcpugjp-dev",
+		BQLoadProjectID: "gcpugjp-dev",
+		BQLoadDatasetID: "datastore",
+		DS2BQJobIDs:     []string{ds2bqJobID},
+		Policy:          RunLockPolicyReject,
+		Lease:           time.Hour,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	runLockID := lock.Lock.ID
+
+	if _, err := dseJS.Create(ctx, &DSExportJobCreateForm{
+		JobID:           ds2bqJobID,
+		Body:            `{"projectId":"gcpugjp-dev","bqLoadProjectId":"gcpugjp-dev","bqLoadDatasetId":"datastore"}`,
+		ExportProjectID: "gcpugjp-dev",
+		RunLockID:       runLockID,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dseJS.StartExportJob(ctx, ds2bqJobID, "operation", 0, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := dseJS.IncrementJobStatusCheckCount(ctx, ds2bqJobID, i, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := api.Replay(ctx, "not-found"); !failure.Is(err, StatusNotFound) {
+		t.Errorf("not found want %v but got %v", StatusNotFound, err)
+	}
+
+	// JobがDeadLetteredではない
+	running, err := dltS.New(TaskOutboxQueueDatastoreExportJobCheck, &DatastoreExportJobCheckRequest{DS2BQJobID: ds2bqJobID, DatastoreExportJobID: "operation"}, ds2bqJobID, "", TaskAttempt{RetryCount: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ds.Put(ctx, running.Key, running); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := api.Replay(ctx, running.ID); !failure.Is(err, StatusConflict) {
+		t.Errorf("not dead lettered want %v but got %v", StatusConflict, err)
+	}
+
+	dlt, err := dltS.New(TaskOutboxQueueDatastoreExportJobCheck, &DatastoreExportJobCheckRequest{DS2BQJobID: ds2bqJobID, DatastoreExportJobID: "operation", CheckSequence: 1}, ds2bqJobID, "", TaskAttempt{RetryCount: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, deadLettered, err := dseJS.DeadLetter(ctx, ds2bqJobID, "operation", dlt, "dead lettered"); err != nil {
+		t.Fatal(err)
+	} else if !deadLettered {
+		t.Fatal("want dead lettered but not dead lettered")
+	}
+	if err := dseAPI.ReleaseRunLock(ctx, runLockID, ds2bqJobID); err != nil {
+		t.Fatal(err)
+	}
+
+	replayed, err := api.Replay(ctx, dlt.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if replayed.ReplayedAt.IsZero() {
+		t.Error("want ReplayedAt is set but zero")
+	}
+	job, err := dseJS.Get(ctx, ds2bqJobID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, g := DSExportJobStatusRunning, job.Status; e != g {
+		t.Errorf("want Status is %v but got %v", e, g)
+	}
+	// 以前の状態確認のTaskとIDが重ならないように、CheckSequenceを進める
+	if e, g := 3, job.StatusCheckCount; e != g {
+		t.Errorf("want StatusCheckCount is %v but got %v", e, g)
+	}
+	// Queueがnilなので、TaskOutboxは残ったままになる
+	l, err := toS.ListCreatedBefore(ctx, time.Now().Add(time.Minute), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, g := 1, len(l); e != g {
+		t.Fatalf("want TaskOutbox length is %v but got %v", e, g)
+	}
+	var body DatastoreExportJobCheckRequest
+	if err := json.Unmarshal([]byte(l[0].Body), &body); err != nil {
+		t.Fatal(err)
+	}
+	if e, g := 3, body.CheckSequence; e != g {
+		t.Errorf("want CheckSequence is %v but got %v", e, g)
+	}
+	if holder, err := rlS.IsHolder(ctx, runLockID, ds2bqJobID); err != nil {
+		t.Fatal(err)
+	} else if !holder {
+		t.Error("want RunLock is reacquired but not holder")
+	}
+
+	if _, err := api.Replay(ctx, dlt.ID); !failure.Is(err, StatusConflict) {
+		t.Errorf("already replayed want %v but got %v", StatusConflict, err)
+	}
+
+	// ReplayCheckに失敗した時は、取得し直したRunLockだけを解放する
+	api.releaseReacquiredRunLock(ctx, job, false)
+	if holder, err := rlS.IsHolder(ctx, runLockID, ds2bqJobID); err != nil {
+		t.Fatal(err)
+	} else if !holder {
+		t.Error("want RunLock is kept when not reacquired but released")
+	}
+	api.releaseReacquiredRunLock(ctx, job, true)
+	if holder, err := rlS.IsHolder(ctx, runLockID, ds2bqJobID); err != nil {
+		t.Fatal(err)
+	} else if holder {
+		t.Error("want reacquired RunLock is released but still holder")
+	}
+}
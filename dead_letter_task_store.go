@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/morikuni/failure"
+	"go.mercari.io/datastore"
+)
+
+type DeadLetterTaskStore struct {
+	ds datastore.Client
+}
+
+func NewDeadLetterTaskStore(ctx context.Context, client datastore.Client) (*DeadLetterTaskStore, error) {
+	return &DeadLetterTaskStore{
+		ds: client,
+	}, nil
+}
+
+// DeadLetterTask is 試行回数の上限を超えた状態確認のTaskの内容
+// Jobは DeadLettered になり、Replayすると保存しておいたTaskの内容で状態確認をやり直す
+// +qbg
+type DeadLetterTask struct {
+	ID             string        `datastore:"-"`
+	Key            datastore.Key `datastore:"-"`
+	Queue          TaskOutboxQueue
+	Body           string `datastore:",noindex"`
+	DS2BQJobID     string
+	Kind           string // BQLoadJobの場合のKind
+	TaskName       string `datastore:",noindex"`
+	RetryCount     int
+	ExecutionCount int
+	ReplayedAt     time.Time // Replayした時刻. Replayしていない場合はZero
+	CreatedAt      time.Time
+	UpdatedAt      time.Time
+	SchemaVersion  int
+}
+
+var _ datastore.PropertyLoadSaver = &DeadLetterTask{}
+var _ datastore.KeyLoader = &DeadLetterTask{}
+
+// LoadKey is Entity Load時にKeyを設定する
+func (e *DeadLetterTask) LoadKey(ctx context.Context, k datastore.Key) error {
+	e.ID = k.Name()
+	e.Key = k
+
+	return nil
+}
+
+// Load is Entity Load時に呼ばれる
+func (e *DeadLetterTask) Load(ctx context.Context, ps []datastore.Property) error {
+	err := datastore.LoadStruct(ctx, e, ps)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Save is Entity Save時に呼ばれる
+func (e *DeadLetterTask) Save(ctx context.Context) ([]datastore.Property, error) {
+	if e.CreatedAt.IsZero() {
+		e.CreatedAt = time.Now()
+	}
+	e.UpdatedAt = time.Now()
+	e.SchemaVersion = 1
+
+	return datastore.SaveStruct(ctx, e)
+}
+
+func (store *DeadLetterTaskStore) NewKey(ctx context.Context, id string) datastore.Key {
+	return store.ds.NameKey("DeadLetterTask", id, nil)
+}
+
+// New is 試行回数の上限を超えた状態確認のTaskの内容からDeadLetterTaskを組み立てる
+// 保存はJobをDeadLetteredにするTransactionの中で行う
+func (store *DeadLetterTaskStore) New(queue TaskOutboxQueue, body interface{}, ds2bqJobID string, kind string, attempt TaskAttempt) (*DeadLetterTask, error) {
+	b, err := json.Marshal(body)
+	if err != nil {
+		return nil, failure.Wrap(err, failure.Messagef("failed json.Marshal. body=%+v", body))
+	}
+	key := store.ds.NameKey("DeadLetterTask", uuid.New().String(), nil)
+	return &DeadLetterTask{
+		ID:             key.Name(),
+		Key:            key,
+		Queue:          queue,
+		Body:           string(b),
+		DS2BQJobID:     ds2bqJobID,
+		Kind:           kind,
+		TaskName:       attempt.TaskName,
+		RetryCount:     attempt.RetryCount,
+		ExecutionCount: attempt.ExecutionCount,
+	}, nil
+}
+
+func (store *DeadLetterTaskStore) Get(ctx context.Context, id string) (*DeadLetterTask, error) {
+	var e DeadLetterTask
+	err := store.ds.Get(ctx, store.NewKey(ctx, id), &e)
+	if err != nil {
+		if err == datastore.ErrNoSuchEntity {
+			return nil, err
+		}
+		return nil, failure.Wrap(err, failure.Messagef("failed datastore.Get() id=%v", id))
+	}
+	return &e, nil
+}
+
+// List is 新しい順にDeadLetterTaskを返す
+func (store *DeadLetterTaskStore) List(ctx context.Context, limit int) ([]*DeadLetterTask, error) {
+	b := NewDeadLetterTaskQueryBuilder(store.ds)
+	b.CreatedAt.Desc()
+	b.Limit(limit)
+
+	var l []*DeadLetterTask
+	if _, err := store.ds.GetAll(ctx, b.Query(), &l); err != nil {
+		_, ok := err.(datastore.MultiError)
+		if ok {
+			return l, err
+		}
+		return nil, failure.Wrap(err, failure.Message("failed datastore.GetAll()"))
+	}
+
+	return l, nil
+}
+
+// MarkReplayed is DeadLetterTaskをReplay済みにする
+func (store *DeadLetterTaskStore) MarkReplayed(ctx context.Context, id string) (*DeadLetterTask, error) {
+	key := store.NewKey(ctx, id)
+	var e DeadLetterTask
+	_, err := RunInTransaction(ctx, store.ds, "DeadLetterTaskStore.MarkReplayed", func(tx datastore.Transaction) error {
+		if err := tx.Get(key, &e); err != nil {
+			return err
+		}
+		e.ReplayedAt = time.Now()
+		_, err := tx.Put(key, &e)
+		if err != nil {
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		if err == datastore.ErrNoSuchEntity {
+			return nil, err
+		}
+		return nil, failure.Wrap(err, failure.Messagef("failed datastore.RunInTx() id=%v", id))
+	}
+	return &e, nil
+}
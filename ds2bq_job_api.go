@@ -0,0 +1,345 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gcpug/ds2bq/bigquery"
+	"github.com/gcpug/ds2bq/datastore"
+	"github.com/morikuni/failure"
+	mds "go.mercari.io/datastore"
+)
+
+// DS2BQJobAPIPathPrefix is DS2BQJobを操作するAPIのPath
+const DS2BQJobAPIPathPrefix = "/api/v1/ds2bq-jobs/"
+
+// DS2BQJobCancelResponse is DS2BQJobをキャンセルした結果
+type DS2BQJobCancelResponse struct {
+	DS2BQJobID              string   `json:"ds2bqJobId"`
+	CancelledDSExportJobIDs []string `json:"cancelledDatastoreExportJobIds"`
+	CancelledBQLoadJobIDs   []string `json:"cancelledBigQueryLoadJobIds"`
+}
+
+// DS2BQJobAPIPath is DS2BQJobを操作するAPIのPathの内容
+// /api/v1/ds2bq-jobs/{ds2bqJobId}:{action} もしくは /api/v1/ds2bq-jobs/{ds2bqJobId}/kinds/{kind}:{action}
+type DS2BQJobAPIPath struct {
+	DS2BQJobID string
+	Kind       string
+	Action     string
+}
+
+// DS2BQJobStatusResponse is DS2BQJobの状態と、状態の変化の履歴
+type DS2BQJobStatusResponse struct {
+	DS2BQJobID  string            `json:"ds2bqJobId"`
+	DSExportJob *DSExportJob      `json:"datastoreExportJob"`
+	BQLoadJobs  []*BQLoadJob      `json:"bigqueryLoadJobs"`
+	Events      []*JobStatusEvent `json:"events"` // 古い順
+}
+
+type DS2BQJobAPI struct {
+	DatastoreExportAPI  *DatastoreExportAPI
+	BQLoadJobCheckQueue *BQLoadJobCheckQueue
+	JobStatusEventStore *JobStatusEventStore
+}
+
+func NewDS2BQJobAPI(dseAPI *DatastoreExportAPI, bqljcQ *BQLoadJobCheckQueue, jseS *JobStatusEventStore) *DS2BQJobAPI {
+	return &DS2BQJobAPI{
+		dseAPI, bqljcQ, jseS,
+	}
+}
+
+// ParseDS2BQJobAPIPath is DS2BQJobを操作するAPIのPathを DS2BQJobAPIPath に変換する
+func ParseDS2BQJobAPIPath(path string) (*DS2BQJobAPIPath, error) {
+	v := strings.TrimPrefix(path, DS2BQJobAPIPathPrefix)
+	if v == path || v == "" {
+		return nil, fmt.Errorf("invalid path. path=%v", path)
+	}
+	var p DS2BQJobAPIPath
+	if i := strings.LastIndex(v, ":"); i >= 0 {
+		p.Action = v[i+1:]
+		v = v[:i]
+	}
+	l := strings.Split(v, "/")
+	switch {
+	case len(l) == 1:
+		p.DS2BQJobID = l[0]
+	case len(l) == 3 && l[1] == "kinds" && l[2] != "":
+		p.DS2BQJobID = l[0]
+		p.Kind = l[2]
+	default:
+		return nil, fmt.Errorf("invalid path. path=%v", path)
+	}
+	if p.DS2BQJobID == "" {
+		return nil, fmt.Errorf("invalid path. path=%v", path)
+	}
+	return &p, nil
+}
+
+func HandleDS2BQJobAPI(r *http.Request) (interface{}, error) {
+	ctx := WithJobTrigger(r.Context(), NewJobTrigger(r))
+
+	p, err := ParseDS2BQJobAPIPath(r.URL.Path)
+	if err != nil {
+		return nil, failure.Translate(err, StatusNotFound, failure.Message("unsupported path"))
+	}
+	ds2bqJobID := p.DS2BQJobID
+	ctx = WithLogFields(ctx, LogFields{DS2BQJobID: ds2bqJobID, Kind: p.Kind})
+
+	queue, err := NewDatastoreExportJobCheckQueue(r.Host, TasksClient)
+	if err != nil {
+		return nil, failure.Wrap(err, failure.Message("failed NewDatastoreExportJobCheckQueue"))
+	}
+
+	bqljcQ, err := NewBQLoadJobCheckQueue(r.Host, TasksClient)
+	if err != nil {
+		return nil, failure.Wrap(err, failure.Message("failed NewBQLoadJobCheckQueue"))
+	}
+
+	dsexportJobStore, err := NewDSExportJobStore(ctx, DatastoreClient)
+	if err != nil {
+		return nil, failure.Wrap(err, failure.Messagef("failed NewDSExportJobStore() ds2bqJobID=%v", ds2bqJobID))
+	}
+
+	bqloadJobStore, err := NewBQLoadJobStore(ctx, DatastoreClient)
+	if err != nil {
+		return nil, failure.Wrap(err, failure.Messagef("failed NewBQLoadJobStore() ds2bqJobID=%v", ds2bqJobID))
+	}
+
+	runLockStore, err := NewRunLockStore(ctx, DatastoreClient)
+	if err != nil {
+		return nil, failure.Wrap(err, failure.Messagef("failed NewRunLockStore() ds2bqJobID=%v", ds2bqJobID))
+	}
+
+	taskOutboxStore, err := NewTaskOutboxStore(ctx, DatastoreClient)
+	if err != nil {
+		return nil, failure.Wrap(err, failure.Messagef("failed NewTaskOutboxStore() ds2bqJobID=%v", ds2bqJobID))
+	}
+
+	jobStatusEventStore, err := NewJobStatusEventStore(ctx, DatastoreClient)
+	if err != nil {
+		return nil, failure.Wrap(err, failure.Messagef("failed NewJobStatusEventStore() ds2bqJobID=%v", ds2bqJobID))
+	}
+
+	api := NewDS2BQJobAPI(NewDatastoreExportAPI(queue, dsexportJobStore, bqloadJobStore, runLockStore, taskOutboxStore), bqljcQ, jobStatusEventStore)
+	if err := api.Authorize(ctx, ds2bqJobID); err != nil {
+		return nil, err
+	}
+
+	var res interface{}
+	switch {
+	case r.Method == http.MethodGet && p.Kind == "" && p.Action == "":
+		res, err = api.Status(ctx, ds2bqJobID)
+	case r.Method == http.MethodPost && p.Kind == "" && p.Action == "cancel":
+		res, err = api.Cancel(ctx, ds2bqJobID)
+	case r.Method == http.MethodPost && p.Kind == "" && p.Action == "rerun":
+		var rerun *DatastoreExportResponse
+		rerun, err = api.Rerun(ctx, ds2bqJobID)
+		if err == nil && rerun.Queued {
+			return &APIResponse{StatusCode: http.StatusAccepted, Body: rerun}, nil
+		}
+		res = rerun
+	case r.Method == http.MethodPost && p.Kind != "" && p.Action == "reload":
+		res, err = api.ReloadKind(ctx, ds2bqJobID, p.Kind)
+	default:
+		return nil, failure.New(StatusNotFound, failure.Messagef("unsupported action. method=%v,path=%v", r.Method, r.URL.Path))
+	}
+	if err != nil {
+		return nil, failure.Wrap(err, failure.Messagef("failed %v ds2bqJobID=%v,kind=%v", p.Action, ds2bqJobID, p.Kind))
+	}
+	return res, nil
+}
+
+// Cancel is DS2BQJobの実行中のDatastore Export, BQ Load のJobをキャンセルして、Cancelledにする
+// Cancelledになった後は、Check APIはJobの状態確認をやめる
+func (api *DS2BQJobAPI) Cancel(ctx context.Context, ds2bqJobID string) (*DS2BQJobCancelResponse, error) {
+	res := &DS2BQJobCancelResponse{
+		DS2BQJobID:              ds2bqJobID,
+		CancelledDSExportJobIDs: []string{},
+		CancelledBQLoadJobIDs:   []string{},
+	}
+
+	// 状態確認のTaskが同時にJobを終わらせても上書きしないように、先にTransactionでCancelledにしてから実行中のJobを止める
+	job, cancelled, err := api.DatastoreExportAPI.DSExportJobStore.Cancel(ctx, ds2bqJobID)
+	if err != nil {
+		if err == mds.ErrNoSuchEntity {
+			return nil, failure.New(StatusNotFound)
+		}
+		return nil, failure.Wrap(err, failure.Messagef("failed DSExportJobStore.Cancel. DS2BQJobID=%v", ds2bqJobID))
+	}
+	if cancelled {
+		for _, id := range job.DSExportJobIDs {
+			// 既に終わっているOperationはキャンセルできないので、失敗しても続ける
+			if err := datastore.Cancel(ctx, id); err != nil {
+				Errorf(ctx, "failed datastore.Cancel. DS2BQJobID=%v,DatastoreExportJobID=%v,err=%v\n", ds2bqJobID, id, err)
+				continue
+			}
+			res.CancelledDSExportJobIDs = append(res.CancelledDSExportJobIDs, id)
+		}
+	}
+
+	loadJobs, err := api.DatastoreExportAPI.BQLoadJobStore.List(ctx, ds2bqJobID)
+	if err != nil {
+		return nil, failure.Wrap(err, failure.Messagef("failed BQLoadJobStore.List. DS2BQJobID=%v", ds2bqJobID))
+	}
+	for _, loadJob := range loadJobs {
+		if loadJob.Status.IsFinished() {
+			continue
+		}
+		cancelledJob, cancelled, err := api.DatastoreExportAPI.BQLoadJobStore.Cancel(ctx, ds2bqJobID, loadJob.Kind)
+		if err != nil {
+			return nil, failure.Wrap(err, failure.Messagef("failed BQLoadJobStore.Cancel. DS2BQJobID=%v,Kind=%v", ds2bqJobID, loadJob.Kind))
+		}
+		if !cancelled || cancelledJob.BQLoadJobID == "" {
+			continue
+		}
+		if err := bigquery.Cancel(ctx, cancelledJob.BQLoadProjectID, cancelledJob.BQLoadJobID); err != nil {
+			Errorf(ctx, "failed bigquery.Cancel. DS2BQJobID=%v,Kind=%v,BigQueryLoadJobID=%v,err=%v\n", ds2bqJobID, loadJob.Kind, cancelledJob.BQLoadJobID, err)
+			continue
+		}
+		res.CancelledBQLoadJobIDs = append(res.CancelledBQLoadJobIDs, cancelledJob.BQLoadJobID)
+	}
+
+	if err := api.DatastoreExportAPI.FinishRun(ctx, job.RunLockID, ds2bqJobID); err != nil {
+		return nil, failure.Wrap(err, failure.Messagef("failed FinishRun. DS2BQJobID=%v", ds2bqJobID))
+	}
+
+	return res, nil
+}
+
+// Status is DS2BQJobのDSExportJob, BQLoadJobと、状態の変化の履歴を返す
+func (api *DS2BQJobAPI) Status(ctx context.Context, ds2bqJobID string) (*DS2BQJobStatusResponse, error) {
+	job, err := api.DatastoreExportAPI.DSExportJobStore.Get(ctx, ds2bqJobID)
+	if err != nil {
+		return nil, failure.New(StoreErrorCode(err), failure.Messagef("failed DSExportJobStore.Get. ds2bqJobID=%v,err=%v", ds2bqJobID, err))
+	}
+	loadJobs, err := api.DatastoreExportAPI.BQLoadJobStore.List(ctx, ds2bqJobID)
+	if err != nil {
+		return nil, failure.Wrap(err, failure.Messagef("failed BQLoadJobStore.List. ds2bqJobID=%v", ds2bqJobID))
+	}
+	events, err := api.JobStatusEventStore.ListByDS2BQJobID(ctx, ds2bqJobID)
+	if err != nil {
+		return nil, failure.Wrap(err, failure.Messagef("failed JobStatusEventStore.ListByDS2BQJobID. ds2bqJobID=%v", ds2bqJobID))
+	}
+	if loadJobs == nil {
+		loadJobs = []*BQLoadJob{}
+	}
+	if events == nil {
+		events = []*JobStatusEvent{}
+	}
+	return &DS2BQJobStatusResponse{
+		DS2BQJobID:  ds2bqJobID,
+		DSExportJob: job,
+		BQLoadJobs:  loadJobs,
+		Events:      events,
+	}, nil
+}
+
+// Authorize is ctxのCallerがDS2BQJobのExport元のProjectとBQ Load先のDatasetを使って良いかを確認する
+// 認証が無効でCallerが無い場合は何もしない
+func (api *DS2BQJobAPI) Authorize(ctx context.Context, ds2bqJobID string) error {
+	if _, ok := CallerFromContext(ctx); !ok {
+		return nil
+	}
+	job, err := api.DatastoreExportAPI.DSExportJobStore.Get(ctx, ds2bqJobID)
+	if err != nil {
+		return failure.New(StoreErrorCode(err), failure.Messagef("failed DSExportJobStore.Get. ds2bqJobID=%v,err=%v", ds2bqJobID, err))
+	}
+	return AuthorizeDSExportJob(ctx, job)
+}
+
+// Rerun is DS2BQJobを保存されているJobRequestBodyから再実行する
+// 再実行は新しいDS2BQJobとして開始し、元のDS2BQJobと同じKindだけをExport, BQ Loadする
+func (api *DS2BQJobAPI) Rerun(ctx context.Context, ds2bqJobID string) (*DatastoreExportResponse, error) {
+	job, err := api.DatastoreExportAPI.DSExportJobStore.Get(ctx, ds2bqJobID)
+	if err != nil {
+		if err == mds.ErrNoSuchEntity {
+			return nil, failure.New(StatusNotFound)
+		}
+		return nil, failure.Wrap(err)
+	}
+	if job.Status == DSExportJobStatusDefault || job.Status == DSExportJobStatusRunning {
+		return nil, failure.New(StatusConflict, failure.Messagef("ds2bqJobID=%v is running", ds2bqJobID))
+	}
+
+	form, body, err := BuildRerunRequest(job)
+	if err != nil {
+		return nil, err
+	}
+
+	policy, err := ParseRunLockPolicy(form.RunLockPolicy)
+	if err != nil {
+		return nil, failure.Wrap(err)
+	}
+	efs, err := BuildEntityFilter(ctx, form.NamespaceIDs, form.Kinds, DefaultSeparateKindCount)
+	if err != nil {
+		return nil, failure.Wrap(err, failure.Messagef("failed BuildEntityFilter. ds2bqJobID=%v", ds2bqJobID))
+	}
+
+	Infof(ctx, "rerun ds2bqJobID=%v. body=%s\n", ds2bqJobID, string(body))
+	return api.DatastoreExportAPI.StartDS2BQJobs(ctx, body, form, efs, policy)
+}
+
+// BuildRerunRequest is DS2BQJobのJobRequestBodyから、同じKind, NamespaceだけをExportし直すRequestとそのBodyを作る
+// 元のRequestのIdempotencyKeyを使うと既存のJobを返すだけになるので、空にする
+func BuildRerunRequest(job *DSExportJob) (*DatastoreExportRequest, string, error) {
+	var form DatastoreExportRequest
+	if err := json.Unmarshal([]byte(job.JobRequestBody), &form); err != nil {
+		return nil, "", failure.Wrap(err, failure.Messagef("failed json.Unmarshal. ds2bqJobID=%v", job.ID))
+	}
+	form.AllKinds = false
+	form.Kinds = job.ExportKinds
+	form.NamespaceIDs = job.ExportNamespaceIDs
+	form.IgnoreKinds = nil
+	form.IdempotencyKey = ""
+	body, err := json.Marshal(&form)
+	if err != nil {
+		return nil, "", failure.Wrap(err, failure.Messagef("failed json.Marshal. ds2bqJobID=%v", job.ID))
+	}
+	return &form, string(body), nil
+}
+
+// ReloadKind is 元のDatastore Exportの出力から、1つのKindだけBQ Loadをやり直す
+// BQ Loadが終わるまではRunLockを保持するので、他のRunがRunLockを保持している間はやり直せない
+func (api *DS2BQJobAPI) ReloadKind(ctx context.Context, ds2bqJobID string, kind string) (*BQLoadJob, error) {
+	job, err := api.DatastoreExportAPI.DSExportJobStore.Get(ctx, ds2bqJobID)
+	if err != nil {
+		if err == mds.ErrNoSuchEntity {
+			return nil, failure.New(StatusNotFound)
+		}
+		return nil, failure.Wrap(err)
+	}
+	if job.Status != DSExportJobStatusDone || job.OutputURLPrefix == "" {
+		return nil, failure.New(StatusConflict, failure.Messagef("datastore export is not done. ds2bqJobID=%v", ds2bqJobID))
+	}
+
+	loadJob, err := api.DatastoreExportAPI.BQLoadJobStore.Get(ctx, ds2bqJobID, kind)
+	if err != nil {
+		if err == mds.ErrNoSuchEntity {
+			return nil, failure.New(StatusNotFound)
+		}
+		return nil, failure.Wrap(err)
+	}
+	if !loadJob.Status.IsFinished() {
+		return nil, failure.New(StatusConflict, failure.Messagef("bq load is running. ds2bqJobID=%v,kind=%v", ds2bqJobID, kind))
+	}
+
+	// 新しいRunのBQ LoadをWriteTruncateで上書きしないように、RunLockを取得し直す. 他のRunが保持している場合はConflictを返す
+	acquired, err := api.DatastoreExportAPI.ReacquireRunLock(ctx, job)
+	if err != nil {
+		return nil, failure.Wrap(err)
+	}
+	ls := NewBQLoadService(api.DatastoreExportAPI.BQLoadJobStore, api.BQLoadJobCheckQueue, api.DatastoreExportAPI.TaskOutboxStore)
+	if err := ls.InsertBigQueryLoadJobForKind(ctx, ds2bqJobID, kind, job.OutputURLPrefix); err != nil {
+		if acquired {
+			if err := api.DatastoreExportAPI.ReleaseRunLock(ctx, job.RunLockID, ds2bqJobID); err != nil {
+				Errorf(ctx, "failed ReleaseRunLock. runLockID=%v,ds2bqJobID=%v,err=%+v\n", job.RunLockID, ds2bqJobID, err)
+			}
+		}
+		return nil, failure.Wrap(err, failure.Messagef("failed BQLoadService.InsertBigQueryLoadJobForKind. ds2bqJobID=%v,kind=%v", ds2bqJobID, kind))
+	}
+
+	return api.DatastoreExportAPI.BQLoadJobStore.Get(ctx, ds2bqJobID, kind)
+}
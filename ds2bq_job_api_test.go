@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	cds "cloud.google.com/go/datastore"
+	"github.com/google/uuid"
+	"github.com/morikuni/failure"
+	"go.mercari.io/datastore/clouddatastore"
+)
+
+func TestParseDS2BQJobAPIPath(t *testing.T) {
+	cases := []struct {
+		name    string
+		path    string
+		want    *DS2BQJobAPIPath
+		wantErr bool
+	}{
+		{"cancel", "/api/v1/ds2bq-jobs/hoge:cancel", &DS2BQJobAPIPath{DS2BQJobID: "hoge", Action: "cancel"}, false},
+		{"rerun", "/api/v1/ds2bq-jobs/hoge:rerun", &DS2BQJobAPIPath{DS2BQJobID: "hoge", Action: "rerun"}, false},
+		{"reload kind", "/api/v1/ds2bq-jobs/hoge/kinds/Fuga:reload", &DS2BQJobAPIPath{DS2BQJobID: "hoge", Kind: "Fuga", Action: "reload"}, false},
+		{"no action", "/api/v1/ds2bq-jobs/hoge", &DS2BQJobAPIPath{DS2BQJobID: "hoge"}, false},
+		{"empty", "/api/v1/ds2bq-jobs/", nil, true},
+		{"empty kind", "/api/v1/ds2bq-jobs/hoge/kinds/:reload", nil, true},
+		{"unknown sub resource", "/api/v1/ds2bq-jobs/hoge/fuga/Fuga:reload", nil, true},
+		{"other path", "/api/v1/datastore-export/", nil, true},
+	}
+
+	for _, tt := range cases {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseDS2BQJobAPIPath(tt.path)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("want error but got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if e, g := tt.want, got; !reflect.DeepEqual(e, g) {
+				t.Errorf("want %+v but got %+v", e, g)
+			}
+		})
+	}
+}
+
+func TestBuildRerunRequest(t *testing.T) {
+	job := &DSExportJob{
+		ID:                 "hoge",
+		JobRequestBody:     `{"projectId":"gcpugjp-dev","allKinds":true,"ignoreKinds":["Ignore"],"outputGCSFilePath":"gs://datastore-export-gcpugjp-dev","idempotencyKey":"daily-20190830","runLockPolicy":"reject"}`,
+		ExportKinds:        []string{"PugEvent", "PugUser"},
+		ExportNamespaceIDs: []string{"", "pug"},
+	}
+
+	form, body, err := BuildRerunRequest(job)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &DatastoreExportRequest{
+		ProjectID:         "gcpugjp-dev",
+		Kinds:             []string{"PugEvent", "PugUser"},
+		NamespaceIDs:      []string{"", "pug"},
+		OutputGCSFilePath: "gs://datastore-export-gcpugjp-dev",
+		RunLockPolicy:     "reject",
+	}
+	if e, g := want, form; !reflect.DeepEqual(e, g) {
+		t.Errorf("want %+v but got %+v", e, g)
+	}
+	// Bodyは新しいDS2BQJobのJobRequestBodyになるので、formと同じ内容にする
+	rerun, _, err := BuildRerunRequest(&DSExportJob{ID: "fuga", JobRequestBody: body, ExportKinds: form.Kinds, ExportNamespaceIDs: form.NamespaceIDs})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, g := form, rerun; !reflect.DeepEqual(e, g) {
+		t.Errorf("body want %+v but got %+v", e, g)
+	}
+
+	if _, _, err := BuildRerunRequest(&DSExportJob{ID: "invalid", JobRequestBody: "{"}); err == nil {
+		t.Error("want error but got nil")
+	}
+}
+
+func newTestDS2BQJobAPI(t *testing.T) *DS2BQJobAPI {
+	ctx := context.Background()
+
+	cdsc, err := cds.NewClient(ctx, uuid.New().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ds, err := clouddatastore.FromClient(ctx, cdsc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dseJS, err := NewDSExportJobStore(ctx, ds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bqlJS, err := NewBQLoadJobStore(ctx, ds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rlS, err := NewRunLockStore(ctx, ds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	toS, err := NewTaskOutboxStore(ctx, ds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewDS2BQJobAPI(NewDatastoreExportAPI(nil, dseJS, bqlJS, rlS, toS), nil, nil)
+}
+
+func TestDS2BQJobAPI_Rerun(t *testing.T) {
+	ctx := context.Background()
+	api := newTestDS2BQJobAPI(t)
+	s := api.DatastoreExportAPI.DSExportJobStore
+
+	if _, err := api.Rerun(ctx, "notfound"); !failure.Is(err, StatusNotFound) {
+		t.Errorf("want %v but got %v", StatusNotFound, err)
+	}
+
+	// 実行中のJobは再実行しない
+	ds2bqJobID := s.NewDS2BQJobID(ctx)
+	if _, err := s.Create(ctx, &DSExportJobCreateForm{JobID: ds2bqJobID, Body: `{"projectId":"gcpugjp-dev"}`, Kinds: []string{"PugEvent"}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := api.Rerun(ctx, ds2bqJobID); !failure.Is(err, StatusConflict) {
+		t.Errorf("Default want %v but got %v", StatusConflict, err)
+	}
+	if _, err := s.StartExportJob(ctx, ds2bqJobID, "operation", 0, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := api.Rerun(ctx, ds2bqJobID); !failure.Is(err, StatusConflict) {
+		t.Errorf("Running want %v but got %v", StatusConflict, err)
+	}
+}
+
+func TestDS2BQJobAPI_ReloadKind(t *testing.T) {
+	ctx := context.Background()
+	api := newTestDS2BQJobAPI(t)
+	dseJS := api.DatastoreExportAPI.DSExportJobStore
+	bqlJS := api.DatastoreExportAPI.BQLoadJobStore
+	rlS := api.DatastoreExportAPI.RunLockStore
+
+	// BQ Loadに失敗させるため、存在しないProjectにLoadする
+	const bqLoadProjectID = "ds2bq-not-found-project"
+	const kind = "PugEvent"
+	lockForm := &RunLockAcquireForm{
+		ExportProjectID: "gcpugjp-dev",
+		BQLoadProjectID: bqLoadProjectID,
+		BQLoadDatasetID: "datastore",
+		DS2BQJobIDs:     []string{"other"},
+		Policy:          RunLockPolicyReject,
+		Lease:           time.Hour,
+	}
+	lock, err := rlS.Acquire(ctx, lockForm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	runLockID := lock.Lock.ID
+
+	ds2bqJobID := dseJS.NewDS2BQJobID(ctx)
+	if _, err := dseJS.Create(ctx, &DSExportJobCreateForm{
+		JobID:           ds2bqJobID,
+		Body:            `{"projectId":"gcpugjp-dev","bqLoadProjectId":"ds2bq-not-found-project","bqLoadDatasetId":"datastore"}`,
+		ExportProjectID: "gcpugjp-dev",
+		Kinds:           []string{kind},
+		RunLockID:       runLockID,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bqlJS.Put(ctx, &BQLoadJobPutForm{JobID: ds2bqJobID, Kind: kind, ExportProjectID: "gcpugjp-dev", BQLoadProjectID: bqLoadProjectID, BQLoadDatasetID: "datastore"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dseJS.StartExportJob(ctx, ds2bqJobID, "operation", 0, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// Datastore Exportが終わっていない
+	if _, err := api.ReloadKind(ctx, ds2bqJobID, kind); !failure.Is(err, StatusConflict) {
+		t.Errorf("export running want %v but got %v", StatusConflict, err)
+	}
+
+	if _, err := dseJS.FinishExportJob(ctx, ds2bqJobID, DSExportJobStatusDone, "operation", ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dseJS.SetExportStatistics(ctx, ds2bqJobID, &DSExportStatistics{OutputURLPrefix: "gs://datastore-export-gcpugjp-dev/20190830"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// BQ Loadが終わっていない
+	if _, err := api.ReloadKind(ctx, ds2bqJobID, kind); !failure.Is(err, StatusConflict) {
+		t.Errorf("bq load running want %v but got %v", StatusConflict, err)
+	}
+	if _, err := bqlJS.FinishExportJob(ctx, ds2bqJobID, kind, BQLoadJobStatusFailed, "failed"); err != nil {
+		t.Fatal(err)
+	}
+
+	// 他のRunがRunLockを保持している
+	if _, err := api.ReloadKind(ctx, ds2bqJobID, kind); !failure.Is(err, StatusConflict) {
+		t.Errorf("run lock held want %v but got %v", StatusConflict, err)
+	}
+	if _, err := rlS.Release(ctx, runLockID, "other"); err != nil {
+		t.Fatal(err)
+	}
+
+	// BQ Loadに失敗した場合は、取得し直したRunLockを解放する
+	if _, err := api.ReloadKind(ctx, ds2bqJobID, kind); err == nil {
+		t.Fatal("want error but got nil")
+	}
+	holder, err := rlS.IsHolder(ctx, runLockID, ds2bqJobID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if holder {
+		t.Error("want run lock is released but held")
+	}
+	lockForm.DS2BQJobIDs = []string{"next"}
+	next, err := rlS.Acquire(ctx, lockForm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !next.Acquired {
+		t.Error("want next run acquires run lock but not acquired")
+	}
+}
@@ -10,6 +10,7 @@ import (
 	"github.com/google/uuid"
 	"github.com/morikuni/failure"
 	"go.mercari.io/datastore"
+	"go.opencensus.io/trace"
 )
 
 type DSExportJobStore struct {
@@ -29,8 +30,26 @@ const (
 	DSExportJobStatusRunning
 	DSExportJobStatusFailed
 	DSExportJobStatusDone
+	DSExportJobStatusTimedOut
+	DSExportJobStatusCancelled
+	DSExportJobStatusDeadLettered // 状態確認のTaskが試行回数の上限を超えた
 )
 
+var dsExportJobStatusNames = []string{"Default", "Running", "Failed", "Done", "TimedOut", "Cancelled", "DeadLettered"}
+
+func (s DSExportJobStatus) String() string {
+	if s < 0 || int(s) >= len(dsExportJobStatusNames) {
+		return fmt.Sprintf("DSExportJobStatus(%d)", int(s))
+	}
+	return dsExportJobStatusNames[s]
+}
+
+// IsActive is Datastore Exportを開始する前か、実行中かを返す
+func (s DSExportJobStatus) IsActive() bool {
+	return s == DSExportJobStatusDefault || s == DSExportJobStatusRunning
+}
+
+// +qbg
 type DSExportJob struct {
 	ID                       string `datastore:"-"`
 	DSExportJobIDs           []string
@@ -39,11 +58,32 @@ type DSExportJob struct {
 	ExportNamespaceIDs       []string `datastore:",noindex"`
 	ExportKinds              []string `datastore:",noindex"`
 	StatusCheckCount         int
+	CheckTaskRetryCount      int       // 最後にRetryされた状態確認のTaskの X-CloudTasks-TaskRetryCount
+	CheckTaskExecutionCount  int       // 最後にRetryされた状態確認のTaskの X-CloudTasks-TaskExecutionCount
+	MaxStatusCheckCount      int       // StatusCheckCountがこの回数に達するとTimedOutになる. 0の場合は無制限
+	TimeoutSeconds           int       // Runningになってからこの秒数が過ぎるとTimedOutになる. 0の場合は無制限
+	CancelOnTimeout          bool      // TimedOutになった時にDatastore Export Jobをキャンセルするか
+	SLOSeconds               int       // 作られてからこの秒数が過ぎても終わっていない場合は、SLO違反として通知する. 0の場合は無し
+	SLOExceededAt            time.Time // SLO違反を通知した時刻
+	RunHistoryWrittenAt      time.Time // Runの履歴を書き込んだ時刻. 履歴を重複して書き込まないように、書き込む前に記録する
 	Status                   DSExportJobStatus
 	MaxRetryCount            int
 	RetryCount               int
 	ChangeStatusAt           time.Time
-	DSExportResponseMessages []string `datastore:",noindex"` // DatastoreExportJobID-_-ResponseMessagesが格納される
+	DSExportResponseMessages []string       `datastore:",noindex"` // DatastoreExportJobID-_-ResponseMessagesが格納される
+	RunLockID                string         // 保持しているRunLockのKey Name
+	OutputURLPrefix          string         `datastore:",noindex"` // Datastore Export JobがDoneになった時の出力先. BQ Loadの再実行に使う
+	ExportedEntities         int64          // Datastore ExportしたEntityの数
+	ExportedBytes            int64          // Datastore ExportしたBytes
+	ExportStartedAt          time.Time      // Datastore Export Jobが開始した時刻
+	ExportEndedAt            time.Time      // Datastore Export Jobが終了した時刻
+	TriggerType              JobTriggerType // Jobを開始したきっかけ
+	TriggeredBy              string         // Jobを開始したCallerのEmail. 認証が無効な場合は空
+	TriggerSourceIP          string         `datastore:",noindex"`
+	TriggerUserAgent         string         `datastore:",noindex"`
+	RetryTriggerType         JobTriggerType // 最後にDatastore Exportを再実行したきっかけ (retry, reconciler)
+	RetryTriggeredBy         string         // 最後にDatastore Exportを再実行したCallerのEmail
+	RetriedAt                time.Time      // 最後にDatastore Exportを再実行した時刻
 	CreatedAt                time.Time
 	UpdatedAt                time.Time
 	SchemaVersion            int
@@ -75,11 +115,36 @@ func (e *DSExportJob) Save(ctx context.Context) ([]datastore.Property, error) {
 		e.CreatedAt = time.Now()
 	}
 	e.UpdatedAt = time.Now()
-	e.SchemaVersion = 2
+	e.SchemaVersion = 9
 
 	return datastore.SaveStruct(ctx, e)
 }
 
+// IsTimedOut is StatusCheckCount, Runningになってからの時間がTimeoutを超えているかを返す
+func (e *DSExportJob) IsTimedOut(now time.Time) bool {
+	t := JobTimeout{
+		MaxStatusCheckCount: e.MaxStatusCheckCount,
+		TimeoutSeconds:      e.TimeoutSeconds,
+	}
+	return t.IsExceeded(e.StatusCheckCount, e.ChangeStatusAt, now)
+}
+
+// LatestDSExportJobID is 最後に開始したDatastore Export JobのIDを返す. 開始していない場合は空文字
+func (e *DSExportJob) LatestDSExportJobID() string {
+	if len(e.DSExportJobIDs) < 1 {
+		return ""
+	}
+	return e.DSExportJobIDs[len(e.DSExportJobIDs)-1]
+}
+
+// IsSLOExceeded is 作られてからの時間がSLOを超えていて、まだ通知していないかを返す
+func (e *DSExportJob) IsSLOExceeded(now time.Time) bool {
+	t := JobTimeout{
+		SLOSeconds: e.SLOSeconds,
+	}
+	return e.SLOExceededAt.IsZero() && t.IsSLOExceeded(e.CreatedAt, now)
+}
+
 // NewJobID is JobIDを生成する
 // JobIDは一度のDatastore Export, BQ Loadで一つ発行され、複数KindのExportが全て終わっているかを確認するためのID
 func (store *DSExportJobStore) NewDS2BQJobID(ctx context.Context) string {
@@ -90,20 +155,44 @@ func (store *DSExportJobStore) NewKey(ctx context.Context, ds2bqJobID string) da
 	return store.ds.NameKey("DSExportJob", ds2bqJobID, nil)
 }
 
-func (store *DSExportJobStore) Create(ctx context.Context, ds2bqJobID string, body string, exportProjectID string, namespaceIDs []string, kinds []string, maxRetryCount int) (*DSExportJob, error) {
+// DSExportJobCreateForm is Create する時のRequest内容
+type DSExportJobCreateForm struct {
+	JobID           string
+	Body            string // DatastoreExportRequestのJSON
+	ExportProjectID string // Datastore ExportするGCP ProjectID
+	NamespaceIDs    []string
+	Kinds           []string
+	MaxRetryCount   int
+	RunLockID       string
+	Timeout         JobTimeout
+	Trigger         *JobTrigger // nil の場合は記録しない
+}
+
+func (store *DSExportJobStore) Create(ctx context.Context, form *DSExportJobCreateForm) (*DSExportJob, error) {
 	e := DSExportJob{
-		ID:                       ds2bqJobID,
+		ID:                       form.JobID,
 		DSExportJobIDs:           []string{},
 		Status:                   DSExportJobStatusDefault,
-		JobRequestBody:           body,
-		ExportProjectID:          exportProjectID,
-		ExportNamespaceIDs:       namespaceIDs,
-		ExportKinds:              kinds,
+		JobRequestBody:           form.Body,
+		ExportProjectID:          form.ExportProjectID,
+		ExportNamespaceIDs:       form.NamespaceIDs,
+		ExportKinds:              form.Kinds,
 		ChangeStatusAt:           time.Now(),
 		DSExportResponseMessages: []string{},
-		MaxRetryCount:            maxRetryCount,
+		MaxRetryCount:            form.MaxRetryCount,
+		RunLockID:                form.RunLockID,
+		MaxStatusCheckCount:      form.Timeout.MaxStatusCheckCount,
+		TimeoutSeconds:           form.Timeout.TimeoutSeconds,
+		CancelOnTimeout:          form.Timeout.CancelOnTimeout,
+		SLOSeconds:               form.Timeout.SLOSeconds,
+	}
+	if trigger := form.Trigger; trigger != nil {
+		e.TriggerType = trigger.Type
+		e.TriggeredBy = trigger.CallerEmail
+		e.TriggerSourceIP = trigger.SourceIP
+		e.TriggerUserAgent = trigger.UserAgent
 	}
-	_, err := store.ds.Put(ctx, store.NewKey(ctx, ds2bqJobID), &e)
+	_, err := store.ds.Put(ctx, store.NewKey(ctx, form.JobID), &e)
 	if err != nil {
 		return nil, failure.Wrap(err)
 	}
@@ -122,63 +211,106 @@ func (store *DSExportJobStore) Get(ctx context.Context, ds2bqJobID string) (*DSE
 	return &e, nil
 }
 
-func (store *DSExportJobStore) StartExportJob(ctx context.Context, ds2bqJobID string, dsExportJobID string, retryCount int) (*DSExportJob, error) {
+// StartExportJob is Datastore Export Jobを開始した状態にする
+// 再実行 (retryCount > 0) の場合は、再実行したきっかけとしてtriggerを記録する
+// outboxを渡した場合は、同じTransactionでTaskOutboxも保存する
+func (store *DSExportJobStore) StartExportJob(ctx context.Context, ds2bqJobID string, dsExportJobID string, retryCount int, trigger *JobTrigger, outbox *TaskOutbox) (*DSExportJob, error) {
 	key := store.NewKey(ctx, ds2bqJobID)
 	var e DSExportJob
-	_, err := store.ds.RunInTransaction(ctx, func(tx datastore.Transaction) error {
+	_, err := RunInTransaction(ctx, store.ds, "DSExportJobStore.StartExportJob", func(tx datastore.Transaction) error {
 		if err := tx.Get(key, &e); err != nil {
 			return err
 		}
+		from := e.Status
 		e.DSExportJobIDs = append(e.DSExportJobIDs, dsExportJobID)
 		e.Status = DSExportJobStatusRunning
 		e.ChangeStatusAt = time.Now()
 		e.RetryCount = retryCount
+		if retryCount > 0 && trigger != nil {
+			e.RetryTriggerType = trigger.Type
+			e.RetryTriggeredBy = trigger.CallerEmail
+			e.RetriedAt = e.ChangeStatusAt
+		}
 
 		_, err := tx.Put(key, &e)
 		if err != nil {
 			return err
 		}
+		if err := putJobStatusEvent(tx, store.ds, key, NewDSExportJobStatusEvent(&e, from, dsExportJobID, "")); err != nil {
+			return err
+		}
+		if outbox != nil {
+			if _, err := tx.Put(outbox.Key, outbox); err != nil {
+				return err
+			}
+		}
 		return nil
-	})
+	}, trace.StringAttribute(SpanAttributeDS2BQJobID, ds2bqJobID))
 	if err != nil {
 		if err == datastore.ErrNoSuchEntity {
 			return nil, err
 		}
 		return nil, failure.Wrap(err, failure.Messagef("failed datastore.RunInTx() ds2bqJobID=%v", ds2bqJobID))
 	}
+	if retryCount > 0 {
+		RecordDSExportRetry(ctx, &e)
+	}
 	return &e, nil
 }
 
-func (store *DSExportJobStore) IncrementJobStatusCheckCount(ctx context.Context, ds2bqJobID string) (*DSExportJob, error) {
+// IncrementJobStatusCheckCount is checkSequence番目の状態確認を数え、同じTransactionで次の状態確認のTaskOutboxを保存する
+// 同じ状態確認のTaskが再配信された場合は、既に数えているので何もしない
+// Timeoutした場合は次の状態確認は不要なので、TaskOutboxは保存しない
+func (store *DSExportJobStore) IncrementJobStatusCheckCount(ctx context.Context, ds2bqJobID string, checkSequence int, outbox *TaskOutbox) (*DSExportJob, error) {
 	key := store.NewKey(ctx, ds2bqJobID)
 	var e DSExportJob
-	_, err := store.ds.RunInTransaction(ctx, func(tx datastore.Transaction) error {
+	var incremented bool
+	_, err := RunInTransaction(ctx, store.ds, "DSExportJobStore.IncrementJobStatusCheckCount", func(tx datastore.Transaction) error {
 		if err := tx.Get(key, &e); err != nil {
 			return err
 		}
-		e.StatusCheckCount++
-		_, err := tx.Put(key, &e)
-		if err != nil {
+		incremented = false
+		if e.StatusCheckCount > checkSequence {
+			return nil
+		}
+		e.StatusCheckCount = checkSequence + 1
+		if _, err := tx.Put(key, &e); err != nil {
 			return err
 		}
+		incremented = true
+		if outbox != nil && !e.IsTimedOut(time.Now()) {
+			if _, err := tx.Put(outbox.Key, outbox); err != nil {
+				return err
+			}
+		}
 		return nil
-	})
+	}, trace.StringAttribute(SpanAttributeDS2BQJobID, ds2bqJobID))
 	if err != nil {
 		if err == datastore.ErrNoSuchEntity {
 			return nil, err
 		}
 		return nil, failure.Wrap(err, failure.Messagef("failed datastore.RunInTx() ds2bqJobID=%v", ds2bqJobID))
 	}
+	if incremented {
+		RecordJobStatusCheck(ctx, JobTypeDSExport, e.ExportProjectID, "")
+	}
 	return &e, nil
 }
 
 func (store *DSExportJobStore) FinishExportJob(ctx context.Context, ds2bqJobID string, status DSExportJobStatus, dsExportJobID string, message string) (*DSExportJob, error) {
 	key := store.NewKey(ctx, ds2bqJobID)
 	var e DSExportJob
-	_, err := store.ds.RunInTransaction(ctx, func(tx datastore.Transaction) error {
+	var from DSExportJobStatus
+	var runningSince time.Time
+	_, err := RunInTransaction(ctx, store.ds, "DSExportJobStore.FinishExportJob", func(tx datastore.Transaction) error {
 		if err := tx.Get(key, &e); err != nil {
 			return err
 		}
+		if !e.Status.IsActive() {
+			return ErrJobFinished
+		}
+		from = e.Status
+		runningSince = e.ChangeStatusAt
 		e.Status = status
 		e.ChangeStatusAt = time.Now()
 		e.DSExportResponseMessages = append(e.DSExportResponseMessages, fmt.Sprintf("%s-_-%s", dsExportJobID, message))
@@ -186,8 +318,294 @@ func (store *DSExportJobStore) FinishExportJob(ctx context.Context, ds2bqJobID s
 		if err != nil {
 			return err
 		}
+		if err := putJobStatusEvent(tx, store.ds, key, NewDSExportJobStatusEvent(&e, from, dsExportJobID, message)); err != nil {
+			return err
+		}
+		return nil
+	}, trace.StringAttribute(SpanAttributeDS2BQJobID, ds2bqJobID))
+	if err != nil {
+		if err == datastore.ErrNoSuchEntity || err == ErrJobFinished {
+			return nil, err
+		}
+		return nil, failure.Wrap(err, failure.Messagef("failed datastore.RunInTx() ds2bqJobID=%v", ds2bqJobID))
+	}
+	RecordDSExportJobFinished(ctx, &e, from, runningSince)
+	return &e, nil
+}
+
+// Cancel is DSExportJobをCancelledにする
+// 既に終わっている場合は、状態確認のTaskが記録した状態を上書きしないように何もせずに false を返す
+func (store *DSExportJobStore) Cancel(ctx context.Context, ds2bqJobID string) (*DSExportJob, bool, error) {
+	key := store.NewKey(ctx, ds2bqJobID)
+	var e DSExportJob
+	var from DSExportJobStatus
+	var cancelled bool
+	var runningSince time.Time
+	_, err := RunInTransaction(ctx, store.ds, "DSExportJobStore.Cancel", func(tx datastore.Transaction) error {
+		cancelled = false
+		if err := tx.Get(key, &e); err != nil {
+			return err
+		}
+		if !e.Status.IsActive() {
+			return nil
+		}
+		from = e.Status
+		runningSince = e.ChangeStatusAt
+		e.Status = DSExportJobStatusCancelled
+		e.ChangeStatusAt = time.Now()
+		e.DSExportResponseMessages = append(e.DSExportResponseMessages, fmt.Sprintf("%s-_-%s", e.LatestDSExportJobID(), "cancelled"))
+		if _, err := tx.Put(key, &e); err != nil {
+			return err
+		}
+		if err := putJobStatusEvent(tx, store.ds, key, NewDSExportJobStatusEvent(&e, from, e.LatestDSExportJobID(), "cancelled")); err != nil {
+			return err
+		}
+		cancelled = true
+		return nil
+	}, trace.StringAttribute(SpanAttributeDS2BQJobID, ds2bqJobID))
+	if err != nil {
+		if err == datastore.ErrNoSuchEntity {
+			return nil, false, err
+		}
+		return nil, false, failure.Wrap(err, failure.Messagef("failed datastore.RunInTx() ds2bqJobID=%v", ds2bqJobID))
+	}
+	if cancelled {
+		RecordDSExportJobFinished(ctx, &e, from, runningSince)
+	}
+	return &e, cancelled, nil
+}
+
+// DeadLetter is DSExportJobをDeadLetteredにし、同じTransactionでDeadLetterTaskを保存する
+// Runningではない場合や、dsExportJobIDが最後に開始したDatastore Export Jobではない場合は何もせずに false を返す
+func (store *DSExportJobStore) DeadLetter(ctx context.Context, ds2bqJobID string, dsExportJobID string, dlt *DeadLetterTask, message string) (*DSExportJob, bool, error) {
+	key := store.NewKey(ctx, ds2bqJobID)
+	var e DSExportJob
+	var deadLettered bool
+	var runningSince time.Time
+	_, err := RunInTransaction(ctx, store.ds, "DSExportJobStore.DeadLetter", func(tx datastore.Transaction) error {
+		deadLettered = false
+		if err := tx.Get(key, &e); err != nil {
+			return err
+		}
+		if e.Status != DSExportJobStatusRunning || e.LatestDSExportJobID() != dsExportJobID {
+			return nil
+		}
+		runningSince = e.ChangeStatusAt
+		e.Status = DSExportJobStatusDeadLettered
+		e.ChangeStatusAt = time.Now()
+		e.DSExportResponseMessages = append(e.DSExportResponseMessages, fmt.Sprintf("%s-_-%s", dsExportJobID, message))
+		if _, err := tx.Put(key, &e); err != nil {
+			return err
+		}
+		if err := putJobStatusEvent(tx, store.ds, key, NewDSExportJobStatusEvent(&e, DSExportJobStatusRunning, dsExportJobID, message)); err != nil {
+			return err
+		}
+		if _, err := tx.Put(dlt.Key, dlt); err != nil {
+			return err
+		}
+		deadLettered = true
+		return nil
+	}, trace.StringAttribute(SpanAttributeDS2BQJobID, ds2bqJobID))
+	if err != nil {
+		if err == datastore.ErrNoSuchEntity {
+			return nil, false, err
+		}
+		return nil, false, failure.Wrap(err, failure.Messagef("failed datastore.RunInTx() ds2bqJobID=%v", ds2bqJobID))
+	}
+	if deadLettered {
+		RecordDSExportJobFinished(ctx, &e, DSExportJobStatusRunning, runningSince)
+	}
+	return &e, deadLettered, nil
+}
+
+// ListByStatus is statusのDSExportJobを返す
+func (store *DSExportJobStore) ListByStatus(ctx context.Context, status DSExportJobStatus) ([]*DSExportJob, error) {
+	b := NewDSExportJobQueryBuilder(store.ds)
+	b.Status.Equal(int(status))
+
+	var l []*DSExportJob
+	if _, err := store.ds.GetAll(ctx, b.Query(), &l); err != nil {
+		_, ok := err.(datastore.MultiError)
+		if ok {
+			return l, err
+		}
+		return nil, failure.Wrap(err, failure.Messagef("failed datastore.GetAll() status=%v", status))
+	}
+
+	return l, nil
+}
+
+// DSExportStatistics is Datastore Export JobがDoneになった時のMetadataから取り出した統計
+type DSExportStatistics struct {
+	OutputURLPrefix string
+	Entities        int64
+	Bytes           int64
+	StartTime       time.Time
+	EndTime         time.Time
+}
+
+// MarkSLOExceeded is SLO違反を通知した時刻を記録する
+// 既に記録されている場合は何もせずに false を返す. 記録した後の状態確認では通知しない
+func (store *DSExportJobStore) MarkSLOExceeded(ctx context.Context, ds2bqJobID string, now time.Time) (*DSExportJob, bool, error) {
+	key := store.NewKey(ctx, ds2bqJobID)
+	var e DSExportJob
+	var marked bool
+	_, err := RunInTransaction(ctx, store.ds, "DSExportJobStore.MarkSLOExceeded", func(tx datastore.Transaction) error {
+		marked = false
+		if err := tx.Get(key, &e); err != nil {
+			return err
+		}
+		if !e.SLOExceededAt.IsZero() {
+			return nil
+		}
+		e.SLOExceededAt = now
+		if _, err := tx.Put(key, &e); err != nil {
+			return err
+		}
+		marked = true
+		return nil
+	}, trace.StringAttribute(SpanAttributeDS2BQJobID, ds2bqJobID))
+	if err != nil {
+		if err == datastore.ErrNoSuchEntity {
+			return nil, false, err
+		}
+		return nil, false, failure.Wrap(err, failure.Messagef("failed datastore.RunInTx() ds2bqJobID=%v", ds2bqJobID))
+	}
+	if marked {
+		RecordJobSLOExceeded(ctx, JobTypeDSExport, e.ExportProjectID, "")
+	}
+	return &e, marked, nil
+}
+
+// ClaimRunHistory is Runの履歴を書き込む前に RunHistoryWrittenAt を記録する
+// 既に記録されている場合は、他のRequestが書き込んでいるので false を返す
+func (store *DSExportJobStore) ClaimRunHistory(ctx context.Context, ds2bqJobID string, now time.Time) (*DSExportJob, bool, error) {
+	key := store.NewKey(ctx, ds2bqJobID)
+	var e DSExportJob
+	var claimed bool
+	_, err := RunInTransaction(ctx, store.ds, "DSExportJobStore.ClaimRunHistory", func(tx datastore.Transaction) error {
+		claimed = false
+		if err := tx.Get(key, &e); err != nil {
+			return err
+		}
+		if !e.RunHistoryWrittenAt.IsZero() {
+			return nil
+		}
+		e.RunHistoryWrittenAt = now
+		if _, err := tx.Put(key, &e); err != nil {
+			return err
+		}
+		claimed = true
+		return nil
+	}, trace.StringAttribute(SpanAttributeDS2BQJobID, ds2bqJobID))
+	if err != nil {
+		if err == datastore.ErrNoSuchEntity {
+			return nil, false, err
+		}
+		return nil, false, failure.Wrap(err, failure.Messagef("failed datastore.RunInTx() ds2bqJobID=%v", ds2bqJobID))
+	}
+	return &e, claimed, nil
+}
+
+// UnclaimRunHistory is Runの履歴の書き込みに失敗した時に RunHistoryWrittenAt を消して、書き込み直せるようにする
+func (store *DSExportJobStore) UnclaimRunHistory(ctx context.Context, ds2bqJobID string) error {
+	key := store.NewKey(ctx, ds2bqJobID)
+	_, err := RunInTransaction(ctx, store.ds, "DSExportJobStore.UnclaimRunHistory", func(tx datastore.Transaction) error {
+		var e DSExportJob
+		if err := tx.Get(key, &e); err != nil {
+			return err
+		}
+		e.RunHistoryWrittenAt = time.Time{}
+		_, err := tx.Put(key, &e)
+		return err
+	}, trace.StringAttribute(SpanAttributeDS2BQJobID, ds2bqJobID))
+	if err != nil {
+		return failure.Wrap(err, failure.Messagef("failed datastore.RunInTx() ds2bqJobID=%v", ds2bqJobID))
+	}
+	return nil
+}
+
+// SetExportStatistics is Datastore Export Jobの出力先と統計を記録する
+func (store *DSExportJobStore) SetExportStatistics(ctx context.Context, ds2bqJobID string, stats *DSExportStatistics) (*DSExportJob, error) {
+	key := store.NewKey(ctx, ds2bqJobID)
+	var e DSExportJob
+	_, err := RunInTransaction(ctx, store.ds, "DSExportJobStore.SetExportStatistics", func(tx datastore.Transaction) error {
+		if err := tx.Get(key, &e); err != nil {
+			return err
+		}
+		e.OutputURLPrefix = stats.OutputURLPrefix
+		e.ExportedEntities = stats.Entities
+		e.ExportedBytes = stats.Bytes
+		e.ExportStartedAt = stats.StartTime
+		e.ExportEndedAt = stats.EndTime
+		_, err := tx.Put(key, &e)
+		if err != nil {
+			return err
+		}
+		return nil
+	}, trace.StringAttribute(SpanAttributeDS2BQJobID, ds2bqJobID))
+	if err != nil {
+		if err == datastore.ErrNoSuchEntity {
+			return nil, err
+		}
+		return nil, failure.Wrap(err, failure.Messagef("failed datastore.RunInTx() ds2bqJobID=%v", ds2bqJobID))
+	}
+	return &e, nil
+}
+
+// RecordCheckTaskAttempt is 状態確認のTaskの試行回数を記録する
+func (store *DSExportJobStore) RecordCheckTaskAttempt(ctx context.Context, ds2bqJobID string, attempt TaskAttempt) (*DSExportJob, error) {
+	key := store.NewKey(ctx, ds2bqJobID)
+	var e DSExportJob
+	_, err := RunInTransaction(ctx, store.ds, "DSExportJobStore.RecordCheckTaskAttempt", func(tx datastore.Transaction) error {
+		if err := tx.Get(key, &e); err != nil {
+			return err
+		}
+		e.CheckTaskRetryCount = attempt.RetryCount
+		e.CheckTaskExecutionCount = attempt.ExecutionCount
+		_, err := tx.Put(key, &e)
+		if err != nil {
+			return err
+		}
+		return nil
+	}, trace.StringAttribute(SpanAttributeDS2BQJobID, ds2bqJobID))
+	if err != nil {
+		if err == datastore.ErrNoSuchEntity {
+			return nil, err
+		}
+		return nil, failure.Wrap(err, failure.Messagef("failed datastore.RunInTx() ds2bqJobID=%v", ds2bqJobID))
+	}
+	return &e, nil
+}
+
+// ReplayCheck is DeadLetteredのDSExportJobをRunningに戻し、同じTransactionでTaskOutboxを保存する
+// StatusCheckCountはcheckSequenceにして、Replayした状態確認のTaskのIDが以前のTaskと重ならないようにする
+func (store *DSExportJobStore) ReplayCheck(ctx context.Context, ds2bqJobID string, checkSequence int, outbox *TaskOutbox) (*DSExportJob, error) {
+	key := store.NewKey(ctx, ds2bqJobID)
+	var e DSExportJob
+	_, err := RunInTransaction(ctx, store.ds, "DSExportJobStore.ReplayCheck", func(tx datastore.Transaction) error {
+		if err := tx.Get(key, &e); err != nil {
+			return err
+		}
+		if e.Status != DSExportJobStatusDeadLettered {
+			return failure.New(StatusConflict, failure.Messagef("ds2bqJobID=%v is not DeadLettered. status=%v", ds2bqJobID, e.Status))
+		}
+		e.Status = DSExportJobStatusRunning
+		e.ChangeStatusAt = time.Now()
+		e.StatusCheckCount = checkSequence
+		e.CheckTaskRetryCount = 0
+		e.CheckTaskExecutionCount = 0
+		if _, err := tx.Put(key, &e); err != nil {
+			return err
+		}
+		if err := putJobStatusEvent(tx, store.ds, key, NewDSExportJobStatusEvent(&e, DSExportJobStatusDeadLettered, e.LatestDSExportJobID(), "replay")); err != nil {
+			return err
+		}
+		if _, err := tx.Put(outbox.Key, outbox); err != nil {
+			return err
+		}
 		return nil
-	})
+	}, trace.StringAttribute(SpanAttributeDS2BQJobID, ds2bqJobID))
 	if err != nil {
 		if err == datastore.ErrNoSuchEntity {
 			return nil, err
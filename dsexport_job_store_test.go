@@ -5,9 +5,12 @@ import (
 	"encoding/json"
 	"fmt"
 	"testing"
+	"time"
 
 	cds "cloud.google.com/go/datastore"
+	"github.com/gcpug/ds2bq/datastore"
 	"github.com/google/uuid"
+	mds "go.mercari.io/datastore"
 	"go.mercari.io/datastore/clouddatastore"
 )
 
@@ -40,7 +43,7 @@ func TestDSExportJobStore_Lifecycle(t *testing.T) {
 
 	ds2bqJobID := s.NewDS2BQJobID(ctx)
 	{
-		job, err := s.Create(ctx, ds2bqJobID, string(body), req.ProjectID, []string{}, []string{"PugEvent"})
+		job, err := s.Create(ctx, &DSExportJobCreateForm{JobID: ds2bqJobID, Body: string(body), ExportProjectID: req.ProjectID, Kinds: []string{"PugEvent"}})
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -55,7 +58,7 @@ func TestDSExportJobStore_Lifecycle(t *testing.T) {
 
 	const dsExportJobID = "dummyDatastoreExportJobID"
 	{
-		job, err := s.StartExportJob(ctx, ds2bqJobID, dsExportJobID, 0)
+		job, err := s.StartExportJob(ctx, ds2bqJobID, dsExportJobID, 0, nil, nil)
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -102,16 +105,343 @@ func TestDSExportJobStore_IncrementJobStatusCheckCount(t *testing.T) {
 	}
 
 	ds2bqJobID := s.NewDS2BQJobID(ctx)
-	_, err = s.Create(ctx, ds2bqJobID, "", "", []string{}, []string{})
+	_, err = s.Create(ctx, &DSExportJobCreateForm{JobID: ds2bqJobID})
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	job, err := s.IncrementJobStatusCheckCount(ctx, ds2bqJobID)
+	job, err := s.IncrementJobStatusCheckCount(ctx, ds2bqJobID, 0, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
 	if e, g := 1, job.StatusCheckCount; e != g {
 		t.Errorf("want StatusCheckCount is %v but got %v", e, g)
 	}
+
+	// 同じ状態確認のTaskが再配信されても数えない
+	job, err = s.IncrementJobStatusCheckCount(ctx, ds2bqJobID, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, g := 1, job.StatusCheckCount; e != g {
+		t.Errorf("redelivered want StatusCheckCount is %v but got %v", e, g)
+	}
+
+	job, err = s.IncrementJobStatusCheckCount(ctx, ds2bqJobID, 1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, g := 2, job.StatusCheckCount; e != g {
+		t.Errorf("want StatusCheckCount is %v but got %v", e, g)
+	}
+}
+
+func TestDSExportJobStore_SetExportStatistics(t *testing.T) {
+	ctx := context.Background()
+
+	cdsc, err := cds.NewClient(ctx, uuid.New().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ds, err := clouddatastore.FromClient(ctx, cdsc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := NewDSExportJobStore(ctx, ds)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ds2bqJobID := s.NewDS2BQJobID(ctx)
+	_, err = s.Create(ctx, &DSExportJobCreateForm{JobID: ds2bqJobID})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Datastore Export JobがDoneになった時のOperationのMetadata
+	const metadata = `{
+  "common": {"startTime": "2019-07-01T01:00:00.123456Z", "endTime": "2019-07-01T01:12:34.567890Z", "operationType": "EXPORT_ENTITIES", "state": "SUCCESSFUL"},
+  "progressEntities": {"workCompleted": "12345", "workEstimated": "12000"},
+  "progressBytes": {"workCompleted": "67890", "workEstimated": "60000"},
+  "entityFilter": {"kinds": ["PugEvent"]},
+  "outputUrlPrefix": "gs://datastore-backup-gcpugjp-dev/2019-07-01T01:00:00_12345"
+}`
+	var meta datastore.ExportOperationResponseMetadata
+	if err := json.Unmarshal([]byte(metadata), &meta); err != nil {
+		t.Fatal(err)
+	}
+
+	job, err := s.SetExportStatistics(ctx, ds2bqJobID, NewDSExportStatistics(&meta))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, g := "gs://datastore-backup-gcpugjp-dev/2019-07-01T01:00:00_12345", job.OutputURLPrefix; e != g {
+		t.Errorf("want OutputURLPrefix is %v but got %v", e, g)
+	}
+	if e, g := int64(12345), job.ExportedEntities; e != g {
+		t.Errorf("want ExportedEntities is %v but got %v", e, g)
+	}
+	if e, g := int64(67890), job.ExportedBytes; e != g {
+		t.Errorf("want ExportedBytes is %v but got %v", e, g)
+	}
+	if e, g := time.Date(2019, 7, 1, 1, 0, 0, 123456000, time.UTC), job.ExportStartedAt; !e.Equal(g) {
+		t.Errorf("want ExportStartedAt is %v but got %v", e, g)
+	}
+	if e, g := time.Date(2019, 7, 1, 1, 12, 34, 567890000, time.UTC), job.ExportEndedAt; !e.Equal(g) {
+		t.Errorf("want ExportEndedAt is %v but got %v", e, g)
+	}
+}
+
+func TestDSExportJobStore_ClaimRunHistory(t *testing.T) {
+	ctx := context.Background()
+
+	cdsc, err := cds.NewClient(ctx, uuid.New().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ds, err := clouddatastore.FromClient(ctx, cdsc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := NewDSExportJobStore(ctx, ds)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ds2bqJobID := s.NewDS2BQJobID(ctx)
+	_, err = s.Create(ctx, &DSExportJobCreateForm{JobID: ds2bqJobID})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Date(2019, 7, 1, 2, 0, 0, 0, time.UTC)
+	job, claimed, err := s.ClaimRunHistory(ctx, ds2bqJobID, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !claimed {
+		t.Fatal("want claimed but not claimed")
+	}
+	if e, g := now, job.RunHistoryWrittenAt; !e.Equal(g) {
+		t.Errorf("want RunHistoryWrittenAt is %v but got %v", e, g)
+	}
+
+	// 2回目は他のRequestが書き込んでいるので claimed にならない
+	job, claimed, err = s.ClaimRunHistory(ctx, ds2bqJobID, now.Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claimed {
+		t.Error("want not claimed but claimed")
+	}
+	if e, g := now, job.RunHistoryWrittenAt; !e.Equal(g) {
+		t.Errorf("want RunHistoryWrittenAt is %v but got %v", e, g)
+	}
+
+	// 書き込みに失敗した時はUnclaimして、書き込み直せるようにする
+	if err := s.UnclaimRunHistory(ctx, ds2bqJobID); err != nil {
+		t.Fatal(err)
+	}
+	_, claimed, err = s.ClaimRunHistory(ctx, ds2bqJobID, now.Add(2*time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !claimed {
+		t.Error("want claimed after unclaim but not claimed")
+	}
+}
+
+func TestDSExportJobStore_DeadLetter(t *testing.T) {
+	ctx := context.Background()
+
+	cdsc, err := cds.NewClient(ctx, uuid.New().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ds, err := clouddatastore.FromClient(ctx, cdsc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := NewDSExportJobStore(ctx, ds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dltS, err := NewDeadLetterTaskStore(ctx, ds)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ds2bqJobID := s.NewDS2BQJobID(ctx)
+	if _, err := s.Create(ctx, &DSExportJobCreateForm{JobID: ds2bqJobID}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.StartExportJob(ctx, ds2bqJobID, "old", 0, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.StartExportJob(ctx, ds2bqJobID, "new", 1, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// Retryする前のDatastore Export Jobの状態確認のTaskではDeadLetteredにしない
+	dlt, err := dltS.New(TaskOutboxQueueDatastoreExportJobCheck, &DatastoreExportJobCheckRequest{DS2BQJobID: ds2bqJobID, DatastoreExportJobID: "old"}, ds2bqJobID, "", TaskAttempt{RetryCount: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	job, deadLettered, err := s.DeadLetter(ctx, ds2bqJobID, "old", dlt, "dead lettered")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deadLettered {
+		t.Error("want not dead lettered but dead lettered")
+	}
+	if e, g := DSExportJobStatusRunning, job.Status; e != g {
+		t.Errorf("want Status is %v but got %v", e, g)
+	}
+	if _, err := dltS.Get(ctx, dlt.ID); err != mds.ErrNoSuchEntity {
+		t.Errorf("want DeadLetterTask is not saved but got err=%v", err)
+	}
+
+	dlt, err = dltS.New(TaskOutboxQueueDatastoreExportJobCheck, &DatastoreExportJobCheckRequest{DS2BQJobID: ds2bqJobID, DatastoreExportJobID: "new"}, ds2bqJobID, "", TaskAttempt{RetryCount: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	job, deadLettered, err = s.DeadLetter(ctx, ds2bqJobID, "new", dlt, "dead lettered")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !deadLettered {
+		t.Error("want dead lettered but not dead lettered")
+	}
+	if e, g := DSExportJobStatusDeadLettered, job.Status; e != g {
+		t.Errorf("want Status is %v but got %v", e, g)
+	}
+	saved, err := dltS.Get(ctx, dlt.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, g := ds2bqJobID, saved.DS2BQJobID; e != g {
+		t.Errorf("want DS2BQJobID is %v but got %v", e, g)
+	}
+}
+
+func TestDSExportJobStore_Cancel(t *testing.T) {
+	ctx := context.Background()
+
+	cdsc, err := cds.NewClient(ctx, uuid.New().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ds, err := clouddatastore.FromClient(ctx, cdsc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := NewDSExportJobStore(ctx, ds)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ds2bqJobID := s.NewDS2BQJobID(ctx)
+	if _, err := s.Create(ctx, &DSExportJobCreateForm{JobID: ds2bqJobID}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.StartExportJob(ctx, ds2bqJobID, "operation", 0, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	job, cancelled, err := s.Cancel(ctx, ds2bqJobID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cancelled {
+		t.Error("want cancelled but not cancelled")
+	}
+	if e, g := DSExportJobStatusCancelled, job.Status; e != g {
+		t.Errorf("want Status is %v but got %v", e, g)
+	}
+
+	// Cancelした後に状態確認のTaskがJobを終わらせようとしても上書きしない
+	if _, err := s.FinishExportJob(ctx, ds2bqJobID, DSExportJobStatusDone, "operation", ""); err != ErrJobFinished {
+		t.Errorf("want ErrJobFinished but got %v", err)
+	}
+	_, cancelled, err = s.Cancel(ctx, ds2bqJobID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cancelled {
+		t.Error("want not cancelled but cancelled")
+	}
+	job, err = s.Get(ctx, ds2bqJobID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, g := DSExportJobStatusCancelled, job.Status; e != g {
+		t.Errorf("want Status is %v but got %v", e, g)
+	}
+}
+
+func TestDSExportJobStore_RetryAfterFail(t *testing.T) {
+	ctx := context.Background()
+
+	cdsc, err := cds.NewClient(ctx, uuid.New().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ds, err := clouddatastore.FromClient(ctx, cdsc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := NewDSExportJobStore(ctx, ds)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ds2bqJobID := s.NewDS2BQJobID(ctx)
+	trigger := &JobTrigger{Type: JobTriggerTypeScheduler, CallerEmail: "scheduler@gcpug-ds2bq-dev.iam.gserviceaccount.com"}
+	if _, err := s.Create(ctx, &DSExportJobCreateForm{JobID: ds2bqJobID, MaxRetryCount: 1, Trigger: trigger}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.StartExportJob(ctx, ds2bqJobID, "operation1", 0, trigger, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// 状態確認のTaskがFailを見つけた時と同じように、Failedにしてから同じDS2BQJobIDで再実行する
+	if _, err := s.FinishExportJob(ctx, ds2bqJobID, DSExportJobStatusFailed, "operation1", "Code=13"); err != nil {
+		t.Fatal(err)
+	}
+	retry := &JobTrigger{Type: JobTriggerTypeRetry}
+	if _, err := s.StartExportJob(ctx, ds2bqJobID, "operation2", 1, retry, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	job, err := s.Get(ctx, ds2bqJobID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, g := DSExportJobStatusRunning, job.Status; e != g {
+		t.Errorf("want Status is %v but got %v", e, g)
+	}
+	if e, g := []string{"operation1", "operation2"}, job.DSExportJobIDs; fmt.Sprint(e) != fmt.Sprint(g) {
+		t.Errorf("want DSExportJobIDs is %v but got %v", e, g)
+	}
+	if e, g := 1, job.RetryCount; e != g {
+		t.Errorf("want RetryCount is %v but got %v", e, g)
+	}
+	if e, g := JobTriggerTypeRetry, job.RetryTriggerType; e != g {
+		t.Errorf("want RetryTriggerType is %v but got %v", e, g)
+	}
+	if job.RetriedAt.IsZero() {
+		t.Error("want RetriedAt is recorded but zero")
+	}
+	// Jobを開始した時の記録は残す
+	if e, g := JobTriggerTypeScheduler, job.TriggerType; e != g {
+		t.Errorf("want TriggerType is %v but got %v", e, g)
+	}
+	if e, g := trigger.CallerEmail, job.TriggeredBy; e != g {
+		t.Errorf("want TriggeredBy is %v but got %v", e, g)
+	}
 }
@@ -1,6 +1,68 @@
 package main
 
-import "github.com/morikuni/failure"
+import (
+	"errors"
+	"net/http"
 
+	"github.com/morikuni/failure"
+	"go.mercari.io/datastore"
+)
+
+// failure.Codeの値は ErrorDetail.Code としてClientに返すので、HTTP StatusのText ( http.StatusText ) から空白を除いた名前にそろえる
 var StatusInternalServerError failure.StringCode = "InternalServerError"
-var StatusConflict failure.StringCode = "StatusConflict"
+var StatusBadRequest failure.StringCode = "BadRequest"
+var StatusConflict failure.StringCode = "Conflict"
+var StatusNotFound failure.StringCode = "NotFound"
+var StatusUnauthorized failure.StringCode = "Unauthorized"
+var StatusForbidden failure.StringCode = "Forbidden"
+
+// ErrJobFinished is 既に終わっているJobの状態を変えようとした時にStoreが返すエラー
+// Cancelした後に状態確認のTaskがJobを上書きしないようにする
+var ErrJobFinished = errors.New("job is already finished")
+
+// HTTPStatusCode is errのfailure.CodeをHTTP Status Codeに変換する
+// Codeが無い場合は500
+func HTTPStatusCode(err error) int {
+	code, ok := failure.CodeOf(err)
+	if !ok {
+		return http.StatusInternalServerError
+	}
+	switch code {
+	case StatusBadRequest:
+		return http.StatusBadRequest
+	case StatusNotFound:
+		return http.StatusNotFound
+	case StatusConflict:
+		return http.StatusConflict
+	case StatusUnauthorized:
+		return http.StatusUnauthorized
+	case StatusForbidden:
+		return http.StatusForbidden
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// TaskHTTPStatusCode is Cloud TasksのTaskを処理した時のerrをHTTP Status Codeに変換する
+// Cloud Tasksは2xx以外を返すとRetryするので、Retryしても成功しない BadRequest, NotFound は200を返してTaskを捨てる
+func TaskHTTPStatusCode(err error) int {
+	if err == nil || IsTerminalTaskError(err) {
+		return http.StatusOK
+	}
+	return HTTPStatusCode(err)
+}
+
+// IsTerminalTaskError is Retryしても成功しないTaskのエラーかを返す
+func IsTerminalTaskError(err error) bool {
+	return failure.Is(err, StatusBadRequest, StatusNotFound)
+}
+
+// StoreErrorCode is Storeが返したerrのfailure.Codeを返す
+// Entityが削除されている場合や、Jobが既に終わっている場合はRetryしても成功しないので StatusNotFound, それ以外は StatusInternalServerError
+// failure.Wrap で包まれている場合も、原因のエラーで判定する
+func StoreErrorCode(err error) failure.StringCode {
+	if cause := failure.CauseOf(err); cause == datastore.ErrNoSuchEntity || cause == ErrJobFinished {
+		return StatusNotFound
+	}
+	return StatusInternalServerError
+}
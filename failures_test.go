@@ -0,0 +1,43 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/morikuni/failure"
+	"go.mercari.io/datastore"
+)
+
+func TestHTTPStatusCode(t *testing.T) {
+	cases := []struct {
+		name     string
+		err      error
+		want     int
+		wantTask int
+	}{
+		{"no code", errors.New("hoge"), http.StatusInternalServerError, http.StatusInternalServerError},
+		{"internal server error", failure.New(StatusInternalServerError), http.StatusInternalServerError, http.StatusInternalServerError},
+		{"bad request", failure.New(StatusBadRequest), http.StatusBadRequest, http.StatusOK},
+		{"not found", failure.New(StatusNotFound), http.StatusNotFound, http.StatusOK},
+		{"conflict", failure.New(StatusConflict), http.StatusConflict, http.StatusConflict},
+		{"unauthorized", failure.New(StatusUnauthorized), http.StatusUnauthorized, http.StatusUnauthorized},
+		{"forbidden", failure.New(StatusForbidden), http.StatusForbidden, http.StatusForbidden},
+		{"no such entity", failure.New(StoreErrorCode(datastore.ErrNoSuchEntity)), http.StatusNotFound, http.StatusOK},
+		{"job finished", failure.New(StoreErrorCode(ErrJobFinished)), http.StatusNotFound, http.StatusOK},
+		{"wrapped no such entity", failure.New(StoreErrorCode(failure.Wrap(datastore.ErrNoSuchEntity))), http.StatusNotFound, http.StatusOK},
+		{"store error", failure.New(StoreErrorCode(errors.New("hoge"))), http.StatusInternalServerError, http.StatusInternalServerError},
+	}
+
+	for _, tt := range cases {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			if e, g := tt.want, HTTPStatusCode(tt.err); e != g {
+				t.Errorf("HTTPStatusCode want %v but got %v", e, g)
+			}
+			if e, g := tt.wantTask, TaskHTTPStatusCode(tt.err); e != g {
+				t.Errorf("TaskHTTPStatusCode want %v but got %v", e, g)
+			}
+		})
+	}
+}
@@ -7,6 +7,7 @@ require (
 	cloud.google.com/go/bigquery v1.0.1
 	cloud.google.com/go/datastore v1.0.0
 	contrib.go.opencensus.io/exporter/stackdriver v0.12.5
+	github.com/golang/protobuf v1.3.2
 	github.com/google/pprof v0.0.0-20190723021845-34ac40c74b70 // indirect
 	github.com/google/uuid v1.1.1
 	github.com/googleapis/gax-go/v2 v2.0.5
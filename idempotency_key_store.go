@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/morikuni/failure"
+	"go.mercari.io/datastore"
+	"go.opencensus.io/trace"
+)
+
+// DefaultIdempotencyKeyWindow is IdempotencyKeyを有効とみなすデフォルトの期間
+const DefaultIdempotencyKeyWindow = 24 * time.Hour
+
+// DefaultIdempotencyKeyRunningLease is Runningのままの同じIdempotencyKeyを実行中とみなすデフォルトの期間
+// Requestが途中で落ちてRunningのまま残った場合でも、この期間を過ぎると同じIdempotencyKeyで再実行できる
+const DefaultIdempotencyKeyRunningLease = 10 * time.Minute
+
+type IdempotencyKeyStore struct {
+	ds datastore.Client
+}
+
+func NewIdempotencyKeyStore(ctx context.Context, client datastore.Client) (*IdempotencyKeyStore, error) {
+	return &IdempotencyKeyStore{
+		ds: client,
+	}, nil
+}
+
+type IdempotencyKeyStatus int
+
+const (
+	IdempotencyKeyStatusDefault IdempotencyKeyStatus = iota
+	IdempotencyKeyStatusRunning
+	IdempotencyKeyStatusDone
+	IdempotencyKeyStatusQueued // RunLockPolicyQueueで待っている. 待っているRunを開始した時にDoneになる
+)
+
+// IdempotencyKey is Datastore Export Requestの重複実行を防ぐためのEntity
+// KeyのNameは ExportProjectID-_-IdempotencyKey
+type IdempotencyKey struct {
+	ID                    string `datastore:"-"`
+	ExportProjectID       string
+	Status                IdempotencyKeyStatus
+	DS2BQJobIDs           []string `datastore:",noindex"`
+	DatastoreExportJobIDs []string `datastore:",noindex"` // DS2BQJobIDsと同じ順番で格納される
+	ExpireAt              time.Time
+	RunningLeaseExpireAt  time.Time // Runningのままこの時刻を過ぎたら、Requestが途中で落ちたとみなして確保し直す
+	CreatedAt             time.Time
+	UpdatedAt             time.Time
+	SchemaVersion         int
+}
+
+var _ datastore.PropertyLoadSaver = &IdempotencyKey{}
+var _ datastore.KeyLoader = &IdempotencyKey{}
+
+// LoadKey is Entity Load時にKeyを設定する
+func (e *IdempotencyKey) LoadKey(ctx context.Context, k datastore.Key) error {
+	e.ID = k.Name()
+
+	return nil
+}
+
+// Load is Entity Load時に呼ばれる
+func (e *IdempotencyKey) Load(ctx context.Context, ps []datastore.Property) error {
+	err := datastore.LoadStruct(ctx, e, ps)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Save is Entity Save時に呼ばれる
+func (e *IdempotencyKey) Save(ctx context.Context) ([]datastore.Property, error) {
+	if e.CreatedAt.IsZero() {
+		e.CreatedAt = time.Now()
+	}
+	e.UpdatedAt = time.Now()
+	e.SchemaVersion = 2
+
+	return datastore.SaveStruct(ctx, e)
+}
+
+// IsReserved is IdempotencyKeyが確保されていて、同じKeyのRequestを実行してはいけないかを返す
+func (e *IdempotencyKey) IsReserved(now time.Time) bool {
+	if !now.Before(e.ExpireAt) {
+		return false
+	}
+	if e.Status == IdempotencyKeyStatusRunning && !e.RunningLeaseExpireAt.IsZero() && !now.Before(e.RunningLeaseExpireAt) {
+		return false
+	}
+	return true
+}
+
+// IdempotencyKeyWindow is 環境変数 IDEMPOTENCY_KEY_WINDOW から同じIdempotencyKeyを重複とみなす期間を返す
+func IdempotencyKeyWindow() (time.Duration, error) {
+	v := os.Getenv("IDEMPOTENCY_KEY_WINDOW")
+	if len(v) < 1 {
+		return DefaultIdempotencyKeyWindow, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return 0, failure.Wrap(err, failure.Messagef("invalid IDEMPOTENCY_KEY_WINDOW=%v", v))
+	}
+	return d, nil
+}
+
+// IdempotencyKeyRunningLease is 環境変数 IDEMPOTENCY_KEY_RUNNING_LEASE からRunningのIdempotencyKeyを実行中とみなす期間を返す
+func IdempotencyKeyRunningLease() (time.Duration, error) {
+	v := os.Getenv("IDEMPOTENCY_KEY_RUNNING_LEASE")
+	if len(v) < 1 {
+		return DefaultIdempotencyKeyRunningLease, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return 0, failure.Wrap(err, failure.Messagef("invalid IDEMPOTENCY_KEY_RUNNING_LEASE=%v", v))
+	}
+	return d, nil
+}
+
+func (store *IdempotencyKeyStore) NewKey(ctx context.Context, exportProjectID string, idempotencyKey string) datastore.Key {
+	return store.ds.NameKey("IdempotencyKey", fmt.Sprintf("%s-_-%s", exportProjectID, idempotencyKey), nil)
+}
+
+// Reserve is IdempotencyKeyを確保する
+// 有効期間内の同じKeyが既に存在する場合は、既存のEntityと false を返す
+// Runningのままleaseを過ぎたKeyは、Requestが途中で落ちたとみなして確保し直す
+func (store *IdempotencyKeyStore) Reserve(ctx context.Context, exportProjectID string, idempotencyKey string, window time.Duration, lease time.Duration) (*IdempotencyKey, bool, error) {
+	key := store.NewKey(ctx, exportProjectID, idempotencyKey)
+	var e IdempotencyKey
+	var reserved bool
+	_, err := RunInTransaction(ctx, store.ds, "IdempotencyKeyStore.Reserve", func(tx datastore.Transaction) error {
+		reserved = false
+		err := tx.Get(key, &e)
+		if err != nil && err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		now := time.Now()
+		if err == nil && e.IsReserved(now) {
+			return nil
+		}
+
+		e = IdempotencyKey{
+			ID:                    key.Name(),
+			ExportProjectID:       exportProjectID,
+			Status:                IdempotencyKeyStatusRunning,
+			DS2BQJobIDs:           []string{},
+			DatastoreExportJobIDs: []string{},
+			ExpireAt:              now.Add(window),
+			RunningLeaseExpireAt:  now.Add(lease),
+		}
+		if _, err := tx.Put(key, &e); err != nil {
+			return err
+		}
+		reserved = true
+		return nil
+	}, trace.StringAttribute(SpanAttributeExportProjectID, exportProjectID))
+	if err != nil {
+		return nil, false, failure.Wrap(err, failure.Messagef("failed datastore.RunInTx() idempotencyKey=%v", key.Name()))
+	}
+	return &e, reserved, nil
+}
+
+// Complete is IdempotencyKeyに実行結果のIDを記録する
+func (store *IdempotencyKeyStore) Complete(ctx context.Context, exportProjectID string, idempotencyKey string, ds2bqJobIDs []string, dsExportJobIDs []string) (*IdempotencyKey, error) {
+	key := store.NewKey(ctx, exportProjectID, idempotencyKey)
+	var e IdempotencyKey
+	_, err := RunInTransaction(ctx, store.ds, "IdempotencyKeyStore.Complete", func(tx datastore.Transaction) error {
+		if err := tx.Get(key, &e); err != nil {
+			return err
+		}
+		e.Status = IdempotencyKeyStatusDone
+		e.DS2BQJobIDs = ds2bqJobIDs
+		e.DatastoreExportJobIDs = dsExportJobIDs
+		_, err := tx.Put(key, &e)
+		if err != nil {
+			return err
+		}
+		return nil
+	}, trace.StringAttribute(SpanAttributeExportProjectID, exportProjectID))
+	if err != nil {
+		if err == datastore.ErrNoSuchEntity {
+			return nil, err
+		}
+		return nil, failure.Wrap(err, failure.Messagef("failed datastore.RunInTx() idempotencyKey=%v", key.Name()))
+	}
+	return &e, nil
+}
+
+// MarkQueued is IdempotencyKeyをRunLockPolicyQueueで待っている状態にする
+// 待っている間はRunningのleaseで確保し直されないようにする
+func (store *IdempotencyKeyStore) MarkQueued(ctx context.Context, exportProjectID string, idempotencyKey string) (*IdempotencyKey, error) {
+	key := store.NewKey(ctx, exportProjectID, idempotencyKey)
+	var e IdempotencyKey
+	_, err := RunInTransaction(ctx, store.ds, "IdempotencyKeyStore.MarkQueued", func(tx datastore.Transaction) error {
+		if err := tx.Get(key, &e); err != nil {
+			return err
+		}
+		e.Status = IdempotencyKeyStatusQueued
+		_, err := tx.Put(key, &e)
+		if err != nil {
+			return err
+		}
+		return nil
+	}, trace.StringAttribute(SpanAttributeExportProjectID, exportProjectID))
+	if err != nil {
+		if err == datastore.ErrNoSuchEntity {
+			return nil, err
+		}
+		return nil, failure.Wrap(err, failure.Messagef("failed datastore.RunInTx() idempotencyKey=%v", key.Name()))
+	}
+	return &e, nil
+}
+
+// Release is 処理に失敗した時にIdempotencyKeyを削除して、再実行できるようにする
+func (store *IdempotencyKeyStore) Release(ctx context.Context, exportProjectID string, idempotencyKey string) error {
+	key := store.NewKey(ctx, exportProjectID, idempotencyKey)
+	if err := store.ds.Delete(ctx, key); err != nil {
+		return failure.Wrap(err, failure.Messagef("failed datastore.Delete() idempotencyKey=%v", key.Name()))
+	}
+	return nil
+}
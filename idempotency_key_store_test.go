@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	cds "cloud.google.com/go/datastore"
+	"github.com/google/uuid"
+	"go.mercari.io/datastore/clouddatastore"
+)
+
+func TestIdempotencyKeyStore_Lifecycle(t *testing.T) {
+	ctx := context.Background()
+
+	cdsc, err := cds.NewClient(ctx, uuid.New().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ds, err := clouddatastore.FromClient(ctx, cdsc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := NewIdempotencyKeyStore(ctx, ds)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const projectID = "gcpugjp-dev"
+	const idempotencyKey = "scheduler-2019-08-30"
+	{
+		ik, reserved, err := s.Reserve(ctx, projectID, idempotencyKey, time.Hour, time.Hour)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reserved {
+			t.Fatal("want reserved but not reserved")
+		}
+		if e, g := IdempotencyKeyStatusRunning, ik.Status; e != g {
+			t.Fatalf("want Status is %v but got %v", e, g)
+		}
+	}
+
+	{
+		ik, reserved, err := s.Reserve(ctx, projectID, idempotencyKey, time.Hour, time.Hour)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if reserved {
+			t.Fatal("want not reserved but reserved")
+		}
+		if e, g := IdempotencyKeyStatusRunning, ik.Status; e != g {
+			t.Fatalf("want Status is %v but got %v", e, g)
+		}
+	}
+
+	{
+		ik, err := s.Complete(ctx, projectID, idempotencyKey, []string{"ds2bqJobID"}, []string{"dsExportJobID"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if e, g := IdempotencyKeyStatusDone, ik.Status; e != g {
+			t.Fatalf("want Status is %v but got %v", e, g)
+		}
+	}
+
+	{
+		ik, reserved, err := s.Reserve(ctx, projectID, idempotencyKey, time.Hour, time.Hour)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if reserved {
+			t.Fatal("want not reserved but reserved")
+		}
+		if e, g := "ds2bqJobID", ik.DS2BQJobIDs[0]; e != g {
+			t.Fatalf("want DS2BQJobID is %v but got %v", e, g)
+		}
+		if e, g := "dsExportJobID", ik.DatastoreExportJobIDs[0]; e != g {
+			t.Fatalf("want DatastoreExportJobID is %v but got %v", e, g)
+		}
+	}
+}
+
+func TestIdempotencyKeyStore_ReserveAfterWindow(t *testing.T) {
+	ctx := context.Background()
+
+	cdsc, err := cds.NewClient(ctx, uuid.New().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ds, err := clouddatastore.FromClient(ctx, cdsc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := NewIdempotencyKeyStore(ctx, ds)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const projectID = "gcpugjp-dev"
+	const idempotencyKey = "expired"
+	if _, _, err := s.Reserve(ctx, projectID, idempotencyKey, -1*time.Second, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	_, reserved, err := s.Reserve(ctx, projectID, idempotencyKey, time.Hour, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reserved {
+		t.Error("want reserved after window but not reserved")
+	}
+}
+
+func TestIdempotencyKeyStore_Release(t *testing.T) {
+	ctx := context.Background()
+
+	cdsc, err := cds.NewClient(ctx, uuid.New().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ds, err := clouddatastore.FromClient(ctx, cdsc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := NewIdempotencyKeyStore(ctx, ds)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const projectID = "gcpugjp-dev"
+	const idempotencyKey = "release"
+	if _, _, err := s.Reserve(ctx, projectID, idempotencyKey, time.Hour, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Release(ctx, projectID, idempotencyKey); err != nil {
+		t.Fatal(err)
+	}
+
+	_, reserved, err := s.Reserve(ctx, projectID, idempotencyKey, time.Hour, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reserved {
+		t.Error("want reserved after release but not reserved")
+	}
+}
+
+func TestIdempotencyKeyStore_ReserveAfterRunningLease(t *testing.T) {
+	ctx := context.Background()
+
+	cdsc, err := cds.NewClient(ctx, uuid.New().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ds, err := clouddatastore.FromClient(ctx, cdsc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := NewIdempotencyKeyStore(ctx, ds)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const projectID = "gcpugjp-dev"
+	const idempotencyKey = "running-lease-expired"
+	if _, _, err := s.Reserve(ctx, projectID, idempotencyKey, time.Hour, -1*time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	_, reserved, err := s.Reserve(ctx, projectID, idempotencyKey, time.Hour, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reserved {
+		t.Error("want reserved after running lease but not reserved")
+	}
+}
+
+func TestIdempotencyKeyStore_MarkQueued(t *testing.T) {
+	ctx := context.Background()
+
+	cdsc, err := cds.NewClient(ctx, uuid.New().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ds, err := clouddatastore.FromClient(ctx, cdsc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := NewIdempotencyKeyStore(ctx, ds)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const projectID = "gcpugjp-dev"
+	const idempotencyKey = "queued"
+	if _, _, err := s.Reserve(ctx, projectID, idempotencyKey, time.Hour, -1*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.MarkQueued(ctx, projectID, idempotencyKey); err != nil {
+		t.Fatal(err)
+	}
+
+	ik, reserved, err := s.Reserve(ctx, projectID, idempotencyKey, time.Hour, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reserved {
+		t.Error("want not reserved while queued but reserved")
+	}
+	if e, g := IdempotencyKeyStatusQueued, ik.Status; e != g {
+		t.Errorf("want Status is %v but got %v", e, g)
+	}
+}
+
+func TestIdempotencyKey_IsReserved(t *testing.T) {
+	now := time.Date(2019, 9, 1, 0, 0, 0, 0, time.UTC)
+
+	cases := []struct {
+		name string
+		ik   IdempotencyKey
+		want bool
+	}{
+		{"running", IdempotencyKey{Status: IdempotencyKeyStatusRunning, ExpireAt: now.Add(time.Hour), RunningLeaseExpireAt: now.Add(time.Minute)}, true},
+		{"running lease expired", IdempotencyKey{Status: IdempotencyKeyStatusRunning, ExpireAt: now.Add(time.Hour), RunningLeaseExpireAt: now.Add(-time.Minute)}, false},
+		{"running without lease", IdempotencyKey{Status: IdempotencyKeyStatusRunning, ExpireAt: now.Add(time.Hour)}, true},
+		{"queued lease expired", IdempotencyKey{Status: IdempotencyKeyStatusQueued, ExpireAt: now.Add(time.Hour), RunningLeaseExpireAt: now.Add(-time.Minute)}, true},
+		{"done lease expired", IdempotencyKey{Status: IdempotencyKeyStatusDone, ExpireAt: now.Add(time.Hour), RunningLeaseExpireAt: now.Add(-time.Minute)}, true},
+		{"window expired", IdempotencyKey{Status: IdempotencyKeyStatusDone, ExpireAt: now.Add(-time.Minute)}, false},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			if e, g := tt.want, tt.ik.IsReserved(now); e != g {
+				t.Errorf("want IsReserved is %v but got %v", e, g)
+			}
+		})
+	}
+}
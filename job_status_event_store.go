@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/morikuni/failure"
+	"go.mercari.io/datastore"
+)
+
+type JobStatusEventStore struct {
+	ds datastore.Client
+}
+
+func NewJobStatusEventStore(ctx context.Context, client datastore.Client) (*JobStatusEventStore, error) {
+	return &JobStatusEventStore{
+		ds: client,
+	}, nil
+}
+
+// JobStatusEvent is DSExportJob, BQLoadJobの状態の変化
+// 状態を変えたJobの子Entityとして、状態を変えたTransactionの中で保存する
+// +qbg
+type JobStatusEvent struct {
+	ID            string `datastore:"-"`
+	DS2BQJobID    string
+	JobKind       string // 状態を変えたJobのEntityのKind. DSExportJob もしくは BQLoadJob
+	Kind          string // BQLoadJobの場合のKind
+	FromStatus    string
+	ToStatus      string
+	OperationID   string // Datastore ExportのOperation名 もしくは BQ Load InsertのJobID
+	Message       string `datastore:",noindex"`
+	Attempt       int    // DSExportJobはDatastore Exportの再実行回数, BQLoadJobは状態確認のTaskのRetry回数
+	ChangedAt     time.Time
+	CreatedAt     time.Time
+	UpdatedAt     time.Time
+	SchemaVersion int
+}
+
+var _ datastore.PropertyLoadSaver = &JobStatusEvent{}
+var _ datastore.KeyLoader = &JobStatusEvent{}
+
+// LoadKey is Entity Load時にKeyを設定する
+func (e *JobStatusEvent) LoadKey(ctx context.Context, k datastore.Key) error {
+	e.ID = k.Name()
+
+	return nil
+}
+
+// Load is Entity Load時に呼ばれる
+func (e *JobStatusEvent) Load(ctx context.Context, ps []datastore.Property) error {
+	err := datastore.LoadStruct(ctx, e, ps)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Save is Entity Save時に呼ばれる
+func (e *JobStatusEvent) Save(ctx context.Context) ([]datastore.Property, error) {
+	if e.CreatedAt.IsZero() {
+		e.CreatedAt = time.Now()
+	}
+	e.UpdatedAt = time.Now()
+	e.SchemaVersion = 1
+
+	return datastore.SaveStruct(ctx, e)
+}
+
+// NewDSExportJobStatusEvent is fromから今のjobの状態に変えたJobStatusEventを作る
+func NewDSExportJobStatusEvent(job *DSExportJob, from DSExportJobStatus, operationID string, message string) *JobStatusEvent {
+	return &JobStatusEvent{
+		DS2BQJobID:  job.ID,
+		JobKind:     "DSExportJob",
+		FromStatus:  from.String(),
+		ToStatus:    job.Status.String(),
+		OperationID: operationID,
+		Message:     message,
+		Attempt:     job.RetryCount,
+		ChangedAt:   job.ChangeStatusAt,
+	}
+}
+
+// NewBQLoadJobStatusEvent is fromから今のjobの状態に変えたJobStatusEventを作る
+func NewBQLoadJobStatusEvent(job *BQLoadJob, from BQLoadJobStatus, message string) *JobStatusEvent {
+	return &JobStatusEvent{
+		DS2BQJobID:  job.JobID,
+		JobKind:     "BQLoadJob",
+		Kind:        job.Kind,
+		FromStatus:  from.String(),
+		ToStatus:    job.Status.String(),
+		OperationID: job.BQLoadJobID,
+		Message:     message,
+		Attempt:     job.CheckTaskRetryCount,
+		ChangedAt:   job.ChangeStatusAt,
+	}
+}
+
+// NewJobStatusEventKey is 状態を変えたJobのKeyを親にしたJobStatusEventのKeyを作る
+func NewJobStatusEventKey(client datastore.Client, parent datastore.Key, id string) datastore.Key {
+	return client.NameKey("JobStatusEvent", id, parent)
+}
+
+// putJobStatusEvent is Jobの状態を変えたTransactionの中でJobStatusEventを保存する
+func putJobStatusEvent(tx datastore.Transaction, client datastore.Client, parent datastore.Key, e *JobStatusEvent) error {
+	e.ID = uuid.New().String()
+	_, err := tx.Put(NewJobStatusEventKey(client, parent, e.ID), e)
+	return err
+}
+
+// ListByDS2BQJobID is DS2BQJobのDSExportJob, BQLoadJobのJobStatusEventを古い順に返す
+func (store *JobStatusEventStore) ListByDS2BQJobID(ctx context.Context, ds2bqJobID string) ([]*JobStatusEvent, error) {
+	b := NewJobStatusEventQueryBuilder(store.ds)
+	b.DS2BQJobID.Equal(ds2bqJobID)
+
+	var l []*JobStatusEvent
+	if _, err := store.ds.GetAll(ctx, b.Query(), &l); err != nil {
+		_, ok := err.(datastore.MultiError)
+		if ok {
+			return l, err
+		}
+		return nil, failure.Wrap(err, failure.Messagef("failed datastore.GetAll() ds2bqJobID=%v", ds2bqJobID))
+	}
+
+	// Composite Indexを使わないように、並び替えはここでやる
+	sort.SliceStable(l, func(i, j int) bool {
+		return l[i].ChangedAt.Before(l[j].ChangedAt)
+	})
+	return l, nil
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	cds "cloud.google.com/go/datastore"
+	"github.com/google/uuid"
+	"go.mercari.io/datastore/clouddatastore"
+)
+
+func TestJobStatusEventStore_ListByDS2BQJobID(t *testing.T) {
+	ctx := context.Background()
+
+	cdsc, err := cds.NewClient(ctx, uuid.New().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ds, err := clouddatastore.FromClient(ctx, cdsc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dseJS, err := NewDSExportJobStore(ctx, ds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bqlJS, err := NewBQLoadJobStore(ctx, ds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewJobStatusEventStore(ctx, ds)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ds2bqJobID := dseJS.NewDS2BQJobID(ctx)
+	if _, err := dseJS.Create(ctx, &DSExportJobCreateForm{JobID: ds2bqJobID, Body: "{}", ExportProjectID: "gcpugjp-dev", Kinds: []string{"PugEvent"}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bqlJS.Put(ctx, &BQLoadJobPutForm{JobID: ds2bqJobID, Kind: "PugEvent"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dseJS.StartExportJob(ctx, ds2bqJobID, "dummyDatastoreExportJobID", 0, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dseJS.FinishExportJob(ctx, ds2bqJobID, DSExportJobStatusDone, "dummyDatastoreExportJobID", ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bqlJS.StartLoadJob(ctx, ds2bqJobID, "PugEvent", "dummyBigQueryLoadJobID", nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bqlJS.FinishExportJob(ctx, ds2bqJobID, "PugEvent", BQLoadJobStatusFailed, "hoge"); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := s.ListByDS2BQJobID(ctx, ds2bqJobID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []struct {
+		jobKind     string
+		from        string
+		to          string
+		operationID string
+		message     string
+	}{
+		{"DSExportJob", "Default", "Running", "dummyDatastoreExportJobID", ""},
+		{"DSExportJob", "Running", "Done", "dummyDatastoreExportJobID", ""},
+		{"BQLoadJob", "Default", "Running", "dummyBigQueryLoadJobID", ""},
+		{"BQLoadJob", "Running", "Failed", "dummyBigQueryLoadJobID", "hoge"},
+	}
+	if e, g := len(want), len(got); e != g {
+		t.Fatalf("want events.length %v but got %v", e, g)
+	}
+	for i, w := range want {
+		if e, g := w.jobKind, got[i].JobKind; e != g {
+			t.Errorf("events[%d] want JobKind %v but got %v", i, e, g)
+		}
+		if e, g := w.from, got[i].FromStatus; e != g {
+			t.Errorf("events[%d] want FromStatus %v but got %v", i, e, g)
+		}
+		if e, g := w.to, got[i].ToStatus; e != g {
+			t.Errorf("events[%d] want ToStatus %v but got %v", i, e, g)
+		}
+		if e, g := w.operationID, got[i].OperationID; e != g {
+			t.Errorf("events[%d] want OperationID %v but got %v", i, e, g)
+		}
+		if e, g := w.message, got[i].Message; e != g {
+			t.Errorf("events[%d] want Message %v but got %v", i, e, g)
+		}
+	}
+}
+
+func TestJobStatus_String(t *testing.T) {
+	cases := []struct {
+		name   string
+		status interface{ String() string }
+		want   string
+	}{
+		{"DSExportJob Running", DSExportJobStatusRunning, "Running"},
+		{"DSExportJob DeadLettered", DSExportJobStatusDeadLettered, "DeadLettered"},
+		{"DSExportJob unknown", DSExportJobStatus(100), "DSExportJobStatus(100)"},
+		{"BQLoadJob Superseded", BQLoadJobStatusSuperseded, "Superseded"},
+		{"BQLoadJob DeadLettered", BQLoadJobStatusDeadLettered, "DeadLettered"},
+		{"BQLoadJob VerificationFailed", BQLoadJobStatusVerificationFailed, "VerificationFailed"},
+		{"BQLoadJob unknown", BQLoadJobStatus(-1), "BQLoadJobStatus(-1)"},
+	}
+
+	for _, tt := range cases {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			if e, g := tt.want, tt.status.String(); e != g {
+				t.Errorf("want %v but got %v", e, g)
+			}
+		})
+	}
+}
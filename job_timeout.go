@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"os"
+	"strconv"
+	"time"
+)
+
+// JobTimeout is Jobの状態確認を打ち切る条件
+// MaxStatusCheckCount, TimeoutSeconds が 0 の場合は無制限
+type JobTimeout struct {
+	MaxStatusCheckCount int
+	TimeoutSeconds      int  // Jobが Running になってからの秒数
+	CancelOnTimeout     bool // Timeoutした時に、Datastore Export, BQ Load のJobをキャンセルするか
+	SLOSeconds          int  // Jobが終わるまでの期待値の秒数. 超えても状態確認は打ち切らず、通知だけをする. 0 の場合は無し
+}
+
+// IsExceeded is statusCheckCount, runningSince からTimeoutしているかを返す
+func (t JobTimeout) IsExceeded(statusCheckCount int, runningSince time.Time, now time.Time) bool {
+	if t.MaxStatusCheckCount > 0 && statusCheckCount >= t.MaxStatusCheckCount {
+		return true
+	}
+	if t.TimeoutSeconds > 0 && now.Sub(runningSince) >= time.Duration(t.TimeoutSeconds)*time.Second {
+		return true
+	}
+	return false
+}
+
+// IsSLOExceeded is sinceからの時間がSLOSecondsを超えているかを返す
+func (t JobTimeout) IsSLOExceeded(since time.Time, now time.Time) bool {
+	return t.SLOSeconds > 0 && now.Sub(since) >= time.Duration(t.SLOSeconds)*time.Second
+}
+
+// BuildDSExportJobTimeout is Datastore Export JobのTimeoutを組み立てる
+// Requestで指定されていない場合は、環境変数 DSEXPORT_JOB_MAX_STATUS_CHECK_COUNT, DSEXPORT_JOB_TIMEOUT, CANCEL_ON_TIMEOUT, DSEXPORT_JOB_SLO を使う
+func BuildDSExportJobTimeout(form *DatastoreExportRequest) JobTimeout {
+	t := JobTimeout{
+		MaxStatusCheckCount: form.MaxExportStatusCheckCount,
+		TimeoutSeconds:      form.ExportTimeoutSeconds,
+		CancelOnTimeout:     form.CancelOnTimeout || getEnvBool("CANCEL_ON_TIMEOUT"),
+		SLOSeconds:          form.ExportSLOSeconds,
+	}
+	if t.MaxStatusCheckCount < 1 {
+		t.MaxStatusCheckCount = getEnvInt("DSEXPORT_JOB_MAX_STATUS_CHECK_COUNT")
+	}
+	if t.TimeoutSeconds < 1 {
+		t.TimeoutSeconds = int(getEnvDuration("DSEXPORT_JOB_TIMEOUT").Seconds())
+	}
+	if t.SLOSeconds < 1 {
+		t.SLOSeconds = int(getEnvDuration("DSEXPORT_JOB_SLO").Seconds())
+	}
+	return t
+}
+
+// BuildBQLoadJobTimeout is BQ Load JobのTimeoutを組み立てる
+// Requestで指定されていない場合は、環境変数 BQLOAD_JOB_MAX_STATUS_CHECK_COUNT, BQLOAD_JOB_TIMEOUT, CANCEL_ON_TIMEOUT, BQLOAD_JOB_SLO を使う
+func BuildBQLoadJobTimeout(form *DatastoreExportRequest) JobTimeout {
+	t := JobTimeout{
+		MaxStatusCheckCount: form.MaxBQLoadStatusCheckCount,
+		TimeoutSeconds:      form.BQLoadTimeoutSeconds,
+		CancelOnTimeout:     form.CancelOnTimeout || getEnvBool("CANCEL_ON_TIMEOUT"),
+		SLOSeconds:          form.BQLoadSLOSeconds,
+	}
+	if t.MaxStatusCheckCount < 1 {
+		t.MaxStatusCheckCount = getEnvInt("BQLOAD_JOB_MAX_STATUS_CHECK_COUNT")
+	}
+	if t.TimeoutSeconds < 1 {
+		t.TimeoutSeconds = int(getEnvDuration("BQLOAD_JOB_TIMEOUT").Seconds())
+	}
+	if t.SLOSeconds < 1 {
+		t.SLOSeconds = int(getEnvDuration("BQLOAD_JOB_SLO").Seconds())
+	}
+	return t
+}
+
+func getEnvInt(name string) int {
+	v := os.Getenv(name)
+	if len(v) < 1 {
+		return 0
+	}
+	i, err := strconv.Atoi(v)
+	if err != nil {
+		Errorf(context.Background(), "invalid %s=%v. ignored.err=%+v\n", name, v, err)
+		return 0
+	}
+	return i
+}
+
+func getEnvFloat(name string) float64 {
+	v := os.Getenv(name)
+	if len(v) < 1 {
+		return 0
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		Errorf(context.Background(), "invalid %s=%v. ignored.err=%+v\n", name, v, err)
+		return 0
+	}
+	return f
+}
+
+func getEnvDuration(name string) time.Duration {
+	v := os.Getenv(name)
+	if len(v) < 1 {
+		return 0
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		Errorf(context.Background(), "invalid %s=%v. ignored.err=%+v\n", name, v, err)
+		return 0
+	}
+	return d
+}
+
+func getEnvBool(name string) bool {
+	v := os.Getenv(name)
+	if len(v) < 1 {
+		return false
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		Errorf(context.Background(), "invalid %s=%v. ignored.err=%+v\n", name, v, err)
+		return false
+	}
+	return b
+}
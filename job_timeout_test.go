@@ -0,0 +1,59 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestJobTimeout_IsExceeded(t *testing.T) {
+	now := time.Date(2019, 8, 30, 10, 0, 0, 0, time.UTC)
+
+	cases := []struct {
+		name             string
+		timeout          JobTimeout
+		statusCheckCount int
+		runningSince     time.Time
+		want             bool
+	}{
+		{"unlimited", JobTimeout{}, 1000, now.Add(-24 * time.Hour), false},
+		{"under max status check count", JobTimeout{MaxStatusCheckCount: 10}, 9, now, false},
+		{"reach max status check count", JobTimeout{MaxStatusCheckCount: 10}, 10, now, true},
+		{"before deadline", JobTimeout{TimeoutSeconds: 3600}, 0, now.Add(-59 * time.Minute), false},
+		{"after deadline", JobTimeout{TimeoutSeconds: 3600}, 0, now.Add(-60 * time.Minute), true},
+		{"both", JobTimeout{MaxStatusCheckCount: 10, TimeoutSeconds: 3600}, 1, now.Add(-2 * time.Hour), true},
+	}
+
+	for _, tt := range cases {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			if e, g := tt.want, tt.timeout.IsExceeded(tt.statusCheckCount, tt.runningSince, now); e != g {
+				t.Errorf("want %v but got %v", e, g)
+			}
+		})
+	}
+}
+
+func TestJobTimeout_IsSLOExceeded(t *testing.T) {
+	now := time.Date(2019, 8, 30, 10, 0, 0, 0, time.UTC)
+
+	cases := []struct {
+		name    string
+		timeout JobTimeout
+		since   time.Time
+		want    bool
+	}{
+		{"no slo", JobTimeout{}, now.Add(-24 * time.Hour), false},
+		{"within slo", JobTimeout{SLOSeconds: 7200}, now.Add(-119 * time.Minute), false},
+		{"exceeded slo", JobTimeout{SLOSeconds: 7200}, now.Add(-120 * time.Minute), true},
+		{"timeout only", JobTimeout{TimeoutSeconds: 60}, now.Add(-2 * time.Hour), false},
+	}
+
+	for _, tt := range cases {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			if e, g := tt.want, tt.timeout.IsSLOExceeded(tt.since, now); e != g {
+				t.Errorf("want %v but got %v", e, g)
+			}
+		})
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// JobTriggerType is DS2BQJobを開始したきっかけ
+type JobTriggerType string
+
+const (
+	JobTriggerTypeScheduler  JobTriggerType = "scheduler"  // Cloud SchedulerからのRequest
+	JobTriggerTypeManual     JobTriggerType = "manual"     // Cloud Scheduler以外からのRequest
+	JobTriggerTypeReconciler JobTriggerType = "reconciler" // Reconcileが止まっていたJobの状態を確認した
+	JobTriggerTypeRetry      JobTriggerType = "retry"      // 状態確認のTaskが失敗したDatastore Exportを再実行した
+)
+
+// JobTrigger is DS2BQJobを開始したRequestの情報
+// CallerEmail は認証が有効な場合だけ入る
+type JobTrigger struct {
+	Type        JobTriggerType `json:"type"`
+	CallerEmail string         `json:"callerEmail,omitempty"`
+	SourceIP    string         `json:"sourceIp,omitempty"`
+	UserAgent   string         `json:"userAgent,omitempty"`
+}
+
+// NewJobTrigger is RequestからJobTriggerを作る
+// ID Tokenで確認したCallerが CallerPolicy.Scheduler の場合は JobTriggerTypeScheduler, それ以外は JobTriggerTypeManual
+// X-CloudScheduler Headerは誰でも付けられるので使わない
+func NewJobTrigger(r *http.Request) *JobTrigger {
+	t := JobTriggerTypeManual
+	if caller, ok := CallerFromContext(r.Context()); ok && caller.IsScheduler() {
+		t = JobTriggerTypeScheduler
+	}
+	return NewJobTriggerWithType(r, t)
+}
+
+// NewJobTriggerWithType is Requestから指定したTypeのJobTriggerを作る
+func NewJobTriggerWithType(r *http.Request, t JobTriggerType) *JobTrigger {
+	var email string
+	if caller, ok := CallerFromContext(r.Context()); ok {
+		email = caller.Email
+	}
+	return &JobTrigger{
+		Type:        t,
+		CallerEmail: email,
+		SourceIP:    SourceIP(r),
+		UserAgent:   r.UserAgent(),
+	}
+}
+
+// SourceIP is Requestの送信元のIPを返す
+// Cloud Runなどの前段のProxyを通っている場合は X-Forwarded-For の末尾を使う
+// 末尾は前段のProxyが追加した値で、それより前はClientが自由に付けられるので信用しない
+func SourceIP(r *http.Request) string {
+	if v := r.Header.Get("X-Forwarded-For"); v != "" {
+		l := strings.Split(v, ",")
+		return strings.TrimSpace(l[len(l)-1])
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+type jobTriggerContextKey struct{}
+
+// WithJobTrigger is ctxにJobTriggerを入れる
+func WithJobTrigger(ctx context.Context, trigger *JobTrigger) context.Context {
+	return context.WithValue(ctx, jobTriggerContextKey{}, trigger)
+}
+
+// JobTriggerFromContext is ctxからJobTriggerを取り出す. 無い場合は nil
+func JobTriggerFromContext(ctx context.Context) *JobTrigger {
+	trigger, _ := ctx.Value(jobTriggerContextKey{}).(*JobTrigger)
+	return trigger
+}
+
+// QueuedDS2BQRequest is RunLockPolicyQueueで待たせておくRequest
+// Runを開始するのは後から別のRequestなので、元のRequestのJobTriggerも一緒に保存する
+type QueuedDS2BQRequest struct {
+	Body           string      `json:"body"`
+	Trigger        *JobTrigger `json:"trigger"`
+	IdempotencyKey string      `json:"idempotencyKey,omitempty"` // 待たせたRequestのIdempotencyKey. Runを開始した時にCompleteする
+}
+
+// EncodeQueuedDS2BQRequest is RunLockのQueueに入れる文字列を作る
+func EncodeQueuedDS2BQRequest(body string, trigger *JobTrigger, idempotencyKey string) (string, error) {
+	b, err := json.Marshal(&QueuedDS2BQRequest{
+		Body:           body,
+		Trigger:        trigger,
+		IdempotencyKey: idempotencyKey,
+	})
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// DecodeQueuedDS2BQRequest is RunLockのQueueから取り出した文字列を QueuedDS2BQRequest に戻す
+// JobTriggerを保存する前にQueueに入ったものは、DatastoreExportRequestのJSONがそのまま入っているので、Bodyとして扱う
+func DecodeQueuedDS2BQRequest(v string) *QueuedDS2BQRequest {
+	var q QueuedDS2BQRequest
+	if err := json.Unmarshal([]byte(v), &q); err != nil || q.Body == "" {
+		return &QueuedDS2BQRequest{Body: v}
+	}
+	return &q
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestNewJobTrigger(t *testing.T) {
+	scheduler := &Caller{Email: "scheduler@gcpug-ds2bq-dev.iam.gserviceaccount.com", Policy: &CallerPolicy{Scheduler: true}}
+	caller := &Caller{Email: "user@gcpug-ds2bq-dev.iam.gserviceaccount.com", Policy: &CallerPolicy{}}
+
+	cases := []struct {
+		name   string
+		header map[string]string
+		ctx    context.Context
+		want   *JobTrigger
+	}{
+		{"manual",
+			map[string]string{"User-Agent": "curl/7.64.1"},
+			context.Background(),
+			&JobTrigger{Type: JobTriggerTypeManual, SourceIP: "192.0.2.1", UserAgent: "curl/7.64.1"},
+		},
+		{"scheduler",
+			map[string]string{"User-Agent": "Google-Cloud-Scheduler", "X-CloudScheduler": "true", "X-Forwarded-For": "203.0.113.1, 198.51.100.1"},
+			WithCaller(context.Background(), scheduler),
+			&JobTrigger{Type: JobTriggerTypeScheduler, CallerEmail: scheduler.Email, SourceIP: "198.51.100.1", UserAgent: "Google-Cloud-Scheduler"},
+		},
+		{"X-CloudScheduler header from not scheduler caller",
+			map[string]string{"User-Agent": "curl/7.64.1", "X-CloudScheduler": "true", "X-Forwarded-For": "203.0.113.1"},
+			WithCaller(context.Background(), caller),
+			&JobTrigger{Type: JobTriggerTypeManual, CallerEmail: caller.Email, SourceIP: "203.0.113.1", UserAgent: "curl/7.64.1"},
+		},
+		{"X-CloudScheduler header without auth",
+			map[string]string{"User-Agent": "curl/7.64.1", "X-CloudScheduler": "true"},
+			context.Background(),
+			&JobTrigger{Type: JobTriggerTypeManual, SourceIP: "192.0.2.1", UserAgent: "curl/7.64.1"},
+		},
+	}
+
+	for _, tt := range cases {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/api/v1/datastore-export/", nil).WithContext(tt.ctx)
+			for k, v := range tt.header {
+				r.Header.Set(k, v)
+			}
+			if e, g := tt.want, NewJobTrigger(r); !reflect.DeepEqual(e, g) {
+				t.Errorf("want %+v but got %+v", e, g)
+			}
+		})
+	}
+}
+
+func TestDecodeQueuedDS2BQRequest(t *testing.T) {
+	trigger := &JobTrigger{Type: JobTriggerTypeScheduler, CallerEmail: "scheduler@gcpug-ds2bq-dev.iam.gserviceaccount.com"}
+	body := `{"projectId":"gcpug-ds2bq-dev","outputGCSFilePath":"gs://datastore-export-gcpug-ds2bq-dev","kinds":["Hoge"]}`
+	encoded, err := EncodeQueuedDS2BQRequest(body, trigger, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	withKey, err := EncodeQueuedDS2BQRequest(body, trigger, "idempotency-key")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name   string
+		queued string
+		want   *QueuedDS2BQRequest
+	}{
+		{"with trigger", encoded, &QueuedDS2BQRequest{Body: body, Trigger: trigger}},
+		{"with idempotency key", withKey, &QueuedDS2BQRequest{Body: body, Trigger: trigger, IdempotencyKey: "idempotency-key"}},
+		{"request body only", body, &QueuedDS2BQRequest{Body: body}},
+	}
+
+	for _, tt := range cases {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			if e, g := tt.want, DecodeQueuedDS2BQRequest(tt.queued); !reflect.DeepEqual(e, g) {
+				t.Errorf("want %+v but got %+v", e, g)
+			}
+		})
+	}
+}
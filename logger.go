@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opencensus.io/trace"
+)
+
+// Severity is Cloud LoggingのLogSeverity
+type Severity string
+
+const (
+	SeverityDefault  Severity = "DEFAULT"
+	SeverityDebug    Severity = "DEBUG"
+	SeverityInfo     Severity = "INFO"
+	SeverityWarning  Severity = "WARNING"
+	SeverityError    Severity = "ERROR"
+	SeverityCritical Severity = "CRITICAL"
+)
+
+// LogEntry is Cloud Loggingの構造化ログの1行
+// https://cloud.google.com/logging/docs/agent/configuration#special-fields
+type LogEntry struct {
+	Severity     Severity  `json:"severity"`
+	Message      string    `json:"message"`
+	Time         time.Time `json:"time"`
+	Trace        string    `json:"logging.googleapis.com/trace,omitempty"`
+	SpanID       string    `json:"logging.googleapis.com/spanId,omitempty"`
+	TraceSampled bool      `json:"logging.googleapis.com/trace_sampled,omitempty"`
+	DS2BQJobID   string    `json:"ds2bqJobId,omitempty"`
+	Kind         string    `json:"kind,omitempty"`
+	Operation    string    `json:"operation,omitempty"`
+}
+
+// LogFields is 同じRunのログをまとめて絞り込めるように、ログに付ける値
+// Operation は Datastore ExportのOperation名 もしくは BQ LoadのJobID
+type LogFields struct {
+	DS2BQJobID string
+	Kind       string
+	Operation  string
+}
+
+type logFieldsKey struct{}
+
+// WithLogFields is ctxにLogFieldsを入れる. 空の値はctxに入っている値をそのまま使う
+func WithLogFields(ctx context.Context, fields LogFields) context.Context {
+	current := LogFieldsFromContext(ctx)
+	if fields.DS2BQJobID != "" {
+		current.DS2BQJobID = fields.DS2BQJobID
+	}
+	if fields.Kind != "" {
+		current.Kind = fields.Kind
+	}
+	if fields.Operation != "" {
+		current.Operation = fields.Operation
+	}
+	if rec, ok := ctx.Value(requestLogFieldsKey{}).(*requestLogFields); ok {
+		rec.set(current)
+	}
+	return context.WithValue(ctx, logFieldsKey{}, current)
+}
+
+type requestLogFieldsKey struct{}
+
+// requestLogFields is Requestの処理の中で最後に WithLogFields した値
+// APIHandlerFuncが返った後に HandleAPI が出すログにも、同じLogFieldsを付けるために使う
+type requestLogFields struct {
+	mu     sync.Mutex
+	fields LogFields
+}
+
+func (rec *requestLogFields) set(fields LogFields) {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	rec.fields = fields
+}
+
+func (rec *requestLogFields) get() LogFields {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	return rec.fields
+}
+
+// withRequestLogFields is ctxの中で WithLogFields した値を記録する requestLogFields を入れる
+func withRequestLogFields(ctx context.Context) (context.Context, *requestLogFields) {
+	rec := &requestLogFields{fields: LogFieldsFromContext(ctx)}
+	return context.WithValue(ctx, requestLogFieldsKey{}, rec), rec
+}
+
+// LogFieldsFromContext is ctxに入っているLogFieldsを返す
+func LogFieldsFromContext(ctx context.Context) LogFields {
+	v, ok := ctx.Value(logFieldsKey{}).(LogFields)
+	if !ok {
+		return LogFields{}
+	}
+	return v
+}
+
+// NewLogEntry is ctxのSpanとLogFieldsを付けたLogEntryを作る
+func NewLogEntry(ctx context.Context, severity Severity, message string) *LogEntry {
+	e := &LogEntry{
+		Severity: severity,
+		Message:  strings.TrimSuffix(message, "\n"),
+		Time:     time.Now(),
+	}
+	if span := trace.FromContext(ctx); span != nil {
+		sc := span.SpanContext()
+		e.Trace = fmt.Sprintf("projects/%s/traces/%s", ProjectID, sc.TraceID.String())
+		e.SpanID = sc.SpanID.String()
+		e.TraceSampled = sc.IsSampled()
+	}
+	fields := LogFieldsFromContext(ctx)
+	e.DS2BQJobID = fields.DS2BQJobID
+	e.Kind = fields.Kind
+	e.Operation = fields.Operation
+	return e
+}
+
+var (
+	logMu     sync.Mutex
+	logOutput io.Writer = os.Stdout
+)
+
+// WriteLogEntry is LogEntryを1行のJSONで出力する
+func WriteLogEntry(e *LogEntry) {
+	b, err := json.Marshal(e)
+	if err != nil {
+		b = []byte(fmt.Sprintf(`{"severity":%q,"message":%q}`, SeverityError, fmt.Sprintf("failed json.Marshal LogEntry. message=%v,err=%v", e.Message, err)))
+	}
+	logMu.Lock()
+	defer logMu.Unlock()
+	if _, err := logOutput.Write(append(b, '\n')); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+	}
+}
+
+// Logf is severityのログを出力する
+func Logf(ctx context.Context, severity Severity, format string, args ...interface{}) {
+	WriteLogEntry(NewLogEntry(ctx, severity, fmt.Sprintf(format, args...)))
+}
+
+func Debugf(ctx context.Context, format string, args ...interface{}) {
+	Logf(ctx, SeverityDebug, format, args...)
+}
+
+func Infof(ctx context.Context, format string, args ...interface{}) {
+	Logf(ctx, SeverityInfo, format, args...)
+}
+
+func Warningf(ctx context.Context, format string, args ...interface{}) {
+	Logf(ctx, SeverityWarning, format, args...)
+}
+
+func Errorf(ctx context.Context, format string, args ...interface{}) {
+	Logf(ctx, SeverityError, format, args...)
+}
+
+// Fatalf is CRITICALのログを出力して終了する. 起動時にだけ使う
+func Fatalf(ctx context.Context, format string, args ...interface{}) {
+	Logf(ctx, SeverityCritical, format, args...)
+	os.Exit(1)
+}
+
+type stdLogWriter struct{}
+
+func (w stdLogWriter) Write(p []byte) (int, error) {
+	WriteLogEntry(NewLogEntry(context.Background(), SeverityDefault, string(p)))
+	return len(p), nil
+}
+
+// InitLogger is 標準のlogパッケージの出力も構造化ログにする
+// ライブラリが出力するログもCloud Loggingで1行ずつ扱えるようにするため
+func InitLogger() {
+	log.SetFlags(0)
+	log.SetOutput(stdLogWriter{})
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"testing"
+
+	"go.opencensus.io/trace"
+)
+
+func TestWithLogFields(t *testing.T) {
+	cases := []struct {
+		name   string
+		fields []LogFields
+		want   LogFields
+	}{
+		{"empty", nil, LogFields{}},
+		{"one", []LogFields{{DS2BQJobID: "job1", Kind: "PugUser"}}, LogFields{DS2BQJobID: "job1", Kind: "PugUser"}},
+		{"merge", []LogFields{{DS2BQJobID: "job1", Kind: "PugUser"}, {Operation: "ope1"}}, LogFields{DS2BQJobID: "job1", Kind: "PugUser", Operation: "ope1"}},
+		{"overwrite", []LogFields{{DS2BQJobID: "job1", Operation: "ope1"}, {Operation: "ope2"}}, LogFields{DS2BQJobID: "job1", Operation: "ope2"}},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			for _, f := range tt.fields {
+				ctx = WithLogFields(ctx, f)
+			}
+			if e, g := tt.want, LogFieldsFromContext(ctx); e != g {
+				t.Errorf("want %+v but got %+v", e, g)
+			}
+		})
+	}
+}
+
+func TestNewLogEntry(t *testing.T) {
+	ctx := WithLogFields(context.Background(), LogFields{DS2BQJobID: "job1", Kind: "PugUser", Operation: "ope1"})
+
+	e := NewLogEntry(ctx, SeverityWarning, "hello\n")
+	if e.Severity != SeverityWarning {
+		t.Errorf("Severity want %v but got %v", SeverityWarning, e.Severity)
+	}
+	if e.Message != "hello" {
+		t.Errorf("Message want hello but got %v", e.Message)
+	}
+	if e.DS2BQJobID != "job1" || e.Kind != "PugUser" || e.Operation != "ope1" {
+		t.Errorf("unexpected fields %+v", e)
+	}
+	if e.Trace != "" || e.SpanID != "" {
+		t.Errorf("Trace want empty but got %v,%v", e.Trace, e.SpanID)
+	}
+
+	ctx, span := trace.StartSpan(ctx, "TestNewLogEntry", trace.WithSampler(trace.AlwaysSample()))
+	defer span.End()
+	sc := span.SpanContext()
+
+	e = NewLogEntry(ctx, SeverityInfo, "traced")
+	if g, w := e.Trace, fmt.Sprintf("projects/%s/traces/%s", ProjectID, sc.TraceID.String()); g != w {
+		t.Errorf("Trace want %v but got %v", w, g)
+	}
+	if g, w := e.SpanID, sc.SpanID.String(); g != w {
+		t.Errorf("SpanID want %v but got %v", w, g)
+	}
+	if !e.TraceSampled {
+		t.Errorf("TraceSampled want true")
+	}
+}
+
+func TestWriteLogEntry(t *testing.T) {
+	var buf bytes.Buffer
+	logOutput = &buf
+	defer func() {
+		logMu.Lock()
+		logOutput = os.Stdout
+		logMu.Unlock()
+	}()
+
+	Errorf(WithLogFields(context.Background(), LogFields{DS2BQJobID: "job1"}), "failed %v\n", "something")
+
+	var got map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatalf("failed json.Unmarshal. body=%s,err=%+v", buf.String(), err)
+	}
+	if e, g := "ERROR", got["severity"]; e != g {
+		t.Errorf("severity want %v but got %v", e, g)
+	}
+	if e, g := "failed something", got["message"]; e != g {
+		t.Errorf("message want %v but got %v", e, g)
+	}
+	if e, g := "job1", got["ds2bqJobId"]; e != g {
+		t.Errorf("ds2bqJobId want %v but got %v", e, g)
+	}
+	if _, ok := got["kind"]; ok {
+		t.Errorf("kind want omitted but got %v", got["kind"])
+	}
+}
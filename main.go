@@ -3,7 +3,6 @@ package main
 import (
 	"context"
 	"fmt"
-	"log"
 	"net/http"
 	"os"
 
@@ -15,6 +14,7 @@ import (
 	"go.mercari.io/datastore/clouddatastore"
 	"go.opencensus.io/exporter/stackdriver/propagation"
 	"go.opencensus.io/plugin/ochttp"
+	"go.opencensus.io/stats/view"
 	"go.opencensus.io/trace"
 	"google.golang.org/api/option"
 	"google.golang.org/grpc"
@@ -27,14 +27,26 @@ var DatastoreClient datastore.Client
 
 func main() {
 	mux := http.NewServeMux()
-	mux.HandleFunc("/api/v1/bigquery-load-job-check/", HandleBQLoadJobCheckAPI)
-	mux.HandleFunc("/api/v1/datastore-export-job-check/", HandleDatastoreExportJobCheckAPI)
-	mux.HandleFunc("/api/v1/datastore-export/", HandleDatastoreExportAPI)
+	mux.HandleFunc("/api/v1/bigquery-load-job-check/", HandleTaskAPI(HandleBQLoadJobCheckAPI))
+	mux.HandleFunc("/api/v1/datastore-export-job-check/", HandleTaskAPI(HandleDatastoreExportJobCheckAPI))
+	mux.HandleFunc("/api/v1/datastore-export/", HandleAPI(HandleDatastoreExportAPI))
+	mux.HandleFunc("/api/v1/ds2bq-jobs/", HandleAPI(HandleDS2BQJobAPI))
+	mux.HandleFunc("/api/v1/reconcile/", HandleAPI(HandleReconcileAPI))
+	mux.HandleFunc("/api/v1/task-outbox-drain/", HandleAPI(HandleTaskOutboxDrainAPI))
+	mux.HandleFunc("/api/v1/dead-letter-tasks/", HandleAPI(HandleDeadLetterTaskAPI))
+	if os.Getenv("PROMETHEUS_METRICS") == "true" {
+		mux.HandleFunc("/metrics", HandlePrometheusMetrics)
+	}
 	mux.HandleFunc("/", HandleHealthCheck)
 
+	authorizer, err := NewAuthorizerFromEnv()
+	if err != nil {
+		Fatalf(context.Background(), "failed NewAuthorizerFromEnv.err=%+v\n", err)
+	}
+
 	http.Handle("/", &ochttp.Handler{
 		Propagation: &propagation.HTTPFormat{},
-		Handler:     mux,
+		Handler:     authorizer.Middleware(mux),
 	})
 
 	port := os.Getenv("PORT")
@@ -42,22 +54,25 @@ func main() {
 		port = "8080"
 	}
 
-	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%s", port), nil))
+	if err := http.ListenAndServe(fmt.Sprintf(":%s", port), nil); err != nil {
+		Fatalf(context.Background(), "failed http.ListenAndServe.err=%+v\n", err)
+	}
 }
 
 func init() {
+	InitLogger()
 	ctx := context.Background()
 
 	projectID, err := gcpmetadata.GetProjectID()
 	if err != nil {
-		log.Fatalf("failed GetProjectID.err=%+v\n", err)
+		Fatalf(ctx, "failed GetProjectID.err=%+v\n", err)
 	}
 	ProjectID = projectID
-	log.Printf("ProjectID is %s\n", projectID)
+	Infof(ctx, "ProjectID is %s\n", projectID)
 
 	sa, err := gcpmetadata.GetServiceAccountEmail()
 	if err != nil {
-		log.Fatalf("failed get ServiceAccountEmail.err=%+v\n", err)
+		Fatalf(ctx, "failed get ServiceAccountEmail.err=%+v\n", err)
 	}
 	ServiceAccountEmail = sa
 
@@ -66,10 +81,14 @@ func init() {
 			ProjectID: ProjectID,
 		})
 		if err != nil {
-			log.Fatalf("failed stackdriver.NewExporter.err=%+v\n", err)
+			Fatalf(ctx, "failed stackdriver.NewExporter.err=%+v\n", err)
 		}
 		trace.RegisterExporter(exporter)
 		trace.ApplyConfig(trace.Config{DefaultSampler: trace.AlwaysSample()})
+		view.RegisterExporter(exporter)
+	}
+	if err := RegisterViews(); err != nil {
+		Fatalf(ctx, "failed RegisterViews.err=%+v\n", err)
 	}
 
 	createClients(ctx)
@@ -86,26 +105,26 @@ func createClients(ctx context.Context) {
 	{
 		TasksClient, err = cloudtasks.NewClient(ctx, opts...)
 		if err != nil {
-			log.Fatalf("failed cloudtasks.NewClient.err=%+v", err)
+			Fatalf(ctx, "failed cloudtasks.NewClient.err=%+v", err)
 		}
 	}
 	{
 		client, err := ds.NewClient(ctx, ProjectID, opts...)
 		if err != nil {
-			log.Fatalf("failed clouddatastore.NewClient.err=%+v", err)
+			Fatalf(ctx, "failed clouddatastore.NewClient.err=%+v", err)
 		}
 		DatastoreClient, err = clouddatastore.FromClient(ctx, client)
 		if err != nil {
-			log.Fatalf("failed clouddatastore.FromClient.err=%+v", err)
+			Fatalf(ctx, "failed clouddatastore.FromClient.err=%+v", err)
 		}
 	}
 }
 
 func HandleHealthCheck(w http.ResponseWriter, r *http.Request) {
 	msg := "Hello ds2bq"
-	log.Print(msg)
+	Infof(r.Context(), msg)
 	_, err := fmt.Fprintf(w, msg)
 	if err != nil {
-		log.Print(err)
+		Errorf(r.Context(), "%+v", err)
 	}
 }
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"go.opencensus.io/stats"
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/tag"
+)
+
+var (
+	// TaskEnqueueRetryCount is Cloud TasksへのTask追加をRetryした回数
+	TaskEnqueueRetryCount = stats.Int64("ds2bq/task_enqueue/retry_count", "retry count of cloudtasks.CreateTask", stats.UnitDimensionless)
+	// TaskEnqueueFailureCount is RetryしてもCloud TasksにTaskを追加できなかった回数
+	TaskEnqueueFailureCount = stats.Int64("ds2bq/task_enqueue/failure_count", "failure count of cloudtasks.CreateTask", stats.UnitDimensionless)
+	// DSExportDuration is Datastore Export JobがRunningになってから終わるまでの秒数
+	DSExportDuration = stats.Float64("ds2bq/datastore_export/duration", "duration of datastore export job", stats.UnitSeconds)
+	// BQLoadDuration is BQ Load JobがRunningになってから終わるまでの秒数
+	BQLoadDuration = stats.Float64("ds2bq/bigquery_load/duration", "duration of bigquery load job", stats.UnitSeconds)
+	// JobFinishedCount is DSExportJob, BQLoadJobが終わった状態になった回数
+	JobFinishedCount = stats.Int64("ds2bq/job/finished_count", "count of jobs changed to terminal status", stats.UnitDimensionless)
+	// DSExportRetryCount is Datastore Exportを再実行した回数
+	DSExportRetryCount = stats.Int64("ds2bq/datastore_export/retry_count", "retry count of datastore export job", stats.UnitDimensionless)
+	// JobStatusCheckCount is 状態確認のTaskがJobの状態を確認した回数
+	JobStatusCheckCount = stats.Int64("ds2bq/job/status_check_count", "count of job status checks", stats.UnitDimensionless)
+	// JobSLOExceededCount is DSExportJob, BQLoadJobがSLOを超えても終わっていなかった回数
+	JobSLOExceededCount = stats.Int64("ds2bq/job/slo_exceeded_count", "count of jobs exceeded slo", stats.UnitDimensionless)
+)
+
+var (
+	// KeyQueue is Cloud TasksのQueue名
+	KeyQueue, _ = tag.NewKey("queue")
+	// KeyCode is gRPCのStatus Code
+	KeyCode, _ = tag.NewKey("code")
+	// KeyExportProject is Datastore ExportするProjectID
+	KeyExportProject, _ = tag.NewKey("export_project")
+	// KeyKind is BQ LoadするKind
+	KeyKind, _ = tag.NewKey("kind")
+	// KeyJobType is JobTypeDSExport もしくは JobTypeBQLoad
+	KeyJobType, _ = tag.NewKey("job_type")
+	// KeyStatus is Jobが終わった時の状態
+	KeyStatus, _ = tag.NewKey("status")
+)
+
+const (
+	JobTypeDSExport = "datastore_export"
+	JobTypeBQLoad   = "bigquery_load"
+)
+
+// JobDurationDistribution is Jobの所要時間 (秒) のBucket. 30秒から8時間まで
+var JobDurationDistribution = view.Distribution(30, 60, 120, 300, 600, 1200, 1800, 3600, 7200, 14400, 28800)
+
+var (
+	TaskEnqueueRetryCountView = &view.View{
+		Name:        "ds2bq/task_enqueue/retry_count",
+		Description: "retry count of cloudtasks.CreateTask",
+		Measure:     TaskEnqueueRetryCount,
+		Aggregation: view.Count(),
+		TagKeys:     []tag.Key{KeyQueue, KeyCode, KeyExportProject, KeyKind},
+	}
+	TaskEnqueueFailureCountView = &view.View{
+		Name:        "ds2bq/task_enqueue/failure_count",
+		Description: "failure count of cloudtasks.CreateTask",
+		Measure:     TaskEnqueueFailureCount,
+		Aggregation: view.Count(),
+		TagKeys:     []tag.Key{KeyQueue, KeyCode, KeyExportProject, KeyKind},
+	}
+	DSExportDurationView = &view.View{
+		Name:        "ds2bq/datastore_export/duration",
+		Description: "duration of datastore export job",
+		Measure:     DSExportDuration,
+		Aggregation: JobDurationDistribution,
+		TagKeys:     []tag.Key{KeyExportProject, KeyStatus},
+	}
+	BQLoadDurationView = &view.View{
+		Name:        "ds2bq/bigquery_load/duration",
+		Description: "duration of bigquery load job",
+		Measure:     BQLoadDuration,
+		Aggregation: JobDurationDistribution,
+		TagKeys:     []tag.Key{KeyExportProject, KeyKind, KeyStatus},
+	}
+	JobFinishedCountView = &view.View{
+		Name:        "ds2bq/job/finished_count",
+		Description: "count of jobs changed to terminal status",
+		Measure:     JobFinishedCount,
+		Aggregation: view.Count(),
+		TagKeys:     []tag.Key{KeyJobType, KeyExportProject, KeyKind, KeyStatus},
+	}
+	DSExportRetryCountView = &view.View{
+		Name:        "ds2bq/datastore_export/retry_count",
+		Description: "retry count of datastore export job",
+		Measure:     DSExportRetryCount,
+		Aggregation: view.Count(),
+		TagKeys:     []tag.Key{KeyExportProject},
+	}
+	JobStatusCheckCountView = &view.View{
+		Name:        "ds2bq/job/status_check_count",
+		Description: "count of job status checks",
+		Measure:     JobStatusCheckCount,
+		Aggregation: view.Count(),
+		TagKeys:     []tag.Key{KeyJobType, KeyExportProject, KeyKind},
+	}
+	JobSLOExceededCountView = &view.View{
+		Name:        "ds2bq/job/slo_exceeded_count",
+		Description: "count of jobs exceeded slo",
+		Measure:     JobSLOExceededCount,
+		Aggregation: view.Count(),
+		TagKeys:     []tag.Key{KeyJobType, KeyExportProject, KeyKind},
+	}
+)
+
+// Views is ds2bqが登録するView
+var Views = []*view.View{
+	TaskEnqueueRetryCountView,
+	TaskEnqueueFailureCountView,
+	DSExportDurationView,
+	BQLoadDurationView,
+	JobFinishedCountView,
+	DSExportRetryCountView,
+	JobStatusCheckCountView,
+	JobSLOExceededCountView,
+}
+
+// RegisterViews is ds2bqのMetricsのViewを登録する
+func RegisterViews() error {
+	return view.Register(Views...)
+}
+
+// WithJobTags is Task追加のMetricsに付けるように、ctxに export_project, kind のTagを入れる
+func WithJobTags(ctx context.Context, exportProjectID string, kind string) context.Context {
+	ctx, err := tag.New(ctx, tag.Upsert(KeyExportProject, exportProjectID), tag.Upsert(KeyKind, kind))
+	if err != nil {
+		Errorf(ctx, "failed tag.New. err=%v\n", err)
+	}
+	return ctx
+}
+
+// RecordDSExportJobFinished is DSExportJobが終わった状態になったことを記録する
+// Runningから終わった場合は、Runningだった時間も記録する
+func RecordDSExportJobFinished(ctx context.Context, job *DSExportJob, from DSExportJobStatus, runningSince time.Time) {
+	mutators := []tag.Mutator{
+		tag.Upsert(KeyJobType, JobTypeDSExport),
+		tag.Upsert(KeyExportProject, job.ExportProjectID),
+		tag.Upsert(KeyKind, ""),
+		tag.Upsert(KeyStatus, job.Status.String()),
+	}
+	ms := []stats.Measurement{JobFinishedCount.M(1)}
+	if from == DSExportJobStatusRunning {
+		ms = append(ms, DSExportDuration.M(job.ChangeStatusAt.Sub(runningSince).Seconds()))
+	}
+	recordJobMetrics(ctx, mutators, ms...)
+}
+
+// RecordBQLoadJobFinished is BQLoadJobが終わった状態になったことを記録する
+// Runningから終わった場合は、Runningだった時間も記録する
+func RecordBQLoadJobFinished(ctx context.Context, job *BQLoadJob, from BQLoadJobStatus, runningSince time.Time) {
+	mutators := []tag.Mutator{
+		tag.Upsert(KeyJobType, JobTypeBQLoad),
+		tag.Upsert(KeyExportProject, job.ExportProjectID),
+		tag.Upsert(KeyKind, job.Kind),
+		tag.Upsert(KeyStatus, job.Status.String()),
+	}
+	ms := []stats.Measurement{JobFinishedCount.M(1)}
+	if from == BQLoadJobStatusRunning {
+		ms = append(ms, BQLoadDuration.M(job.ChangeStatusAt.Sub(runningSince).Seconds()))
+	}
+	recordJobMetrics(ctx, mutators, ms...)
+}
+
+// RecordDSExportRetry is Datastore Exportを再実行したことを記録する
+func RecordDSExportRetry(ctx context.Context, job *DSExportJob) {
+	recordJobMetrics(ctx, []tag.Mutator{tag.Upsert(KeyExportProject, job.ExportProjectID)}, DSExportRetryCount.M(1))
+}
+
+// RecordJobStatusCheck is 状態確認のTaskがJobの状態を確認したことを記録する
+func RecordJobStatusCheck(ctx context.Context, jobType string, exportProjectID string, kind string) {
+	mutators := []tag.Mutator{
+		tag.Upsert(KeyJobType, jobType),
+		tag.Upsert(KeyExportProject, exportProjectID),
+		tag.Upsert(KeyKind, kind),
+	}
+	recordJobMetrics(ctx, mutators, JobStatusCheckCount.M(1))
+}
+
+// RecordJobSLOExceeded is JobがSLOを超えても終わっていなかったことを記録する
+func RecordJobSLOExceeded(ctx context.Context, jobType string, exportProjectID string, kind string) {
+	mutators := []tag.Mutator{
+		tag.Upsert(KeyJobType, jobType),
+		tag.Upsert(KeyExportProject, exportProjectID),
+		tag.Upsert(KeyKind, kind),
+	}
+	recordJobMetrics(ctx, mutators, JobSLOExceededCount.M(1))
+}
+
+func recordJobMetrics(ctx context.Context, mutators []tag.Mutator, ms ...stats.Measurement) {
+	if err := stats.RecordWithTags(ctx, mutators, ms...); err != nil {
+		Errorf(ctx, "failed stats.RecordWithTags. err=%v\n", err)
+	}
+}
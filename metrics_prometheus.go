@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/morikuni/failure"
+	"go.opencensus.io/stats/view"
+)
+
+var prometheusInvalidNameChars = regexp.MustCompile(`[^a-zA-Z0-9_]`)
+
+// HandlePrometheusMetrics is ds2bqのViewの値をPrometheusのText Formatで返す
+// ローカルでMetricsを確認するためのもので、環境変数 PROMETHEUS_METRICS=true の場合だけ /metrics に登録する
+func HandlePrometheusMetrics(w http.ResponseWriter, r *http.Request) {
+	var buf bytes.Buffer
+	for _, v := range Views {
+		rows, err := view.RetrieveData(v.Name)
+		if err != nil {
+			err = failure.Wrap(err, failure.Messagef("failed view.RetrieveData. view=%v", v.Name))
+			Errorf(r.Context(), "%+v\n", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		buf.WriteString(FormatPrometheusView(v, rows))
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	if _, err := buf.WriteTo(w); err != nil {
+		Errorf(r.Context(), "%+v", err)
+	}
+}
+
+// PrometheusMetricName is Viewの名前をPrometheusのMetric名にする. ds2bq/job/finished_count -> ds2bq_job_finished_count
+func PrometheusMetricName(name string) string {
+	return prometheusInvalidNameChars.ReplaceAllString(name, "_")
+}
+
+// FormatPrometheusView is ViewのRowをPrometheusのText Formatにする
+// Count, Sum は counter, Distribution は histogram, LastValue は gauge になる
+func FormatPrometheusView(v *view.View, rows []*view.Row) string {
+	name := PrometheusMetricName(v.Name)
+	var metricType string
+	switch v.Aggregation.Type {
+	case view.AggTypeCount, view.AggTypeSum:
+		metricType = "counter"
+	case view.AggTypeDistribution:
+		metricType = "histogram"
+	case view.AggTypeLastValue:
+		metricType = "gauge"
+	default:
+		return ""
+	}
+
+	rows = append([]*view.Row{}, rows...)
+	sort.Slice(rows, func(i, j int) bool {
+		return formatPrometheusLabels(prometheusLabels(rows[i])) < formatPrometheusLabels(prometheusLabels(rows[j]))
+	})
+
+	var lines []string
+	for _, row := range rows {
+		labels := prometheusLabels(row)
+		switch data := row.Data.(type) {
+		case *view.CountData:
+			lines = append(lines, fmt.Sprintf("%s%s %d", name, formatPrometheusLabels(labels), data.Value))
+		case *view.SumData:
+			lines = append(lines, fmt.Sprintf("%s%s %s", name, formatPrometheusLabels(labels), formatPrometheusFloat(data.Value)))
+		case *view.LastValueData:
+			lines = append(lines, fmt.Sprintf("%s%s %s", name, formatPrometheusLabels(labels), formatPrometheusFloat(data.Value)))
+		case *view.DistributionData:
+			var cumulative int64
+			for i, bound := range v.Aggregation.Buckets {
+				if i < len(data.CountPerBucket) {
+					cumulative += data.CountPerBucket[i]
+				}
+				l := append(append([]string{}, labels...), fmt.Sprintf(`le="%s"`, formatPrometheusFloat(bound)))
+				lines = append(lines, fmt.Sprintf("%s_bucket%s %d", name, formatPrometheusLabels(l), cumulative))
+			}
+			l := append(append([]string{}, labels...), `le="+Inf"`)
+			lines = append(lines, fmt.Sprintf("%s_bucket%s %d", name, formatPrometheusLabels(l), data.Count))
+			lines = append(lines, fmt.Sprintf("%s_sum%s %s", name, formatPrometheusLabels(labels), formatPrometheusFloat(data.Sum())))
+			lines = append(lines, fmt.Sprintf("%s_count%s %d", name, formatPrometheusLabels(labels), data.Count))
+		}
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "# HELP %s %s\n", name, v.Description)
+	fmt.Fprintf(&b, "# TYPE %s %s\n", name, metricType)
+	for _, l := range lines {
+		b.WriteString(l)
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+func prometheusLabels(row *view.Row) []string {
+	var labels []string
+	for _, t := range row.Tags {
+		labels = append(labels, fmt.Sprintf("%s=%s", PrometheusMetricName(t.Key.Name()), strconv.Quote(t.Value)))
+	}
+	return labels
+}
+
+func formatPrometheusLabels(labels []string) string {
+	if len(labels) < 1 {
+		return ""
+	}
+	return "{" + strings.Join(labels, ",") + "}"
+}
+
+func formatPrometheusFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
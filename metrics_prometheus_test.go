@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"go.opencensus.io/stats"
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/tag"
+)
+
+func TestFormatPrometheusView(t *testing.T) {
+	measure := stats.Int64("ds2bq/test/measure", "test measure", stats.UnitDimensionless)
+	tags := func(project string, kind string) []tag.Tag {
+		return []tag.Tag{{Key: KeyExportProject, Value: project}, {Key: KeyKind, Value: kind}}
+	}
+
+	cases := []struct {
+		name string
+		view *view.View
+		rows []*view.Row
+		want string
+	}{
+		{"count",
+			&view.View{Name: "ds2bq/job/finished_count", Description: "count of jobs", Measure: measure, Aggregation: view.Count()},
+			[]*view.Row{
+				{Tags: tags("gcpugjp-dev", "PugUser"), Data: &view.CountData{Value: 1}},
+				{Tags: tags("gcpugjp-dev", "PugEvent"), Data: &view.CountData{Value: 3}},
+			},
+			`# HELP ds2bq_job_finished_count count of jobs
+# TYPE ds2bq_job_finished_count counter
+ds2bq_job_finished_count{export_project="gcpugjp-dev",kind="PugEvent"} 3
+ds2bq_job_finished_count{export_project="gcpugjp-dev",kind="PugUser"} 1
+`,
+		},
+		{"distribution",
+			&view.View{Name: "ds2bq/bigquery_load/duration", Description: "duration", Measure: measure, Aggregation: view.Distribution(60, 600)},
+			[]*view.Row{
+				{Tags: tags("gcpugjp-dev", "PugEvent"), Data: &view.DistributionData{Count: 3, Mean: 200, CountPerBucket: []int64{1, 1, 1}}},
+			},
+			`# HELP ds2bq_bigquery_load_duration duration
+# TYPE ds2bq_bigquery_load_duration histogram
+ds2bq_bigquery_load_duration_bucket{export_project="gcpugjp-dev",kind="PugEvent",le="60"} 1
+ds2bq_bigquery_load_duration_bucket{export_project="gcpugjp-dev",kind="PugEvent",le="600"} 2
+ds2bq_bigquery_load_duration_bucket{export_project="gcpugjp-dev",kind="PugEvent",le="+Inf"} 3
+ds2bq_bigquery_load_duration_sum{export_project="gcpugjp-dev",kind="PugEvent"} 600
+ds2bq_bigquery_load_duration_count{export_project="gcpugjp-dev",kind="PugEvent"} 3
+`,
+		},
+		{"no rows",
+			&view.View{Name: "ds2bq/test/last", Description: "last value", Measure: measure, Aggregation: view.LastValue()},
+			nil,
+			`# HELP ds2bq_test_last last value
+# TYPE ds2bq_test_last gauge
+`,
+		},
+	}
+
+	for _, tt := range cases {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			if e, g := tt.want, FormatPrometheusView(tt.view, tt.rows); e != g {
+				t.Errorf("want\n%v\nbut got\n%v", e, g)
+			}
+		})
+	}
+}
+
+func TestRecordBQLoadJobFinished(t *testing.T) {
+	if err := RegisterViews(); err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	job := &BQLoadJob{
+		ExportProjectID: "gcpugjp-dev",
+		Kind:            "TestRecordBQLoadJobFinished",
+		Status:          BQLoadJobStatusDone,
+		ChangeStatusAt:  now,
+	}
+	RecordBQLoadJobFinished(context.Background(), job, BQLoadJobStatusRunning, now.Add(-90*time.Second))
+
+	rows, err := view.RetrieveData(BQLoadDurationView.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, row := range rows {
+		for _, tg := range row.Tags {
+			if tg.Key == KeyKind && tg.Value == job.Kind {
+				data := row.Data.(*view.DistributionData)
+				if e, g := int64(1), data.Count; e != g {
+					t.Errorf("want Count %v but got %v", e, g)
+				}
+				if e, g := float64(90), data.Sum(); e != g {
+					t.Errorf("want Sum %v but got %v", e, g)
+				}
+				return
+			}
+		}
+	}
+	t.Errorf("row of kind %v is not found. rows=%+v", job.Kind, rows)
+}
@@ -223,3 +223,908 @@ func (p *BQLoadJobQueryProperty) Desc() *BQLoadJobQueryBuilder {
 	}
 	return p.bldr
 }
+
+// DSExportJobQueryBuilder build query for DSExportJob.
+type DSExportJobQueryBuilder struct {
+	q                       datastore.Query
+	plugin                  Plugin
+	DSExportJobIDs          *DSExportJobQueryProperty
+	ExportProjectID         *DSExportJobQueryProperty
+	StatusCheckCount        *DSExportJobQueryProperty
+	CheckTaskRetryCount     *DSExportJobQueryProperty
+	CheckTaskExecutionCount *DSExportJobQueryProperty
+	MaxStatusCheckCount     *DSExportJobQueryProperty
+	TimeoutSeconds          *DSExportJobQueryProperty
+	CancelOnTimeout         *DSExportJobQueryProperty
+	Status                  *DSExportJobQueryProperty
+	MaxRetryCount           *DSExportJobQueryProperty
+	RetryCount              *DSExportJobQueryProperty
+	ChangeStatusAt          *DSExportJobQueryProperty
+	RunLockID               *DSExportJobQueryProperty
+	ExportedEntities        *DSExportJobQueryProperty
+	ExportedBytes           *DSExportJobQueryProperty
+	ExportStartedAt         *DSExportJobQueryProperty
+	ExportEndedAt           *DSExportJobQueryProperty
+	TriggerType             *DSExportJobQueryProperty
+	TriggeredBy             *DSExportJobQueryProperty
+	RetryTriggerType        *DSExportJobQueryProperty
+	RetryTriggeredBy        *DSExportJobQueryProperty
+	RetriedAt               *DSExportJobQueryProperty
+	CreatedAt               *DSExportJobQueryProperty
+	UpdatedAt               *DSExportJobQueryProperty
+	SchemaVersion           *DSExportJobQueryProperty
+}
+
+// DSExportJobQueryProperty has property information for DSExportJobQueryBuilder.
+type DSExportJobQueryProperty struct {
+	bldr *DSExportJobQueryBuilder
+	name string
+}
+
+// NewDSExportJobQueryBuilder create new DSExportJobQueryBuilder.
+func NewDSExportJobQueryBuilder(client datastore.Client) *DSExportJobQueryBuilder {
+	return NewDSExportJobQueryBuilderWithKind(client, "DSExportJob")
+}
+
+// NewDSExportJobQueryBuilderWithKind create new DSExportJobQueryBuilder with specific kind.
+func NewDSExportJobQueryBuilderWithKind(client datastore.Client, kind string) *DSExportJobQueryBuilder {
+	q := client.NewQuery(kind)
+	bldr := &DSExportJobQueryBuilder{q: q}
+	bldr.DSExportJobIDs = &DSExportJobQueryProperty{
+		bldr: bldr,
+		name: "DSExportJobIDs",
+	}
+	bldr.ExportProjectID = &DSExportJobQueryProperty{
+		bldr: bldr,
+		name: "ExportProjectID",
+	}
+	bldr.StatusCheckCount = &DSExportJobQueryProperty{
+		bldr: bldr,
+		name: "StatusCheckCount",
+	}
+	bldr.CheckTaskRetryCount = &DSExportJobQueryProperty{
+		bldr: bldr,
+		name: "CheckTaskRetryCount",
+	}
+	bldr.CheckTaskExecutionCount = &DSExportJobQueryProperty{
+		bldr: bldr,
+		name: "CheckTaskExecutionCount",
+	}
+	bldr.MaxStatusCheckCount = &DSExportJobQueryProperty{
+		bldr: bldr,
+		name: "MaxStatusCheckCount",
+	}
+	bldr.TimeoutSeconds = &DSExportJobQueryProperty{
+		bldr: bldr,
+		name: "TimeoutSeconds",
+	}
+	bldr.CancelOnTimeout = &DSExportJobQueryProperty{
+		bldr: bldr,
+		name: "CancelOnTimeout",
+	}
+	bldr.Status = &DSExportJobQueryProperty{
+		bldr: bldr,
+		name: "Status",
+	}
+	bldr.MaxRetryCount = &DSExportJobQueryProperty{
+		bldr: bldr,
+		name: "MaxRetryCount",
+	}
+	bldr.RetryCount = &DSExportJobQueryProperty{
+		bldr: bldr,
+		name: "RetryCount",
+	}
+	bldr.ChangeStatusAt = &DSExportJobQueryProperty{
+		bldr: bldr,
+		name: "ChangeStatusAt",
+	}
+	bldr.RunLockID = &DSExportJobQueryProperty{
+		bldr: bldr,
+		name: "RunLockID",
+	}
+	bldr.ExportedEntities = &DSExportJobQueryProperty{
+		bldr: bldr,
+		name: "ExportedEntities",
+	}
+	bldr.ExportedBytes = &DSExportJobQueryProperty{
+		bldr: bldr,
+		name: "ExportedBytes",
+	}
+	bldr.ExportStartedAt = &DSExportJobQueryProperty{
+		bldr: bldr,
+		name: "ExportStartedAt",
+	}
+	bldr.ExportEndedAt = &DSExportJobQueryProperty{
+		bldr: bldr,
+		name: "ExportEndedAt",
+	}
+	bldr.TriggerType = &DSExportJobQueryProperty{
+		bldr: bldr,
+		name: "TriggerType",
+	}
+	bldr.TriggeredBy = &DSExportJobQueryProperty{
+		bldr: bldr,
+		name: "TriggeredBy",
+	}
+	bldr.RetryTriggerType = &DSExportJobQueryProperty{
+		bldr: bldr,
+		name: "RetryTriggerType",
+	}
+	bldr.RetryTriggeredBy = &DSExportJobQueryProperty{
+		bldr: bldr,
+		name: "RetryTriggeredBy",
+	}
+	bldr.RetriedAt = &DSExportJobQueryProperty{
+		bldr: bldr,
+		name: "RetriedAt",
+	}
+	bldr.CreatedAt = &DSExportJobQueryProperty{
+		bldr: bldr,
+		name: "CreatedAt",
+	}
+	bldr.UpdatedAt = &DSExportJobQueryProperty{
+		bldr: bldr,
+		name: "UpdatedAt",
+	}
+	bldr.SchemaVersion = &DSExportJobQueryProperty{
+		bldr: bldr,
+		name: "SchemaVersion",
+	}
+
+	if plugger, ok := interface{}(bldr).(Plugger); ok {
+		bldr.plugin = plugger.Plugin()
+		bldr.plugin.Init("DSExportJob")
+	}
+
+	return bldr
+}
+
+// Ancestor sets parent key to ancestor query.
+func (bldr *DSExportJobQueryBuilder) Ancestor(parentKey datastore.Key) *DSExportJobQueryBuilder {
+	bldr.q = bldr.q.Ancestor(parentKey)
+	if bldr.plugin != nil {
+		bldr.plugin.Ancestor(parentKey)
+	}
+	return bldr
+}
+
+// KeysOnly sets keys only option to query.
+func (bldr *DSExportJobQueryBuilder) KeysOnly() *DSExportJobQueryBuilder {
+	bldr.q = bldr.q.KeysOnly()
+	if bldr.plugin != nil {
+		bldr.plugin.KeysOnly()
+	}
+	return bldr
+}
+
+// Start setup to query.
+func (bldr *DSExportJobQueryBuilder) Start(cur datastore.Cursor) *DSExportJobQueryBuilder {
+	bldr.q = bldr.q.Start(cur)
+	if bldr.plugin != nil {
+		bldr.plugin.Start(cur)
+	}
+	return bldr
+}
+
+// Offset setup to query.
+func (bldr *DSExportJobQueryBuilder) Offset(offset int) *DSExportJobQueryBuilder {
+	bldr.q = bldr.q.Offset(offset)
+	if bldr.plugin != nil {
+		bldr.plugin.Offset(offset)
+	}
+	return bldr
+}
+
+// Limit setup to query.
+func (bldr *DSExportJobQueryBuilder) Limit(limit int) *DSExportJobQueryBuilder {
+	bldr.q = bldr.q.Limit(limit)
+	if bldr.plugin != nil {
+		bldr.plugin.Limit(limit)
+	}
+	return bldr
+}
+
+// Query returns *datastore.Query.
+func (bldr *DSExportJobQueryBuilder) Query() datastore.Query {
+	return bldr.q
+}
+
+// Filter with op & value.
+func (p *DSExportJobQueryProperty) Filter(op string, value interface{}) *DSExportJobQueryBuilder {
+	switch op {
+	case "<=":
+		p.LessThanOrEqual(value)
+	case ">=":
+		p.GreaterThanOrEqual(value)
+	case "<":
+		p.LessThan(value)
+	case ">":
+		p.GreaterThan(value)
+	case "=":
+		p.Equal(value)
+	default:
+		p.bldr.q = p.bldr.q.Filter(p.name+" "+op, value) // error raised by native query
+	}
+	if p.bldr.plugin != nil {
+		p.bldr.plugin.Filter(p.name, op, value)
+	}
+	return p.bldr
+}
+
+// LessThanOrEqual filter with value.
+func (p *DSExportJobQueryProperty) LessThanOrEqual(value interface{}) *DSExportJobQueryBuilder {
+	p.bldr.q = p.bldr.q.Filter(p.name+" <=", value)
+	if p.bldr.plugin != nil {
+		p.bldr.plugin.Filter(p.name, "<=", value)
+	}
+	return p.bldr
+}
+
+// GreaterThanOrEqual filter with value.
+func (p *DSExportJobQueryProperty) GreaterThanOrEqual(value interface{}) *DSExportJobQueryBuilder {
+	p.bldr.q = p.bldr.q.Filter(p.name+" >=", value)
+	if p.bldr.plugin != nil {
+		p.bldr.plugin.Filter(p.name, ">=", value)
+	}
+	return p.bldr
+}
+
+// LessThan filter with value.
+func (p *DSExportJobQueryProperty) LessThan(value interface{}) *DSExportJobQueryBuilder {
+	p.bldr.q = p.bldr.q.Filter(p.name+" <", value)
+	if p.bldr.plugin != nil {
+		p.bldr.plugin.Filter(p.name, "<", value)
+	}
+	return p.bldr
+}
+
+// GreaterThan filter with value.
+func (p *DSExportJobQueryProperty) GreaterThan(value interface{}) *DSExportJobQueryBuilder {
+	p.bldr.q = p.bldr.q.Filter(p.name+" >", value)
+	if p.bldr.plugin != nil {
+		p.bldr.plugin.Filter(p.name, ">", value)
+	}
+	return p.bldr
+}
+
+// Equal filter with value.
+func (p *DSExportJobQueryProperty) Equal(value interface{}) *DSExportJobQueryBuilder {
+	p.bldr.q = p.bldr.q.Filter(p.name+" =", value)
+	if p.bldr.plugin != nil {
+		p.bldr.plugin.Filter(p.name, "=", value)
+	}
+	return p.bldr
+}
+
+// Asc order.
+func (p *DSExportJobQueryProperty) Asc() *DSExportJobQueryBuilder {
+	p.bldr.q = p.bldr.q.Order(p.name)
+	if p.bldr.plugin != nil {
+		p.bldr.plugin.Asc(p.name)
+	}
+	return p.bldr
+}
+
+// Desc order.
+func (p *DSExportJobQueryProperty) Desc() *DSExportJobQueryBuilder {
+	p.bldr.q = p.bldr.q.Order("-" + p.name)
+	if p.bldr.plugin != nil {
+		p.bldr.plugin.Desc(p.name)
+	}
+	return p.bldr
+}
+
+// TaskOutboxQueryBuilder build query for TaskOutbox.
+type TaskOutboxQueryBuilder struct {
+	q             datastore.Query
+	plugin        Plugin
+	Queue         *TaskOutboxQueryProperty
+	CreatedAt     *TaskOutboxQueryProperty
+	UpdatedAt     *TaskOutboxQueryProperty
+	SchemaVersion *TaskOutboxQueryProperty
+}
+
+// TaskOutboxQueryProperty has property information for TaskOutboxQueryBuilder.
+type TaskOutboxQueryProperty struct {
+	bldr *TaskOutboxQueryBuilder
+	name string
+}
+
+// NewTaskOutboxQueryBuilder create new TaskOutboxQueryBuilder.
+func NewTaskOutboxQueryBuilder(client datastore.Client) *TaskOutboxQueryBuilder {
+	return NewTaskOutboxQueryBuilderWithKind(client, "TaskOutbox")
+}
+
+// NewTaskOutboxQueryBuilderWithKind create new TaskOutboxQueryBuilder with specific kind.
+func NewTaskOutboxQueryBuilderWithKind(client datastore.Client, kind string) *TaskOutboxQueryBuilder {
+	q := client.NewQuery(kind)
+	bldr := &TaskOutboxQueryBuilder{q: q}
+	bldr.Queue = &TaskOutboxQueryProperty{
+		bldr: bldr,
+		name: "Queue",
+	}
+	bldr.CreatedAt = &TaskOutboxQueryProperty{
+		bldr: bldr,
+		name: "CreatedAt",
+	}
+	bldr.UpdatedAt = &TaskOutboxQueryProperty{
+		bldr: bldr,
+		name: "UpdatedAt",
+	}
+	bldr.SchemaVersion = &TaskOutboxQueryProperty{
+		bldr: bldr,
+		name: "SchemaVersion",
+	}
+
+	if plugger, ok := interface{}(bldr).(Plugger); ok {
+		bldr.plugin = plugger.Plugin()
+		bldr.plugin.Init("TaskOutbox")
+	}
+
+	return bldr
+}
+
+// Ancestor sets parent key to ancestor query.
+func (bldr *TaskOutboxQueryBuilder) Ancestor(parentKey datastore.Key) *TaskOutboxQueryBuilder {
+	bldr.q = bldr.q.Ancestor(parentKey)
+	if bldr.plugin != nil {
+		bldr.plugin.Ancestor(parentKey)
+	}
+	return bldr
+}
+
+// KeysOnly sets keys only option to query.
+func (bldr *TaskOutboxQueryBuilder) KeysOnly() *TaskOutboxQueryBuilder {
+	bldr.q = bldr.q.KeysOnly()
+	if bldr.plugin != nil {
+		bldr.plugin.KeysOnly()
+	}
+	return bldr
+}
+
+// Start setup to query.
+func (bldr *TaskOutboxQueryBuilder) Start(cur datastore.Cursor) *TaskOutboxQueryBuilder {
+	bldr.q = bldr.q.Start(cur)
+	if bldr.plugin != nil {
+		bldr.plugin.Start(cur)
+	}
+	return bldr
+}
+
+// Offset setup to query.
+func (bldr *TaskOutboxQueryBuilder) Offset(offset int) *TaskOutboxQueryBuilder {
+	bldr.q = bldr.q.Offset(offset)
+	if bldr.plugin != nil {
+		bldr.plugin.Offset(offset)
+	}
+	return bldr
+}
+
+// Limit setup to query.
+func (bldr *TaskOutboxQueryBuilder) Limit(limit int) *TaskOutboxQueryBuilder {
+	bldr.q = bldr.q.Limit(limit)
+	if bldr.plugin != nil {
+		bldr.plugin.Limit(limit)
+	}
+	return bldr
+}
+
+// Query returns *datastore.Query.
+func (bldr *TaskOutboxQueryBuilder) Query() datastore.Query {
+	return bldr.q
+}
+
+// Filter with op & value.
+func (p *TaskOutboxQueryProperty) Filter(op string, value interface{}) *TaskOutboxQueryBuilder {
+	switch op {
+	case "<=":
+		p.LessThanOrEqual(value)
+	case ">=":
+		p.GreaterThanOrEqual(value)
+	case "<":
+		p.LessThan(value)
+	case ">":
+		p.GreaterThan(value)
+	case "=":
+		p.Equal(value)
+	default:
+		p.bldr.q = p.bldr.q.Filter(p.name+" "+op, value) // error raised by native query
+	}
+	if p.bldr.plugin != nil {
+		p.bldr.plugin.Filter(p.name, op, value)
+	}
+	return p.bldr
+}
+
+// LessThanOrEqual filter with value.
+func (p *TaskOutboxQueryProperty) LessThanOrEqual(value interface{}) *TaskOutboxQueryBuilder {
+	p.bldr.q = p.bldr.q.Filter(p.name+" <=", value)
+	if p.bldr.plugin != nil {
+		p.bldr.plugin.Filter(p.name, "<=", value)
+	}
+	return p.bldr
+}
+
+// GreaterThanOrEqual filter with value.
+func (p *TaskOutboxQueryProperty) GreaterThanOrEqual(value interface{}) *TaskOutboxQueryBuilder {
+	p.bldr.q = p.bldr.q.Filter(p.name+" >=", value)
+	if p.bldr.plugin != nil {
+		p.bldr.plugin.Filter(p.name, ">=", value)
+	}
+	return p.bldr
+}
+
+// LessThan filter with value.
+func (p *TaskOutboxQueryProperty) LessThan(value interface{}) *TaskOutboxQueryBuilder {
+	p.bldr.q = p.bldr.q.Filter(p.name+" <", value)
+	if p.bldr.plugin != nil {
+		p.bldr.plugin.Filter(p.name, "<", value)
+	}
+	return p.bldr
+}
+
+// GreaterThan filter with value.
+func (p *TaskOutboxQueryProperty) GreaterThan(value interface{}) *TaskOutboxQueryBuilder {
+	p.bldr.q = p.bldr.q.Filter(p.name+" >", value)
+	if p.bldr.plugin != nil {
+		p.bldr.plugin.Filter(p.name, ">", value)
+	}
+	return p.bldr
+}
+
+// Equal filter with value.
+func (p *TaskOutboxQueryProperty) Equal(value interface{}) *TaskOutboxQueryBuilder {
+	p.bldr.q = p.bldr.q.Filter(p.name+" =", value)
+	if p.bldr.plugin != nil {
+		p.bldr.plugin.Filter(p.name, "=", value)
+	}
+	return p.bldr
+}
+
+// Asc order.
+func (p *TaskOutboxQueryProperty) Asc() *TaskOutboxQueryBuilder {
+	p.bldr.q = p.bldr.q.Order(p.name)
+	if p.bldr.plugin != nil {
+		p.bldr.plugin.Asc(p.name)
+	}
+	return p.bldr
+}
+
+// Desc order.
+func (p *TaskOutboxQueryProperty) Desc() *TaskOutboxQueryBuilder {
+	p.bldr.q = p.bldr.q.Order("-" + p.name)
+	if p.bldr.plugin != nil {
+		p.bldr.plugin.Desc(p.name)
+	}
+	return p.bldr
+}
+
+// DeadLetterTaskQueryBuilder build query for DeadLetterTask.
+type DeadLetterTaskQueryBuilder struct {
+	q              datastore.Query
+	plugin         Plugin
+	Queue          *DeadLetterTaskQueryProperty
+	DS2BQJobID     *DeadLetterTaskQueryProperty
+	Kind           *DeadLetterTaskQueryProperty
+	RetryCount     *DeadLetterTaskQueryProperty
+	ExecutionCount *DeadLetterTaskQueryProperty
+	ReplayedAt     *DeadLetterTaskQueryProperty
+	CreatedAt      *DeadLetterTaskQueryProperty
+	UpdatedAt      *DeadLetterTaskQueryProperty
+	SchemaVersion  *DeadLetterTaskQueryProperty
+}
+
+// DeadLetterTaskQueryProperty has property information for DeadLetterTaskQueryBuilder.
+type DeadLetterTaskQueryProperty struct {
+	bldr *DeadLetterTaskQueryBuilder
+	name string
+}
+
+// NewDeadLetterTaskQueryBuilder create new DeadLetterTaskQueryBuilder.
+func NewDeadLetterTaskQueryBuilder(client datastore.Client) *DeadLetterTaskQueryBuilder {
+	return NewDeadLetterTaskQueryBuilderWithKind(client, "DeadLetterTask")
+}
+
+// NewDeadLetterTaskQueryBuilderWithKind create new DeadLetterTaskQueryBuilder with specific kind.
+func NewDeadLetterTaskQueryBuilderWithKind(client datastore.Client, kind string) *DeadLetterTaskQueryBuilder {
+	q := client.NewQuery(kind)
+	bldr := &DeadLetterTaskQueryBuilder{q: q}
+	bldr.Queue = &DeadLetterTaskQueryProperty{
+		bldr: bldr,
+		name: "Queue",
+	}
+	bldr.DS2BQJobID = &DeadLetterTaskQueryProperty{
+		bldr: bldr,
+		name: "DS2BQJobID",
+	}
+	bldr.Kind = &DeadLetterTaskQueryProperty{
+		bldr: bldr,
+		name: "Kind",
+	}
+	bldr.RetryCount = &DeadLetterTaskQueryProperty{
+		bldr: bldr,
+		name: "RetryCount",
+	}
+	bldr.ExecutionCount = &DeadLetterTaskQueryProperty{
+		bldr: bldr,
+		name: "ExecutionCount",
+	}
+	bldr.ReplayedAt = &DeadLetterTaskQueryProperty{
+		bldr: bldr,
+		name: "ReplayedAt",
+	}
+	bldr.CreatedAt = &DeadLetterTaskQueryProperty{
+		bldr: bldr,
+		name: "CreatedAt",
+	}
+	bldr.UpdatedAt = &DeadLetterTaskQueryProperty{
+		bldr: bldr,
+		name: "UpdatedAt",
+	}
+	bldr.SchemaVersion = &DeadLetterTaskQueryProperty{
+		bldr: bldr,
+		name: "SchemaVersion",
+	}
+
+	if plugger, ok := interface{}(bldr).(Plugger); ok {
+		bldr.plugin = plugger.Plugin()
+		bldr.plugin.Init("DeadLetterTask")
+	}
+
+	return bldr
+}
+
+// Ancestor sets parent key to ancestor query.
+func (bldr *DeadLetterTaskQueryBuilder) Ancestor(parentKey datastore.Key) *DeadLetterTaskQueryBuilder {
+	bldr.q = bldr.q.Ancestor(parentKey)
+	if bldr.plugin != nil {
+		bldr.plugin.Ancestor(parentKey)
+	}
+	return bldr
+}
+
+// KeysOnly sets keys only option to query.
+func (bldr *DeadLetterTaskQueryBuilder) KeysOnly() *DeadLetterTaskQueryBuilder {
+	bldr.q = bldr.q.KeysOnly()
+	if bldr.plugin != nil {
+		bldr.plugin.KeysOnly()
+	}
+	return bldr
+}
+
+// Start setup to query.
+func (bldr *DeadLetterTaskQueryBuilder) Start(cur datastore.Cursor) *DeadLetterTaskQueryBuilder {
+	bldr.q = bldr.q.Start(cur)
+	if bldr.plugin != nil {
+		bldr.plugin.Start(cur)
+	}
+	return bldr
+}
+
+// Offset setup to query.
+func (bldr *DeadLetterTaskQueryBuilder) Offset(offset int) *DeadLetterTaskQueryBuilder {
+	bldr.q = bldr.q.Offset(offset)
+	if bldr.plugin != nil {
+		bldr.plugin.Offset(offset)
+	}
+	return bldr
+}
+
+// Limit setup to query.
+func (bldr *DeadLetterTaskQueryBuilder) Limit(limit int) *DeadLetterTaskQueryBuilder {
+	bldr.q = bldr.q.Limit(limit)
+	if bldr.plugin != nil {
+		bldr.plugin.Limit(limit)
+	}
+	return bldr
+}
+
+// Query returns *datastore.Query.
+func (bldr *DeadLetterTaskQueryBuilder) Query() datastore.Query {
+	return bldr.q
+}
+
+// Filter with op & value.
+func (p *DeadLetterTaskQueryProperty) Filter(op string, value interface{}) *DeadLetterTaskQueryBuilder {
+	switch op {
+	case "<=":
+		p.LessThanOrEqual(value)
+	case ">=":
+		p.GreaterThanOrEqual(value)
+	case "<":
+		p.LessThan(value)
+	case ">":
+		p.GreaterThan(value)
+	case "=":
+		p.Equal(value)
+	default:
+		p.bldr.q = p.bldr.q.Filter(p.name+" "+op, value) // error raised by native query
+	}
+	if p.bldr.plugin != nil {
+		p.bldr.plugin.Filter(p.name, op, value)
+	}
+	return p.bldr
+}
+
+// LessThanOrEqual filter with value.
+func (p *DeadLetterTaskQueryProperty) LessThanOrEqual(value interface{}) *DeadLetterTaskQueryBuilder {
+	p.bldr.q = p.bldr.q.Filter(p.name+" <=", value)
+	if p.bldr.plugin != nil {
+		p.bldr.plugin.Filter(p.name, "<=", value)
+	}
+	return p.bldr
+}
+
+// GreaterThanOrEqual filter with value.
+func (p *DeadLetterTaskQueryProperty) GreaterThanOrEqual(value interface{}) *DeadLetterTaskQueryBuilder {
+	p.bldr.q = p.bldr.q.Filter(p.name+" >=", value)
+	if p.bldr.plugin != nil {
+		p.bldr.plugin.Filter(p.name, ">=", value)
+	}
+	return p.bldr
+}
+
+// LessThan filter with value.
+func (p *DeadLetterTaskQueryProperty) LessThan(value interface{}) *DeadLetterTaskQueryBuilder {
+	p.bldr.q = p.bldr.q.Filter(p.name+" <", value)
+	if p.bldr.plugin != nil {
+		p.bldr.plugin.Filter(p.name, "<", value)
+	}
+	return p.bldr
+}
+
+// GreaterThan filter with value.
+func (p *DeadLetterTaskQueryProperty) GreaterThan(value interface{}) *DeadLetterTaskQueryBuilder {
+	p.bldr.q = p.bldr.q.Filter(p.name+" >", value)
+	if p.bldr.plugin != nil {
+		p.bldr.plugin.Filter(p.name, ">", value)
+	}
+	return p.bldr
+}
+
+// Equal filter with value.
+func (p *DeadLetterTaskQueryProperty) Equal(value interface{}) *DeadLetterTaskQueryBuilder {
+	p.bldr.q = p.bldr.q.Filter(p.name+" =", value)
+	if p.bldr.plugin != nil {
+		p.bldr.plugin.Filter(p.name, "=", value)
+	}
+	return p.bldr
+}
+
+// Asc order.
+func (p *DeadLetterTaskQueryProperty) Asc() *DeadLetterTaskQueryBuilder {
+	p.bldr.q = p.bldr.q.Order(p.name)
+	if p.bldr.plugin != nil {
+		p.bldr.plugin.Asc(p.name)
+	}
+	return p.bldr
+}
+
+// Desc order.
+func (p *DeadLetterTaskQueryProperty) Desc() *DeadLetterTaskQueryBuilder {
+	p.bldr.q = p.bldr.q.Order("-" + p.name)
+	if p.bldr.plugin != nil {
+		p.bldr.plugin.Desc(p.name)
+	}
+	return p.bldr
+}
+
+// JobStatusEventQueryBuilder build query for JobStatusEvent.
+type JobStatusEventQueryBuilder struct {
+	q             datastore.Query
+	plugin        Plugin
+	DS2BQJobID    *JobStatusEventQueryProperty
+	JobKind       *JobStatusEventQueryProperty
+	Kind          *JobStatusEventQueryProperty
+	FromStatus    *JobStatusEventQueryProperty
+	ToStatus      *JobStatusEventQueryProperty
+	OperationID   *JobStatusEventQueryProperty
+	Attempt       *JobStatusEventQueryProperty
+	ChangedAt     *JobStatusEventQueryProperty
+	CreatedAt     *JobStatusEventQueryProperty
+	UpdatedAt     *JobStatusEventQueryProperty
+	SchemaVersion *JobStatusEventQueryProperty
+}
+
+// JobStatusEventQueryProperty has property information for JobStatusEventQueryBuilder.
+type JobStatusEventQueryProperty struct {
+	bldr *JobStatusEventQueryBuilder
+	name string
+}
+
+// NewJobStatusEventQueryBuilder create new JobStatusEventQueryBuilder.
+func NewJobStatusEventQueryBuilder(client datastore.Client) *JobStatusEventQueryBuilder {
+	return NewJobStatusEventQueryBuilderWithKind(client, "JobStatusEvent")
+}
+
+// NewJobStatusEventQueryBuilderWithKind create new JobStatusEventQueryBuilder with specific kind.
+func NewJobStatusEventQueryBuilderWithKind(client datastore.Client, kind string) *JobStatusEventQueryBuilder {
+	q := client.NewQuery(kind)
+	bldr := &JobStatusEventQueryBuilder{q: q}
+	bldr.DS2BQJobID = &JobStatusEventQueryProperty{
+		bldr: bldr,
+		name: "DS2BQJobID",
+	}
+	bldr.JobKind = &JobStatusEventQueryProperty{
+		bldr: bldr,
+		name: "JobKind",
+	}
+	bldr.Kind = &JobStatusEventQueryProperty{
+		bldr: bldr,
+		name: "Kind",
+	}
+	bldr.FromStatus = &JobStatusEventQueryProperty{
+		bldr: bldr,
+		name: "FromStatus",
+	}
+	bldr.ToStatus = &JobStatusEventQueryProperty{
+		bldr: bldr,
+		name: "ToStatus",
+	}
+	bldr.OperationID = &JobStatusEventQueryProperty{
+		bldr: bldr,
+		name: "OperationID",
+	}
+	bldr.Attempt = &JobStatusEventQueryProperty{
+		bldr: bldr,
+		name: "Attempt",
+	}
+	bldr.ChangedAt = &JobStatusEventQueryProperty{
+		bldr: bldr,
+		name: "ChangedAt",
+	}
+	bldr.CreatedAt = &JobStatusEventQueryProperty{
+		bldr: bldr,
+		name: "CreatedAt",
+	}
+	bldr.UpdatedAt = &JobStatusEventQueryProperty{
+		bldr: bldr,
+		name: "UpdatedAt",
+	}
+	bldr.SchemaVersion = &JobStatusEventQueryProperty{
+		bldr: bldr,
+		name: "SchemaVersion",
+	}
+
+	if plugger, ok := interface{}(bldr).(Plugger); ok {
+		bldr.plugin = plugger.Plugin()
+		bldr.plugin.Init("JobStatusEvent")
+	}
+
+	return bldr
+}
+
+// Ancestor sets parent key to ancestor query.
+func (bldr *JobStatusEventQueryBuilder) Ancestor(parentKey datastore.Key) *JobStatusEventQueryBuilder {
+	bldr.q = bldr.q.Ancestor(parentKey)
+	if bldr.plugin != nil {
+		bldr.plugin.Ancestor(parentKey)
+	}
+	return bldr
+}
+
+// KeysOnly sets keys only option to query.
+func (bldr *JobStatusEventQueryBuilder) KeysOnly() *JobStatusEventQueryBuilder {
+	bldr.q = bldr.q.KeysOnly()
+	if bldr.plugin != nil {
+		bldr.plugin.KeysOnly()
+	}
+	return bldr
+}
+
+// Start setup to query.
+func (bldr *JobStatusEventQueryBuilder) Start(cur datastore.Cursor) *JobStatusEventQueryBuilder {
+	bldr.q = bldr.q.Start(cur)
+	if bldr.plugin != nil {
+		bldr.plugin.Start(cur)
+	}
+	return bldr
+}
+
+// Offset setup to query.
+func (bldr *JobStatusEventQueryBuilder) Offset(offset int) *JobStatusEventQueryBuilder {
+	bldr.q = bldr.q.Offset(offset)
+	if bldr.plugin != nil {
+		bldr.plugin.Offset(offset)
+	}
+	return bldr
+}
+
+// Limit setup to query.
+func (bldr *JobStatusEventQueryBuilder) Limit(limit int) *JobStatusEventQueryBuilder {
+	bldr.q = bldr.q.Limit(limit)
+	if bldr.plugin != nil {
+		bldr.plugin.Limit(limit)
+	}
+	return bldr
+}
+
+// Query returns *datastore.Query.
+func (bldr *JobStatusEventQueryBuilder) Query() datastore.Query {
+	return bldr.q
+}
+
+// Filter with op & value.
+func (p *JobStatusEventQueryProperty) Filter(op string, value interface{}) *JobStatusEventQueryBuilder {
+	switch op {
+	case "<=":
+		p.LessThanOrEqual(value)
+	case ">=":
+		p.GreaterThanOrEqual(value)
+	case "<":
+		p.LessThan(value)
+	case ">":
+		p.GreaterThan(value)
+	case "=":
+		p.Equal(value)
+	default:
+		p.bldr.q = p.bldr.q.Filter(p.name+" "+op, value) // error raised by native query
+	}
+	if p.bldr.plugin != nil {
+		p.bldr.plugin.Filter(p.name, op, value)
+	}
+	return p.bldr
+}
+
+// LessThanOrEqual filter with value.
+func (p *JobStatusEventQueryProperty) LessThanOrEqual(value interface{}) *JobStatusEventQueryBuilder {
+	p.bldr.q = p.bldr.q.Filter(p.name+" <=", value)
+	if p.bldr.plugin != nil {
+		p.bldr.plugin.Filter(p.name, "<=", value)
+	}
+	return p.bldr
+}
+
+// GreaterThanOrEqual filter with value.
+func (p *JobStatusEventQueryProperty) GreaterThanOrEqual(value interface{}) *JobStatusEventQueryBuilder {
+	p.bldr.q = p.bldr.q.Filter(p.name+" >=", value)
+	if p.bldr.plugin != nil {
+		p.bldr.plugin.Filter(p.name, ">=", value)
+	}
+	return p.bldr
+}
+
+// LessThan filter with value.
+func (p *JobStatusEventQueryProperty) LessThan(value interface{}) *JobStatusEventQueryBuilder {
+	p.bldr.q = p.bldr.q.Filter(p.name+" <", value)
+	if p.bldr.plugin != nil {
+		p.bldr.plugin.Filter(p.name, "<", value)
+	}
+	return p.bldr
+}
+
+// GreaterThan filter with value.
+func (p *JobStatusEventQueryProperty) GreaterThan(value interface{}) *JobStatusEventQueryBuilder {
+	p.bldr.q = p.bldr.q.Filter(p.name+" >", value)
+	if p.bldr.plugin != nil {
+		p.bldr.plugin.Filter(p.name, ">", value)
+	}
+	return p.bldr
+}
+
+// Equal filter with value.
+func (p *JobStatusEventQueryProperty) Equal(value interface{}) *JobStatusEventQueryBuilder {
+	p.bldr.q = p.bldr.q.Filter(p.name+" =", value)
+	if p.bldr.plugin != nil {
+		p.bldr.plugin.Filter(p.name, "=", value)
+	}
+	return p.bldr
+}
+
+// Asc order.
+func (p *JobStatusEventQueryProperty) Asc() *JobStatusEventQueryBuilder {
+	p.bldr.q = p.bldr.q.Order(p.name)
+	if p.bldr.plugin != nil {
+		p.bldr.plugin.Asc(p.name)
+	}
+	return p.bldr
+}
+
+// Desc order.
+func (p *JobStatusEventQueryProperty) Desc() *JobStatusEventQueryBuilder {
+	p.bldr.q = p.bldr.q.Order("-" + p.name)
+	if p.bldr.plugin != nil {
+		p.bldr.plugin.Desc(p.name)
+	}
+	return p.bldr
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/morikuni/failure"
+)
+
+// Notification is Jobの異常を通知する内容
+type Notification struct {
+	Type       string `json:"type"`
+	DS2BQJobID string `json:"ds2bqJobId"`
+	Kind       string `json:"kind,omitempty"`
+	Message    string `json:"message"`
+}
+
+// Notifier is 環境変数 NOTIFICATION_WEBHOOK_URL にNotificationをPOSTする
+// Slack Incoming Webhookでそのまま表示できるように text も入れている
+type Notifier struct {
+	webhookURL string
+	hc         *http.Client
+}
+
+func NewNotifier() *Notifier {
+	return &Notifier{
+		webhookURL: os.Getenv("NOTIFICATION_WEBHOOK_URL"),
+		hc:         &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (n *Notifier) Notify(ctx context.Context, notification *Notification) error {
+	Warningf(ctx, "notification %+v\n", notification)
+	if n.webhookURL == "" {
+		return nil
+	}
+
+	body := struct {
+		Text string `json:"text"`
+		*Notification
+	}{
+		Text:         fmt.Sprintf("[ds2bq] %s ds2bqJobID=%s,kind=%s : %s", notification.Type, notification.DS2BQJobID, notification.Kind, notification.Message),
+		Notification: notification,
+	}
+	b, err := json.Marshal(body)
+	if err != nil {
+		return failure.Wrap(err, failure.Messagef("failed json.Marshal. notification=%+v", notification))
+	}
+	req, err := http.NewRequest(http.MethodPost, n.webhookURL, bytes.NewReader(b))
+	if err != nil {
+		return failure.Wrap(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := n.hc.Do(req.WithContext(ctx))
+	if err != nil {
+		return failure.Wrap(err, failure.Messagef("failed POST notification. notification=%+v", notification))
+	}
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			Errorf(ctx, "%+v", err)
+		}
+	}()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("notification webhook responded %d. notification=%+v", resp.StatusCode, notification)
+	}
+	return nil
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/morikuni/failure"
+)
+
+// GoogleCertsURL is GoogleがOIDC ID Tokenの署名に使う公開鍵 (JWK Set) のURL
+const GoogleCertsURL = "https://www.googleapis.com/oauth2/v3/certs"
+
+// GoogleIssuers is GoogleのOIDC ID TokenのIssuer
+var GoogleIssuers = []string{"https://accounts.google.com", "accounts.google.com"}
+
+// IDTokenClockSkew is ID Tokenの有効期限を確認する時に許容する時刻のずれ
+const IDTokenClockSkew = 1 * time.Minute
+
+// IDTokenClaims is OIDC ID TokenのClaimのうち、ds2bqが使うもの
+type IDTokenClaims struct {
+	Issuer        string `json:"iss"`
+	Audience      string `json:"aud"`
+	Subject       string `json:"sub"`
+	Email         string `json:"email"`
+	EmailVerified bool   `json:"email_verified"`
+	ExpiresAt     int64  `json:"exp"`
+	IssuedAt      int64  `json:"iat"`
+}
+
+// KeySet is ID Tokenの署名を検証する公開鍵を返す
+type KeySet interface {
+	PublicKey(ctx context.Context, kid string) (*rsa.PublicKey, error)
+}
+
+// StaticKeySet is kidごとに固定の公開鍵を返すKeySet
+// 手元で署名したID Tokenを検証する時に使う
+type StaticKeySet map[string]*rsa.PublicKey
+
+func (s StaticKeySet) PublicKey(ctx context.Context, kid string) (*rsa.PublicKey, error) {
+	key, ok := s[kid]
+	if !ok {
+		return nil, fmt.Errorf("kid=%v is not found", kid)
+	}
+	return key, nil
+}
+
+// RemoteKeySet is JWK SetのURLから公開鍵を取得してCacheするKeySet
+type RemoteKeySet struct {
+	url string
+	hc  *http.Client
+
+	mu        sync.Mutex
+	keys      map[string]*rsa.PublicKey
+	expireAt  time.Time
+	fetchedAt time.Time
+}
+
+func NewRemoteKeySet(url string) *RemoteKeySet {
+	return &RemoteKeySet{
+		url: url,
+		hc:  &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// PublicKey is kidの公開鍵を返す
+// Cacheが切れている場合や、知らないkidの場合 (鍵のRotation) は取得し直す
+func (s *RemoteKeySet) PublicKey(ctx context.Context, kid string) (*rsa.PublicKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	key, ok := s.keys[kid]
+	if ok && now.Before(s.expireAt) {
+		return key, nil
+	}
+	if !ok && now.Sub(s.fetchedAt) < time.Minute && now.Before(s.expireAt) {
+		// 不正なkidで何度も取得し直さないようにする
+		return nil, fmt.Errorf("kid=%v is not found", kid)
+	}
+	if err := s.fetch(ctx, now); err != nil {
+		return nil, err
+	}
+	key, ok = s.keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("kid=%v is not found", kid)
+	}
+	return key, nil
+}
+
+func (s *RemoteKeySet) fetch(ctx context.Context, now time.Time) error {
+	req, err := http.NewRequest(http.MethodGet, s.url, nil)
+	if err != nil {
+		return failure.Wrap(err)
+	}
+	resp, err := s.hc.Do(req.WithContext(ctx))
+	if err != nil {
+		return failure.Wrap(err, failure.Messagef("failed GET %v", s.url))
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed GET %v. status=%v", s.url, resp.StatusCode)
+	}
+
+	var jwks struct {
+		Keys []struct {
+			Kid string `json:"kid"`
+			Kty string `json:"kty"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&jwks); err != nil {
+		return failure.Wrap(err, failure.Messagef("failed decode JWK Set. url=%v", s.url))
+	}
+	keys := map[string]*rsa.PublicKey{}
+	for _, v := range jwks.Keys {
+		if v.Kty != "RSA" {
+			continue
+		}
+		key, err := ParseRSAPublicKey(v.N, v.E)
+		if err != nil {
+			return failure.Wrap(err, failure.Messagef("failed ParseRSAPublicKey. kid=%v", v.Kid))
+		}
+		keys[v.Kid] = key
+	}
+
+	s.keys = keys
+	s.fetchedAt = now
+	s.expireAt = now.Add(maxAge(resp.Header.Get("Cache-Control"), time.Hour))
+	return nil
+}
+
+// ParseRSAPublicKey is JWKの n, e からRSAの公開鍵を組み立てる
+func ParseRSAPublicKey(n string, e string) (*rsa.PublicKey, error) {
+	nb, err := base64.RawURLEncoding.DecodeString(n)
+	if err != nil {
+		return nil, failure.Wrap(err, failure.Message("invalid n"))
+	}
+	eb, err := base64.RawURLEncoding.DecodeString(e)
+	if err != nil {
+		return nil, failure.Wrap(err, failure.Message("invalid e"))
+	}
+	ei := new(big.Int).SetBytes(eb)
+	if !ei.IsInt64() || ei.Int64() < 1 || ei.Int64() > 1<<31-1 {
+		return nil, fmt.Errorf("invalid e=%v", e)
+	}
+	return &rsa.PublicKey{
+		N: new(big.Int).SetBytes(nb),
+		E: int(ei.Int64()),
+	}, nil
+}
+
+// maxAge is Cache-Control の max-age を返す. 無い場合はdefaultValue
+func maxAge(cacheControl string, defaultValue time.Duration) time.Duration {
+	for _, v := range strings.Split(cacheControl, ",") {
+		v = strings.TrimSpace(v)
+		if !strings.HasPrefix(v, "max-age=") {
+			continue
+		}
+		sec, err := strconv.Atoi(strings.TrimPrefix(v, "max-age="))
+		if err != nil || sec < 1 {
+			return defaultValue
+		}
+		return time.Duration(sec) * time.Second
+	}
+	return defaultValue
+}
+
+// OIDCVerifier is RS256で署名されたOIDC ID Tokenを検証する
+type OIDCVerifier struct {
+	Audiences []string
+	Issuers   []string
+	KeySet    KeySet
+	Now       func() time.Time
+}
+
+func NewOIDCVerifier(audiences []string, issuers []string, keySet KeySet) *OIDCVerifier {
+	return &OIDCVerifier{
+		audiences, issuers, keySet, time.Now,
+	}
+}
+
+// Verify is ID Tokenの署名, Issuer, Audience, 有効期限を検証してClaimを返す
+// 検証に失敗した場合は StatusUnauthorized を返す
+func (v *OIDCVerifier) Verify(ctx context.Context, rawIDToken string) (*IDTokenClaims, error) {
+	parts := strings.Split(rawIDToken, ".")
+	if len(parts) != 3 {
+		return nil, failure.New(StatusUnauthorized, failure.Message("malformed id token"))
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return nil, failure.Translate(err, StatusUnauthorized, failure.Message("malformed id token header"))
+	}
+	if header.Alg != "RS256" {
+		return nil, failure.New(StatusUnauthorized, failure.Messagef("unsupported alg=%v", header.Alg))
+	}
+
+	key, err := v.KeySet.PublicKey(ctx, header.Kid)
+	if err != nil {
+		return nil, failure.Translate(err, StatusUnauthorized, failure.Messagef("failed KeySet.PublicKey. kid=%v", header.Kid))
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, failure.Translate(err, StatusUnauthorized, failure.Message("malformed id token signature"))
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], sig); err != nil {
+		return nil, failure.Translate(err, StatusUnauthorized, failure.Message("invalid id token signature"))
+	}
+
+	var claims IDTokenClaims
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return nil, failure.Translate(err, StatusUnauthorized, failure.Message("malformed id token claims"))
+	}
+	if !contains(v.Issuers, claims.Issuer) {
+		return nil, failure.New(StatusUnauthorized, failure.Messagef("unexpected iss=%v", claims.Issuer))
+	}
+	if !contains(v.Audiences, claims.Audience) {
+		return nil, failure.New(StatusUnauthorized, failure.Messagef("unexpected aud=%v", claims.Audience))
+	}
+	now := v.Now()
+	if now.Add(-IDTokenClockSkew).After(time.Unix(claims.ExpiresAt, 0)) {
+		return nil, failure.New(StatusUnauthorized, failure.Messagef("id token is expired. exp=%v", claims.ExpiresAt))
+	}
+	if now.Add(IDTokenClockSkew).Before(time.Unix(claims.IssuedAt, 0)) {
+		return nil, failure.New(StatusUnauthorized, failure.Messagef("id token is issued in the future. iat=%v", claims.IssuedAt))
+	}
+	if claims.Email == "" || !claims.EmailVerified {
+		return nil, failure.New(StatusUnauthorized, failure.Message("id token has no verified email"))
+	}
+	return &claims, nil
+}
+
+func decodeJWTPart(part string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+func contains(l []string, v string) bool {
+	for _, s := range l {
+		if s == v {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/morikuni/failure"
+)
+
+// signIDToken is テスト用にkeyでRS256の署名をしたID Tokenを作る
+func signIDToken(t *testing.T, key *rsa.PrivateKey, kid string, alg string, claims *IDTokenClaims) string {
+	header, err := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signingInput))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func newTestIDTokenClaims(now time.Time) *IDTokenClaims {
+	return &IDTokenClaims{
+		Issuer:        "https://accounts.google.com",
+		Audience:      "https://ds2bq.example.com",
+		Subject:       "1234567890",
+		Email:         "scheduler@gcpug-ds2bq-dev.iam.gserviceaccount.com",
+		EmailVerified: true,
+		ExpiresAt:     now.Add(time.Hour).Unix(),
+		IssuedAt:      now.Unix(),
+	}
+}
+
+func TestOIDCVerifier_Verify(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2019, 7, 1, 0, 0, 0, 0, time.UTC)
+	verifier := NewOIDCVerifier([]string{"https://ds2bq.example.com"}, GoogleIssuers, StaticKeySet{"kid1": &key.PublicKey})
+	verifier.Now = func() time.Time { return now }
+
+	cases := []struct {
+		name    string
+		token   func() string
+		wantErr bool
+	}{
+		{"valid", func() string {
+			return signIDToken(t, key, "kid1", "RS256", newTestIDTokenClaims(now))
+		}, false},
+		{"issuer without scheme", func() string {
+			c := newTestIDTokenClaims(now)
+			c.Issuer = "accounts.google.com"
+			return signIDToken(t, key, "kid1", "RS256", c)
+		}, false},
+		{"malformed", func() string {
+			return "hoge"
+		}, true},
+		{"unsupported alg", func() string {
+			return signIDToken(t, key, "kid1", "RS512", newTestIDTokenClaims(now))
+		}, true},
+		{"unknown kid", func() string {
+			return signIDToken(t, key, "kid2", "RS256", newTestIDTokenClaims(now))
+		}, true},
+		{"invalid signature", func() string {
+			return signIDToken(t, otherKey, "kid1", "RS256", newTestIDTokenClaims(now))
+		}, true},
+		{"tampered claims", func() string {
+			parts := strings.Split(signIDToken(t, key, "kid1", "RS256", newTestIDTokenClaims(now)), ".")
+			c := newTestIDTokenClaims(now)
+			c.Email = "attacker@example.com"
+			b, err := json.Marshal(c)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return parts[0] + "." + base64.RawURLEncoding.EncodeToString(b) + "." + parts[2]
+		}, true},
+		{"unexpected issuer", func() string {
+			c := newTestIDTokenClaims(now)
+			c.Issuer = "https://example.com"
+			return signIDToken(t, key, "kid1", "RS256", c)
+		}, true},
+		{"unexpected audience", func() string {
+			c := newTestIDTokenClaims(now)
+			c.Audience = "https://example.com"
+			return signIDToken(t, key, "kid1", "RS256", c)
+		}, true},
+		{"expired", func() string {
+			c := newTestIDTokenClaims(now)
+			c.ExpiresAt = now.Add(-IDTokenClockSkew - time.Second).Unix()
+			return signIDToken(t, key, "kid1", "RS256", c)
+		}, true},
+		{"expired within clock skew", func() string {
+			c := newTestIDTokenClaims(now)
+			c.ExpiresAt = now.Add(-IDTokenClockSkew + time.Second).Unix()
+			return signIDToken(t, key, "kid1", "RS256", c)
+		}, false},
+		{"issued in the future", func() string {
+			c := newTestIDTokenClaims(now)
+			c.IssuedAt = now.Add(IDTokenClockSkew + time.Second).Unix()
+			return signIDToken(t, key, "kid1", "RS256", c)
+		}, true},
+		{"email not verified", func() string {
+			c := newTestIDTokenClaims(now)
+			c.EmailVerified = false
+			return signIDToken(t, key, "kid1", "RS256", c)
+		}, true},
+	}
+
+	for _, tt := range cases {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			claims, err := verifier.Verify(ctx, tt.token())
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("want error but got nil")
+				}
+				if !failure.Is(err, StatusUnauthorized) {
+					t.Errorf("want StatusUnauthorized but got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if e, g := "scheduler@gcpug-ds2bq-dev.iam.gserviceaccount.com", claims.Email; e != g {
+				t.Errorf("want Email %v but got %v", e, g)
+			}
+		})
+	}
+}
+
+func TestParseRSAPublicKey(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := base64.RawURLEncoding.EncodeToString(key.PublicKey.N.Bytes())
+	e := base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.PublicKey.E)).Bytes())
+
+	got, err := ParseRSAPublicKey(n, e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.N.Cmp(key.PublicKey.N) != 0 || got.E != key.PublicKey.E {
+		t.Errorf("want %+v but got %+v", key.PublicKey, got)
+	}
+	if _, err := ParseRSAPublicKey(n, ""); err == nil {
+		t.Errorf("want error but got nil")
+	}
+}
+
+func TestMaxAge(t *testing.T) {
+	cases := []struct {
+		name         string
+		cacheControl string
+		want         time.Duration
+	}{
+		{"empty", "", time.Hour},
+		{"max-age", "public, max-age=21600, must-revalidate, no-transform", 6 * time.Hour},
+		{"invalid", "max-age=hoge", time.Hour},
+	}
+
+	for _, tt := range cases {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			if e, g := tt.want, maxAge(tt.cacheControl, time.Hour); e != g {
+				t.Errorf("want %v but got %v", e, g)
+			}
+		})
+	}
+}
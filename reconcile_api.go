@@ -0,0 +1,306 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/morikuni/failure"
+)
+
+// DefaultReconcileStaleThreshold is Running のまま更新されていないJobを止まっているとみなすデフォルトの期間
+const DefaultReconcileStaleThreshold = 1 * time.Hour
+
+// ReconcileResponse is Reconcileの結果
+type ReconcileResponse struct {
+	ReconciledDS2BQJobIDs  []string `json:"reconciledDs2bqJobIds"`  // 実際のDatastore Export Jobの状態に進めたDS2BQJobID
+	RequeuedDS2BQJobIDs    []string `json:"requeuedDs2bqJobIds"`    // まだRunningなので、状態確認のTaskを追加し直したDS2BQJobID
+	ReconciledBQLoadJobIDs []string `json:"reconciledBqLoadJobIds"` // 実際のBQ Load Jobの状態に進めたBQLoadJobのID
+	RequeuedBQLoadJobIDs   []string `json:"requeuedBqLoadJobIds"`   // まだRunningなので、状態確認のTaskを追加し直したBQLoadJobのID
+	FailedDS2BQJobIDs      []string `json:"failedDs2bqJobIds"`      // Datastore Exportを開始しないままDefaultで止まっていたので、Failedにして終わらせたDS2BQJobID
+	StartedBQLoadJobIDs    []string `json:"startedBqLoadJobIds"`    // Datastore ExportがDoneなのにDefaultで止まっていたので、BQ Loadを開始したBQLoadJobのID
+	StartedRunLockIDs      []string `json:"startedRunLockIds"`      // leaseが切れていたので、待っていたRequestのRunを開始したRunLockのID
+}
+
+type ReconcileAPI struct {
+	DatastoreExportJobCheckAPI *DatastoreExportJobCheckAPI
+	BQLoadJobCheckAPI          *BQLoadJobCheckAPI
+}
+
+func NewReconcileAPI(dsejcAPI *DatastoreExportJobCheckAPI, bqljcAPI *BQLoadJobCheckAPI) *ReconcileAPI {
+	return &ReconcileAPI{
+		dsejcAPI, bqljcAPI,
+	}
+}
+
+// ReconcileStaleThreshold is 環境変数 RECONCILE_STALE_THRESHOLD からJobを止まっているとみなす期間を返す
+func ReconcileStaleThreshold() (time.Duration, error) {
+	v := os.Getenv("RECONCILE_STALE_THRESHOLD")
+	if len(v) < 1 {
+		return DefaultReconcileStaleThreshold, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return 0, failure.Wrap(err, failure.Messagef("invalid RECONCILE_STALE_THRESHOLD=%v", v))
+	}
+	return d, nil
+}
+
+// IsStaleJob is Jobが止まっているかを返す
+// ChangeStatusAtが古くても、状態確認のTaskがEntityを更新し続けている場合は止まっていない
+func IsStaleJob(changeStatusAt time.Time, updatedAt time.Time, now time.Time, threshold time.Duration) bool {
+	if now.Sub(changeStatusAt) < threshold {
+		return false
+	}
+	return now.Sub(updatedAt) >= threshold
+}
+
+func HandleReconcileAPI(r *http.Request) (interface{}, error) {
+	ctx := WithJobTrigger(r.Context(), NewJobTriggerWithType(r, JobTriggerTypeReconciler))
+
+	threshold, err := ReconcileStaleThreshold()
+	if err != nil {
+		return nil, failure.Wrap(err, failure.Message("failed ReconcileStaleThreshold()"))
+	}
+
+	queue, err := NewDatastoreExportJobCheckQueue(r.Host, TasksClient)
+	if err != nil {
+		return nil, failure.Wrap(err, failure.Message("failed NewDatastoreExportJobCheckQueue"))
+	}
+
+	bqljcQ, err := NewBQLoadJobCheckQueue(r.Host, TasksClient)
+	if err != nil {
+		return nil, failure.Wrap(err, failure.Message("failed NewBQLoadJobCheckQueue"))
+	}
+
+	dsexportJobStore, err := NewDSExportJobStore(ctx, DatastoreClient)
+	if err != nil {
+		return nil, failure.Wrap(err, failure.Message("failed NewDSExportJobStore()"))
+	}
+
+	bqloadJobStore, err := NewBQLoadJobStore(ctx, DatastoreClient)
+	if err != nil {
+		return nil, failure.Wrap(err, failure.Message("failed NewBQLoadJobStore()"))
+	}
+
+	runLockStore, err := NewRunLockStore(ctx, DatastoreClient)
+	if err != nil {
+		return nil, failure.Wrap(err, failure.Message("failed NewRunLockStore()"))
+	}
+
+	taskOutboxStore, err := NewTaskOutboxStore(ctx, DatastoreClient)
+	if err != nil {
+		return nil, failure.Wrap(err, failure.Message("failed NewTaskOutboxStore()"))
+	}
+
+	deadLetterTaskStore, err := NewDeadLetterTaskStore(ctx, DatastoreClient)
+	if err != nil {
+		return nil, failure.Wrap(err, failure.Message("failed NewDeadLetterTaskStore()"))
+	}
+
+	notifier := NewNotifier()
+	api := NewReconcileAPI(
+		NewDatastoreExportJobCheckAPI(queue, dsexportJobStore, bqloadJobStore, bqljcQ, runLockStore, taskOutboxStore, deadLetterTaskStore, notifier),
+		NewBQLoadJobCheckAPI(bqljcQ, bqloadJobStore, NewDatastoreExportAPI(queue, dsexportJobStore, bqloadJobStore, runLockStore, taskOutboxStore), deadLetterTaskStore, notifier),
+	)
+
+	res, err := api.Reconcile(ctx, time.Now(), threshold)
+	if err != nil {
+		return nil, failure.Wrap(err, failure.Message("failed Reconcile"))
+	}
+	Infof(ctx, "reconcile result=%+v\n", res)
+
+	return res, nil
+}
+
+// Reconcile is Running のまま止まっているDSExportJob, BQLoadJobの実際の状態を確認する
+// 終わっている場合は状態を進め、まだRunningの場合はCheckが次の状態確認のTaskを追加し直す
+// Default のまま止まっているDSExportJobはFailedにして、Datastore ExportがDoneなのに Default のBQLoadJobはBQ Loadを開始する
+// leaseが切れたRunLockで待っているRequestがある場合は、そのRunを開始する
+func (api *ReconcileAPI) Reconcile(ctx context.Context, now time.Time, threshold time.Duration) (*ReconcileResponse, error) {
+	res := &ReconcileResponse{
+		ReconciledDS2BQJobIDs:  []string{},
+		RequeuedDS2BQJobIDs:    []string{},
+		ReconciledBQLoadJobIDs: []string{},
+		RequeuedBQLoadJobIDs:   []string{},
+		FailedDS2BQJobIDs:      []string{},
+		StartedBQLoadJobIDs:    []string{},
+	}
+
+	dsJobs, err := api.DatastoreExportJobCheckAPI.DSExportJobStore.ListByStatus(ctx, DSExportJobStatusRunning)
+	if err != nil {
+		return nil, failure.Wrap(err, failure.Message("failed DSExportJobStore.ListByStatus"))
+	}
+	for _, job := range dsJobs {
+		if !IsStaleJob(job.ChangeStatusAt, job.UpdatedAt, now, threshold) || len(job.DSExportJobIDs) < 1 {
+			continue
+		}
+		form := &DatastoreExportJobCheckRequest{
+			DS2BQJobID:           job.ID,
+			DatastoreExportJobID: job.DSExportJobIDs[len(job.DSExportJobIDs)-1],
+			CheckSequence:        job.StatusCheckCount,
+			TraceContext:         EncodeTraceContext(ctx),
+		}
+		Infof(ctx, "reconcile stale DSExportJob. DS2BQJobID=%v,DatastoreExportJobID=%v,changeStatusAt=%v\n", form.DS2BQJobID, form.DatastoreExportJobID, job.ChangeStatusAt)
+		if err := api.DatastoreExportJobCheckAPI.Check(ctx, form); err != nil {
+			Errorf(ctx, "failed DatastoreExportJobCheckAPI.Check. DS2BQJobID=%v,err=%v\n", form.DS2BQJobID, err)
+			continue
+		}
+		checked, err := api.DatastoreExportJobCheckAPI.DSExportJobStore.Get(ctx, job.ID)
+		if err != nil {
+			Errorf(ctx, "failed DSExportJobStore.Get. DS2BQJobID=%v,err=%v\n", form.DS2BQJobID, err)
+			continue
+		}
+		if checked.Status == DSExportJobStatusRunning {
+			res.RequeuedDS2BQJobIDs = append(res.RequeuedDS2BQJobIDs, job.ID)
+			continue
+		}
+		res.ReconciledDS2BQJobIDs = append(res.ReconciledDS2BQJobIDs, job.ID)
+	}
+
+	loadJobs, err := api.BQLoadJobCheckAPI.BQLoadJobStore.ListByStatus(ctx, BQLoadJobStatusRunning)
+	if err != nil {
+		return nil, failure.Wrap(err, failure.Message("failed BQLoadJobStore.ListByStatus"))
+	}
+	for _, loadJob := range loadJobs {
+		if !IsStaleJob(loadJob.ChangeStatusAt, loadJob.UpdatedAt, now, threshold) || loadJob.BQLoadJobID == "" {
+			continue
+		}
+		form := &BQLoadJobCheckRequest{
+			DS2BQJobID:        loadJob.JobID,
+			BQLoadProjectID:   loadJob.BQLoadProjectID,
+			BQLoadKind:        loadJob.Kind,
+			BigQueryLoadJobID: loadJob.BQLoadJobID,
+			CheckSequence:     loadJob.StatusCheckCount,
+			TraceContext:      EncodeTraceContext(ctx),
+		}
+		Infof(ctx, "reconcile stale BQLoadJob. ID=%v,BigQueryLoadJobID=%v,changeStatusAt=%v\n", loadJob.ID, loadJob.BQLoadJobID, loadJob.ChangeStatusAt)
+		if err := api.BQLoadJobCheckAPI.Check(ctx, form); err != nil {
+			Errorf(ctx, "failed BQLoadJobCheckAPI.Check. ID=%v,err=%v\n", loadJob.ID, err)
+			continue
+		}
+		checked, err := api.BQLoadJobCheckAPI.BQLoadJobStore.Get(ctx, loadJob.JobID, loadJob.Kind)
+		if err != nil {
+			Errorf(ctx, "failed BQLoadJobStore.Get. ID=%v,err=%v\n", loadJob.ID, err)
+			continue
+		}
+		if checked.Status == BQLoadJobStatusRunning {
+			res.RequeuedBQLoadJobIDs = append(res.RequeuedBQLoadJobIDs, loadJob.ID)
+			continue
+		}
+		res.ReconciledBQLoadJobIDs = append(res.ReconciledBQLoadJobIDs, loadJob.ID)
+	}
+
+	defaultDSJobs, err := api.DatastoreExportJobCheckAPI.DSExportJobStore.ListByStatus(ctx, DSExportJobStatusDefault)
+	if err != nil {
+		return nil, failure.Wrap(err, failure.Message("failed DSExportJobStore.ListByStatus"))
+	}
+	for _, job := range defaultDSJobs {
+		if !IsStaleJob(job.ChangeStatusAt, job.UpdatedAt, now, threshold) {
+			continue
+		}
+		Infof(ctx, "reconcile stale Default DSExportJob. DS2BQJobID=%v,changeStatusAt=%v\n", job.ID, job.ChangeStatusAt)
+		if err := api.FailDefaultDSExportJob(ctx, job); err != nil {
+			Errorf(ctx, "failed FailDefaultDSExportJob. DS2BQJobID=%v,err=%v\n", job.ID, err)
+			continue
+		}
+		res.FailedDS2BQJobIDs = append(res.FailedDS2BQJobIDs, job.ID)
+	}
+
+	defaultLoadJobs, err := api.BQLoadJobCheckAPI.BQLoadJobStore.ListByStatus(ctx, BQLoadJobStatusDefault)
+	if err != nil {
+		return nil, failure.Wrap(err, failure.Message("failed BQLoadJobStore.ListByStatus"))
+	}
+	for _, loadJob := range defaultLoadJobs {
+		if !IsStaleJob(loadJob.ChangeStatusAt, loadJob.UpdatedAt, now, threshold) {
+			continue
+		}
+		job, err := api.DatastoreExportJobCheckAPI.DSExportJobStore.Get(ctx, loadJob.JobID)
+		if err != nil {
+			Errorf(ctx, "failed DSExportJobStore.Get. ID=%v,err=%v\n", loadJob.ID, err)
+			continue
+		}
+		// Datastore Exportが終わっていないBQLoadJobは、DSExportJobの状態確認が進める
+		if job.Status != DSExportJobStatusDone || job.OutputURLPrefix == "" {
+			continue
+		}
+		Infof(ctx, "reconcile stale Default BQLoadJob. ID=%v,changeStatusAt=%v\n", loadJob.ID, loadJob.ChangeStatusAt)
+		started, err := api.StartDefaultBQLoadJob(ctx, job, loadJob)
+		if err != nil {
+			Errorf(ctx, "failed StartDefaultBQLoadJob. ID=%v,err=%v\n", loadJob.ID, err)
+			continue
+		}
+		if !started {
+			res.ReconciledBQLoadJobIDs = append(res.ReconciledBQLoadJobIDs, loadJob.ID)
+			continue
+		}
+		res.StartedBQLoadJobIDs = append(res.StartedBQLoadJobIDs, loadJob.ID)
+	}
+
+	started, err := api.BQLoadJobCheckAPI.DatastoreExportAPI.StartExpiredRunLockQueues(ctx, now)
+	if err != nil {
+		return nil, failure.Wrap(err, failure.Message("failed DatastoreExportAPI.StartExpiredRunLockQueues"))
+	}
+	res.StartedRunLockIDs = started
+
+	return res, nil
+}
+
+// FailDefaultDSExportJob is Datastore Exportを開始しないまま Default で止まっているDSExportJobをFailedにして、Runを終わらせる
+// 開始する途中で落ちた場合はRequestの呼び出し元にエラーを返しているので、Exportし直さずにRunLockを解放して、呼び出し元の再実行に任せる
+func (api *ReconcileAPI) FailDefaultDSExportJob(ctx context.Context, job *DSExportJob) error {
+	ctx = WithLogFields(ctx, LogFields{DS2BQJobID: job.ID})
+	const message = "datastore export was not started"
+	if _, err := api.DatastoreExportJobCheckAPI.DSExportJobStore.FinishExportJob(ctx, job.ID, DSExportJobStatusFailed, "", message); err != nil {
+		return failure.Wrap(err, failure.Messagef("failed DSExportJobStore.FinishExportJob. DS2BQJobID=%v", job.ID))
+	}
+
+	loadJobs, err := api.BQLoadJobCheckAPI.BQLoadJobStore.List(ctx, job.ID)
+	if err != nil {
+		return failure.Wrap(err, failure.Messagef("failed BQLoadJobStore.List. DS2BQJobID=%v", job.ID))
+	}
+	for _, loadJob := range loadJobs {
+		if loadJob.Status.IsFinished() {
+			continue
+		}
+		if _, err := api.BQLoadJobCheckAPI.BQLoadJobStore.FinishExportJob(ctx, job.ID, loadJob.Kind, BQLoadJobStatusFailed, message); err != nil && err != ErrJobFinished {
+			return failure.Wrap(err, failure.Messagef("failed BQLoadJobStore.FinishExportJob. DS2BQJobID=%v,Kind=%v", job.ID, loadJob.Kind))
+		}
+	}
+
+	if err := api.BQLoadJobCheckAPI.DatastoreExportAPI.FinishRun(ctx, job.RunLockID, job.ID); err != nil {
+		return failure.Wrap(err, failure.Messagef("failed FinishRun. DS2BQJobID=%v", job.ID))
+	}
+	return nil
+}
+
+// StartDefaultBQLoadJob is Datastore ExportがDoneなのに Default で止まっているBQLoadJobのBQ Loadを開始する
+// RunLockを他のRunに奪われている場合は、状態確認のTaskと同じようにBQ Loadせずに Superseded にして false を返す
+func (api *ReconcileAPI) StartDefaultBQLoadJob(ctx context.Context, job *DSExportJob, loadJob *BQLoadJob) (bool, error) {
+	ctx = WithLogFields(ctx, LogFields{DS2BQJobID: job.ID, Kind: loadJob.Kind})
+	checkAPI := api.DatastoreExportJobCheckAPI
+	ls := NewBQLoadService(checkAPI.BQLoadJobStore, checkAPI.BQLoadJobCheckQueue, checkAPI.TaskOutboxStore)
+	if job.RunLockID != "" {
+		holder, err := checkAPI.RunLockStore.IsHolder(ctx, job.RunLockID, job.ID)
+		if err != nil {
+			return false, failure.Wrap(err, failure.Messagef("failed RunLockStore.IsHolder. DS2BQJobID=%v", job.ID))
+		}
+		if !holder {
+			if err := ls.SupersedeLoadJobs(ctx, job.ID, fmt.Sprintf("run lock %v is superseded", job.RunLockID)); err != nil {
+				return false, failure.Wrap(err, failure.Messagef("failed BQLoadService.SupersedeLoadJobs. DS2BQJobID=%v", job.ID))
+			}
+			// RunLockは新しいRunが保持しているので、履歴だけ書き込む
+			if err := api.BQLoadJobCheckAPI.DatastoreExportAPI.WriteRunHistory(ctx, job.ID); err != nil {
+				Errorf(ctx, "failed WriteRunHistory. DS2BQJobID=%v,err=%+v\n", job.ID, err)
+			}
+			return false, nil
+		}
+	}
+
+	if err := ls.InsertBigQueryLoadJobForKind(ctx, job.ID, loadJob.Kind, job.OutputURLPrefix); err != nil {
+		return false, failure.Wrap(err, failure.Messagef("failed BQLoadService.InsertBigQueryLoadJobForKind. DS2BQJobID=%v,Kind=%v", job.ID, loadJob.Kind))
+	}
+	return true, nil
+}
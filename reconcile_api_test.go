@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"go.mercari.io/datastore"
+	"go.mercari.io/datastore/clouddatastore"
+)
+
+func TestIsStaleJob(t *testing.T) {
+	now := time.Date(2019, 8, 30, 10, 0, 0, 0, time.UTC)
+	threshold := 1 * time.Hour
+
+	cases := []struct {
+		name           string
+		changeStatusAt time.Time
+		updatedAt      time.Time
+		want           bool
+	}{
+		{"recently started", now.Add(-30 * time.Minute), now.Add(-30 * time.Minute), false},
+		{"still checked", now.Add(-3 * time.Hour), now.Add(-1 * time.Minute), false},
+		{"stale", now.Add(-3 * time.Hour), now.Add(-2 * time.Hour), true},
+		{"just threshold", now.Add(-1 * time.Hour), now.Add(-1 * time.Hour), true},
+	}
+
+	for _, tt := range cases {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			if e, g := tt.want, IsStaleJob(tt.changeStatusAt, tt.updatedAt, now, threshold); e != g {
+				t.Errorf("want %v but got %v", e, g)
+			}
+		})
+	}
+}
+
+func TestReconcileAPI_FailDefaultDSExportJob(t *testing.T) {
+	ctx := context.Background()
+
+	ds, err := clouddatastore.FromContext(ctx, datastore.WithProjectID(uuid.New().String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dseJS, err := NewDSExportJobStore(ctx, ds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bqlJS, err := NewBQLoadJobStore(ctx, ds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ds2bqJobID := dseJS.NewDS2BQJobID(ctx)
+	job, err := dseJS.Create(ctx, &DSExportJobCreateForm{JobID: ds2bqJobID, Kinds: []string{"PugEvent"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bqlJS.Put(ctx, &BQLoadJobPutForm{JobID: ds2bqJobID, Kind: "PugEvent"}); err != nil {
+		t.Fatal(err)
+	}
+
+	api := NewReconcileAPI(
+		&DatastoreExportJobCheckAPI{DSExportJobStore: dseJS, BQLoadJobStore: bqlJS},
+		&BQLoadJobCheckAPI{BQLoadJobStore: bqlJS, DatastoreExportAPI: &DatastoreExportAPI{DSExportJobStore: dseJS, BQLoadJobStore: bqlJS}},
+	)
+	if err := api.FailDefaultDSExportJob(ctx, job); err != nil {
+		t.Fatal(err)
+	}
+
+	job, err = dseJS.Get(ctx, ds2bqJobID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, g := DSExportJobStatusFailed, job.Status; e != g {
+		t.Errorf("want DSExportJob Status is %v but got %v", e, g)
+	}
+	loadJob, err := bqlJS.Get(ctx, ds2bqJobID, "PugEvent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, g := BQLoadJobStatusFailed, loadJob.Status; e != g {
+		t.Errorf("want BQLoadJob Status is %v but got %v", e, g)
+	}
+
+	// 既に終わっている場合は状態を変えない
+	if err := api.FailDefaultDSExportJob(ctx, job); err == nil {
+		t.Error("want error but got nil")
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import "time"
+
+// DefaultRowCountTolerance is Toleranceが指定されていない場合に許容する差の割合
+// __Stat_Kind__ は1日に1回ほどしか更新されないので、Export中に増減したEntityの分を許容する
+const DefaultRowCountTolerance = 0.01
+
+// DefaultRowCountStatMaxAge is Export開始時にこの期間より古い __Stat_Kind__ では、Row数を比べない
+const DefaultRowCountStatMaxAge = 48 * time.Hour
+
+// RowCountVerification is BQ LoadしたTableのRow数を、Datastoreの統計のEntity数と比べる設定
+type RowCountVerification struct {
+	Enabled   bool
+	Tolerance float64 // Entity数に対して許容するRow数の差の割合
+}
+
+// BuildRowCountVerification is Row数を比べる設定を組み立てる
+// Requestで指定されていない場合は、環境変数 VERIFY_ROW_COUNT, ROW_COUNT_TOLERANCE を使う
+func BuildRowCountVerification(form *DatastoreExportRequest) RowCountVerification {
+	v := RowCountVerification{
+		Enabled:   form.VerifyRowCount || getEnvBool("VERIFY_ROW_COUNT"),
+		Tolerance: form.RowCountTolerance,
+	}
+	if v.Tolerance <= 0 {
+		v.Tolerance = getEnvFloat("ROW_COUNT_TOLERANCE")
+	}
+	if v.Tolerance <= 0 {
+		v.Tolerance = DefaultRowCountTolerance
+	}
+	return v
+}
+
+// IsMatched is expected と actual の差が、expectedに対してTolerance以内かを返す
+func (v RowCountVerification) IsMatched(expected int64, actual int64) bool {
+	diff := actual - expected
+	if diff < 0 {
+		diff = -diff
+	}
+	return float64(diff) <= float64(expected)*v.Tolerance
+}
+
+// RowCountStatMaxAge is 環境変数 ROW_COUNT_STAT_MAX_AGE から、Row数を比べる __Stat_Kind__ の古さの上限を返す
+func RowCountStatMaxAge() time.Duration {
+	if d := getEnvDuration("ROW_COUNT_STAT_MAX_AGE"); d > 0 {
+		return d
+	}
+	return DefaultRowCountStatMaxAge
+}
+
+// RowCountVerificationSkipReason is Row数を比べられない場合に、その理由を返す. 比べられる場合は空文字
+// __Stat_Kind__ は全てのNamespaceの合計なので、Namespaceを指定したExportとは比べられない
+// Entity数が0の場合は、統計が更新される前に作られたKindかもしれないので比べない
+func RowCountVerificationSkipReason(namespaceIDs []string, expected int64, statTimestamp time.Time, exportStartedAt time.Time, maxStatAge time.Duration) string {
+	if len(namespaceIDs) > 0 {
+		return "export is limited to namespaces"
+	}
+	if expected < 1 {
+		return "no entities in __Stat_Kind__"
+	}
+	if exportStartedAt.Sub(statTimestamp) > maxStatAge {
+		return "__Stat_Kind__ is too old. timestamp=" + statTimestamp.Format(time.RFC3339)
+	}
+	return ""
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestRowCountVerification_IsMatched(t *testing.T) {
+	cases := []struct {
+		name      string
+		tolerance float64
+		expected  int64
+		actual    int64
+		want      bool
+	}{
+		{"same", 0.01, 1000, 1000, true},
+		{"within tolerance fewer", 0.01, 1000, 990, true},
+		{"within tolerance more", 0.01, 1000, 1010, true},
+		{"truncated", 0.01, 1000, 989, false},
+		{"too many", 0.01, 1000, 1011, false},
+		{"empty", 0.01, 0, 0, true},
+		{"empty stat", 0.01, 0, 1, false},
+	}
+
+	for _, tt := range cases {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			v := RowCountVerification{Enabled: true, Tolerance: tt.tolerance}
+			if e, g := tt.want, v.IsMatched(tt.expected, tt.actual); e != g {
+				t.Errorf("want %v but got %v", e, g)
+			}
+		})
+	}
+}
+
+func TestBuildRowCountVerification(t *testing.T) {
+	cases := []struct {
+		name string
+		form *DatastoreExportRequest
+		env  map[string]string
+		want RowCountVerification
+	}{
+		{"default", &DatastoreExportRequest{}, nil, RowCountVerification{Enabled: false, Tolerance: DefaultRowCountTolerance}},
+		{"request", &DatastoreExportRequest{VerifyRowCount: true, RowCountTolerance: 0.05}, map[string]string{"ROW_COUNT_TOLERANCE": "0.1"}, RowCountVerification{Enabled: true, Tolerance: 0.05}},
+		{"env", &DatastoreExportRequest{}, map[string]string{"VERIFY_ROW_COUNT": "true", "ROW_COUNT_TOLERANCE": "0.1"}, RowCountVerification{Enabled: true, Tolerance: 0.1}},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, k := range []string{"VERIFY_ROW_COUNT", "ROW_COUNT_TOLERANCE"} {
+				if err := os.Unsetenv(k); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for k, v := range tt.env {
+				if err := os.Setenv(k, v); err != nil {
+					t.Fatal(err)
+				}
+			}
+			defer func() {
+				for k := range tt.env {
+					if err := os.Unsetenv(k); err != nil {
+						t.Fatal(err)
+					}
+				}
+			}()
+
+			if e, g := tt.want, BuildRowCountVerification(tt.form); e != g {
+				t.Errorf("want %+v but got %+v", e, g)
+			}
+		})
+	}
+}
+
+func TestRowCountVerificationSkipReason(t *testing.T) {
+	exportStartedAt := time.Date(2019, 9, 1, 0, 0, 0, 0, time.UTC)
+
+	cases := []struct {
+		name          string
+		namespaceIDs  []string
+		expected      int64
+		statTimestamp time.Time
+		wantSkip      bool
+	}{
+		{"verify", nil, 100, exportStartedAt.Add(-24 * time.Hour), false},
+		{"namespace", []string{"ns"}, 100, exportStartedAt.Add(-24 * time.Hour), true},
+		{"no entities", nil, 0, exportStartedAt.Add(-24 * time.Hour), true},
+		{"too old", nil, 100, exportStartedAt.Add(-49 * time.Hour), true},
+		{"newer than export", nil, 100, exportStartedAt.Add(time.Hour), false},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			reason := RowCountVerificationSkipReason(tt.namespaceIDs, tt.expected, tt.statTimestamp, exportStartedAt, DefaultRowCountStatMaxAge)
+			if e, g := tt.wantSkip, reason != ""; e != g {
+				t.Errorf("want skip is %v but got reason=%q", e, reason)
+			}
+		})
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gcpug/ds2bq/bigquery"
+	"github.com/morikuni/failure"
+)
+
+// RunHistoryTableID is Runの履歴を書き込むBigQueryのTable
+const RunHistoryTableID = "ds2bq_run_history"
+
+// RunHistoryPartitionField is RunHistoryTableIDを日付分割するColumn
+const RunHistoryPartitionField = "finished_at"
+
+// RunHistoryRow is ds2bq_run_history の1行. RunのKindごとに1行書き込む
+// Datastore ExportはKindごとの統計を返さないので、run_exported_entities, run_exported_bytes はRun全体の値
+type RunHistoryRow struct {
+	RunID                 string    `bigquery:"run_id"`
+	ExportProjectID       string    `bigquery:"export_project_id"`
+	Kind                  string    `bigquery:"kind"`
+	BQLoadProjectID       string    `bigquery:"bq_load_project_id"`
+	BQLoadDatasetID       string    `bigquery:"bq_load_dataset_id"`
+	RunExportedEntities   int64     `bigquery:"run_exported_entities"`
+	RunExportedBytes      int64     `bigquery:"run_exported_bytes"`
+	BQRows                int64     `bigquery:"bq_rows"`
+	BQBytes               int64     `bigquery:"bq_bytes"`
+	BQBadRecords          int64     `bigquery:"bq_bad_records"`
+	ExportDurationSeconds float64   `bigquery:"export_duration_seconds"`
+	LoadDurationSeconds   float64   `bigquery:"load_duration_seconds"`
+	TotalDurationSeconds  float64   `bigquery:"total_duration_seconds"`
+	ExportStatus          string    `bigquery:"export_status"`
+	Status                string    `bigquery:"status"`
+	Error                 string    `bigquery:"error"`
+	TriggerType           string    `bigquery:"trigger_type"`
+	StartedAt             time.Time `bigquery:"started_at"`
+	FinishedAt            time.Time `bigquery:"finished_at"`
+}
+
+// NewRunHistoryRows is 終わったRunのDSExportJobとBQLoadJobから RunHistoryRow を作る
+// Statusは各KindのBQLoadJobの状態. Datastore Exportが失敗した場合はBQ Loadしていないので、Errorには Datastore Export のエラーを入れる
+// BQ LoadするKindが無い場合も、Runが終わったことが分かるように Kind が空の1行を返す
+func NewRunHistoryRows(job *DSExportJob, loadJobs []*BQLoadJob, finishedAt time.Time) []*RunHistoryRow {
+	base := RunHistoryRow{
+		RunID:                 job.ID,
+		ExportProjectID:       job.ExportProjectID,
+		RunExportedEntities:   job.ExportedEntities,
+		RunExportedBytes:      job.ExportedBytes,
+		ExportDurationSeconds: durationSeconds(job.ExportStartedAt, job.ExportEndedAt),
+		TotalDurationSeconds:  durationSeconds(job.CreatedAt, finishedAt),
+		ExportStatus:          job.Status.String(),
+		Status:                job.Status.String(),
+		TriggerType:           string(job.TriggerType),
+		StartedAt:             job.CreatedAt,
+		FinishedAt:            finishedAt,
+	}
+	if job.Status != DSExportJobStatusDone && len(job.DSExportResponseMessages) > 0 {
+		base.Error = job.DSExportResponseMessages[len(job.DSExportResponseMessages)-1]
+	}
+	if len(loadJobs) < 1 {
+		return []*RunHistoryRow{&base}
+	}
+
+	var rows []*RunHistoryRow
+	for _, v := range loadJobs {
+		row := base
+		row.Kind = v.Kind
+		row.BQLoadProjectID = v.BQLoadProjectID
+		row.BQLoadDatasetID = v.BQLoadDatasetID
+		row.BQRows = v.OutputRows
+		row.BQBytes = v.OutputBytes
+		row.BQBadRecords = v.BadRecords
+		row.LoadDurationSeconds = durationSeconds(v.LoadStartedAt, v.LoadEndedAt)
+		if job.Status == DSExportJobStatusDone {
+			row.Status = v.Status.String()
+			row.Error = v.BQLoadResponseMessage
+		}
+		rows = append(rows, &row)
+	}
+	return rows
+}
+
+func durationSeconds(start time.Time, end time.Time) float64 {
+	if start.IsZero() || end.IsZero() {
+		return 0
+	}
+	return end.Sub(start).Seconds()
+}
+
+// ParseRunHistoryDataset is "project.dataset" 形式の値を ProjectID と DatasetID に分ける
+func ParseRunHistoryDataset(v string) (string, string, error) {
+	l := strings.Split(v, ".")
+	if len(l) != 2 || l[0] == "" || l[1] == "" {
+		return "", "", failure.New(StatusBadRequest, failure.Messagef("run history dataset must be project.dataset. value=%v", v))
+	}
+	return l[0], l[1], nil
+}
+
+// RunHistoryWriter is 環境変数 RUN_HISTORY_DATASET ( project.dataset ) の ds2bq_run_history にRunの履歴を書き込む
+// RUN_HISTORY_DATASET が空の場合は何もしない
+type RunHistoryWriter struct {
+	projectID string
+	datasetID string
+}
+
+func NewRunHistoryWriter() (*RunHistoryWriter, error) {
+	v := os.Getenv("RUN_HISTORY_DATASET")
+	if v == "" {
+		return &RunHistoryWriter{}, nil
+	}
+	projectID, datasetID, err := ParseRunHistoryDataset(v)
+	if err != nil {
+		return nil, failure.Wrap(err)
+	}
+	return &RunHistoryWriter{
+		projectID: projectID,
+		datasetID: datasetID,
+	}, nil
+}
+
+// Enabled is RUN_HISTORY_DATASET が設定されているかを返す
+func (w *RunHistoryWriter) Enabled() bool {
+	return w.projectID != ""
+}
+
+// Write is RunのKindごとの履歴を書き込む
+// InsertIDによるBigQueryの重複の除去はbest-effortなので、呼び出し側で DSExportJobStore.ClaimRunHistory してから1回だけ呼ぶ
+func (w *RunHistoryWriter) Write(ctx context.Context, rows []*RunHistoryRow) error {
+	if !w.Enabled() {
+		return nil
+	}
+	var l []*bigquery.InsertRow
+	for _, v := range rows {
+		l = append(l, &bigquery.InsertRow{
+			InsertID: fmt.Sprintf("%s-_-%s", v.RunID, v.Kind),
+			Row:      v,
+		})
+	}
+	if err := bigquery.InsertRows(ctx, w.projectID, w.datasetID, RunHistoryTableID, RunHistoryPartitionField, l); err != nil {
+		return failure.Wrap(err, failure.Messagef("failed bigquery.InsertRows. project=%v,dataset=%v", w.projectID, w.datasetID))
+	}
+	return nil
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestNewRunHistoryRows(t *testing.T) {
+	createdAt := time.Date(2019, 7, 1, 1, 0, 0, 0, time.UTC)
+	finishedAt := createdAt.Add(30 * time.Minute)
+
+	exportJob := func(status DSExportJobStatus) *DSExportJob {
+		return &DSExportJob{
+			ID:                       "ds2bqJob",
+			ExportProjectID:          "gcpugjp-dev",
+			Status:                   status,
+			DSExportResponseMessages: []string{"op1-_-Code=13,MSG=internal"},
+			ExportedEntities:         12345,
+			ExportedBytes:            67890,
+			ExportStartedAt:          createdAt.Add(1 * time.Minute),
+			ExportEndedAt:            createdAt.Add(11 * time.Minute),
+			TriggerType:              JobTriggerTypeScheduler,
+			CreatedAt:                createdAt,
+		}
+	}
+	loadJobs := []*BQLoadJob{
+		{
+			Kind:            "PugEvent",
+			BQLoadProjectID: "gcpugjp-dev",
+			BQLoadDatasetID: "datastore",
+			Status:          BQLoadJobStatusDone,
+			OutputRows:      100,
+			OutputBytes:     1024,
+			LoadStartedAt:   createdAt.Add(12 * time.Minute),
+			LoadEndedAt:     createdAt.Add(14 * time.Minute),
+		},
+		{
+			Kind:                  "PugUser",
+			BQLoadProjectID:       "gcpugjp-dev",
+			BQLoadDatasetID:       "datastore",
+			Status:                BQLoadJobStatusFailed,
+			BQLoadResponseMessage: "MSG=invalid: Too many errors",
+			BadRecords:            3,
+		},
+	}
+
+	cases := []struct {
+		name     string
+		job      *DSExportJob
+		loadJobs []*BQLoadJob
+		want     []*RunHistoryRow
+	}{
+		{"per kind",
+			exportJob(DSExportJobStatusDone),
+			loadJobs,
+			[]*RunHistoryRow{
+				{
+					RunID: "ds2bqJob", ExportProjectID: "gcpugjp-dev", Kind: "PugEvent", BQLoadProjectID: "gcpugjp-dev", BQLoadDatasetID: "datastore",
+					RunExportedEntities: 12345, RunExportedBytes: 67890, BQRows: 100, BQBytes: 1024,
+					ExportDurationSeconds: 600, LoadDurationSeconds: 120, TotalDurationSeconds: 1800,
+					ExportStatus: "Done", Status: "Done", TriggerType: "scheduler", StartedAt: createdAt, FinishedAt: finishedAt,
+				},
+				{
+					RunID: "ds2bqJob", ExportProjectID: "gcpugjp-dev", Kind: "PugUser", BQLoadProjectID: "gcpugjp-dev", BQLoadDatasetID: "datastore",
+					RunExportedEntities: 12345, RunExportedBytes: 67890, BQBadRecords: 3,
+					ExportDurationSeconds: 600, TotalDurationSeconds: 1800,
+					ExportStatus: "Done", Status: "Failed", Error: "MSG=invalid: Too many errors", TriggerType: "scheduler", StartedAt: createdAt, FinishedAt: finishedAt,
+				},
+			},
+		},
+		{"export failed",
+			exportJob(DSExportJobStatusFailed),
+			loadJobs[:1],
+			[]*RunHistoryRow{
+				{
+					RunID: "ds2bqJob", ExportProjectID: "gcpugjp-dev", Kind: "PugEvent", BQLoadProjectID: "gcpugjp-dev", BQLoadDatasetID: "datastore",
+					RunExportedEntities: 12345, RunExportedBytes: 67890, BQRows: 100, BQBytes: 1024,
+					ExportDurationSeconds: 600, LoadDurationSeconds: 120, TotalDurationSeconds: 1800,
+					ExportStatus: "Failed", Status: "Failed", Error: "op1-_-Code=13,MSG=internal", TriggerType: "scheduler", StartedAt: createdAt, FinishedAt: finishedAt,
+				},
+			},
+		},
+		{"no kinds",
+			exportJob(DSExportJobStatusDone),
+			nil,
+			[]*RunHistoryRow{
+				{
+					RunID: "ds2bqJob", ExportProjectID: "gcpugjp-dev",
+					RunExportedEntities: 12345, RunExportedBytes: 67890,
+					ExportDurationSeconds: 600, TotalDurationSeconds: 1800,
+					ExportStatus: "Done", Status: "Done", TriggerType: "scheduler", StartedAt: createdAt, FinishedAt: finishedAt,
+				},
+			},
+		},
+	}
+
+	for _, tt := range cases {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			got := NewRunHistoryRows(tt.job, tt.loadJobs, finishedAt)
+			if e, g := len(tt.want), len(got); e != g {
+				t.Fatalf("want rows.length %v but got %v", e, g)
+			}
+			for i := range tt.want {
+				if e, g := tt.want[i], got[i]; !reflect.DeepEqual(e, g) {
+					t.Errorf("want %+v but got %+v", e, g)
+				}
+			}
+		})
+	}
+}
+
+func TestParseRunHistoryDataset(t *testing.T) {
+	cases := []struct {
+		name        string
+		v           string
+		wantProject string
+		wantDataset string
+		wantErr     bool
+	}{
+		{"ok", "gcpugjp-dev.ds2bq", "gcpugjp-dev", "ds2bq", false},
+		{"no dataset", "gcpugjp-dev", "", "", true},
+		{"empty dataset", "gcpugjp-dev.", "", "", true},
+		{"too many", "gcpugjp-dev.ds2bq.table", "", "", true},
+	}
+
+	for _, tt := range cases {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			project, dataset, err := ParseRunHistoryDataset(tt.v)
+			if e, g := tt.wantErr, err != nil; e != g {
+				t.Fatalf("want err %v but got %v", e, err)
+			}
+			if e, g := tt.wantProject, project; e != g {
+				t.Errorf("want project %v but got %v", e, g)
+			}
+			if e, g := tt.wantDataset, dataset; e != g {
+				t.Errorf("want dataset %v but got %v", e, g)
+			}
+		})
+	}
+}
@@ -0,0 +1,338 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/morikuni/failure"
+	"go.mercari.io/datastore"
+	"go.opencensus.io/trace"
+)
+
+// DefaultRunLockLease is RunLockを保持できるデフォルトの期間
+// ds2bqが途中で落ちてRunLockが解放されなかった場合でも、この期間を過ぎると次のRunが取得できる
+const DefaultRunLockLease = 24 * time.Hour
+
+// RunLockExpiredListLimit is 一度のReconcileで待っているRequestを開始するRunLockの最大数
+const RunLockExpiredListLimit = 100
+
+// RunLockPolicy is RunLockが既に取得されている時に、新しいRunをどう扱うか
+type RunLockPolicy string
+
+const (
+	// RunLockPolicyNone is RunLockを取得せずに新しいRunを開始する. RunLockを導入する前と同じ動作
+	RunLockPolicyNone RunLockPolicy = "none"
+	// RunLockPolicyReject is 新しいRunを409で拒否する
+	RunLockPolicyReject RunLockPolicy = "reject"
+	// RunLockPolicyQueue is 新しいRunを待たせて、RunLockが解放された時に開始する
+	RunLockPolicyQueue RunLockPolicy = "queue"
+	// RunLockPolicySupersede is 新しいRunがRunLockを奪い、古いRunのBQ Loadは行わない
+	RunLockPolicySupersede RunLockPolicy = "supersede"
+)
+
+type RunLockStore struct {
+	ds datastore.Client
+}
+
+func NewRunLockStore(ctx context.Context, client datastore.Client) (*RunLockStore, error) {
+	return &RunLockStore{
+		ds: client,
+	}, nil
+}
+
+// RunLock is 同じProjectを同じDatasetに重複してExport, BQ Loadしないためのlease
+// KeyのNameは ExportProjectID-_-BQLoadProjectID-_-BQLoadDatasetID
+type RunLock struct {
+	ID                  string `datastore:"-"`
+	ExportProjectID     string
+	BQLoadProjectID     string
+	BQLoadDatasetID     string
+	HolderDS2BQJobIDs   []string // RunLockを保持しているDS2BQJobID. 全てのBQLoadJobが終わると取り除かれる
+	LeaseExpireAt       time.Time
+	QueuedRequestBodies []string `datastore:",noindex"` // RunLockPolicyQueueで待っているDatastoreExportRequest
+	HasQueuedRequests   bool     // QueuedRequestBodies があるか. ListExpired で待っているRequestがあるRunLockだけを取り出すために Save で設定する
+	CreatedAt           time.Time
+	UpdatedAt           time.Time
+	SchemaVersion       int
+}
+
+var _ datastore.PropertyLoadSaver = &RunLock{}
+var _ datastore.KeyLoader = &RunLock{}
+
+// LoadKey is Entity Load時にKeyを設定する
+func (e *RunLock) LoadKey(ctx context.Context, k datastore.Key) error {
+	e.ID = k.Name()
+
+	return nil
+}
+
+// Load is Entity Load時に呼ばれる
+func (e *RunLock) Load(ctx context.Context, ps []datastore.Property) error {
+	err := datastore.LoadStruct(ctx, e, ps)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Save is Entity Save時に呼ばれる
+func (e *RunLock) Save(ctx context.Context) ([]datastore.Property, error) {
+	if e.CreatedAt.IsZero() {
+		e.CreatedAt = time.Now()
+	}
+	e.UpdatedAt = time.Now()
+	e.HasQueuedRequests = len(e.QueuedRequestBodies) > 0
+	e.SchemaVersion = 2
+
+	return datastore.SaveStruct(ctx, e)
+}
+
+// IsHeld is 有効なleaseを持つHolderが存在するか
+func (e *RunLock) IsHeld(now time.Time) bool {
+	return len(e.HolderDS2BQJobIDs) > 0 && now.Before(e.LeaseExpireAt)
+}
+
+// ParseRunLockPolicy is 文字列をRunLockPolicyに変換する
+// 空文字の場合は環境変数 RUN_LOCK_POLICY, それも無い場合は RunLockPolicyNone を返す
+func ParseRunLockPolicy(v string) (RunLockPolicy, error) {
+	if len(v) < 1 {
+		v = os.Getenv("RUN_LOCK_POLICY")
+	}
+	if len(v) < 1 {
+		return RunLockPolicyNone, nil
+	}
+	switch p := RunLockPolicy(v); p {
+	case RunLockPolicyNone, RunLockPolicyReject, RunLockPolicyQueue, RunLockPolicySupersede:
+		return p, nil
+	default:
+		return "", fmt.Errorf("%v is unsupported RunLockPolicy", v)
+	}
+}
+
+// RunLockLease is 環境変数 RUN_LOCK_LEASE からRunLockのlease期間を返す
+func RunLockLease() (time.Duration, error) {
+	v := os.Getenv("RUN_LOCK_LEASE")
+	if len(v) < 1 {
+		return DefaultRunLockLease, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return 0, failure.Wrap(err, failure.Messagef("invalid RUN_LOCK_LEASE=%v", v))
+	}
+	return d, nil
+}
+
+func (store *RunLockStore) NewKey(ctx context.Context, exportProjectID string, bqLoadProjectID string, bqLoadDatasetID string) datastore.Key {
+	return store.ds.NameKey("RunLock", fmt.Sprintf("%s-_-%s-_-%s", exportProjectID, bqLoadProjectID, bqLoadDatasetID), nil)
+}
+
+// RunLockAcquireForm is Acquire する時のRequest内容
+type RunLockAcquireForm struct {
+	ExportProjectID string
+	BQLoadProjectID string
+	BQLoadDatasetID string
+	DS2BQJobIDs     []string
+	Policy          RunLockPolicy
+	RequestBody     string // RunLockPolicyQueueの時に待たせておくDatastoreExportRequest
+	Lease           time.Duration
+}
+
+// RunLockAcquireResult is Acquire の結果
+type RunLockAcquireResult struct {
+	Lock                  *RunLock
+	Acquired              bool
+	Queued                bool
+	SupersededDS2BQJobIDs []string
+}
+
+// Acquire is RunLockを取得する
+// 既に他のRunが保持している場合は、Policyに従って拒否, 待機, 奪取する
+func (store *RunLockStore) Acquire(ctx context.Context, form *RunLockAcquireForm) (*RunLockAcquireResult, error) {
+	key := store.NewKey(ctx, form.ExportProjectID, form.BQLoadProjectID, form.BQLoadDatasetID)
+	var res RunLockAcquireResult
+	_, err := RunInTransaction(ctx, store.ds, "RunLockStore.Acquire", func(tx datastore.Transaction) error {
+		res = RunLockAcquireResult{}
+		var e RunLock
+		if err := tx.Get(key, &e); err != nil {
+			if err != datastore.ErrNoSuchEntity {
+				return err
+			}
+			e = RunLock{
+				ID:              key.Name(),
+				ExportProjectID: form.ExportProjectID,
+				BQLoadProjectID: form.BQLoadProjectID,
+				BQLoadDatasetID: form.BQLoadDatasetID,
+			}
+		}
+
+		now := time.Now()
+		if e.IsHeld(now) {
+			switch form.Policy {
+			case RunLockPolicyQueue:
+				e.QueuedRequestBodies = append(e.QueuedRequestBodies, form.RequestBody)
+				res.Queued = true
+			case RunLockPolicySupersede:
+				res.SupersededDS2BQJobIDs = e.HolderDS2BQJobIDs
+				res.Acquired = true
+			default:
+				res.Lock = &e
+				return nil
+			}
+		} else {
+			res.Acquired = true
+		}
+
+		if res.Acquired {
+			e.HolderDS2BQJobIDs = form.DS2BQJobIDs
+			e.LeaseExpireAt = now.Add(form.Lease)
+		}
+		if _, err := tx.Put(key, &e); err != nil {
+			return err
+		}
+		res.Lock = &e
+		return nil
+	}, trace.StringAttribute(SpanAttributeExportProjectID, form.ExportProjectID), trace.StringAttribute(SpanAttributeBQLoadProjectID, form.BQLoadProjectID), trace.StringAttribute(SpanAttributeBQLoadDatasetID, form.BQLoadDatasetID))
+	if err != nil {
+		return nil, failure.Wrap(err, failure.Messagef("failed datastore.RunInTx() runLockID=%v", key.Name()))
+	}
+	return &res, nil
+}
+
+// IsHolder is ds2bqJobIDがRunLockを保持しているかを返す
+// RunLockが存在しない場合は、他のRunに奪われていないので true を返す
+func (store *RunLockStore) IsHolder(ctx context.Context, runLockID string, ds2bqJobID string) (bool, error) {
+	var e RunLock
+	if err := store.ds.Get(ctx, store.ds.NameKey("RunLock", runLockID, nil), &e); err != nil {
+		if err == datastore.ErrNoSuchEntity {
+			return true, nil
+		}
+		return false, failure.Wrap(err, failure.Messagef("failed datastore.Get() runLockID=%v", runLockID))
+	}
+	for _, v := range e.HolderDS2BQJobIDs {
+		if v == ds2bqJobID {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Release is ds2bqJobIDをRunLockのHolderから取り除く
+// Holderが居なくなり、待っているRequestがある場合は、先頭のRequest Bodyを取り出して返す
+func (store *RunLockStore) Release(ctx context.Context, runLockID string, ds2bqJobID string) (string, error) {
+	key := store.ds.NameKey("RunLock", runLockID, nil)
+	var queued string
+	_, err := RunInTransaction(ctx, store.ds, "RunLockStore.Release", func(tx datastore.Transaction) error {
+		queued = ""
+		var e RunLock
+		if err := tx.Get(key, &e); err != nil {
+			return err
+		}
+		var holders []string
+		var holder bool
+		for _, v := range e.HolderDS2BQJobIDs {
+			if v == ds2bqJobID {
+				holder = true
+				continue
+			}
+			holders = append(holders, v)
+		}
+		if !holder {
+			// 他のRunが保持しているRunLockや、待っているRequestには触らない
+			return nil
+		}
+		e.HolderDS2BQJobIDs = holders
+		if len(holders) < 1 {
+			// Queueに戻したRequestを ListExpired で見つけられるように、leaseも終わらせておく
+			e.LeaseExpireAt = time.Now()
+			if len(e.QueuedRequestBodies) > 0 {
+				queued = e.QueuedRequestBodies[0]
+				e.QueuedRequestBodies = e.QueuedRequestBodies[1:]
+			}
+		}
+		_, err := tx.Put(key, &e)
+		if err != nil {
+			return err
+		}
+		return nil
+	}, trace.StringAttribute(SpanAttributeRunLockID, runLockID), trace.StringAttribute(SpanAttributeDS2BQJobID, ds2bqJobID))
+	if err != nil {
+		if err == datastore.ErrNoSuchEntity {
+			return "", nil
+		}
+		return "", failure.Wrap(err, failure.Messagef("failed datastore.RunInTx() runLockID=%v,ds2bqJobID=%v", runLockID, ds2bqJobID))
+	}
+	return queued, nil
+}
+
+// Enqueue is 開始できなかったRequest BodyをQueueの先頭に戻す
+func (store *RunLockStore) Enqueue(ctx context.Context, runLockID string, body string) error {
+	key := store.ds.NameKey("RunLock", runLockID, nil)
+	_, err := RunInTransaction(ctx, store.ds, "RunLockStore.Enqueue", func(tx datastore.Transaction) error {
+		var e RunLock
+		if err := tx.Get(key, &e); err != nil {
+			return err
+		}
+		e.QueuedRequestBodies = append([]string{body}, e.QueuedRequestBodies...)
+		_, err := tx.Put(key, &e)
+		if err != nil {
+			return err
+		}
+		return nil
+	}, trace.StringAttribute(SpanAttributeRunLockID, runLockID))
+	if err != nil {
+		return failure.Wrap(err, failure.Messagef("failed datastore.RunInTx() runLockID=%v", runLockID))
+	}
+	return nil
+}
+
+// ListExpired is leaseが切れていて、Requestが待っているRunLockを返す
+// 保持していたRunが途中で落ちてReleaseされなかった場合、待っているRequestはReconcileで開始する
+// Requestが待っていないRunLockは数が多く、limitを埋めてしまうので、HasQueuedRequests でQueryしてからleaseを確認する
+func (store *RunLockStore) ListExpired(ctx context.Context, now time.Time, limit int) ([]*RunLock, error) {
+	q := store.ds.NewQuery("RunLock").Filter("HasQueuedRequests =", true).Limit(limit)
+
+	var l []*RunLock
+	if _, err := store.ds.GetAll(ctx, q, &l); err != nil {
+		return nil, failure.Wrap(err, failure.Messagef("failed datastore.GetAll() now=%v", now))
+	}
+	var res []*RunLock
+	for _, v := range l {
+		if v.LeaseExpireAt.Before(now) {
+			res = append(res, v)
+		}
+	}
+	return res, nil
+}
+
+// Dequeue is RunLockが保持されていない場合に、待っているRequest Bodyを先頭から1つ取り出す
+// 他のRunが保持している場合や、待っているRequestが無い場合は空文字を返す
+func (store *RunLockStore) Dequeue(ctx context.Context, runLockID string, now time.Time) (string, error) {
+	key := store.ds.NameKey("RunLock", runLockID, nil)
+	var queued string
+	_, err := RunInTransaction(ctx, store.ds, "RunLockStore.Dequeue", func(tx datastore.Transaction) error {
+		queued = ""
+		var e RunLock
+		if err := tx.Get(key, &e); err != nil {
+			return err
+		}
+		if e.IsHeld(now) || len(e.QueuedRequestBodies) < 1 {
+			return nil
+		}
+		queued = e.QueuedRequestBodies[0]
+		e.QueuedRequestBodies = e.QueuedRequestBodies[1:]
+		if _, err := tx.Put(key, &e); err != nil {
+			return err
+		}
+		return nil
+	}, trace.StringAttribute(SpanAttributeRunLockID, runLockID))
+	if err != nil {
+		if err == datastore.ErrNoSuchEntity {
+			return "", nil
+		}
+		return "", failure.Wrap(err, failure.Messagef("failed datastore.RunInTx() runLockID=%v", runLockID))
+	}
+	return queued, nil
+}
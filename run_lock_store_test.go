@@ -0,0 +1,292 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	cds "cloud.google.com/go/datastore"
+	"github.com/google/uuid"
+	"go.mercari.io/datastore/clouddatastore"
+)
+
+func TestRunLockStore_Acquire(t *testing.T) {
+	cases := []struct {
+		name           string
+		policy         RunLockPolicy
+		wantAcquired   bool
+		wantQueued     bool
+		wantSuperseded []string
+		wantHolders    []string
+	}{
+		{"reject", RunLockPolicyReject, false, false, nil, []string{"first"}},
+		{"queue", RunLockPolicyQueue, false, true, nil, []string{"first"}},
+		{"supersede", RunLockPolicySupersede, true, false, []string{"first"}, []string{"second"}},
+	}
+
+	for _, tt := range cases {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+
+			cdsc, err := cds.NewClient(ctx, uuid.New().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			ds, err := clouddatastore.FromClient(ctx, cdsc)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			s, err := NewRunLockStore(ctx, ds)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			form := &RunLockAcquireForm{
+				ExportProjectID: "gcpugjp-dev",
+				BQLoadProjectID: "gcpugjp-dev",
+				BQLoadDatasetID: "datastore",
+				DS2BQJobIDs:     []string{"first"},
+				Policy:          RunLockPolicyReject,
+				RequestBody:     "{}",
+				Lease:           time.Hour,
+			}
+			first, err := s.Acquire(ctx, form)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !first.Acquired {
+				t.Fatal("want first run acquired but not acquired")
+			}
+
+			form.DS2BQJobIDs = []string{"second"}
+			form.Policy = tt.policy
+			got, err := s.Acquire(ctx, form)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if e, g := tt.wantAcquired, got.Acquired; e != g {
+				t.Errorf("want Acquired %v but got %v", e, g)
+			}
+			if e, g := tt.wantQueued, got.Queued; e != g {
+				t.Errorf("want Queued %v but got %v", e, g)
+			}
+			if e, g := len(tt.wantSuperseded), len(got.SupersededDS2BQJobIDs); e != g {
+				t.Errorf("want SupersededDS2BQJobIDs.length %v but got %v", e, g)
+			}
+			if e, g := tt.wantHolders[0], got.Lock.HolderDS2BQJobIDs[0]; e != g {
+				t.Errorf("want Holder %v but got %v", e, g)
+			}
+		})
+	}
+}
+
+func TestRunLockStore_Release(t *testing.T) {
+	ctx := context.Background()
+
+	cdsc, err := cds.NewClient(ctx, uuid.New().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ds, err := clouddatastore.FromClient(ctx, cdsc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := NewRunLockStore(ctx, ds)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	form := &RunLockAcquireForm{
+		ExportProjectID: "gcpugjp-dev",
+		BQLoadProjectID: "gcpugjp-dev",
+		BQLoadDatasetID: "datastore",
+		DS2BQJobIDs:     []string{"job1", "job2"},
+		Policy:          RunLockPolicyQueue,
+		Lease:           time.Hour,
+	}
+	first, err := s.Acquire(ctx, form)
+	if err != nil {
+		t.Fatal(err)
+	}
+	form.DS2BQJobIDs = []string{"job3"}
+	form.RequestBody = `{"projectId":"gcpugjp-dev"}`
+	if _, err := s.Acquire(ctx, form); err != nil {
+		t.Fatal(err)
+	}
+
+	{
+		// 保持していないDS2BQJobのReleaseでは、他のRunのRunLockや待っているRequestに触らない
+		body, err := s.Release(ctx, first.Lock.ID, "reloaded")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if body != "" {
+			t.Errorf("want empty body for not holder but got %v", body)
+		}
+		holder, err := s.IsHolder(ctx, first.Lock.ID, "job1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !holder {
+			t.Error("want job1 is holder")
+		}
+	}
+
+	{
+		body, err := s.Release(ctx, first.Lock.ID, "job1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if body != "" {
+			t.Errorf("want empty body while job2 holds the lock but got %v", body)
+		}
+		holder, err := s.IsHolder(ctx, first.Lock.ID, "job2")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !holder {
+			t.Error("want job2 is holder")
+		}
+	}
+
+	{
+		body, err := s.Release(ctx, first.Lock.ID, "job2")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if e, g := form.RequestBody, body; e != g {
+			t.Errorf("want queued body %v but got %v", e, g)
+		}
+	}
+
+	{
+		got, err := s.Acquire(ctx, form)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !got.Acquired {
+			t.Error("want acquired after release but not acquired")
+		}
+	}
+}
+
+func TestRunLockStore_DequeueExpired(t *testing.T) {
+	ctx := context.Background()
+
+	cdsc, err := cds.NewClient(ctx, uuid.New().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ds, err := clouddatastore.FromClient(ctx, cdsc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := NewRunLockStore(ctx, ds)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	form := &RunLockAcquireForm{
+		ExportProjectID: "gcpugjp-dev",
+		BQLoadProjectID: "gcpugjp-dev",
+		BQLoadDatasetID: "datastore",
+		DS2BQJobIDs:     []string{"crashed"},
+		Policy:          RunLockPolicyQueue,
+		Lease:           time.Minute,
+	}
+	first, err := s.Acquire(ctx, form)
+	if err != nil {
+		t.Fatal(err)
+	}
+	form.DS2BQJobIDs = []string{"queued"}
+	form.RequestBody = `{"projectId":"gcpugjp-dev"}`
+	if _, err := s.Acquire(ctx, form); err != nil {
+		t.Fatal(err)
+	}
+
+	{
+		// leaseが切れるまでは取り出さない
+		body, err := s.Dequeue(ctx, first.Lock.ID, time.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if body != "" {
+			t.Errorf("want empty body while the lease is valid but got %v", body)
+		}
+	}
+
+	// Requestが待っていないRunLockがlimitより多くあっても、待っているRunLockを返す
+	for _, dataset := range []string{"idle1", "idle2", "idle3"} {
+		idle, err := s.Acquire(ctx, &RunLockAcquireForm{
+			ExportProjectID: "gcpugjp-dev",
+			BQLoadProjectID: "gcpugjp-dev",
+			BQLoadDatasetID: dataset,
+			DS2BQJobIDs:     []string{dataset},
+			Policy:          RunLockPolicyQueue,
+			Lease:           time.Minute,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.Release(ctx, idle.Lock.ID, dataset); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// crashedがReleaseしないままleaseが切れた
+	expired := time.Now().Add(2 * time.Minute)
+	l, err := s.ListExpired(ctx, expired, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, g := 1, len(l); e != g {
+		t.Fatalf("want ListExpired length %v but got %v", e, g)
+	}
+	body, err := s.Dequeue(ctx, l[0].ID, expired)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, g := form.RequestBody, body; e != g {
+		t.Errorf("want queued body %v but got %v", e, g)
+	}
+	l, err = s.ListExpired(ctx, expired, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, g := 0, len(l); e != g {
+		t.Errorf("want ListExpired length %v but got %v", e, g)
+	}
+}
+
+func TestParseRunLockPolicy(t *testing.T) {
+	cases := []struct {
+		name    string
+		value   string
+		want    RunLockPolicy
+		wantErr bool
+	}{
+		{"default", "", RunLockPolicyNone, false},
+		{"none", "none", RunLockPolicyNone, false},
+		{"reject", "reject", RunLockPolicyReject, false},
+		{"queue", "queue", RunLockPolicyQueue, false},
+		{"supersede", "supersede", RunLockPolicySupersede, false},
+		{"unsupported", "hoge", "", true},
+	}
+
+	for _, tt := range cases {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseRunLockPolicy(tt.value)
+			if e, g := tt.wantErr, err != nil; e != g {
+				t.Fatalf("want err %v but got %v", e, err)
+			}
+			if e, g := tt.want, got; e != g {
+				t.Errorf("want %v but got %v", e, g)
+			}
+		})
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+
+	"github.com/morikuni/failure"
+)
+
+// DefaultCheckTaskMaxAttempts is 状態確認のTaskを実行するデフォルトの最大回数
+const DefaultCheckTaskMaxAttempts = 10
+
+// TaskAttempt is Cloud TasksがRequest Headerで渡してくるTaskの試行回数
+type TaskAttempt struct {
+	TaskName       string
+	RetryCount     int // X-CloudTasks-TaskRetryCount. 何回Retryされたか. 最初の実行は0
+	ExecutionCount int // X-CloudTasks-TaskExecutionCount. Handlerが実際にResponseを返した回数
+}
+
+// ParseTaskAttempt is Request HeaderからTaskAttemptを組み立てる
+// Cloud Tasks以外からのRequestでHeaderが無い場合は0になる
+func ParseTaskAttempt(h http.Header) TaskAttempt {
+	return TaskAttempt{
+		TaskName:       h.Get("X-CloudTasks-TaskName"),
+		RetryCount:     atoiOrZero(h.Get("X-CloudTasks-TaskRetryCount")),
+		ExecutionCount: atoiOrZero(h.Get("X-CloudTasks-TaskExecutionCount")),
+	}
+}
+
+// IsExceeded is 試行回数がmaxAttemptsを超えているかを返す
+// maxAttemptsが0の場合は無制限
+func (a TaskAttempt) IsExceeded(maxAttempts int) bool {
+	if maxAttempts < 1 {
+		return false
+	}
+	return a.RetryCount+1 > maxAttempts
+}
+
+// CheckTaskMaxAttempts is 環境変数 CHECK_TASK_MAX_ATTEMPTS から状態確認のTaskを実行する最大回数を返す
+func CheckTaskMaxAttempts() (int, error) {
+	v := os.Getenv("CHECK_TASK_MAX_ATTEMPTS")
+	if len(v) < 1 {
+		return DefaultCheckTaskMaxAttempts, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, failure.Wrap(err, failure.Messagef("invalid CHECK_TASK_MAX_ATTEMPTS=%v", v))
+	}
+	if n < 0 {
+		return 0, fmt.Errorf("invalid CHECK_TASK_MAX_ATTEMPTS=%v", v)
+	}
+	return n, nil
+}
+
+func atoiOrZero(v string) int {
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		return 0
+	}
+	return n
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"testing"
+)
+
+func TestParseTaskAttempt(t *testing.T) {
+	cases := []struct {
+		name   string
+		header map[string]string
+		want   TaskAttempt
+	}{
+		{"no header", map[string]string{}, TaskAttempt{}},
+		{"cloud tasks", map[string]string{
+			"X-CloudTasks-TaskName":           "hoge",
+			"X-CloudTasks-TaskRetryCount":     "3",
+			"X-CloudTasks-TaskExecutionCount": "2",
+		}, TaskAttempt{TaskName: "hoge", RetryCount: 3, ExecutionCount: 2}},
+		{"invalid", map[string]string{
+			"X-CloudTasks-TaskRetryCount":     "hoge",
+			"X-CloudTasks-TaskExecutionCount": "-1",
+		}, TaskAttempt{}},
+	}
+
+	for _, tt := range cases {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			h := http.Header{}
+			for k, v := range tt.header {
+				h.Set(k, v)
+			}
+			if e, g := tt.want, ParseTaskAttempt(h); e != g {
+				t.Errorf("want %+v but got %+v", e, g)
+			}
+		})
+	}
+}
+
+func TestTaskAttempt_IsExceeded(t *testing.T) {
+	cases := []struct {
+		name        string
+		attempt     TaskAttempt
+		maxAttempts int
+		want        bool
+	}{
+		{"unlimited", TaskAttempt{RetryCount: 100}, 0, false},
+		{"first attempt", TaskAttempt{RetryCount: 0}, 1, false},
+		{"last attempt", TaskAttempt{RetryCount: 9}, 10, false},
+		{"over max attempts", TaskAttempt{RetryCount: 10}, 10, true},
+	}
+
+	for _, tt := range cases {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			if e, g := tt.want, tt.attempt.IsExceeded(tt.maxAttempts); e != g {
+				t.Errorf("want %v but got %v", e, g)
+			}
+		})
+	}
+}
+
+func TestCheckTaskMaxAttempts(t *testing.T) {
+	defer os.Unsetenv("CHECK_TASK_MAX_ATTEMPTS")
+
+	cases := []struct {
+		name    string
+		env     string
+		want    int
+		wantErr bool
+	}{
+		{"default", "", DefaultCheckTaskMaxAttempts, false},
+		{"env", "5", 5, false},
+		{"unlimited", "0", 0, false},
+		{"negative", "-1", 0, true},
+		{"invalid", "hoge", 0, true},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := os.Setenv("CHECK_TASK_MAX_ATTEMPTS", tt.env); err != nil {
+				t.Fatal(err)
+			}
+			got, err := CheckTaskMaxAttempts()
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("want error but got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if e, g := tt.want, got; e != g {
+				t.Errorf("want %v but got %v", e, g)
+			}
+		})
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"math/rand"
+	"time"
+
+	"cloud.google.com/go/cloudtasks/apiv2beta3"
+	"github.com/morikuni/failure"
+	"go.opencensus.io/stats"
+	"go.opencensus.io/tag"
+	taskspb "google.golang.org/genproto/googleapis/cloud/tasks/v2beta3"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func init() {
+	rand.Seed(time.Now().UnixNano())
+}
+
+// TaskEnqueueBackoff is Cloud TasksへのTask追加をRetryする時の間隔
+type TaskEnqueueBackoff struct {
+	Initial       time.Duration
+	Max           time.Duration
+	MaxRetryCount int
+}
+
+// DefaultTaskEnqueueBackoff is デフォルトのTaskEnqueueBackoff
+var DefaultTaskEnqueueBackoff = TaskEnqueueBackoff{
+	Initial:       100 * time.Millisecond,
+	Max:           10 * time.Second,
+	MaxRetryCount: 5,
+}
+
+// Delay is retryCount回目のRetryまでに待つ時間を返す
+// Initialから倍々に増やしてMaxで打ち止めにし、jitter (0 <= jitter < 1) で後半の半分をばらつかせる
+func (b TaskEnqueueBackoff) Delay(retryCount int, jitter float64) time.Duration {
+	d := b.Initial
+	for i := 0; i < retryCount && d < b.Max; i++ {
+		d *= 2
+	}
+	if d > b.Max {
+		d = b.Max
+	}
+	half := d / 2
+	return half + time.Duration(float64(half)*jitter)
+}
+
+// IsRetryableTaskEnqueueCode is cloudtasks.CreateTask をRetryするStatus Codeかを返す
+func IsRetryableTaskEnqueueCode(code codes.Code) bool {
+	switch code {
+	case codes.Unavailable, codes.DeadlineExceeded, codes.ResourceExhausted:
+		return true
+	default:
+		return false
+	}
+}
+
+// EnqueueTask is Cloud TasksにTaskを追加する
+// 一時的なエラーの場合は、ctxのDeadlineを超えない範囲でExponential BackoffしながらRetryする
+// 同じNameのTaskが既に存在する場合 (AlreadyExists) は、追加済みとみなして成功にする
+func EnqueueTask(ctx context.Context, tasks *cloudtasks.Client, req *taskspb.CreateTaskRequest, backoff TaskEnqueueBackoff) error {
+	for retryCount := 0; ; retryCount++ {
+		_, err := tasks.CreateTask(ctx, req)
+		if err == nil {
+			return nil
+		}
+
+		code := status.Code(err)
+		if code == codes.AlreadyExists {
+			// 同じNameのTaskが既に追加されているので、重複したTaskは追加しない
+			Infof(ctx, "task is already exists. name=%v\n", req.Task.GetName())
+			return nil
+		}
+		mutators := []tag.Mutator{tag.Upsert(KeyQueue, req.Parent), tag.Upsert(KeyCode, code.String())}
+		if !IsRetryableTaskEnqueueCode(code) || retryCount >= backoff.MaxRetryCount {
+			recordTaskEnqueueMetrics(ctx, mutators, TaskEnqueueFailureCount.M(1))
+			return failure.Wrap(err, failure.Messagef("failed cloudtasks.CreateTask. queue=%v,retryCount=%v", req.Parent, retryCount))
+		}
+
+		delay := backoff.Delay(retryCount, rand.Float64())
+		if deadline, ok := ctx.Deadline(); ok && time.Now().Add(delay).After(deadline) {
+			recordTaskEnqueueMetrics(ctx, mutators, TaskEnqueueFailureCount.M(1))
+			return failure.Wrap(err, failure.Messagef("failed cloudtasks.CreateTask. deadline exceeded before retry. queue=%v,retryCount=%v", req.Parent, retryCount))
+		}
+
+		recordTaskEnqueueMetrics(ctx, mutators, TaskEnqueueRetryCount.M(1))
+		Warningf(ctx, "failed cloudtasks.CreateTask. retry after %v. queue=%v,retryCount=%v,err=%v\n", delay, req.Parent, retryCount, err)
+		select {
+		case <-ctx.Done():
+			return failure.Wrap(ctx.Err(), failure.Messagef("failed cloudtasks.CreateTask. queue=%v,retryCount=%v,lastErr=%v", req.Parent, retryCount, err))
+		case <-time.After(delay):
+		}
+	}
+}
+
+func recordTaskEnqueueMetrics(ctx context.Context, mutators []tag.Mutator, ms ...stats.Measurement) {
+	if err := stats.RecordWithTags(ctx, mutators, ms...); err != nil {
+		Errorf(ctx, "failed stats.RecordWithTags. err=%v\n", err)
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+)
+
+func TestTaskEnqueueBackoff_Delay(t *testing.T) {
+	b := TaskEnqueueBackoff{
+		Initial:       100 * time.Millisecond,
+		Max:           1 * time.Second,
+		MaxRetryCount: 5,
+	}
+
+	cases := []struct {
+		name       string
+		retryCount int
+		jitter     float64
+		want       time.Duration
+	}{
+		{"first retry without jitter", 0, 0, 50 * time.Millisecond},
+		{"second retry", 1, 0, 100 * time.Millisecond},
+		{"third retry", 2, 0.5, 300 * time.Millisecond},
+		{"capped by max", 10, 0, 500 * time.Millisecond},
+		{"capped by max with jitter", 10, 0.5, 750 * time.Millisecond},
+	}
+
+	for _, tt := range cases {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			if e, g := tt.want, b.Delay(tt.retryCount, tt.jitter); e != g {
+				t.Errorf("want %v but got %v", e, g)
+			}
+		})
+	}
+}
+
+func TestIsRetryableTaskEnqueueCode(t *testing.T) {
+	cases := []struct {
+		code codes.Code
+		want bool
+	}{
+		{codes.Unavailable, true},
+		{codes.DeadlineExceeded, true},
+		{codes.ResourceExhausted, true},
+		{codes.InvalidArgument, false},
+		{codes.AlreadyExists, false},
+		{codes.PermissionDenied, false},
+	}
+
+	for _, tt := range cases {
+		tt := tt
+		t.Run(tt.code.String(), func(t *testing.T) {
+			if e, g := tt.want, IsRetryableTaskEnqueueCode(tt.code); e != g {
+				t.Errorf("want %v but got %v", e, g)
+			}
+		})
+	}
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+)
+
+// MaxTaskIDLength is Cloud TasksのTask IDの最大長
+const MaxTaskIDLength = 500
+
+// BuildTaskID is hashKeyから決まるCloud TasksのTask IDを作る
+// 同じhashKeyからは同じTask IDになるので、重複したTaskはCloud Tasksが AlreadyExists で弾く
+// 先頭が同じTask IDはCloud Tasksの負荷が偏るので、先頭にhashを付け、labelsは読みやすさのために後ろに付ける
+func BuildTaskID(hashKey string, labels ...string) string {
+	sum := sha256.Sum256([]byte(hashKey))
+	id := hex.EncodeToString(sum[:])[:16]
+	if len(labels) > 0 {
+		id += "-" + sanitizeTaskID(strings.Join(labels, "-"))
+	}
+	if len(id) > MaxTaskIDLength {
+		id = id[:MaxTaskIDLength]
+	}
+	return id
+}
+
+// sanitizeTaskID is Task IDに使えない文字を _ に置き換える
+// Task IDに使えるのは英数字, -, _ だけ
+func sanitizeTaskID(v string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case 'a' <= r && r <= 'z', 'A' <= r && r <= 'Z', '0' <= r && r <= '9', r == '-', r == '_':
+			return r
+		default:
+			return '_'
+		}
+	}, v)
+}
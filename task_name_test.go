@@ -0,0 +1,79 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestBuildTaskID(t *testing.T) {
+	a := BuildTaskID("job/kind/1", "bqload", "job", "Kind.Name", "1")
+	if e, g := a, BuildTaskID("job/kind/1", "bqload", "job", "Kind.Name", "1"); e != g {
+		t.Errorf("same hashKey want same task id. %v != %v", e, g)
+	}
+	if !strings.HasSuffix(a, "-bqload-job-Kind_Name-1") {
+		t.Errorf("unexpected task id %v", a)
+	}
+	if b := BuildTaskID("job/kind/2", "bqload", "job", "Kind.Name", "2"); a == b {
+		t.Errorf("different hashKey want different task id. %v", a)
+	}
+
+	long := BuildTaskID("long", strings.Repeat("a", 1000))
+	if e, g := MaxTaskIDLength, len(long); e != g {
+		t.Errorf("task id length want %v but got %v", e, g)
+	}
+}
+
+func TestCheckRequestTaskID(t *testing.T) {
+	dse := &DatastoreExportJobCheckRequest{
+		DS2BQJobID:           "job",
+		DatastoreExportJobID: "projects/hoge/operations/fuga",
+	}
+	first := dse.TaskID()
+	dse.CheckSequence = 1
+	if first == dse.TaskID() {
+		t.Errorf("different CheckSequence want different task id. %v", first)
+	}
+
+	bql := &BQLoadJobCheckRequest{
+		DS2BQJobID:        "job",
+		BQLoadKind:        "Kind",
+		BigQueryLoadJobID: "bqjob1",
+	}
+	first = bql.TaskID()
+	bql.BigQueryLoadJobID = "bqjob2"
+	if first == bql.TaskID() {
+		t.Errorf("different BigQueryLoadJobID want different task id. %v", first)
+	}
+}
+
+func TestCheckRequestNext(t *testing.T) {
+	dse := &DatastoreExportJobCheckRequest{
+		DS2BQJobID:           "job",
+		DatastoreExportJobID: "projects/hoge/operations/fuga",
+		CheckSequence:        3,
+	}
+	// 同じTaskが2回配信されても、次のTaskは1つだけになる
+	first, redelivered := dse.Next(), dse.Next()
+	if e, g := first.TaskID(), redelivered.TaskID(); e != g {
+		t.Errorf("redelivered want same next task id. %v != %v", e, g)
+	}
+	if e, g := 4, first.CheckSequence; e != g {
+		t.Errorf("want CheckSequence is %v but got %v", e, g)
+	}
+	if dse.TaskID() == first.TaskID() {
+		t.Errorf("next want different task id. %v", first.TaskID())
+	}
+
+	bql := &BQLoadJobCheckRequest{
+		DS2BQJobID:        "job",
+		BQLoadKind:        "Kind",
+		BigQueryLoadJobID: "bqjob1",
+		CheckSequence:     3,
+	}
+	if e, g := bql.Next().TaskID(), bql.Next().TaskID(); e != g {
+		t.Errorf("redelivered want same next task id. %v != %v", e, g)
+	}
+	if e, g := 4, bql.Next().CheckSequence; e != g {
+		t.Errorf("want CheckSequence is %v but got %v", e, g)
+	}
+}
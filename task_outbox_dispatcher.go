@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/morikuni/failure"
+)
+
+// TaskOutboxDrainDelay is 作られてからこの期間が過ぎたTaskOutboxをDrainの対象にする
+// 作った直後のTaskOutboxは、作ったRequestの中でDispatchされるので対象にしない
+const TaskOutboxDrainDelay = 1 * time.Minute
+
+// TaskOutboxDrainLimit is 一度のDrainでDispatchするTaskOutboxの最大数
+const TaskOutboxDrainLimit = 500
+
+// TaskOutboxDrainResponse is Drainの結果
+type TaskOutboxDrainResponse struct {
+	DispatchedCount int `json:"dispatchedCount"`
+	FailedCount     int `json:"failedCount"`
+}
+
+// TaskOutboxDispatcher is TaskOutboxをCloud Tasksに追加する
+type TaskOutboxDispatcher struct {
+	TaskOutboxStore              *TaskOutboxStore
+	DatastoreExportJobCheckQueue *DatastoreExportJobCheckQueue
+	BQLoadJobCheckQueue          *BQLoadJobCheckQueue
+}
+
+func NewTaskOutboxDispatcher(toS *TaskOutboxStore, dsejcQ *DatastoreExportJobCheckQueue, bqljcQ *BQLoadJobCheckQueue) *TaskOutboxDispatcher {
+	return &TaskOutboxDispatcher{
+		toS, dsejcQ, bqljcQ,
+	}
+}
+
+func HandleTaskOutboxDrainAPI(r *http.Request) (interface{}, error) {
+	ctx := r.Context()
+
+	queue, err := NewDatastoreExportJobCheckQueue(r.Host, TasksClient)
+	if err != nil {
+		return nil, failure.Wrap(err, failure.Message("failed NewDatastoreExportJobCheckQueue"))
+	}
+
+	bqljcQ, err := NewBQLoadJobCheckQueue(r.Host, TasksClient)
+	if err != nil {
+		return nil, failure.Wrap(err, failure.Message("failed NewBQLoadJobCheckQueue"))
+	}
+
+	taskOutboxStore, err := NewTaskOutboxStore(ctx, DatastoreClient)
+	if err != nil {
+		return nil, failure.Wrap(err, failure.Message("failed NewTaskOutboxStore()"))
+	}
+
+	d := NewTaskOutboxDispatcher(taskOutboxStore, queue, bqljcQ)
+	res, err := d.DispatchAll(ctx, time.Now().Add(-TaskOutboxDrainDelay))
+	if err != nil {
+		return nil, failure.Wrap(err, failure.Message("failed TaskOutboxDispatcher.DispatchAll"))
+	}
+	Infof(ctx, "task outbox drain result=%+v\n", res)
+
+	return res, nil
+}
+
+// Dispatch is TaskOutboxをCloud Tasksに追加して、TaskOutboxを削除する
+func (d *TaskOutboxDispatcher) Dispatch(ctx context.Context, outbox *TaskOutbox) error {
+	switch outbox.Queue {
+	case TaskOutboxQueueDatastoreExportJobCheck:
+		if d.DatastoreExportJobCheckQueue == nil {
+			return fmt.Errorf("DatastoreExportJobCheckQueue is nil. taskOutbox=%v", outbox.Key)
+		}
+		var body DatastoreExportJobCheckRequest
+		if err := json.Unmarshal([]byte(outbox.Body), &body); err != nil {
+			return failure.Wrap(err, failure.Messagef("failed json.Unmarshal. taskOutbox=%v", outbox.Key))
+		}
+		if err := d.DatastoreExportJobCheckQueue.ScheduleTask(ctx, &body, outbox.ScheduleTime); err != nil {
+			return failure.Wrap(err, failure.Messagef("failed DatastoreExportJobCheckQueue.ScheduleTask. taskOutbox=%v", outbox.Key))
+		}
+	case TaskOutboxQueueBQLoadJobCheck:
+		if d.BQLoadJobCheckQueue == nil {
+			return fmt.Errorf("BQLoadJobCheckQueue is nil. taskOutbox=%v", outbox.Key)
+		}
+		var body BQLoadJobCheckRequest
+		if err := json.Unmarshal([]byte(outbox.Body), &body); err != nil {
+			return failure.Wrap(err, failure.Messagef("failed json.Unmarshal. taskOutbox=%v", outbox.Key))
+		}
+		if err := d.BQLoadJobCheckQueue.ScheduleTask(ctx, &body, outbox.ScheduleTime); err != nil {
+			return failure.Wrap(err, failure.Messagef("failed BQLoadJobCheckQueue.ScheduleTask. taskOutbox=%v", outbox.Key))
+		}
+	default:
+		return fmt.Errorf("%v is unsupported TaskOutboxQueue. taskOutbox=%v", outbox.Queue, outbox.Key)
+	}
+
+	return d.TaskOutboxStore.Delete(ctx, outbox)
+}
+
+// DispatchAll is createdBeforeより前に作られ、まだCloud Tasksに追加されていないTaskOutboxを追加する
+func (d *TaskOutboxDispatcher) DispatchAll(ctx context.Context, createdBefore time.Time) (*TaskOutboxDrainResponse, error) {
+	l, err := d.TaskOutboxStore.ListCreatedBefore(ctx, createdBefore, TaskOutboxDrainLimit)
+	if err != nil {
+		return nil, failure.Wrap(err, failure.Message("failed TaskOutboxStore.ListCreatedBefore"))
+	}
+
+	res := &TaskOutboxDrainResponse{}
+	for _, outbox := range l {
+		if err := d.Dispatch(ctx, outbox); err != nil {
+			Errorf(ctx, "failed TaskOutboxDispatcher.Dispatch. taskOutbox=%v,err=%+v\n", outbox.Key, err)
+			res.FailedCount++
+			continue
+		}
+		res.DispatchedCount++
+	}
+	return res, nil
+}
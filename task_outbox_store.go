@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/morikuni/failure"
+	"go.mercari.io/datastore"
+)
+
+type TaskOutboxStore struct {
+	ds datastore.Client
+}
+
+func NewTaskOutboxStore(ctx context.Context, client datastore.Client) (*TaskOutboxStore, error) {
+	return &TaskOutboxStore{
+		ds: client,
+	}, nil
+}
+
+// TaskOutboxQueue is TaskOutboxのTaskを追加するQueue
+type TaskOutboxQueue string
+
+const (
+	TaskOutboxQueueDatastoreExportJobCheck TaskOutboxQueue = "DatastoreExportJobCheck"
+	TaskOutboxQueueBQLoadJobCheck          TaskOutboxQueue = "BQLoadJobCheck"
+)
+
+// TaskOutbox is Cloud Tasksに追加するTaskの内容
+// Jobの状態の変更と同じTransactionで、JobのEntityの子として保存する
+// Cloud Tasksに追加できたら削除し、追加できなかったものは TaskOutboxDispatcher.DispatchAll で追加し直す
+// +qbg
+type TaskOutbox struct {
+	ID            string        `datastore:"-"`
+	Key           datastore.Key `datastore:"-"`
+	Queue         TaskOutboxQueue
+	Body          string    `datastore:",noindex"`
+	ScheduleTime  time.Time `datastore:",noindex"` // Cloud TasksでTaskを実行する時刻. Zeroの場合はすぐに実行する
+	CreatedAt     time.Time
+	UpdatedAt     time.Time
+	SchemaVersion int
+}
+
+var _ datastore.PropertyLoadSaver = &TaskOutbox{}
+var _ datastore.KeyLoader = &TaskOutbox{}
+
+// LoadKey is Entity Load時にKeyを設定する
+func (e *TaskOutbox) LoadKey(ctx context.Context, k datastore.Key) error {
+	e.ID = k.Name()
+	e.Key = k
+
+	return nil
+}
+
+// Load is Entity Load時に呼ばれる
+func (e *TaskOutbox) Load(ctx context.Context, ps []datastore.Property) error {
+	err := datastore.LoadStruct(ctx, e, ps)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Save is Entity Save時に呼ばれる
+func (e *TaskOutbox) Save(ctx context.Context) ([]datastore.Property, error) {
+	if e.CreatedAt.IsZero() {
+		e.CreatedAt = time.Now()
+	}
+	e.UpdatedAt = time.Now()
+	e.SchemaVersion = 2
+
+	return datastore.SaveStruct(ctx, e)
+}
+
+// New is parentの子としてTaskOutboxを組み立てる
+// 保存はJobの状態を変更するTransactionの中で行う
+func (store *TaskOutboxStore) New(parent datastore.Key, queue TaskOutboxQueue, body interface{}) (*TaskOutbox, error) {
+	b, err := json.Marshal(body)
+	if err != nil {
+		return nil, failure.Wrap(err, failure.Messagef("failed json.Marshal. body=%+v", body))
+	}
+	key := store.ds.NameKey("TaskOutbox", uuid.New().String(), parent)
+	return &TaskOutbox{
+		ID:    key.Name(),
+		Key:   key,
+		Queue: queue,
+		Body:  string(b),
+	}, nil
+}
+
+// NewScheduled is parentの子として、scheduleTimeに実行するTaskOutboxを組み立てる
+// TaskOutboxのKeyにはtaskIDを使うので、同じTaskを何度組み立てても同じTaskOutboxになる
+func (store *TaskOutboxStore) NewScheduled(parent datastore.Key, queue TaskOutboxQueue, taskID string, body interface{}, scheduleTime time.Time) (*TaskOutbox, error) {
+	b, err := json.Marshal(body)
+	if err != nil {
+		return nil, failure.Wrap(err, failure.Messagef("failed json.Marshal. body=%+v", body))
+	}
+	key := store.ds.NameKey("TaskOutbox", taskID, parent)
+	return &TaskOutbox{
+		ID:           key.Name(),
+		Key:          key,
+		Queue:        queue,
+		Body:         string(b),
+		ScheduleTime: scheduleTime,
+	}, nil
+}
+
+// ListCreatedBefore is tより前に作られた、まだCloud Tasksに追加されていないTaskOutboxを返す
+func (store *TaskOutboxStore) ListCreatedBefore(ctx context.Context, t time.Time, limit int) ([]*TaskOutbox, error) {
+	b := NewTaskOutboxQueryBuilder(store.ds)
+	b.CreatedAt.LessThan(t)
+	b.CreatedAt.Asc()
+	b.Limit(limit)
+
+	var l []*TaskOutbox
+	if _, err := store.ds.GetAll(ctx, b.Query(), &l); err != nil {
+		_, ok := err.(datastore.MultiError)
+		if ok {
+			return l, err
+		}
+		return nil, failure.Wrap(err, failure.Messagef("failed datastore.GetAll() createdBefore=%v", t))
+	}
+
+	return l, nil
+}
+
+// Delete is Cloud Tasksに追加したTaskOutboxを削除する
+func (store *TaskOutboxStore) Delete(ctx context.Context, outbox *TaskOutbox) error {
+	if err := store.ds.Delete(ctx, outbox.Key); err != nil {
+		return failure.Wrap(err, failure.Messagef("failed datastore.Delete() taskOutbox=%v", outbox.Key))
+	}
+	return nil
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	cds "cloud.google.com/go/datastore"
+	"github.com/google/uuid"
+	"go.mercari.io/datastore/clouddatastore"
+)
+
+func TestTaskOutboxStore_StartExportJobWithOutbox(t *testing.T) {
+	ctx := context.Background()
+
+	cdsc, err := cds.NewClient(ctx, uuid.New().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ds, err := clouddatastore.FromClient(ctx, cdsc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dseJS, err := NewDSExportJobStore(ctx, ds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewTaskOutboxStore(ctx, ds)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ds2bqJobID := dseJS.NewDS2BQJobID(ctx)
+	if _, err := dseJS.Create(ctx, &DSExportJobCreateForm{JobID: ds2bqJobID, Body: "{}", ExportProjectID: "gcpugjp-dev", Kinds: []string{"PugEvent"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	const dsExportJobID = "projects/gcpugjp-dev/operations/hoge"
+	outbox, err := s.New(dseJS.NewKey(ctx, ds2bqJobID), TaskOutboxQueueDatastoreExportJobCheck, &DatastoreExportJobCheckRequest{
+		DS2BQJobID:           ds2bqJobID,
+		DatastoreExportJobID: dsExportJobID,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dseJS.StartExportJob(ctx, ds2bqJobID, dsExportJobID, 0, nil, outbox); err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := s.ListCreatedBefore(ctx, time.Now().Add(time.Minute), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, g := 1, len(l); e != g {
+		t.Fatalf("TaskOutbox length want %v but got %v", e, g)
+	}
+	if e, g := TaskOutboxQueueDatastoreExportJobCheck, l[0].Queue; e != g {
+		t.Errorf("Queue want %v but got %v", e, g)
+	}
+	if e, g := ds2bqJobID, l[0].Key.ParentKey().Name(); e != g {
+		t.Errorf("Parent want %v but got %v", e, g)
+	}
+
+	if err := s.Delete(ctx, l[0]); err != nil {
+		t.Fatal(err)
+	}
+	l, err = s.ListCreatedBefore(ctx, time.Now().Add(time.Minute), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, g := 0, len(l); e != g {
+		t.Errorf("TaskOutbox length want %v but got %v", e, g)
+	}
+}
+
+func TestTaskOutboxStore_IncrementJobStatusCheckCountWithOutbox(t *testing.T) {
+	ctx := context.Background()
+
+	cdsc, err := cds.NewClient(ctx, uuid.New().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ds, err := clouddatastore.FromClient(ctx, cdsc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dseJS, err := NewDSExportJobStore(ctx, ds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewTaskOutboxStore(ctx, ds)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ds2bqJobID := dseJS.NewDS2BQJobID(ctx)
+	if _, err := dseJS.Create(ctx, &DSExportJobCreateForm{JobID: ds2bqJobID, Body: "{}", ExportProjectID: "gcpugjp-dev", Kinds: []string{"PugEvent"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	form := &DatastoreExportJobCheckRequest{
+		DS2BQJobID:           ds2bqJobID,
+		DatastoreExportJobID: "projects/gcpugjp-dev/operations/hoge",
+	}
+	scheduleTime := time.Now().Add(time.Minute).Truncate(time.Second)
+	// 同じ状態確認のTaskが2回配信されても、次の状態確認のTaskOutboxは1つだけになる
+	for i := 0; i < 2; i++ {
+		next := form.Next()
+		outbox, err := s.NewScheduled(dseJS.NewKey(ctx, ds2bqJobID), TaskOutboxQueueDatastoreExportJobCheck, next.TaskID(), next, scheduleTime)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := dseJS.IncrementJobStatusCheckCount(ctx, ds2bqJobID, form.CheckSequence, outbox); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	l, err := s.ListCreatedBefore(ctx, time.Now().Add(time.Minute), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, g := 1, len(l); e != g {
+		t.Fatalf("TaskOutbox length want %v but got %v", e, g)
+	}
+	if e, g := form.Next().TaskID(), l[0].ID; e != g {
+		t.Errorf("ID want %v but got %v", e, g)
+	}
+	if e, g := scheduleTime, l[0].ScheduleTime; !e.Equal(g) {
+		t.Errorf("ScheduleTime want %v but got %v", e, g)
+	}
+}
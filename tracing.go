@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+
+	"go.mercari.io/datastore"
+	"go.opencensus.io/trace"
+	"go.opencensus.io/trace/propagation"
+)
+
+// Spanに付けるAttributeのKey. ログのFieldと同じ名前にしている
+const (
+	SpanAttributeDS2BQJobID      = "ds2bqJobId"
+	SpanAttributeKind            = "kind"
+	SpanAttributeOperation       = "operation"
+	SpanAttributeExportProjectID = "exportProjectId"
+	SpanAttributeBQLoadProjectID = "bqLoadProjectId"
+	SpanAttributeBQLoadDatasetID = "bqLoadDatasetId"
+	SpanAttributeRunLockID       = "runLockId"
+	SpanAttributeStatus          = "status"
+	SpanAttributeKindCount       = "kindCount"
+)
+
+// StartSpan is nameのSpanを開始する
+// ctxに入っているLogFieldsもAttributeとして付ける
+func StartSpan(ctx context.Context, name string, attributes ...trace.Attribute) (context.Context, *trace.Span) {
+	ctx, span := trace.StartSpan(ctx, name)
+	span.AddAttributes(logFieldsAttributes(LogFieldsFromContext(ctx))...)
+	span.AddAttributes(attributes...)
+	return ctx, span
+}
+
+// EndSpan is errがある場合はSpanのStatusをエラーにして、Spanを終了する
+func EndSpan(span *trace.Span, err error) {
+	if err != nil {
+		span.SetStatus(trace.Status{Code: trace.StatusCodeUnknown, Message: err.Error()})
+	}
+	span.End()
+}
+
+func logFieldsAttributes(fields LogFields) []trace.Attribute {
+	var l []trace.Attribute
+	if fields.DS2BQJobID != "" {
+		l = append(l, trace.StringAttribute(SpanAttributeDS2BQJobID, fields.DS2BQJobID))
+	}
+	if fields.Kind != "" {
+		l = append(l, trace.StringAttribute(SpanAttributeKind, fields.Kind))
+	}
+	if fields.Operation != "" {
+		l = append(l, trace.StringAttribute(SpanAttributeOperation, fields.Operation))
+	}
+	return l
+}
+
+// RunInTransaction is nameのSpanの中でTransactionを実行する
+func RunInTransaction(ctx context.Context, ds datastore.Client, name string, f func(tx datastore.Transaction) error, attributes ...trace.Attribute) (datastore.Commit, error) {
+	ctx, span := StartSpan(ctx, name, attributes...)
+	commit, err := ds.RunInTransaction(ctx, f)
+	EndSpan(span, err)
+	return commit, err
+}
+
+// EncodeTraceContext is ctxのSpanContextをCloud TasksのTaskのBodyに入れられる文字列にする
+// Spanが無い場合は空文字を返す
+func EncodeTraceContext(ctx context.Context) string {
+	span := trace.FromContext(ctx)
+	if span == nil {
+		return ""
+	}
+	return base64.StdEncoding.EncodeToString(propagation.Binary(span.SpanContext()))
+}
+
+// DecodeTraceContext is EncodeTraceContext で作った文字列をSpanContextに戻す
+func DecodeTraceContext(traceContext string) (trace.SpanContext, bool) {
+	if traceContext == "" {
+		return trace.SpanContext{}, false
+	}
+	b, err := base64.StdEncoding.DecodeString(traceContext)
+	if err != nil {
+		return trace.SpanContext{}, false
+	}
+	return propagation.FromBinary(b)
+}
+
+// StartSpanWithTraceContext is Taskを追加したRunのSpanを親にして、nameのSpanを開始する
+// Runの最初から最後までを1つのTraceとして見られるようにするため. RequestのSpanとはLinkでつなぐ
+// traceContextが無い場合は、ctxのSpanの子にする
+func StartSpanWithTraceContext(ctx context.Context, name string, traceContext string) (context.Context, *trace.Span) {
+	parent, ok := DecodeTraceContext(traceContext)
+	if !ok {
+		return StartSpan(ctx, name)
+	}
+	current := trace.FromContext(ctx)
+	ctx, span := trace.StartSpanWithRemoteParent(ctx, name, parent)
+	if current != nil {
+		sc := current.SpanContext()
+		span.AddLink(trace.Link{TraceID: sc.TraceID, SpanID: sc.SpanID, Type: trace.LinkTypeParent})
+	}
+	span.AddAttributes(logFieldsAttributes(LogFieldsFromContext(ctx))...)
+	return ctx, span
+}
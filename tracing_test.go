@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"go.opencensus.io/trace"
+)
+
+func TestDecodeTraceContext(t *testing.T) {
+	ctx, span := trace.StartSpan(context.Background(), "TestDecodeTraceContext", trace.WithSampler(trace.AlwaysSample()))
+	defer span.End()
+
+	cases := []struct {
+		name         string
+		traceContext string
+		want         trace.SpanContext
+		wantOK       bool
+	}{
+		{"encoded", EncodeTraceContext(ctx), span.SpanContext(), true},
+		{"empty", "", trace.SpanContext{}, false},
+		{"no span", EncodeTraceContext(context.Background()), trace.SpanContext{}, false},
+		{"invalid base64", "!!!", trace.SpanContext{}, false},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := DecodeTraceContext(tt.traceContext)
+			if ok != tt.wantOK {
+				t.Fatalf("ok want %v but got %v", tt.wantOK, ok)
+			}
+			if got != tt.want {
+				t.Errorf("want %+v but got %+v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestStartSpanWithTraceContext(t *testing.T) {
+	runCtx, runSpan := trace.StartSpan(context.Background(), "run", trace.WithSampler(trace.AlwaysSample()))
+	defer runSpan.End()
+	traceContext := EncodeTraceContext(runCtx)
+
+	reqCtx, reqSpan := trace.StartSpan(context.Background(), "request", trace.WithSampler(trace.AlwaysSample()))
+	defer reqSpan.End()
+
+	ctx, span := StartSpanWithTraceContext(reqCtx, "check", traceContext)
+	defer span.End()
+	if e, g := runSpan.SpanContext().TraceID, span.SpanContext().TraceID; e != g {
+		t.Errorf("TraceID want %v but got %v", e, g)
+	}
+	if e, g := span.SpanContext().TraceID, trace.FromContext(ctx).SpanContext().TraceID; e != g {
+		t.Errorf("ctx TraceID want %v but got %v", e, g)
+	}
+
+	_, span = StartSpanWithTraceContext(reqCtx, "check", "")
+	defer span.End()
+	if e, g := reqSpan.SpanContext().TraceID, span.SpanContext().TraceID; e != g {
+		t.Errorf("TraceID without traceContext want %v but got %v", e, g)
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/morikuni/failure"
+)
+
+// FieldError is Requestの項目ごとの検証エラー
+type FieldError struct {
+	Field   string `json:"field"` // RequestのJSONの項目名
+	Message string `json:"message"`
+}
+
+// ValidationError is Requestの検証エラー
+type ValidationError struct {
+	Fields []*FieldError
+}
+
+// Add is fieldの検証エラーを追加する
+func (e *ValidationError) Add(field string, message string) {
+	e.Fields = append(e.Fields, &FieldError{Field: field, Message: message})
+}
+
+func (e *ValidationError) Error() string {
+	var l []string
+	for _, v := range e.Fields {
+		l = append(l, fmt.Sprintf("%s: %s", v.Field, v.Message))
+	}
+	return fmt.Sprintf("invalid request. %s", strings.Join(l, ", "))
+}
+
+// Err is 検証エラーが無い場合はnil, ある場合は StatusBadRequest のエラーを返す
+func (e *ValidationError) Err() error {
+	if len(e.Fields) < 1 {
+		return nil
+	}
+	return failure.Translate(e, StatusBadRequest)
+}
+
+// FieldErrorsOf is errの原因がValidationErrorの場合に、項目ごとの検証エラーを返す
+func FieldErrorsOf(err error) []*FieldError {
+	verr, ok := failure.CauseOf(err).(*ValidationError)
+	if !ok {
+		return nil
+	}
+	return verr.Fields
+}
+
+// Validate is DatastoreExportRequestを検証する
+// 状態を保存する前に呼び、不正な場合は StatusBadRequest のエラーを返す
+func (form *DatastoreExportRequest) Validate() error {
+	verr := &ValidationError{}
+	if form.ProjectID == "" {
+		verr.Add("projectId", "required")
+	}
+	if form.OutputGCSFilePath == "" {
+		verr.Add("outputGCSFilePath", "required")
+	} else if !strings.HasPrefix(form.OutputGCSFilePath, "gs://") || len(form.OutputGCSFilePath) <= len("gs://") {
+		verr.Add("outputGCSFilePath", "must be gs://{bucket}")
+	}
+	switch {
+	case form.AllKinds && len(form.Kinds) > 0:
+		verr.Add("kinds", "cannot be used with allKinds")
+	case !form.AllKinds && len(form.Kinds) < 1:
+		verr.Add("kinds", "required unless allKinds is true")
+	}
+	for _, v := range form.Kinds {
+		if v == "" {
+			verr.Add("kinds", "must not contain empty kind")
+			break
+		}
+	}
+	if _, err := ParseRunLockPolicy(form.RunLockPolicy); err != nil {
+		verr.Add("runLockPolicy", fmt.Sprintf("must be one of %s, %s, %s, %s", RunLockPolicyNone, RunLockPolicyReject, RunLockPolicyQueue, RunLockPolicySupersede))
+	}
+	for _, v := range []struct {
+		field string
+		value int
+	}{
+		{"maxRetryCount", form.MaxRetryCount},
+		{"maxExportStatusCheckCount", form.MaxExportStatusCheckCount},
+		{"exportTimeoutSeconds", form.ExportTimeoutSeconds},
+		{"maxBQLoadStatusCheckCount", form.MaxBQLoadStatusCheckCount},
+		{"bqLoadTimeoutSeconds", form.BQLoadTimeoutSeconds},
+		{"exportSLOSeconds", form.ExportSLOSeconds},
+		{"bqLoadSLOSeconds", form.BQLoadSLOSeconds},
+	} {
+		if v.value < 0 {
+			verr.Add(v.field, "must be greater than or equal to 0")
+		}
+	}
+	if form.RowCountTolerance < 0 {
+		verr.Add("rowCountTolerance", "must be greater than or equal to 0")
+	}
+	return verr.Err()
+}
+
+// ValidateKinds is IgnoreKindsなどを除いた、Exportする全てのKindを検証する
+func ValidateKinds(kinds []string) error {
+	verr := &ValidationError{}
+	if len(kinds) < 1 {
+		verr.Add("kinds", "no kinds to export")
+	}
+	return verr.Err()
+}
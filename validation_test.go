@@ -0,0 +1,97 @@
+package main
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestDatastoreExportRequest_Validate(t *testing.T) {
+	valid := func() *DatastoreExportRequest {
+		return &DatastoreExportRequest{
+			ProjectID:         "hoge",
+			OutputGCSFilePath: "gs://fuga",
+			Kinds:             []string{"Hoge"},
+		}
+	}
+
+	cases := []struct {
+		name       string
+		form       func() *DatastoreExportRequest
+		wantFields []string
+	}{
+		{"valid", valid, nil},
+		{"all kinds", func() *DatastoreExportRequest {
+			f := valid()
+			f.Kinds = nil
+			f.AllKinds = true
+			return f
+		}, nil},
+		{"empty", func() *DatastoreExportRequest {
+			return &DatastoreExportRequest{}
+		}, []string{"projectId", "outputGCSFilePath", "kinds"}},
+		{"not gcs path", func() *DatastoreExportRequest {
+			f := valid()
+			f.OutputGCSFilePath = "fuga"
+			return f
+		}, []string{"outputGCSFilePath"}},
+		{"only gs://", func() *DatastoreExportRequest {
+			f := valid()
+			f.OutputGCSFilePath = "gs://"
+			return f
+		}, []string{"outputGCSFilePath"}},
+		{"all kinds and kinds", func() *DatastoreExportRequest {
+			f := valid()
+			f.AllKinds = true
+			return f
+		}, []string{"kinds"}},
+		{"empty kind", func() *DatastoreExportRequest {
+			f := valid()
+			f.Kinds = []string{"Hoge", ""}
+			return f
+		}, []string{"kinds"}},
+		{"invalid run lock policy", func() *DatastoreExportRequest {
+			f := valid()
+			f.RunLockPolicy = "hoge"
+			return f
+		}, []string{"runLockPolicy"}},
+		{"negative", func() *DatastoreExportRequest {
+			f := valid()
+			f.MaxRetryCount = -1
+			f.BQLoadTimeoutSeconds = -1
+			return f
+		}, []string{"maxRetryCount", "bqLoadTimeoutSeconds"}},
+	}
+
+	for _, tt := range cases {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.form().Validate()
+			if tt.wantFields == nil {
+				if err != nil {
+					t.Fatalf("want nil but got %v", err)
+				}
+				return
+			}
+			if e, g := http.StatusBadRequest, HTTPStatusCode(err); e != g {
+				t.Errorf("status want %v but got %v", e, g)
+			}
+			var fields []string
+			for _, v := range FieldErrorsOf(err) {
+				fields = append(fields, v.Field)
+			}
+			if e, g := tt.wantFields, fields; !reflect.DeepEqual(e, g) {
+				t.Errorf("fields want %+v but got %+v", e, g)
+			}
+		})
+	}
+}
+
+func TestValidateKinds(t *testing.T) {
+	if err := ValidateKinds([]string{"Hoge"}); err != nil {
+		t.Errorf("want nil but got %v", err)
+	}
+	if e, g := http.StatusBadRequest, HTTPStatusCode(ValidateKinds(nil)); e != g {
+		t.Errorf("status want %v but got %v", e, g)
+	}
+}